@@ -0,0 +1,372 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lebauce/vlaunch/logging"
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/viper"
+)
+
+var logger = logging.Module("api")
+
+var statsPeriod = time.Second
+
+var (
+	NoMachine      = errors.New("The machine does not exist")
+	MachineExists  = errors.New("The machine already exists")
+	AlreadyStarted = errors.New("The machine is already running")
+)
+
+// Server exposes the lifecycle of a machine over a REST API. Requests
+// must carry the token in a 'Authorization: Bearer' header.
+type Server struct {
+	sync.Mutex
+	ctx     context.Context
+	cfg     *viper.Viper
+	token   string
+	vm      *vm.VirtualMachine
+	running bool
+	mux     *http.ServeMux
+}
+
+type propertyRequest struct {
+	Value string `json:"value"`
+	Flags string `json:"flags"`
+}
+
+type snapshotRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if value != nil {
+		json.NewEncoder(w).Encode(value)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case NoMachine:
+		status = http.StatusNotFound
+	case MachineExists, AlreadyStarted:
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Invalid token"})
+		return
+	}
+
+	logger.Debug("API request", "method", r.Method, "path", r.URL.Path)
+	s.mux.ServeHTTP(w, r)
+}
+
+// machine returns the managed machine or NoMachine if it was not created
+func (s *Server) machine() (*vm.VirtualMachine, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.vm == nil {
+		return nil, NoMachine
+	}
+	return s.vm, nil
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.vm != nil {
+		writeError(w, MachineExists)
+		return
+	}
+
+	machine, err := vm.NewVM(s.cfg)
+	if err == nil {
+		err = machine.Create(r.Context())
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s.vm = machine
+	writeJSON(w, http.StatusCreated, nil)
+}
+
+func (s *Server) start(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.vm == nil {
+		writeError(w, NoMachine)
+		return
+	}
+
+	if s.running {
+		writeError(w, AlreadyStarted)
+		return
+	}
+
+	if err := s.vm.Start(r.Context()); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.running = true
+
+	if err := s.vm.EnableStats(statsPeriod); err != nil {
+		logger.Warn("Failed to enable statistics", "error", err)
+	}
+
+	machine := s.vm
+	go func() {
+		if err := machine.Run(s.ctx); err != nil {
+			logger.Error("Error during vm execution", "error", err)
+		}
+
+		s.Lock()
+		s.running = false
+		s.Unlock()
+	}()
+
+	writeJSON(w, http.StatusAccepted, nil)
+}
+
+func (s *Server) stop(w http.ResponseWriter, r *http.Request) {
+	machine, err := s.machine()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if r.URL.Query().Get("force") == "true" {
+		err = machine.PowerOff()
+	} else {
+		err = machine.Stop()
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, nil)
+}
+
+func (s *Server) release(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.vm == nil {
+		writeError(w, NoMachine)
+		return
+	}
+
+	if s.running {
+		writeError(w, AlreadyStarted)
+		return
+	}
+
+	if err := s.vm.Release(r.Context()); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s.vm = nil
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	machine, err := s.machine()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	status, err := machine.Status()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	machine, err := s.machine()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	stats, err := machine.Stats()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (s *Server) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	machine, err := s.machine()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	snapshots, err := machine.Snapshots()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshots)
+}
+
+func (s *Server) takeSnapshot(w http.ResponseWriter, r *http.Request) {
+	machine, err := s.machine()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var request snapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Name == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "A snapshot name is required"})
+		return
+	}
+
+	if err := machine.Snapshot(request.Name, request.Description); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, nil)
+}
+
+func (s *Server) restoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	machine, err := s.machine()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := machine.RestoreSnapshot(r.PathValue("name")); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) deleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	machine, err := s.machine()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := machine.DeleteSnapshot(r.PathValue("name")); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) listProperties(w http.ResponseWriter, r *http.Request) {
+	machine, err := s.machine()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	properties, err := machine.GuestProperties(r.URL.Query().Get("pattern"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, properties)
+}
+
+// propertyName returns the name of the guest property of the request path,
+// e.g. /VirtualBox/GuestInfo/OS/Product for
+// /vm/properties/VirtualBox/GuestInfo/OS/Product
+func propertyName(r *http.Request) string {
+	return "/" + strings.TrimPrefix(r.PathValue("name"), "/")
+}
+
+func (s *Server) getProperty(w http.ResponseWriter, r *http.Request) {
+	machine, err := s.machine()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	value, err := machine.GetGuestProperty(propertyName(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"value": value})
+}
+
+func (s *Server) setProperty(w http.ResponseWriter, r *http.Request) {
+	machine, err := s.machine()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var request propertyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := machine.SetGuestProperty(propertyName(r), request.Value, request.Flags); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+// NewServer returns an API server for the machine described by cfg. If the
+// machine is already registered, it is managed by the server.
+func NewServer(ctx context.Context, cfg *viper.Viper, token string) *Server {
+	s := &Server{ctx: ctx, cfg: cfg, token: token, mux: http.NewServeMux()}
+
+	if machine, err := vm.FindVM(cfg); err == nil {
+		s.vm = machine
+		if running, err := machine.IsRunning(); err == nil && running {
+			s.running = true
+			machine.EnableStats(statsPeriod)
+		}
+	}
+
+	s.mux.HandleFunc("POST /vm", s.create)
+	s.mux.HandleFunc("DELETE /vm", s.release)
+	s.mux.HandleFunc("POST /vm/start", s.start)
+	s.mux.HandleFunc("POST /vm/stop", s.stop)
+	s.mux.HandleFunc("GET /vm/status", s.status)
+	s.mux.HandleFunc("GET /vm/stats", s.stats)
+	s.mux.HandleFunc("GET /vm/snapshots", s.listSnapshots)
+	s.mux.HandleFunc("POST /vm/snapshots", s.takeSnapshot)
+	s.mux.HandleFunc("POST /vm/snapshots/{name}/restore", s.restoreSnapshot)
+	s.mux.HandleFunc("DELETE /vm/snapshots/{name}", s.deleteSnapshot)
+	s.mux.HandleFunc("GET /vm/properties", s.listProperties)
+	s.mux.HandleFunc("GET /vm/properties/{name...}", s.getProperty)
+	s.mux.HandleFunc("PUT /vm/properties/{name...}", s.setProperty)
+
+	return s
+}
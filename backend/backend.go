@@ -1,19 +1,73 @@
+// Package backend gives access to the disks, the power events and the
+// settings of the host, with an implementation per platform
 package backend
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/lebauce/vlaunch/config"
+	"github.com/lebauce/vlaunch/logging"
+	"github.com/spf13/viper"
 )
 
+var logger = logging.Module("backend")
+
 var DeviceNotFound = errors.New("Could not find device")
 
+// ElevationCancelled is returned by RunAsRoot when the user dismissed or
+// failed the authentication
+var ElevationCancelled = errors.New("Privilege elevation was cancelled")
+
+// MultipleDevicesError is returned by FindDevice when several USB disks
+// could hold the guest
+type MultipleDevicesError struct {
+	Devices []USBDevice
+}
+
+func (e *MultipleDevicesError) Error() string {
+	return fmt.Sprintf("Found %d USB disks, select one with --device or the 'device' setting", len(e.Devices))
+}
+
+// PowerEventsNotSupported is returned by WatchPowerEvents when the host
+// power changes can not be watched
+var PowerEventsNotSupported = errors.New("Host power events are not supported on this platform")
+
+// PowerEvent is a change of the power state of the host
+type PowerEvent int
+
+const (
+	// HostSuspending is sent when the host is about to sleep
+	HostSuspending PowerEvent = iota
+	// HostResumed is sent when the host woke up
+	HostResumed
+	// HostShuttingDown is sent when the host is about to shut down or
+	// the user is logging off
+	HostShuttingDown
+)
+
+func (e PowerEvent) String() string {
+	switch e {
+	case HostSuspending:
+		return "suspending"
+	case HostResumed:
+		return "resumed"
+	case HostShuttingDown:
+		return "shutting down"
+	default:
+		return fmt.Sprintf("PowerEvent(%d)", int(e))
+	}
+}
+
 type USBDevice struct {
-	Mountpoint string
-	VolumeName string
-	Device     string
+	Mountpoint string `json:"mountpoint"`
+	VolumeName string `json:"volume_name"`
+	Device     string `json:"device"`
 }
 
 type DeviceFile interface {
@@ -23,12 +77,12 @@ type DeviceFile interface {
 	io.Closer
 }
 
-func FindDevice() (string, error) {
-	if device := config.GetConfig().GetString("device"); device != "" {
+func FindDevice(cfg *viper.Viper) (string, error) {
+	if device := cfg.GetString("device"); device != "" {
 		return device, nil
 	}
 
-	if uuid := config.GetConfig().GetString("device_uuid"); uuid != "" {
+	if uuid := cfg.GetString("device_uuid"); uuid != "" {
 		if device, err := FindDeviceByUUID(uuid); err == nil {
 			return device, nil
 		}
@@ -40,5 +94,250 @@ func FindDevice() (string, error) {
 		}
 	}
 
-	return "", DeviceNotFound
+	devices, err := ListUSBDisks()
+	if err != nil {
+		return "", err
+	}
+
+	switch len(devices) {
+	case 0:
+		return "", DeviceNotFound
+	case 1:
+		logger.Info("Using the only USB disk", "device", devices[0].Device)
+		return devices[0].Device, nil
+	default:
+		return "", &MultipleDevicesError{Devices: devices}
+	}
+}
+
+// ListUSBDisks returns the disks attached through USB, once even if they
+// have several volumes
+func ListUSBDisks() ([]USBDevice, error) {
+	devices, err := GetUSBDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	var disks []USBDevice
+	seen := make(map[string]bool)
+	for _, device := range devices {
+		if !seen[device.Device] {
+			seen[device.Device] = true
+			disks = append(disks, device)
+		}
+	}
+	return disks, nil
+}
+
+// Proxy is the HTTP proxy configuration of the host, NoProxy is a comma
+// separated list of hosts to reach directly
+type Proxy struct {
+	HTTP    string
+	HTTPS   string
+	NoProxy string
+}
+
+func getenv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// environmentProxy returns the proxy set in the environment, nil if there
+// is none
+func environmentProxy() *Proxy {
+	proxy := &Proxy{
+		HTTP:    getenv("http_proxy", "HTTP_PROXY"),
+		HTTPS:   getenv("https_proxy", "HTTPS_PROXY"),
+		NoProxy: getenv("no_proxy", "NO_PROXY"),
+	}
+	if proxy.HTTP == "" && proxy.HTTPS == "" {
+		return nil
+	}
+	return proxy
+}
+
+// HostKey is the key of the host keyboard releasing the keyboard and mouse
+// captured by the machine, Code being how VirtualBox knows it on the host
+type HostKey struct {
+	Name string `json:"name"`
+	Code string `json:"code"`
+}
+
+// ResolveHostKey returns the host key given by name, e.g. right_ctrl, or by
+// code, the default one of the host keyboard if empty
+func ResolveHostKey(key string) (HostKey, error) {
+	if key == "" {
+		key = defaultHostKey()
+	}
+
+	if code, found := hostKeyCodes[key]; found {
+		return HostKey{Name: key, Code: code}, nil
+	}
+
+	for name, code := range hostKeyCodes {
+		if code == key {
+			return HostKey{Name: name, Code: code}, nil
+		}
+	}
+
+	if _, err := strconv.Atoi(key); err != nil {
+		return HostKey{}, fmt.Errorf("Unknown host key '%s'", key)
+	}
+	return HostKey{Name: key, Code: key}, nil
+}
+
+// DiskGeometry is the geometry of a disk as reported by the host, the CHS
+// values being the ones of the firmware or of the driver, zero if unknown
+type DiskGeometry struct {
+	LogicalSectorSize  uint64
+	PhysicalSectorSize uint64
+	Cylinders          uint64
+	Heads              uint64
+	SectorsPerTrack    uint64
+}
+
+// Partition is a partition of a disk of the host, Size being in bytes
+type Partition struct {
+	Path       string `json:"path"`
+	Size       uint64 `json:"size"`
+	Label      string `json:"label,omitempty"`
+	Mountpoint string `json:"mountpoint,omitempty"`
+}
+
+// Device is a disk of the host. Bus is usb, sata, nvme, scsi, mmc, virtio
+// or unknown, and Size is in bytes. Removable disks include the USB ones,
+// even when they do not report removable media.
+type Device struct {
+	Path       string      `json:"path"`
+	Model      string      `json:"model,omitempty"`
+	Serial     string      `json:"serial,omitempty"`
+	Size       uint64      `json:"size"`
+	Bus        string      `json:"bus"`
+	Removable  bool        `json:"removable"`
+	Partitions []Partition `json:"partitions"`
+}
+
+// Mountpoints returns where the partitions of the disk are mounted
+func (d Device) Mountpoints() (mountpoints []string) {
+	for _, partition := range d.Partitions {
+		if partition.Mountpoint != "" {
+			mountpoints = append(mountpoints, partition.Mountpoint)
+		}
+	}
+	return mountpoints
+}
+
+// GetDevice returns the disk of the host at the given path
+func GetDevice(path string) (Device, error) {
+	devices, err := ListDevices()
+	if err != nil {
+		return Device{}, err
+	}
+
+	for _, device := range devices {
+		if strings.EqualFold(device.Path, path) {
+			return device, nil
+		}
+	}
+	return Device{}, DeviceNotFound
+}
+
+// DeviceEventType tells whether a disk was attached to or detached from
+// the host
+type DeviceEventType int
+
+const (
+	// DeviceAttached is sent when a disk was plugged
+	DeviceAttached DeviceEventType = iota
+	// DeviceDetached is sent when a disk was unplugged
+	DeviceDetached
+)
+
+func (e DeviceEventType) String() string {
+	switch e {
+	case DeviceAttached:
+		return "attached"
+	case DeviceDetached:
+		return "detached"
+	default:
+		return fmt.Sprintf("DeviceEventType(%d)", int(e))
+	}
+}
+
+// DeviceEvent is the attachment or the detachment of a disk. The device of
+// a detached disk is the one last listed.
+type DeviceEvent struct {
+	Type   DeviceEventType
+	Device Device
+}
+
+// WatchDevices lists the disks of the host every interval and sends the
+// ones attached or detached since WatchDevices was called, until the
+// context is done. The channel is then closed.
+func WatchDevices(ctx context.Context, interval time.Duration) (<-chan DeviceEvent, error) {
+	devices, err := ListDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	present := make(map[string]Device)
+	for _, device := range devices {
+		present[device.Path] = device
+	}
+
+	events := make(chan DeviceEvent, 16)
+	go func() {
+		defer close(events)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		send := func(event DeviceEvent) bool {
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			devices, err := ListDevices()
+			if err != nil {
+				logger.Warn("Failed to list disks", "error", err)
+				continue
+			}
+
+			current := make(map[string]Device)
+			for _, device := range devices {
+				current[device.Path] = device
+				if _, found := present[device.Path]; !found {
+					present[device.Path] = device
+					if !send(DeviceEvent{Type: DeviceAttached, Device: device}) {
+						return
+					}
+				}
+			}
+
+			for path, device := range present {
+				if _, found := current[path]; !found {
+					delete(present, path)
+					if !send(DeviceEvent{Type: DeviceDetached, Device: device}) {
+						return
+					}
+				}
+			}
+		}
+	}()
+	return events, nil
 }
@@ -0,0 +1,554 @@
+// +build darwin
+
+package backend
+
+/*
+#cgo LDFLAGS: -framework IOKit -framework CoreFoundation
+#include <CoreFoundation/CoreFoundation.h>
+#include <IOKit/IOMessage.h>
+#include <IOKit/pwr_mgt/IOPMLib.h>
+
+extern void goPowerCallback(void *refCon, io_service_t service, natural_t messageType, void *messageArgument);
+*/
+import "C"
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// VirtualBox only writes relative raw VMDKs on Linux, FreeBSD and Solaris
+var RelativeRawVMDK = false
+var SupportPassiveListener = true
+var CanDropPrivileges = true
+var AudioDriver = "coreaudio"
+
+func IsAdmin() bool {
+	return os.Geteuid() == 0
+}
+
+// RunAsRoot runs the executable with the given arguments as root, asking
+// for the administrator password through osascript, and returns its exit
+// code once it exited
+func RunAsRoot(executable string, args ...string) (int, error) {
+	command := []string{shellQuote(executable)}
+	for _, arg := range args {
+		command = append(command, shellQuote(arg))
+	}
+
+	// The command is embedded in an AppleScript string
+	script := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(strings.Join(command, " "))
+
+	logger.Info("Running as root", "executable", executable, "args", args)
+	cmd := exec.Command("osascript", "-e", `do shell script "`+script+`" with prompt "Vlaunch needs administrator privileges to access the USB disk." with administrator privileges`)
+	var stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = os.Stdout, &stderr
+	err := cmd.Run()
+	if err == nil {
+		return 0, nil
+	}
+
+	if _, ok := err.(*exec.ExitError); !ok {
+		return 0, err
+	}
+
+	// AppleScript reports the dismissal of the dialog as error -128,
+	// and the failure of the command without its exit code
+	if strings.Contains(stderr.String(), "(-128)") {
+		return 0, ElevationCancelled
+	}
+	return 1, nil
+}
+
+var (
+	powerRootPort    C.io_connect_t
+	powerHandler     func(PowerEvent)
+	powerHandlerLock sync.Mutex
+)
+
+func notifyPowerEvent(event PowerEvent) {
+	powerHandlerLock.Lock()
+	handler := powerHandler
+	powerHandlerLock.Unlock()
+
+	if handler != nil {
+		handler(event)
+	}
+}
+
+// goPowerCallback is called by IOKit on the thread of the run loop, the
+// system waits for IOAllowPowerChange before sleeping, up to 30 seconds
+//export goPowerCallback
+func goPowerCallback(refCon unsafe.Pointer, service C.io_service_t, messageType C.natural_t, messageArgument unsafe.Pointer) {
+	switch messageType {
+	case C.kIOMessageCanSystemSleep:
+		C.IOAllowPowerChange(powerRootPort, C.long(uintptr(messageArgument)))
+	case C.kIOMessageSystemWillSleep:
+		notifyPowerEvent(HostSuspending)
+		C.IOAllowPowerChange(powerRootPort, C.long(uintptr(messageArgument)))
+	case C.kIOMessageSystemHasPoweredOn:
+		notifyPowerEvent(HostResumed)
+	}
+}
+
+// WatchPowerEvents calls the handler when the host goes to sleep or wakes
+// up. Logging off and shutting down are reported by launchd with SIGTERM
+func WatchPowerEvents(ctx context.Context, handler func(PowerEvent)) error {
+	powerHandlerLock.Lock()
+	if powerHandler != nil {
+		powerHandlerLock.Unlock()
+		return errors.New("Host power events are already watched")
+	}
+	powerHandler = handler
+	powerHandlerLock.Unlock()
+
+	registered := make(chan error, 1)
+	go func() {
+		// The notifications are delivered to the run loop of this thread
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		defer func() {
+			powerHandlerLock.Lock()
+			powerHandler = nil
+			powerHandlerLock.Unlock()
+		}()
+
+		var notifyPort C.IONotificationPortRef
+		var notifier C.io_object_t
+		powerRootPort = C.IORegisterForSystemPower(nil, &notifyPort, C.IOServiceInterestCallback(C.goPowerCallback), &notifier)
+		if powerRootPort == 0 {
+			registered <- errors.New("Failed to register for system power notifications")
+			return
+		}
+		defer C.IONotificationPortDestroy(notifyPort)
+		defer C.IOServiceClose(powerRootPort)
+		defer C.IODeregisterForSystemPower(&notifier)
+
+		runLoop := C.CFRunLoopGetCurrent()
+		C.CFRunLoopAddSource(runLoop, C.IONotificationPortGetRunLoopSource(notifyPort), C.kCFRunLoopCommonModes)
+		registered <- nil
+
+		go func() {
+			<-ctx.Done()
+			C.CFRunLoopStop(runLoop)
+		}()
+		C.CFRunLoopRun()
+	}()
+	return <-registered
+}
+
+// CheckDriver returns an error if the VirtualBox kernel extension is not
+// loaded
+func CheckDriver() error {
+	output, err := exec.Command("kextstat", "-l", "-b", "org.virtualbox.kext.VBoxDrv").Output()
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(output), "org.virtualbox.kext.VBoxDrv") {
+		return errors.New("The VirtualBox kernel extension is not loaded, allow it in the Security & Privacy preferences")
+	}
+	return nil
+}
+
+// OpenURL opens a URL with the default application
+func OpenURL(url string) error {
+	return exec.Command("open", url).Start()
+}
+
+// EjectDevice unmounts and ejects a disk so that it can be unplugged
+func EjectDevice(device string) error {
+	if output, err := exec.Command("diskutil", "eject", device).CombinedOutput(); err != nil {
+		return errors.New(strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// CheckVirtualization returns an error if the Hypervisor framework is not
+// supported by the CPU
+func CheckVirtualization() error {
+	output, err := exec.Command("sysctl", "-n", "kern.hv_support").Output()
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(output)) != "1" {
+		return errors.New("Hardware virtualization is not supported by this Mac")
+	}
+	return nil
+}
+
+// hostKeyCodes are the macOS virtual key codes of the keys that can be the
+// host key
+var hostKeyCodes = map[string]string{
+	"left_cmd":   "55",
+	"right_cmd":  "54",
+	"left_ctrl":  "59",
+	"right_ctrl": "62",
+	"left_alt":   "58",
+	"right_alt":  "61",
+}
+
+// KeyboardLayout returns the input source of the host keyboard, e.g.
+// 'com.apple.keylayout.US'
+func KeyboardLayout() string {
+	output, err := exec.Command("defaults", "read", "com.apple.HIToolbox", "AppleCurrentKeyboardLayoutInputSourceID").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// defaultHostKey returns the left Command key, as Mac keyboards have no right
+// Ctrl key
+func defaultHostKey() string {
+	return "left_cmd"
+}
+
+// The ioctls of sys/disk.h returning the sector sizes and the sector count
+// of a disk
+const (
+	dkiocGetBlockSize         = 0x40046418
+	dkiocGetBlockCount        = 0x40086419
+	dkiocGetPhysicalBlockSize = 0x4004644d
+)
+
+// GetDiskGeometry returns the sector sizes of a disk, macOS reporting no
+// CHS geometry
+func GetDiskGeometry(device string) (geometry DiskGeometry, err error) {
+	file, err := os.Open(device)
+	if err != nil {
+		return geometry, err
+	}
+	defer file.Close()
+
+	var logical, physical uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), dkiocGetBlockSize, uintptr(unsafe.Pointer(&logical))); errno != 0 {
+		return geometry, errno
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), dkiocGetPhysicalBlockSize, uintptr(unsafe.Pointer(&physical))); errno != 0 {
+		physical = logical
+	}
+
+	geometry.LogicalSectorSize, geometry.PhysicalSectorSize = uint64(logical), uint64(physical)
+	return geometry, nil
+}
+
+// OnBattery returns whether the host runs on battery, as reported by pmset
+func OnBattery() (bool, error) {
+	output, err := exec.Command("pmset", "-g", "batt").Output()
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(string(output), "'Battery Power'"), nil
+}
+
+// GetProxy returns the proxy configuration of the host, the one of the
+// environment if any or else the one of the network settings as reported
+// by scutil, nil if there is none
+func GetProxy() (*Proxy, error) {
+	if proxy := environmentProxy(); proxy != nil {
+		return proxy, nil
+	}
+
+	output, err := exec.Command("scutil", "--proxy").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// The exceptions are listed as the items of an array, one per line
+	settings := make(map[string]string)
+	var exceptions []string
+	inExceptions := false
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.SplitN(line, " : ", 2)
+		if len(fields) != 2 {
+			if strings.TrimSpace(line) == "}" {
+				inExceptions = false
+			}
+			continue
+		}
+
+		key, value := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+		if inExceptions {
+			exceptions = append(exceptions, value)
+		} else if key == "ExceptionsList" {
+			inExceptions = true
+		} else {
+			settings[key] = value
+		}
+	}
+
+	proxy := &Proxy{NoProxy: strings.Join(exceptions, ",")}
+	if settings["HTTPEnable"] == "1" && settings["HTTPProxy"] != "" {
+		proxy.HTTP = "http://" + settings["HTTPProxy"] + ":" + settings["HTTPPort"]
+	}
+	if settings["HTTPSEnable"] == "1" && settings["HTTPSProxy"] != "" {
+		proxy.HTTPS = "http://" + settings["HTTPSProxy"] + ":" + settings["HTTPSPort"]
+	}
+	if proxy.HTTP == "" && proxy.HTTPS == "" {
+		return nil, nil
+	}
+	return proxy, nil
+}
+
+func DefaultDataPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, "Library", "Application Support", "vlaunch")
+}
+
+// FindVBoxManage returns the path of the VBoxManage command of the
+// VirtualBox installation
+func FindVBoxManage() (string, error) {
+	if path, err := exec.LookPath("VBoxManage"); err == nil {
+		return path, nil
+	}
+
+	path := "/Applications/VirtualBox.app/Contents/MacOS/VBoxManage"
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// GetFreeRam returns the free and inactive memory reported by vm_stat
+func GetFreeRam() (uint64, error) {
+	output, err := exec.Command("vm_stat").Output()
+	if err != nil {
+		return 0, err
+	}
+
+	// The first line gives the page size, e.g. 'Mach Virtual Memory
+	// Statistics: (page size of 4096 bytes)'
+	lines := strings.Split(string(output), "\n")
+	var pageSize, pages uint64
+	if fields := strings.Fields(lines[0]); len(fields) > 2 {
+		pageSize, _ = strconv.ParseUint(fields[len(fields)-2], 10, 64)
+	}
+	if pageSize == 0 {
+		return 0, fmt.Errorf("Failed to parse the page size of '%s'", lines[0])
+	}
+
+	for _, line := range lines[1:] {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "Pages free", "Pages inactive", "Pages speculative":
+			count, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(fields[1]), "."), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			pages += count
+		}
+	}
+	return pages * pageSize, nil
+}
+
+func GetDeviceSize(device string) (uint64, error) {
+	file, err := os.Open(device)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var blockSize uint32
+	var blockCount uint64
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), dkiocGetBlockSize, uintptr(unsafe.Pointer(&blockSize))); errno != 0 {
+		return 0, errno
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), dkiocGetBlockCount, uintptr(unsafe.Pointer(&blockCount))); errno != 0 {
+		return 0, errno
+	}
+	return uint64(blockSize) * blockCount, nil
+}
+
+// diskutilInfo returns the properties of a disk or a partition reported by
+// diskutil, e.g. 'Protocol' or 'Mount Point'
+func diskutilInfo(device string) (map[string]string, error) {
+	output, err := exec.Command("diskutil", "info", device).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	properties := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.SplitN(line, ":", 2); len(fields) == 2 {
+			properties[strings.TrimSpace(fields[0])] = strings.TrimSpace(fields[1])
+		}
+	}
+	return properties, nil
+}
+
+// diskutilSize parses a size reported by diskutil, e.g. '16.0 GB
+// (16008609792 Bytes) (exactly 31266816 512-Byte-Units)'
+func diskutilSize(size string) uint64 {
+	start, end := strings.Index(size, "("), strings.Index(size, " Bytes)")
+	if start < 0 || end < start {
+		return 0
+	}
+	bytes, _ := strconv.ParseUint(size[start+1:end], 10, 64)
+	return bytes
+}
+
+// wholeDisk returns the disk holding a partition, e.g. /dev/disk2 for
+// /dev/disk2s1
+func wholeDisk(device string) (string, error) {
+	properties, err := diskutilInfo(device)
+	if err != nil {
+		return "", err
+	}
+
+	if whole := properties["Part of Whole"]; whole != "" {
+		return "/dev/" + whole, nil
+	}
+	return "", DeviceNotFound
+}
+
+// ListDisks returns the physical disk devices of the machine
+func ListDisks() (disks []string, err error) {
+	output, err := exec.Command("diskutil", "list", "physical").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// Each disk starts with a line like '/dev/disk2 (external, physical):'
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "/dev/disk") {
+			disks = append(disks, strings.Fields(line)[0])
+		}
+	}
+	return disks, nil
+}
+
+// ListDevices returns the disks of the host with their partitions. diskutil
+// does not report the serial number of the disks.
+func ListDevices() (devices []Device, err error) {
+	disks, err := ListDisks()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, disk := range disks {
+		properties, err := diskutilInfo(disk)
+		if err != nil {
+			logger.Debug("Failed to get disk information", "device", disk, "error", err)
+			continue
+		}
+
+		bus := strings.ToLower(properties["Protocol"])
+		switch bus {
+		case "usb", "sata", "nvme", "scsi":
+		case "pci-express":
+			bus = "nvme"
+		case "secure digital":
+			bus = "mmc"
+		default:
+			bus = "unknown"
+		}
+
+		device := Device{
+			Path:      disk,
+			Model:     properties["Device / Media Name"],
+			Size:      diskutilSize(properties["Disk Size"]),
+			Bus:       bus,
+			Removable: properties["Removable Media"] == "Removable" || properties["Device Location"] == "External",
+		}
+		device.Removable = device.Removable || device.Bus == "usb"
+
+		partitions, _ := filepath.Glob(disk + "s*")
+		for _, partition := range partitions {
+			properties, err := diskutilInfo(partition)
+			if err != nil {
+				continue
+			}
+
+			device.Partitions = append(device.Partitions, Partition{
+				Path:       partition,
+				Size:       diskutilSize(properties["Disk Size"]),
+				Label:      properties["Volume Name"],
+				Mountpoint: properties["Mount Point"],
+			})
+		}
+
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
+
+// GetUSBDevices returns the disks attached through USB
+func GetUSBDevices() (devices []USBDevice, err error) {
+	disks, err := ListDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, disk := range disks {
+		if disk.Bus == "usb" {
+			devices = append(devices, USBDevice{
+				VolumeName: disk.Model,
+				Device:     disk.Path,
+			})
+		}
+	}
+	return devices, nil
+}
+
+// FindDeviceByUUID returns the disk holding the volume with the given UUID
+func FindDeviceByUUID(uuid string) (string, error) {
+	properties, err := diskutilInfo(uuid)
+	if err != nil || properties["Volume UUID"] != strings.ToUpper(uuid) {
+		return "", DeviceNotFound
+	}
+
+	if whole := properties["Part of Whole"]; whole != "" {
+		return "/dev/" + whole, nil
+	}
+	return "", DeviceNotFound
+}
+
+// FindDeviceByPath returns the disk holding the volume of a file
+func FindDeviceByPath(path string) (string, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return "", err
+	}
+
+	var name []byte
+	for _, c := range stat.Mntfromname {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+
+	if device := string(name); strings.HasPrefix(device, "/dev/disk") {
+		return wholeDisk(device)
+	}
+	return "", DeviceNotFound
+}
+
+func OpenDevice(device string, mode int) (DeviceFile, error) {
+	return os.OpenFile(device, mode, 0)
+}
+
+// ProcessExists returns whether a process with the given PID is running
+func ProcessExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
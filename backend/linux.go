@@ -3,23 +3,28 @@
 package backend
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"unicode"
+	"unsafe"
 
 	"github.com/guillermo/go.procmeminfo"
 )
 
 var RelativeRawVMDK = true
 var SupportPassiveListener = true
+var CanDropPrivileges = true
+var AudioDriver = "pulse"
 
 func OpenDevice(device string, mode int) (DeviceFile, error) {
 	return os.OpenFile(device, mode, 0)
@@ -43,6 +48,51 @@ func GetDeviceSize(device string) (uint64, error) {
 	return uint64(size) * 512, err
 }
 
+// hdGeometry is the hd_geometry structure of the HDIO_GETGEO ioctl
+type hdGeometry struct {
+	heads     uint8
+	sectors   uint8
+	cylinders uint16
+	start     uintptr
+}
+
+const hdioGetGeo = 0x0301
+
+// readSysBlock reads a number from the queue attributes of a disk
+func readSysBlock(device, attribute string) (uint64, error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/sys/block/%s/queue/%s", path.Base(device), attribute))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// GetDiskGeometry returns the sector sizes of a disk and the geometry the
+// kernel reports for it
+func GetDiskGeometry(device string) (geometry DiskGeometry, err error) {
+	if geometry.LogicalSectorSize, err = readSysBlock(device, "logical_block_size"); err != nil {
+		return geometry, err
+	}
+
+	if geometry.PhysicalSectorSize, err = readSysBlock(device, "physical_block_size"); err != nil {
+		return geometry, err
+	}
+
+	file, err := os.Open(device)
+	if err != nil {
+		return geometry, err
+	}
+	defer file.Close()
+
+	// The cylinders are truncated to 16 bits, they are derived from the
+	// size instead
+	var geo hdGeometry
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), hdioGetGeo, uintptr(unsafe.Pointer(&geo))); errno == 0 {
+		geometry.Heads, geometry.SectorsPerTrack = uint64(geo.heads), uint64(geo.sectors)
+	}
+	return geometry, nil
+}
+
 func FindDeviceByUUID(uuid string) (string, error) {
 	matches, err := filepath.Glob("/dev/sd?[0-9]")
 	if err != nil {
@@ -59,6 +109,165 @@ func FindDeviceByUUID(uuid string) (string, error) {
 	return "", DeviceNotFound
 }
 
+// GetUSBDevices returns the disks attached through USB
+func GetUSBDevices() (devices []USBDevice, err error) {
+	matches, err := filepath.Glob("/sys/block/sd?")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, block := range matches {
+		target, err := filepath.EvalSymlinks(block)
+		if err != nil || !strings.Contains(target, "/usb") {
+			continue
+		}
+
+		model, _ := ioutil.ReadFile(path.Join(block, "device", "model"))
+		devices = append(devices, USBDevice{
+			VolumeName: strings.TrimSpace(string(model)),
+			Device:     path.Join("/dev", path.Base(block)),
+		})
+	}
+
+	return devices, nil
+}
+
+// ListDisks returns the disk devices of the machine
+func ListDisks() ([]string, error) {
+	return filepath.Glob("/dev/sd?")
+}
+
+// virtualBlockPrefixes are the block devices of the kernel that are not
+// disks
+var virtualBlockPrefixes = []string{"loop", "ram", "zram", "dm-", "md", "sr", "fd", "nbd"}
+
+// udevProperties returns the properties udev stored for a block device,
+// such as ID_BUS or ID_SERIAL_SHORT
+func udevProperties(block string) map[string]string {
+	properties := make(map[string]string)
+	dev, err := ioutil.ReadFile(path.Join(block, "dev"))
+	if err != nil {
+		return properties
+	}
+
+	content, err := ioutil.ReadFile("/run/udev/data/b" + strings.TrimSpace(string(dev)))
+	if err != nil {
+		return properties
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if !strings.HasPrefix(line, "E:") {
+			continue
+		}
+		if fields := strings.SplitN(line[2:], "=", 2); len(fields) == 2 {
+			properties[fields[0]] = fields[1]
+		}
+	}
+	return properties
+}
+
+// mountpoints returns where the block devices are mounted
+func mountpoints() map[string]string {
+	mounts := make(map[string]string)
+	file, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return mounts
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) >= 2 && strings.HasPrefix(fields[0], "/dev/") {
+			if _, found := mounts[fields[0]]; !found {
+				mounts[fields[0]] = strings.Replace(fields[1], "\\040", " ", -1)
+			}
+		}
+	}
+	return mounts
+}
+
+// blockBus returns the bus of a disk from udev, or from its path in sysfs
+func blockBus(name, target string, properties map[string]string) string {
+	switch {
+	case strings.Contains(target, "/usb"):
+		return "usb"
+	case strings.HasPrefix(name, "nvme"):
+		return "nvme"
+	case strings.HasPrefix(name, "mmcblk"):
+		return "mmc"
+	case strings.HasPrefix(name, "vd"):
+		return "virtio"
+	}
+
+	switch bus := properties["ID_BUS"]; bus {
+	case "ata":
+		return "sata"
+	case "":
+		if strings.HasPrefix(name, "sd") {
+			return "scsi"
+		}
+		return "unknown"
+	default:
+		return bus
+	}
+}
+
+// ListDevices returns the disks of the host with their partitions
+func ListDevices() (devices []Device, err error) {
+	blocks, err := filepath.Glob("/sys/block/*")
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := mountpoints()
+	for _, block := range blocks {
+		name := path.Base(block)
+		virtual := false
+		for _, prefix := range virtualBlockPrefixes {
+			virtual = virtual || strings.HasPrefix(name, prefix)
+		}
+		if virtual {
+			continue
+		}
+
+		target, _ := filepath.EvalSymlinks(block)
+		properties := udevProperties(block)
+		model, _ := ioutil.ReadFile(path.Join(block, "device", "model"))
+		removable, _ := ioutil.ReadFile(path.Join(block, "removable"))
+		size, _ := GetDeviceSize(name)
+
+		device := Device{
+			Path:      path.Join("/dev", name),
+			Model:     strings.TrimSpace(string(model)),
+			Serial:    properties["ID_SERIAL_SHORT"],
+			Size:      size,
+			Bus:       blockBus(name, target, properties),
+			Removable: strings.TrimSpace(string(removable)) == "1",
+		}
+		device.Removable = device.Removable || device.Bus == "usb"
+
+		partitions, _ := filepath.Glob(path.Join(block, name+"*"))
+		for _, partition := range partitions {
+			sectors, err := ioutil.ReadFile(path.Join(partition, "size"))
+			if err != nil {
+				continue
+			}
+			size, _ := strconv.ParseUint(strings.TrimSpace(string(sectors)), 10, 64)
+			partitionPath := path.Join("/dev", path.Base(partition))
+			device.Partitions = append(device.Partitions, Partition{
+				Path:       partitionPath,
+				Size:       size * 512,
+				Label:      udevProperties(partition)["ID_FS_LABEL"],
+				Mountpoint: mounts[partitionPath],
+			})
+		}
+
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
+
 func FindDeviceByPath(path string) (string, error) {
 	output, _ := exec.Command("/usr/bin/findmnt", "-v", "-n", "-o", "SOURCE", "--target", path).Output()
 	if device := strings.TrimSpace(string(output)); device != "" {
@@ -68,24 +277,250 @@ func FindDeviceByPath(path string) (string, error) {
 	return "", DeviceNotFound
 }
 
-func RunAsRoot(executable string, args ...string) error {
-	if _, err := os.Stat("/usr/bin/beesu"); err == nil {
-		rootArgs := []string{}
-		for _, environ := range os.Environ() {
-			if strings.HasPrefix(environ, "VLAUNCH_") || strings.HasPrefix(environ, "VBOX_") {
-				rootArgs = append(rootArgs, environ)
+// RunAsRoot runs the executable with the given arguments as root, through
+// polkit or beesu, and returns its exit code once it exited
+func RunAsRoot(executable string, args ...string) (int, error) {
+	var cmd *exec.Cmd
+	if pkexec, err := exec.LookPath("pkexec"); err == nil {
+		cmd = exec.Command(pkexec, append([]string{executable}, args...)...)
+	} else if _, err := os.Stat("/usr/bin/beesu"); err == nil {
+		// beesu runs its argument through a shell
+		command := []string{shellQuote(executable)}
+		for _, arg := range args {
+			command = append(command, shellQuote(arg))
+		}
+		cmd = exec.Command("/usr/bin/beesu", strings.Join(command, " "))
+	} else {
+		return 0, errors.New("Failed to find a way to run as root, install pkexec")
+	}
+
+	logger.Info("Running as root", "command", cmd.Path, "args", args)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return 0, err
+		}
+
+		// pkexec exits with 126 when the dialog is dismissed and 127
+		// when the authentication failed
+		code := exitErr.ExitCode()
+		if filepath.Base(cmd.Path) == "pkexec" && (code == 126 || code == 127) {
+			return 0, ElevationCancelled
+		}
+		return code, nil
+	}
+	return 0, nil
+}
+
+// FindVBoxManage returns the path of the VBoxManage command of the
+// VirtualBox installation
+func FindVBoxManage() (string, error) {
+	return exec.LookPath("VBoxManage")
+}
+
+// CheckDriver returns an error if the VirtualBox kernel driver is not loaded
+func CheckDriver() error {
+	if _, err := os.Stat("/dev/vboxdrv"); err != nil {
+		return errors.New("The VirtualBox kernel driver is not loaded, run /sbin/vboxconfig as root")
+	}
+	return nil
+}
+
+// OpenURL opens a URL with the default application of the desktop
+func OpenURL(url string) error {
+	return exec.Command("xdg-open", url).Start()
+}
+
+// EjectDevice powers off a USB disk so that it can be unplugged, its
+// partitions must not be mounted
+func EjectDevice(device string) error {
+	if output, err := exec.Command("udisksctl", "power-off", "-b", device).CombinedOutput(); err != nil {
+		return errors.New(strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// CheckVirtualization returns an error if the CPU does not expose hardware
+// virtualization, which the kernel hides when the firmware disables it
+func CheckVirtualization() error {
+	content, err := ioutil.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if !strings.HasPrefix(line, "flags") {
+			continue
+		}
+		for _, flag := range strings.Fields(line) {
+			if flag == "vmx" || flag == "svm" {
+				return nil
+			}
+		}
+		break
+	}
+	return errors.New("Hardware virtualization (VT-x/AMD-V) is not available, enable it in the firmware settings")
+}
+
+// hostKeyCodes are the X11 keysyms of the keys that can be the host key
+var hostKeyCodes = map[string]string{
+	"left_ctrl":   "65507",
+	"right_ctrl":  "65508",
+	"left_alt":    "65513",
+	"right_alt":   "65514",
+	"left_super":  "65515",
+	"right_super": "65516",
+	"menu":        "65383",
+}
+
+// keyboardSettings returns the XKB settings of the keyboard, such as its
+// layout and model, from the X server or else from the system defaults
+func keyboardSettings() map[string]string {
+	settings := make(map[string]string)
+	if output, err := exec.Command("setxkbmap", "-query").Output(); err == nil {
+		for _, line := range strings.Split(string(output), "\n") {
+			if fields := strings.SplitN(line, ":", 2); len(fields) == 2 {
+				settings[strings.TrimSpace(fields[0])] = strings.TrimSpace(fields[1])
 			}
 		}
-		rootArgs = append(rootArgs, executable)
-		rootArgs = append(rootArgs, args...)
-		log.Printf("Running /usr/bin/beesu %s", strings.Join(rootArgs, " "))
-		cmd := exec.Command("/usr/bin/beesu", strings.Join(rootArgs, " "))
-		return cmd.Start()
+		return settings
 	}
 
-	return errors.New("Failed to find a way to run as root")
+	if content, err := ioutil.ReadFile("/etc/default/keyboard"); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if fields := strings.SplitN(line, "=", 2); len(fields) == 2 && strings.HasPrefix(fields[0], "XKB") {
+				settings[strings.ToLower(strings.TrimPrefix(fields[0], "XKB"))] = strings.Trim(fields[1], `"`)
+			}
+		}
+	}
+	return settings
+}
+
+// KeyboardLayout returns the layout of the host keyboard, e.g. 'us'
+func KeyboardLayout() string {
+	return keyboardSettings()["layout"]
+}
+
+// defaultHostKey returns the right Ctrl key, as VirtualBox does, but for
+// Apple keyboards that have none
+func defaultHostKey() string {
+	model := keyboardSettings()["model"]
+	if strings.HasPrefix(model, "mac") || strings.HasPrefix(model, "apple") {
+		return "left_super"
+	}
+	return "right_ctrl"
+}
+
+func DefaultDataPath() string {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, _ := os.UserHomeDir()
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dataHome, "vlaunch")
 }
 
 func IsAdmin() bool {
 	return os.Geteuid() == 0
 }
+
+// ProcessExists returns whether a process with the given PID is running
+func ProcessExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+var logindMatches = []string{
+	"type='signal',interface='org.freedesktop.login1.Manager',member='PrepareForSleep'",
+	"type='signal',interface='org.freedesktop.login1.Manager',member='PrepareForShutdown'",
+}
+
+// WatchPowerEvents calls the handler when the host goes to sleep, wakes up
+// or shuts down, as announced by logind. A delay inhibitor lock is held
+// while watching so that logind waits a few seconds for the handler
+func WatchPowerEvents(ctx context.Context, handler func(PowerEvent)) error {
+	if _, err := exec.LookPath("dbus-monitor"); err != nil {
+		return PowerEventsNotSupported
+	}
+
+	args := append([]string{"dbus-monitor", "--system"}, logindMatches...)
+	if _, err := exec.LookPath("systemd-inhibit"); err == nil {
+		args = append([]string{"systemd-inhibit", "--what=sleep:shutdown", "--mode=delay",
+			"--who=vlaunch", "--why=Stopping the virtual machine"}, args...)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to watch logind: %s", err.Error())
+	}
+
+	go func() {
+		defer cmd.Wait()
+
+		// The signal header gives its name, its argument is on the next
+		// lines, true before sleeping or shutting down and false after
+		// waking up
+		var member string
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			switch {
+			case strings.HasPrefix(line, "signal "):
+				member = ""
+				if strings.Contains(line, "member=PrepareForSleep") {
+					member = "PrepareForSleep"
+				} else if strings.Contains(line, "member=PrepareForShutdown") {
+					member = "PrepareForShutdown"
+				}
+			case line == "boolean true" && member == "PrepareForSleep":
+				handler(HostSuspending)
+			case line == "boolean false" && member == "PrepareForSleep":
+				handler(HostResumed)
+			case line == "boolean true" && member == "PrepareForShutdown":
+				handler(HostShuttingDown)
+			}
+		}
+	}()
+	return nil
+}
+
+// OnBattery returns whether the host runs on battery, which is never the
+// case without one. The batteries of peripherals are ignored
+func OnBattery() (bool, error) {
+	supplies, err := filepath.Glob("/sys/class/power_supply/*")
+	if err != nil {
+		return false, err
+	}
+
+	readAttribute := func(supply, name string) string {
+		content, _ := ioutil.ReadFile(filepath.Join(supply, name))
+		return strings.TrimSpace(string(content))
+	}
+
+	hasBattery := false
+	for _, supply := range supplies {
+		switch readAttribute(supply, "type") {
+		case "Mains", "USB":
+			if readAttribute(supply, "online") == "1" {
+				return false, nil
+			}
+		case "Battery":
+			if readAttribute(supply, "scope") != "Device" {
+				hasBattery = true
+			}
+		}
+	}
+	return hasBattery, nil
+}
+
+// GetProxy returns the proxy configuration of the host, taken from the
+// environment, nil if there is none
+func GetProxy() (*Proxy, error) {
+	return environmentProxy(), nil
+}
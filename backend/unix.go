@@ -0,0 +1,88 @@
+// +build linux darwin
+
+package backend
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// shellQuote quotes a string for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// InvokingUser returns the user that ran vlaunch as root through sudo or
+// pkexec
+func InvokingUser() (uid, gid int, found bool) {
+	if sudoUID, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil && sudoUID != 0 {
+		if sudoGID, err := strconv.Atoi(os.Getenv("SUDO_GID")); err == nil {
+			return sudoUID, sudoGID, true
+		}
+	}
+
+	if pkexecUID, err := strconv.Atoi(os.Getenv("PKEXEC_UID")); err == nil && pkexecUID != 0 {
+		if u, err := user.LookupId(strconv.Itoa(pkexecUID)); err == nil {
+			if gid, err := strconv.Atoi(u.Gid); err == nil {
+				return pkexecUID, gid, true
+			}
+		}
+	}
+
+	return 0, 0, false
+}
+
+// DropPrivileges makes the process run as the given user, with its groups
+// and home directory, so that VirtualBox uses the registry of the user
+func DropPrivileges(uid, gid int) error {
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return err
+	}
+
+	var groups []int
+	if groupIds, err := u.GroupIds(); err == nil {
+		for _, id := range groupIds {
+			if group, err := strconv.Atoi(id); err == nil {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	if err := syscall.Setgroups(groups); err != nil {
+		return err
+	}
+
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+
+	if err := syscall.Setuid(uid); err != nil {
+		return err
+	}
+
+	os.Setenv("HOME", u.HomeDir)
+	os.Setenv("USER", u.Username)
+	os.Setenv("LOGNAME", u.Username)
+	return nil
+}
+
+// GrantDeviceAccess gives the ownership of a device node to a user, until
+// the device is plugged again
+func GrantDeviceAccess(device string, uid int) error {
+	logger.Info("Granting device access", "device", device, "uid", uid)
+	return os.Chown(device, uid, -1)
+}
+
+// GetFreeDiskSpace returns the space available to the user on the file
+// system holding the given path
+func GetFreeDiskSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
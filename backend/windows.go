@@ -10,12 +10,17 @@ import "C"
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"unsafe"
 
 	"github.com/StackExchange/wmi"
@@ -25,6 +30,10 @@ import (
 var RelativeRawVMDK = false
 var SupportPassiveListener = false
 
+// VirtualBox needs administrator privileges to open raw disks on Windows
+var CanDropPrivileges = false
+var AudioDriver = "dsound"
+
 type Win32_LogicalDisk struct {
 	DriveType  uint32
 	Caption    string
@@ -34,14 +43,21 @@ type Win32_LogicalDisk struct {
 
 type Win32_DiskPartition struct {
 	DeviceID string
+	Size     uint64
 }
 
 type Win32_DiskDrive struct {
-	DeviceID string
-	Name     string
+	DeviceID      string
+	Name          string
+	Model         string
+	SerialNumber  *string
+	Size          uint64
+	InterfaceType string
+	MediaType     *string
 }
 
-type DiskGeometry struct {
+// diskGeometry is the DISK_GEOMETRY structure
+type diskGeometry struct {
 	Cylinders         uint64
 	MediaType         uint32
 	TracksPerCylinder uint32
@@ -53,8 +69,170 @@ type GetLengthInformation struct {
 	Size uint64
 }
 
+// FindVBoxManage returns the path of the VBoxManage command of the
+// VirtualBox installation
+func FindVBoxManage() (string, error) {
+	for _, variable := range []string{"VBOX_MSI_INSTALL_PATH", "VBOX_INSTALL_PATH"} {
+		if installPath := os.Getenv(variable); installPath != "" {
+			vboxManage := filepath.Join(installPath, "VBoxManage.exe")
+			if _, err := os.Stat(vboxManage); err == nil {
+				return vboxManage, nil
+			}
+		}
+	}
+
+	return exec.LookPath("VBoxManage.exe")
+}
+
+// CheckDriver returns an error if the VirtualBox support driver is not
+// running, it was named VBoxDrv before VirtualBox 6.1
+func CheckDriver() error {
+	for _, service := range []string{"VBoxSup", "VBoxDrv"} {
+		output, err := exec.Command("sc", "query", service).Output()
+		if err != nil {
+			continue
+		}
+		if strings.Contains(string(output), "RUNNING") {
+			return nil
+		}
+		return fmt.Errorf("The VirtualBox driver service %s is not running, reinstall VirtualBox or restart the computer", service)
+	}
+	return errors.New("The VirtualBox driver service is not installed, reinstall VirtualBox")
+}
+
+// OpenURL opens a URL with the default browser
+func OpenURL(url string) error {
+	return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+}
+
+// EjectDevice is not supported on Windows, the disks are ejected from the
+// notification area
+func EjectDevice(device string) error {
+	return errors.New("Ejecting a disk is not supported on Windows")
+}
+
+// pfVirtFirmwareEnabled is the processor feature reporting that the firmware
+// enables hardware virtualization
+const pfVirtFirmwareEnabled = 21
+
+// CheckVirtualization returns an error if the firmware disables hardware
+// virtualization. Windows does not report it while Hyper-V runs, which
+// VirtualBox can use instead.
+func CheckVirtualization() error {
+	if ret, _, _ := procIsProcessorFeaturePresent.Call(pfVirtFirmwareEnabled); ret != 0 {
+		return nil
+	}
+
+	if output, err := exec.Command("sc", "query", "hvservice").Output(); err == nil && strings.Contains(string(output), "RUNNING") {
+		return nil
+	}
+	return errors.New("Hardware virtualization (VT-x/AMD-V) is disabled, enable it in the firmware settings")
+}
+
+// memoryStatusEx is the MEMORYSTATUSEX structure
+type memoryStatusEx struct {
+	length               uint32
+	memoryLoad           uint32
+	totalPhys            uint64
+	availPhys            uint64
+	totalPageFile        uint64
+	availPageFile        uint64
+	totalVirtual         uint64
+	availVirtual         uint64
+	availExtendedVirtual uint64
+}
+
+// GetFreeRam returns the physical memory available, in bytes
+func GetFreeRam() (uint64, error) {
+	status := memoryStatusEx{}
+	status.length = uint32(unsafe.Sizeof(status))
+	if ret, _, err := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status))); ret == 0 {
+		return 0, err
+	}
+	return status.availPhys, nil
+}
+
+// GetFreeDiskSpace returns the space available to the user on the volume
+// holding the given path
+func GetFreeDiskSpace(path string) (uint64, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var available uint64
+	if ret, _, err := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&available)), 0, 0); ret == 0 {
+		return 0, err
+	}
+	return available, nil
+}
+
+// hostKeyCodes are the virtual-key codes of the keys that can be the host
+// key
+var hostKeyCodes = map[string]string{
+	"left_ctrl":  "162",
+	"right_ctrl": "163",
+	"left_alt":   "164",
+	"right_alt":  "165",
+	"left_win":   "91",
+	"right_win":  "92",
+	"menu":       "93",
+}
+
+// KeyboardLayout returns the identifier of the active keyboard layout,
+// e.g. '00000409' for US English
+func KeyboardLayout() string {
+	name := make([]uint16, 9)
+	if ret, _, _ := procGetKeyboardLayoutNameW.Call(uintptr(unsafe.Pointer(&name[0]))); ret == 0 {
+		return ""
+	}
+	return windows.UTF16ToString(name)
+}
+
+// defaultHostKey returns the right Ctrl key, as VirtualBox does
+func defaultHostKey() string {
+	return "right_ctrl"
+}
+
+func DefaultDataPath() string {
+	return filepath.Join(os.Getenv("LOCALAPPDATA"), "vlaunch")
+}
+
+var (
+	kernel32                 = windows.NewLazySystemDLL("kernel32.dll")
+	procGetSystemPowerStatus = kernel32.NewProc("GetSystemPowerStatus")
+	procGetDiskFreeSpaceExW  = kernel32.NewProc("GetDiskFreeSpaceExW")
+
+	procIsProcessorFeaturePresent = kernel32.NewProc("IsProcessorFeaturePresent")
+	procGlobalMemoryStatusEx      = kernel32.NewProc("GlobalMemoryStatusEx")
+)
+
+var (
+	shell32             = windows.NewLazySystemDLL("shell32.dll")
+	procIsUserAnAdmin   = shell32.NewProc("IsUserAnAdmin")
+	procShellExecuteExW = shell32.NewProc("ShellExecuteExW")
+)
+
+// IsAdmin returns whether the process runs elevated
 func IsAdmin() bool {
-	return true
+	ret, _, _ := procIsUserAnAdmin.Call()
+	return ret != 0
+}
+
+// ProcessExists returns whether a process with the given PID is running
+func ProcessExists(pid int) bool {
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(handle)
+
+	// Processes that exited keep a handle until all are closed
+	var exitCode uint32
+	if err := windows.GetExitCodeProcess(handle, &exitCode); err != nil {
+		return false
+	}
+	return exitCode == 259 // STILL_ACTIVE
 }
 
 func controlCode(t, f, m, a int) int {
@@ -84,6 +262,60 @@ func GetDeviceSize(device string) (uint64, error) {
 	return size, nil
 }
 
+// storageAccessAlignment is the STORAGE_ACCESS_ALIGNMENT_DESCRIPTOR structure
+type storageAccessAlignment struct {
+	Version                       uint32
+	Size                          uint32
+	BytesPerCacheLine             uint32
+	BytesOffsetForCacheAlignment  uint32
+	BytesPerLogicalSector         uint32
+	BytesPerPhysicalSector        uint32
+	BytesOffsetForSectorAlignment uint32
+}
+
+// GetDiskGeometry returns the sector sizes of a disk and the geometry the
+// driver reports for it
+func GetDiskGeometry(device string) (geometry DiskGeometry, err error) {
+	fd, err := windows.Open(device, os.O_RDONLY, 0)
+	if err != nil {
+		return geometry, err
+	}
+	defer windows.Close(fd)
+
+	var geo diskGeometry
+	var bytesReturned uint32
+	buffer := make([]byte, binary.Size(geo))
+	if err := windows.DeviceIoControl(fd, C.IOCTL_DISK_GET_DRIVE_GEOMETRY, nil, 0, &buffer[0], uint32(len(buffer)), &bytesReturned, nil); err != nil {
+		return geometry, err
+	}
+
+	if err := binary.Read(bytes.NewReader(buffer), binary.LittleEndian, &geo); err != nil {
+		return geometry, err
+	}
+
+	geometry = DiskGeometry{
+		LogicalSectorSize:  uint64(geo.BytesPerSector),
+		PhysicalSectorSize: uint64(geo.BytesPerSector),
+		Cylinders:          geo.Cylinders,
+		Heads:              uint64(geo.TracksPerCylinder),
+		SectorsPerTrack:    uint64(geo.SectorsPerTrack),
+	}
+
+	// STORAGE_PROPERTY_QUERY asking for the StorageAccessAlignmentProperty
+	query := make([]byte, 12)
+	binary.LittleEndian.PutUint32(query, C.StorageAccessAlignmentProperty)
+
+	var alignment storageAccessAlignment
+	buffer = make([]byte, binary.Size(alignment))
+	if err := windows.DeviceIoControl(fd, C.IOCTL_STORAGE_QUERY_PROPERTY, &query[0], uint32(len(query)), &buffer[0], uint32(len(buffer)), &bytesReturned, nil); err == nil {
+		if err := binary.Read(bytes.NewReader(buffer), binary.LittleEndian, &alignment); err == nil && alignment.BytesPerPhysicalSector != 0 {
+			geometry.PhysicalSectorSize = uint64(alignment.BytesPerPhysicalSector)
+		}
+	}
+
+	return geometry, nil
+}
+
 func FindDeviceByUUID(uuid string) (string, error) {
 	return "", DeviceNotFound
 }
@@ -108,7 +340,7 @@ func getDiskFromPartition(partition string) (string, error) {
 	return "", DeviceNotFound
 }
 
-func getUsbDevices() (devices []USBDevice, err error) {
+func GetUSBDevices() (devices []USBDevice, err error) {
 	var logicalDisks []Win32_LogicalDisk
 	q := wmi.CreateQuery(&logicalDisks, "WHERE DriveType = 2")
 	err = wmi.Query(q, &logicalDisks)
@@ -132,16 +364,108 @@ func getUsbDevices() (devices []USBDevice, err error) {
 	return devices, nil
 }
 
+// ListDisks returns the disk devices of the machine
+func ListDisks() (disks []string, err error) {
+	var drives []Win32_DiskDrive
+	if err := wmi.Query(wmi.CreateQuery(&drives, ""), &drives); err != nil {
+		return nil, err
+	}
+
+	for _, drive := range drives {
+		disks = append(disks, drive.DeviceID)
+	}
+	return disks, nil
+}
+
+// driveBus returns the bus of a disk from its WMI interface type
+func driveBus(drive Win32_DiskDrive) string {
+	switch drive.InterfaceType {
+	case "USB":
+		return "usb"
+	case "IDE":
+		return "sata"
+	case "SCSI":
+		// NVMe and SATA disks are reported as SCSI by storport
+		if strings.Contains(strings.ToUpper(drive.Model), "NVME") {
+			return "nvme"
+		}
+		return "scsi"
+	case "":
+		return "unknown"
+	default:
+		return strings.ToLower(drive.InterfaceType)
+	}
+}
+
+// ListDevices returns the disks of the host with their partitions, a
+// partition being the letter of the volume it holds
+func ListDevices() (devices []Device, err error) {
+	var drives []Win32_DiskDrive
+	if err := wmi.Query(wmi.CreateQuery(&drives, ""), &drives); err != nil {
+		return nil, err
+	}
+
+	for _, drive := range drives {
+		device := Device{
+			Path:  drive.DeviceID,
+			Model: strings.TrimSpace(drive.Model),
+			Size:  drive.Size,
+			Bus:   driveBus(drive),
+		}
+		if drive.SerialNumber != nil {
+			device.Serial = strings.TrimSpace(*drive.SerialNumber)
+		}
+		device.Removable = device.Bus == "usb" || (drive.MediaType != nil && strings.HasPrefix(*drive.MediaType, "Removable"))
+
+		// The backslashes of \\.\PHYSICALDRIVEn must be escaped in WQL
+		var partitions []Win32_DiskPartition
+		deviceID := strings.Replace(drive.DeviceID, `\`, `\\`, -1)
+		query := fmt.Sprintf("ASSOCIATORS OF {Win32_DiskDrive.DeviceID=\"%s\"} WHERE AssocClass = Win32_DiskDriveToDiskPartition", deviceID)
+		if err := wmi.Query(query, &partitions); err != nil {
+			return nil, err
+		}
+
+		for _, partition := range partitions {
+			var logicalDisks []Win32_LogicalDisk
+			query := fmt.Sprintf("ASSOCIATORS OF {Win32_DiskPartition.DeviceID=\"%s\"} WHERE AssocClass = Win32_LogicalDiskToPartition", partition.DeviceID)
+			if err := wmi.Query(query, &logicalDisks); err != nil {
+				return nil, err
+			}
+
+			if len(logicalDisks) == 0 {
+				device.Partitions = append(device.Partitions, Partition{Path: partition.DeviceID, Size: partition.Size})
+				continue
+			}
+
+			for _, logicalDisk := range logicalDisks {
+				label := ""
+				if logicalDisk.VolumeName != nil {
+					label = *logicalDisk.VolumeName
+				}
+				device.Partitions = append(device.Partitions, Partition{
+					Path:       logicalDisk.DeviceID,
+					Size:       partition.Size,
+					Label:      label,
+					Mountpoint: logicalDisk.Caption + "\\",
+				})
+			}
+		}
+
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
 func FindDeviceByPath(path string) (string, error) {
-	usbDevices, err := getUsbDevices()
+	usbDevices, err := GetUSBDevices()
 	if err != nil {
 		return "", err
 	}
-	log.Printf("Found USB devices: %+v\n", usbDevices)
+	logger.Debug("Found USB devices", "devices", usbDevices)
 
 	for _, device := range usbDevices {
 		if strings.HasPrefix(strings.ToLower(path), strings.ToLower(device.Mountpoint)) {
-			log.Printf("Found device %s\n", device.Device)
+			logger.Info("Found device", "device", device.Device)
 			return device.Device, nil
 		}
 	}
@@ -149,8 +473,88 @@ func FindDeviceByPath(path string) (string, error) {
 	return "", DeviceNotFound
 }
 
-func RunAsRoot(executable string, args ...string) error {
-	return errors.New("Failed to find a way to run as root")
+const (
+	seeMaskNoCloseProcess = 0x40
+	swShowNormal          = 1
+	errorCancelled        = 1223
+)
+
+// shellExecuteInfo is the SHELLEXECUTEINFOW structure
+type shellExecuteInfo struct {
+	size       uint32
+	mask       uint32
+	hwnd       uintptr
+	verb       *uint16
+	file       *uint16
+	parameters *uint16
+	directory  *uint16
+	show       int32
+	instApp    uintptr
+	idList     uintptr
+	class      *uint16
+	keyClass   uintptr
+	hotKey     uint32
+	icon       uintptr
+	process    windows.Handle
+}
+
+func InvokingUser() (uid, gid int, found bool) {
+	return 0, 0, false
+}
+
+func DropPrivileges(uid, gid int) error {
+	return errors.New("Dropping privileges is not supported on Windows")
+}
+
+func GrantDeviceAccess(device string, uid int) error {
+	return nil
+}
+
+// RunAsRoot runs the executable with the given arguments elevated through
+// UAC, and returns its exit code once it exited
+func RunAsRoot(executable string, args ...string) (int, error) {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = syscall.EscapeArg(arg)
+	}
+
+	verb, _ := windows.UTF16PtrFromString("runas")
+	file, err := windows.UTF16PtrFromString(executable)
+	if err != nil {
+		return 0, err
+	}
+	parameters, err := windows.UTF16PtrFromString(strings.Join(quoted, " "))
+	if err != nil {
+		return 0, err
+	}
+
+	info := shellExecuteInfo{
+		mask:       seeMaskNoCloseProcess,
+		verb:       verb,
+		file:       file,
+		parameters: parameters,
+		show:       swShowNormal,
+	}
+	info.size = uint32(unsafe.Sizeof(info))
+
+	logger.Info("Running elevated", "executable", executable, "args", args)
+	if ret, _, err := procShellExecuteExW.Call(uintptr(unsafe.Pointer(&info))); ret == 0 {
+		if errno, ok := err.(syscall.Errno); ok && errno == errorCancelled {
+			return 0, ElevationCancelled
+		}
+		return 0, fmt.Errorf("Failed to run elevated: %s", err.Error())
+	}
+	defer windows.CloseHandle(info.process)
+
+	if _, err := windows.WaitForSingleObject(info.process, windows.INFINITE); err != nil {
+		return 0, err
+	}
+
+	var exitCode uint32
+	if err := windows.GetExitCodeProcess(info.process, &exitCode); err != nil {
+		return 0, err
+	}
+	return int(exitCode), nil
 }
 
 type windowsDevice struct {
@@ -183,3 +587,268 @@ func OpenDevice(device string, mode int) (DeviceFile, error) {
 
 	return dev, nil
 }
+
+const (
+	wmQueryEndSession     = 0x0011
+	wmEndSession          = 0x0016
+	wmPowerBroadcast      = 0x0218
+	wmQuit                = 0x0012
+	pbtAPMSuspend         = 0x4
+	pbtAPMResumeSuspend   = 0x7
+	pbtAPMResumeAutomatic = 0x12
+)
+
+var (
+	user32                         = windows.NewLazySystemDLL("user32.dll")
+	procRegisterClassExW           = user32.NewProc("RegisterClassExW")
+	procCreateWindowExW            = user32.NewProc("CreateWindowExW")
+	procDestroyWindow              = user32.NewProc("DestroyWindow")
+	procDefWindowProcW             = user32.NewProc("DefWindowProcW")
+	procGetMessageW                = user32.NewProc("GetMessageW")
+	procDispatchMessageW           = user32.NewProc("DispatchMessageW")
+	procPostMessageW               = user32.NewProc("PostMessageW")
+	procShutdownBlockReasonCreate  = user32.NewProc("ShutdownBlockReasonCreate")
+	procShutdownBlockReasonDestroy = user32.NewProc("ShutdownBlockReasonDestroy")
+	procGetKeyboardLayoutNameW     = user32.NewProc("GetKeyboardLayoutNameW")
+)
+
+type wndClassEx struct {
+	size       uint32
+	style      uint32
+	wndProc    uintptr
+	clsExtra   int32
+	wndExtra   int32
+	instance   windows.Handle
+	icon       windows.Handle
+	cursor     windows.Handle
+	background windows.Handle
+	menuName   *uint16
+	className  *uint16
+	iconSm     windows.Handle
+}
+
+type winMsg struct {
+	hwnd    uintptr
+	message uint32
+	wParam  uintptr
+	lParam  uintptr
+	time    uint32
+	x, y    int32
+}
+
+var (
+	powerWindowClass sync.Once
+	powerWindowErr   error
+	powerHandler     func(PowerEvent)
+	powerHandlerLock sync.Mutex
+)
+
+var (
+	powerWindowClassName, _ = windows.UTF16PtrFromString("vlaunchPowerWindow")
+	shutdownBlockReason, _  = windows.UTF16PtrFromString("Stopping the virtual machine")
+)
+
+func notifyPowerEvent(event PowerEvent) {
+	powerHandlerLock.Lock()
+	handler := powerHandler
+	powerHandlerLock.Unlock()
+
+	if handler != nil {
+		handler(event)
+	}
+}
+
+// powerWindowProc runs the power handler on the thread of the message loop.
+// Windows waits about two seconds for the suspend broadcast and until the
+// session end message is handled before logging off or shutting down
+func powerWindowProc(hwnd, message, wParam, lParam uintptr) uintptr {
+	switch message {
+	case wmPowerBroadcast:
+		switch wParam {
+		case pbtAPMSuspend:
+			notifyPowerEvent(HostSuspending)
+		case pbtAPMResumeSuspend, pbtAPMResumeAutomatic:
+			notifyPowerEvent(HostResumed)
+		}
+		return 1
+	case wmQueryEndSession:
+		// Tell the user why the shutdown is delayed
+		procShutdownBlockReasonCreate.Call(hwnd, uintptr(unsafe.Pointer(shutdownBlockReason)))
+		return 1
+	case wmEndSession:
+		if wParam != 0 {
+			notifyPowerEvent(HostShuttingDown)
+		}
+		procShutdownBlockReasonDestroy.Call(hwnd)
+		return 0
+	}
+
+	ret, _, _ := procDefWindowProcW.Call(hwnd, message, wParam, lParam)
+	return ret
+}
+
+func registerPowerWindowClass() error {
+	powerWindowClass.Do(func() {
+		class := wndClassEx{
+			wndProc:   syscall.NewCallback(powerWindowProc),
+			className: powerWindowClassName,
+		}
+		class.size = uint32(unsafe.Sizeof(class))
+		if ret, _, err := procRegisterClassExW.Call(uintptr(unsafe.Pointer(&class))); ret == 0 {
+			powerWindowErr = err
+		}
+	})
+	return powerWindowErr
+}
+
+// WatchPowerEvents calls the handler when the host goes to sleep, wakes up,
+// shuts down or when the user logs off. These messages are only sent to
+// top-level windows, so a hidden one is created with its own message loop
+func WatchPowerEvents(ctx context.Context, handler func(PowerEvent)) error {
+	if err := registerPowerWindowClass(); err != nil {
+		return fmt.Errorf("Failed to register window class: %s", err.Error())
+	}
+
+	powerHandlerLock.Lock()
+	if powerHandler != nil {
+		powerHandlerLock.Unlock()
+		return errors.New("Host power events are already watched")
+	}
+	powerHandler = handler
+	powerHandlerLock.Unlock()
+
+	created := make(chan error, 1)
+	go func() {
+		// The window belongs to the thread that created it
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		defer func() {
+			powerHandlerLock.Lock()
+			powerHandler = nil
+			powerHandlerLock.Unlock()
+		}()
+
+		hwnd, _, err := procCreateWindowExW.Call(0, uintptr(unsafe.Pointer(powerWindowClassName)), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+		if hwnd == 0 {
+			created <- err
+			return
+		}
+		defer procDestroyWindow.Call(hwnd)
+		created <- nil
+
+		go func() {
+			<-ctx.Done()
+			procPostMessageW.Call(hwnd, wmQuit, 0, 0)
+		}()
+
+		var msg winMsg
+		for {
+			if ret, _, _ := procGetMessageW.Call(uintptr(unsafe.Pointer(&msg)), 0, 0, 0); int32(ret) <= 0 {
+				return
+			}
+			procDispatchMessageW.Call(uintptr(unsafe.Pointer(&msg)))
+		}
+	}()
+
+	if err := <-created; err != nil {
+		return fmt.Errorf("Failed to create power window: %s", err.Error())
+	}
+	return nil
+}
+
+const (
+	acLineOffline   = 0
+	batteryNoSystem = 128
+)
+
+type systemPowerStatus struct {
+	acLineStatus        byte
+	batteryFlag         byte
+	batteryLifePercent  byte
+	systemStatusFlag    byte
+	batteryLifeTime     uint32
+	batteryFullLifeTime uint32
+}
+
+// OnBattery returns whether the host runs on battery, which is never the
+// case without one
+func OnBattery() (bool, error) {
+	var status systemPowerStatus
+	if ret, _, err := procGetSystemPowerStatus.Call(uintptr(unsafe.Pointer(&status))); ret == 0 {
+		return false, err
+	}
+	return status.acLineStatus == acLineOffline && status.batteryFlag != batteryNoSystem, nil
+}
+
+const internetSettingsKey = `HKCU\Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// queryRegistry returns a value of the Internet settings of the user, empty
+// if it is not set
+func queryRegistry(name string) string {
+	output, err := exec.Command("reg", "query", internetSettingsKey, "/v", name).Output()
+	if err != nil {
+		return ""
+	}
+
+	// The value is on the line of its name, after its type
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && strings.EqualFold(fields[0], name) {
+			return strings.Join(fields[2:], " ")
+		}
+	}
+	return ""
+}
+
+// GetProxy returns the proxy configuration of the host, the one of the
+// environment if any or else the one of the Internet settings of the user,
+// nil if there is none
+func GetProxy() (*Proxy, error) {
+	if proxy := environmentProxy(); proxy != nil {
+		return proxy, nil
+	}
+
+	if enabled := queryRegistry("ProxyEnable"); enabled != "0x1" {
+		return nil, nil
+	}
+
+	// The server is either used for all the protocols or given per
+	// protocol, as in http=proxy:3128;https=proxy:3129
+	proxy := &Proxy{}
+	server := queryRegistry("ProxyServer")
+	if !strings.Contains(server, "=") {
+		proxy.HTTP, proxy.HTTPS = server, server
+	} else {
+		for _, entry := range strings.Split(server, ";") {
+			if fields := strings.SplitN(entry, "=", 2); len(fields) == 2 {
+				switch strings.ToLower(fields[0]) {
+				case "http":
+					proxy.HTTP = fields[1]
+				case "https":
+					proxy.HTTPS = fields[1]
+				}
+			}
+		}
+	}
+
+	for _, address := range []*string{&proxy.HTTP, &proxy.HTTPS} {
+		if *address != "" && !strings.Contains(*address, "://") {
+			*address = "http://" + *address
+		}
+	}
+
+	// <local> stands for the host names without a dot
+	var exceptions []string
+	for _, exception := range strings.Split(queryRegistry("ProxyOverride"), ";") {
+		if exception != "" && exception != "<local>" {
+			exceptions = append(exceptions, exception)
+		}
+	}
+	proxy.NoProxy = strings.Join(exceptions, ",")
+
+	if proxy.HTTP == "" && proxy.HTTPS == "" {
+		return nil, nil
+	}
+	return proxy, nil
+}
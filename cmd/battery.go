@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/lebauce/vlaunch/vm"
+)
+
+// batteryCheckInterval is how often the power source of the host is checked
+const batteryCheckInterval = 30 * time.Second
+
+// powerSourceProperty tells the guest whether the host runs on battery or AC
+const powerSourceProperty = "/vlaunch/Host/PowerSource"
+
+// applyBatteryPolicy limits, pauses or warns the machine while the host runs
+// on battery, undoing it when it is plugged in again
+func applyBatteryPolicy(ctx context.Context, vm *vm.VirtualMachine) {
+	policy := vmConfig.GetString("power.on_battery")
+	if policy == "none" {
+		return
+	}
+
+	ticker := time.NewTicker(batteryCheckInterval)
+	defer ticker.Stop()
+
+	var (
+		onBattery, known bool
+		paused           bool
+		previousCap      int
+	)
+
+	for {
+		battery, err := backend.OnBattery()
+		if err != nil {
+			slog.Warn("Failed to get the power source of the host", "error", err)
+		} else if !known || battery != onBattery {
+			known, onBattery = true, battery
+
+			source := "ac"
+			if onBattery {
+				source = "battery"
+			}
+			slog.Info("Power source of the host changed", "source", source, "policy", policy)
+
+			if err := vm.SetGuestProperty(powerSourceProperty, source, "RDONLYGUEST"); err != nil {
+				slog.Warn("Failed to set the power source guest property", "error", err)
+			}
+
+			switch policy {
+			case "cpu_cap":
+				if onBattery {
+					previousCap = vmConfig.GetInt("cpu_execution_cap")
+					if cap := vmConfig.GetInt("power.battery_cpu_cap"); cap < previousCap {
+						if err := vm.SetCPUExecutionCap(cap); err != nil {
+							slog.Error("Failed to lower the CPU execution cap", "error", err)
+							previousCap = 0
+						}
+					} else {
+						previousCap = 0
+					}
+				} else if previousCap != 0 {
+					if err := vm.SetCPUExecutionCap(previousCap); err != nil {
+						slog.Error("Failed to restore the CPU execution cap", "error", err)
+					}
+					previousCap = 0
+				}
+			case "pause":
+				if onBattery {
+					if err := vm.Pause(); err != nil {
+						slog.Info("Machine not paused", "error", err)
+					} else {
+						paused = true
+					}
+				} else if paused {
+					paused = false
+					if err := vm.Resume(); err != nil {
+						slog.Error("Failed to resume the machine", "error", err)
+					}
+				}
+			case "warn":
+				if onBattery {
+					slog.Warn("The host runs on battery")
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// bundleArgumentsFile holds, in the Resources folder of an app bundle, the
+// arguments vlaunch runs with when the bundle is opened
+const bundleArgumentsFile = "arguments.json"
+
+var (
+	bundleSign       string
+	bundleIdentifier string
+	bundleAutostart  bool
+)
+
+var infoPlistTemplate = template.Must(template.New("plist").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>CFBundleName</key>
+	<string>{{html .Name}}</string>
+	<key>CFBundleIdentifier</key>
+	<string>{{html .Identifier}}</string>
+	<key>CFBundleExecutable</key>
+	<string>vlaunch</string>
+	<key>CFBundlePackageType</key>
+	<string>APPL</string>
+	<key>CFBundleInfoDictionaryVersion</key>
+	<string>6.0</string>
+	<key>CFBundleVersion</key>
+	<string>1</string>
+	<key>NSHighResolutionCapable</key>
+	<true/>
+	<key>NSRemovableVolumesUsageDescription</key>
+	<string>The machine boots from a USB disk.</string>
+</dict>
+</plist>
+`))
+
+var launchAgentTemplate = template.Must(template.New("agent").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{html .Label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>{{html .Executable}}</string>
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>LimitLoadToSessionType</key>
+	<string>Aqua</string>
+	<key>ProcessType</key>
+	<string>Interactive</string>
+	<key>ExitTimeOut</key>
+	<integer>{{.StopTimeout}}</integer>
+</dict>
+</plist>
+`))
+
+// bundleResources returns the Resources folder of the app bundle vlaunch
+// runs from, if any
+func bundleResources() (string, bool) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", false
+	}
+
+	macOS := filepath.Dir(executable)
+	contents := filepath.Dir(macOS)
+	if filepath.Base(macOS) != "MacOS" || filepath.Base(contents) != "Contents" || filepath.Ext(filepath.Dir(contents)) != ".app" {
+		return "", false
+	}
+	return filepath.Join(contents, "Resources"), true
+}
+
+// bundleArgs returns the arguments of the command line. The Finder of older
+// macOS versions adds a -psn_ argument, which is dropped, and an app bundle
+// opened without arguments runs with the ones it was created with.
+func bundleArgs() []string {
+	args := []string{}
+	for _, arg := range os.Args[1:] {
+		if !strings.HasPrefix(arg, "-psn_") {
+			args = append(args, arg)
+		}
+	}
+
+	resources, found := bundleResources()
+	if !found || len(args) > 0 {
+		return args
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(resources, bundleArgumentsFile))
+	if err != nil {
+		return args
+	}
+
+	if err := json.Unmarshal(content, &args); err != nil {
+		slog.Warn("Failed to decode the arguments of the app bundle", "error", err)
+		return []string{}
+	}
+
+	// The configuration files are copied into the bundle
+	for i := 1; i < len(args); i++ {
+		if args[i-1] == "--config" && !filepath.IsAbs(args[i]) {
+			args[i] = filepath.Join(resources, args[i])
+		}
+	}
+	return args
+}
+
+func copyFile(source, destination string, mode os.FileMode) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(output, input); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+// writeTemplate writes a file from a template
+func writeTemplate(path string, tmpl *template.Template, data interface{}) error {
+	var content bytes.Buffer
+	if err := tmpl.Execute(&content, data); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content.Bytes(), 0644)
+}
+
+// launchAgentPath returns the path of the launch agent of the machine
+func launchAgentPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", bundleLabel()+".plist"), nil
+}
+
+// bundleLabel returns the identifier of the app bundle and of the launch
+// agent of the machine
+func bundleLabel() string {
+	if bundleIdentifier != "" {
+		return bundleIdentifier
+	}
+	return "org.vlaunch." + vmConfig.GetString("machine_name")
+}
+
+func launchctl(args ...string) error {
+	output, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %s failed: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// installLaunchAgent starts the app bundle when the user logs in, and again
+// when it fails
+func installLaunchAgent(app string) error {
+	path, err := launchAgentPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// A previous agent would prevent this one from being loaded
+	launchctl("bootout", "gui/"+strconv.Itoa(os.Getuid()), path)
+
+	err = writeTemplate(path, launchAgentTemplate, map[string]interface{}{
+		"Label":       bundleLabel(),
+		"Executable":  filepath.Join(app, "Contents", "MacOS", "vlaunch"),
+		"StopTimeout": int((vmConfig.GetDuration("shutdown_handshake.timeout") + vmConfig.GetDuration("timeouts.shutdown") + 30*time.Second).Seconds()),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to write launch agent: %s", err.Error())
+	}
+
+	return launchctl("bootstrap", "gui/"+strconv.Itoa(os.Getuid()), path)
+}
+
+var bundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Wrap the machine in a macOS app bundle",
+}
+
+var bundleCreateCmd = &cobra.Command{
+	Use:   "create <Name.app>",
+	Short: "Create a signed app bundle running the machine",
+	Long: `Create an app bundle holding vlaunch and its configuration files, that
+runs the machine when opened from the Finder. Raw disks are set up after
+asking for the password of an administrator, the machine runs as the user.
+With --autostart, a launch agent opens it when the user logs in.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if runtime.GOOS != "darwin" {
+			return errors.New("App bundles are only available on macOS")
+		}
+
+		if len(args) != 1 {
+			return errors.New("The path of the app bundle is required")
+		}
+
+		app, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+		if filepath.Ext(app) != ".app" {
+			app += ".app"
+		}
+
+		executable, err := os.Executable()
+		if err != nil {
+			return err
+		}
+
+		macOS := filepath.Join(app, "Contents", "MacOS")
+		resources := filepath.Join(app, "Contents", "Resources")
+		for _, dir := range []string{macOS, resources} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+
+		if err := copyFile(executable, filepath.Join(macOS, "vlaunch"), 0755); err != nil {
+			return fmt.Errorf("Failed to copy vlaunch: %s", err.Error())
+		}
+
+		var bundledArgs []string
+		for i, file := range cfgFiles {
+			name := fmt.Sprintf("config-%d.yml", i)
+			if err := copyFile(file, filepath.Join(resources, name), 0644); err != nil {
+				return fmt.Errorf("Failed to copy %s: %s", file, err.Error())
+			}
+			bundledArgs = append(bundledArgs, "--config", name)
+		}
+
+		if profile != "" {
+			bundledArgs = append(bundledArgs, "--profile", profile)
+		}
+
+		if machineName != "" {
+			bundledArgs = append(bundledArgs, "--name", machineName)
+		}
+
+		content, err := json.Marshal(bundledArgs)
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(resources, bundleArgumentsFile), content, 0644); err != nil {
+			return err
+		}
+
+		err = writeTemplate(filepath.Join(app, "Contents", "Info.plist"), infoPlistTemplate, map[string]interface{}{
+			"Name":       vmConfig.GetString("machine_name"),
+			"Identifier": bundleLabel(),
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to write Info.plist: %s", err.Error())
+		}
+
+		if output, err := exec.Command("codesign", "--force", "--deep", "--sign", bundleSign, app).CombinedOutput(); err != nil {
+			return fmt.Errorf("Failed to sign the app bundle: %s", strings.TrimSpace(string(output)))
+		}
+		fmt.Printf("App bundle %s created\n", app)
+
+		if bundleAutostart {
+			if err := installLaunchAgent(app); err != nil {
+				return err
+			}
+			fmt.Printf("Launch agent %s installed\n", bundleLabel())
+		}
+		return nil
+	},
+}
+
+var bundleUninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Remove the launch agent opening the app bundle at login",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := launchAgentPath()
+		if err != nil {
+			return err
+		}
+
+		if err := launchctl("bootout", "gui/"+strconv.Itoa(os.Getuid()), path); err != nil {
+			slog.Warn("Failed to unload launch agent", "error", err)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("Failed to remove launch agent: %s", err.Error())
+		}
+		return nil
+	},
+}
+
+func init() {
+	bundleCmd.PersistentFlags().StringVar(&bundleIdentifier, "identifier", "", "bundle identifier and launch agent label, org.vlaunch.<machine_name> by default")
+	bundleCreateCmd.Flags().StringVar(&bundleSign, "sign", "-", "code signing identity, '-' for an ad-hoc signature")
+	bundleCreateCmd.Flags().BoolVar(&bundleAutostart, "autostart", false, "open the app bundle when the user logs in")
+
+	bundleCmd.AddCommand(bundleCreateCmd)
+	bundleCmd.AddCommand(bundleUninstallCmd)
+	RootCmd.AddCommand(bundleCmd)
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var cleanupDryRun bool
+
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "Remove the machines and disks left behind by interrupted runs",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		removed, err := vm.Cleanup(context.Background(), vmConfig, cleanupDryRun)
+		if jsonOutput() {
+			if printErr := printJSON(map[string]interface{}{"dry_run": cleanupDryRun, "removed": append([]string{}, removed...)}); printErr != nil {
+				return printErr
+			}
+			return err
+		}
+
+		for _, item := range removed {
+			if cleanupDryRun {
+				fmt.Println("Would remove", item)
+			} else {
+				fmt.Println("Removed", item)
+			}
+		}
+		return err
+	},
+}
+
+func init() {
+	cleanupCmd.Flags().BoolVar(&cleanupDryRun, "dry-run", false, "only list what would be removed")
+
+	RootCmd.AddCommand(cleanupCmd)
+}
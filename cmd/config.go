@@ -0,0 +1,446 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"text/template"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/spf13/cobra"
+)
+
+var (
+	configInitForce bool
+	configInitProbe bool
+)
+
+var configTemplate = template.Must(template.New("config").Parse(`# Vlaunch configuration
+
+# Hypervisor running the machine, virtualbox, qemu or hyperv. QEMU and
+# Hyper-V only support the basic machine life cycle.
+# hypervisor: virtualbox
+
+# Name of the VirtualBox machine
+machine_name: ufo
+
+# VirtualBox OS type of the guest, see 'VBoxManage list ostypes'
+distro_type: Linux_64
+
+# Firmware of the machine, bios or efi, and the devices to boot from in
+# order: disk, dvd, net or none
+firmware: bios
+# boot_order: [disk, dvd]
+
+# Real-time clock of the guest in utc or local time, auto uses local time for
+# Windows guests only. The clock can be shifted by an offset, e.g. -1h, and
+# kept in sync with the host by the Guest Additions
+time:
+  rtc: auto
+  sync: true
+  # offset: 0s
+
+# Folder holding the VirtualBox settings, generated disks and logs. The setup
+# steps whose inputs did not change since the last run are skipped, removing
+# <machine_name>.setup.json from it makes vlaunch redo them all.
+data_path: {{.DataPath}}
+
+# Resources allotted to the guest, RAM is in MB. When not set, half of
+# the host CPUs and two thirds of its free memory are used.
+cpus: {{.CPUs}}
+ram: {{.RAM}}
+# min_ram: 1024
+
+# Share of the host CPU time the guest can use, in percent. It can be
+# changed while the machine runs with 'vlaunch cpu-cap'.
+# cpu_execution_cap: 100
+# cpu_hotplug: false
+
+# Disk to boot from: 'raw' for a physical device, 'vdi', 'vmdk' or 'vhd' for
+# an image, 'none' to boot a live system from the ISO images
+disk_type: raw
+{{- if .Devices}}
+# Detected USB disks:
+{{- range .Devices}}
+#   {{.Device}}{{if .VolumeName}} ({{.VolumeName}}){{end}}
+{{- end}}
+device: {{(index .Devices 0).Device}}
+{{- else}}
+# Device to use for raw disks, the one holding vlaunch by default
+# device: /dev/sdb
+{{- end}}
+# Partitions of the raw device the guest can access, the others read as zeros
+# disk_partitions: [2]
+# disk_location: /path/to/disk.vdi
+# With 'immutable' or 'multiattach', the changes are written to a differencing
+# disk reset on every boot. Multi-attach disks can be shared by several machines.
+# disk_mode: normal
+# Image downloaded to the data path, or to disk_location, on first run
+# disk_url: https://example.com/images/disk.vdi
+# disk_sha256: <SHA-256 digest of the image>
+
+# Storage controller: ide, sata, nvme or virtio-scsi. Several controllers can
+# be listed instead, the disks are attached to the first one unless they name
+# another one, e.g. with disks: [{type: raw, controller: Boot, port: 1}]
+storage:
+  controller: ide
+  # controllers:
+  #   - name: Boot
+  #     type: sata
+  #     ports: 2
+  #   - name: Data
+  #     type: nvme
+
+# ISO images attached as DVD drives
+# iso_images:
+#   - /path/to/image.iso
+
+# Cloud images are set up by cloud-init from a NoCloud seed ISO attached until
+# the guest booted once, the files are copied at its root. The meta-data
+# defaults to the machine name as instance-id and host name. Removing
+# <machine_name>.provisioned from the data path provisions the guest again
+# provision:
+#   user_data: /path/to/user-data
+#   meta_data: /path/to/meta-data
+#   files:
+#     - /path/to/network-config
+
+# USB disks plugged into the host while the machine runs are attached to it
+# as raw disks with 'raw', on the first SATA controller or a dedicated one.
+# They should not be mounted on the host meanwhile.
+# usb:
+#   hotplug: none
+
+# Guest Additions: attach the ISO shipped with VirtualBox, warn when the
+# guest runs older additions and optionally update them
+# guest_additions:
+#   attach: false
+#   check: true
+#   update: false
+
+# Wait for the guest to report its IP address, print it and write it to a
+# file. The Guest Additions must be installed in the guest.
+# guest_ip:
+#   wait: true
+#   timeout: 5m
+#   file: /tmp/vlaunch.ip
+
+# Commands run, or webhooks called, on the vm-started, vm-stopped,
+# property-changed, device-removed and device-returned events. Commands get
+# the event details in VLAUNCH_* environment variables, webhooks receive them
+# as a JSON POST body.
+#
+# The pre-create, post-start, pre-shutdown and post-release hooks are run
+# before vlaunch goes on, for at most timeout (30s by default). When one
+# fails with on_failure set to abort, the machine is not created, powered
+# off after it started, kept running instead of shut down, or vlaunch exits
+# with an error after the release. The default, warn, only logs the failure.
+# hooks:
+#   - event: vm-started
+#     url: http://localhost:8080/vlaunch
+#   - event: property-changed
+#     property: /VirtualBox/GuestInfo/Net/*/V4/IP
+#     command: echo $VLAUNCH_VALUE > /tmp/guest-ip
+#   - event: pre-create
+#     command: vpn-up
+#     on_failure: abort
+#   - event: post-release
+#     command: backup $VLAUNCH_DATA_PATH
+#     timeout: 10m
+
+# How long the machine may take to launch, to shut down once asked to,
+# and to be deleted on exit. 0 waits forever.
+# timeouts:
+#   launch: 50s
+#   shutdown: 30s
+#   delete: 5m
+
+# Interval between the polls of the machine on hosts without event
+# listeners, and how long polling may fail before vlaunch gives up.
+# Only the guest properties matching 'properties' are watched, '*' matches
+# any sequence and alternatives are separated by '|', all by default
+# events:
+#   polling_interval: 250ms
+#   failure_timeout: 30s
+#   properties: /vlaunch/*|/VirtualBox/GuestInfo/Net/*|/UFO/*
+
+# Network adapter, in NAT mode by default
+# network:
+#   mode: nat
+# port_forwards:
+#   ssh:
+#     protocol: tcp
+#     host_port: 2222
+#     guest_port: 22
+
+# Folders of the host shared with the guest
+# shared_folders:
+#   home:
+#     path: {{.Home}}
+#     automount: true
+
+audio:
+  enabled: true
+  controller: hda
+
+# Serial port (COM1) of the guest, wired to a host file or pipe to capture
+# the kernel and console output. The output is written to the data path
+# unless a path is set. On Windows, pipes are named like \\.\pipe\vlaunch.
+serial:
+  mode: disabled
+  # path: /tmp/vlaunch-serial.log
+
+# Recording of the display to a WebM file, a new file of the data path is
+# used for each session unless a path is set. The maximum size is in MB.
+# recording:
+#   enabled: true
+#   path: /tmp/session.webm
+#   width: 1024
+#   height: 768
+#   fps: 25
+#   max_size: 0
+
+# Clipboard and drag and drop: disabled, host_to_guest, guest_to_host or bidirectional
+clipboard_mode: bidirectional
+dnd_mode: bidirectional
+
+# Video memory in MB and 3D acceleration. The guest can have up to 8
+# monitors, with an initial resolution each and the host screen they are
+# shown on in full screen. Several monitors need more video memory. The
+# window of the machine is shown in window, fullscreen or seamless mode,
+# which can be changed while it runs with 'vlaunch display'
+display:
+  vram: 32
+  accelerate_3d: true
+  monitors: 1
+  mode: window
+  # resolutions: [1920x1080, 1280x1024]
+  # host_screens: [0, 1]
+
+# Paravirtualization provider (default, none, kvm or hyperv) and hardware
+# virtualization features. Nested virtualization lets the guest run its own
+# machines, such as WSL or containers using a hypervisor.
+virtualization:
+  paravirt_provider: default
+  nested_paging: true
+  large_pages: true
+  nested_hw_virt: false
+
+# Frontend used to display the guest: gui, headless, separate or sdl
+frontend: gui
+menubar: false
+
+# Key releasing the keyboard and mouse captured by the guest, by name or by
+# code. It defaults to the left Command key on macOS, and to the right Ctrl
+# key elsewhere but for Apple keyboards. The names are left_ctrl, right_ctrl,
+# left_alt, right_alt, left_cmd and right_cmd on macOS, left_win, right_win
+# and menu on Windows, left_super, right_super and menu on Linux
+# host_key: right_ctrl
+
+# Save the state of the machine on exit and resume it on next launch
+save_state: false
+
+# Before shutting down or powering off the machine, set the
+# /vlaunch/shutdown-requested guest property and wait up to timeout for the
+# guest to flush its data and set /vlaunch/shutdown-acknowledged
+shutdown_handshake:
+  enabled: true
+  timeout: 10s
+
+# Check the headers of the VDI and VMDK images before starting the machine,
+# and that the metadata of the VDI images did not change since it last
+# stopped cleanly. A corrupted image can be restored from the current
+# snapshot of the machine: on_failure is ask, restore or refuse.
+# integrity:
+#   enabled: false
+#   on_failure: ask
+
+# Record the guest property changes in <machine_name>.properties.jsonl in the
+# data path, rotated once it reaches max_size megabytes, to replay them with
+# 'vlaunch events' after the machine stopped
+journal:
+  enabled: true
+  max_size: 10
+
+# Pause the machine when one of its raw devices is unplugged from the host,
+# setting the /vlaunch/device-removed guest property, and resume it once the
+# same device is plugged back
+device_removal:
+  pause: true
+
+# Pause the machine while the host sleeps, resuming it on wake up, and save
+# it or shut it down when the host shuts down or the user logs off, following
+# save_state
+#
+# When the host runs on battery, the machine can be limited to a share of the
+# host CPU (cpu_cap), paused (pause) or told through the guest property
+# /vlaunch/Host/PowerSource (warn). The guest property is set by all policies
+# but none.
+power:
+  pause_on_sleep: true
+  stop_on_shutdown: true
+  on_battery: none
+  battery_cpu_cap: 50
+
+# When the guest hangs, i.e. it hit a Guru Meditation or stopped updating the
+# heartbeat guest property for timeout, the machine can be reset (reset),
+# restarted from its current snapshot (restore) or powered off, vlaunch then
+# exiting with code 6 (exit). The heartbeat must change value on each update
+# and is only checked once the guest updated it
+health:
+  action: none
+  # heartbeat_property: /vlaunch/Guest/Heartbeat
+  timeout: 60s
+
+# When no user activity was reported by the guest for timeout, save the state
+# of the machine (save, which requires save_state), shut it down or power it
+# off, which ends vlaunch. Activity is any change of the listed guest
+# properties, the UsageState reported by the Guest Additions for each user
+# keeping the machine active while InUse. The guest can also report activity
+# by updating /vlaunch/Guest/Activity
+idle:
+  action: none
+  timeout: 30m
+  # properties: [/VirtualBox/GuestInfo/Users/*/UsageState, /vlaunch/Guest/Activity]
+
+# Before creating the machine, check that the host has enough free RAM, free
+# disk space in the data path for the logs and the saved state, and hardware
+# virtualization enabled
+preflight:
+  enabled: true
+
+# Extra data of VirtualBox, shared by all the machines (global) or of the
+# machine, given as KEY=VALUE as the keys are case sensitive. They are set
+# over defaults hiding the update checks and the tray icon of the GUI, which
+# can be disabled, and an empty value unsets a key. The messages of the GUI
+# listed in suppress_messages are not shown, in addition to default ones.
+extra_data:
+  defaults: true
+  # global:
+  #   - GUI/Input/AutoCapture=false
+  # machine:
+  #   - GUI/Fullscreen=true
+  # suppress_messages: [remindAboutPausedVMInput]
+
+# The guest can request host actions by setting /vlaunch/request/<id> to the
+# action followed by its argument, the host answers in /vlaunch/response/<id>
+# with 'ok' or 'error' followed by the result. The actions are open_url <url>,
+# eject, which ejects the USB disk once the machine stopped, and shutdown.
+# Only the listed ones are allowed if any.
+guest_requests:
+  enabled: true
+  # verbs: [open_url, shutdown]
+
+# When enabled, the machine does not boot but waits on the port for a machine
+# teleported from another host with 'vlaunch migrate --to host:port', giving
+# up after timeout if set. Both hosts need access to the same disks and the
+# password, if any, must match
+teleporter:
+  enabled: false
+  port: 6000
+  # address: 0.0.0.0
+  # password: secret
+  # timeout: 10m
+
+# Maximum throughput of the hard disks and of the network adapters of the
+# guest, with a K, M or G suffix for bytes per second, or k, m or g for bits
+# per second. The limits can be changed while the machine runs
+# bandwidth:
+#   disk: 20M
+#   network: 100m
+
+# HTTP proxy published to the guest as the /vlaunch/Host/Proxy/HTTP, HTTPS and
+# NoProxy guest properties and set in the environment of the guest processes.
+# It is detected from the host unless given here
+proxy:
+  enabled: true
+  # http: http://proxy.example.com:3128
+  # https: http://proxy.example.com:3128
+  # no_proxy: localhost,.example.com
+
+# Profiles, selected with --profile, override the keys above for other
+# machines. 'vlaunch up' starts the machines of several profiles at once, a
+# machine being started once the ones of its depends_on run
+# vms:
+#   server:
+#     ram: 2048
+#   client:
+#     depends_on: [server]
+`))
+
+type configValues struct {
+	DataPath string
+	CPUs     int
+	RAM      int
+	Home     string
+	Devices  []backend.USBDevice
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the configuration",
+}
+
+var configInitCmd = &cobra.Command{
+	Use:   "init [file]",
+	Short: "Write a commented default configuration",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return errors.New("Only one configuration file can be written")
+		}
+
+		file := "vlaunch.yml"
+		if len(args) == 1 {
+			file = args[0]
+		}
+
+		if _, err := os.Stat(file); err == nil && !configInitForce {
+			return fmt.Errorf("%s already exists, use --force to overwrite it", file)
+		}
+
+		values := configValues{
+			DataPath: backend.DefaultDataPath(),
+			CPUs:     runtime.NumCPU(),
+		}
+
+		if values.CPUs > 1 {
+			values.CPUs /= 2
+		}
+
+		if freeRam, err := backend.GetFreeRam(); err == nil {
+			values.RAM = (int(freeRam) * 2 / 3) / 1024 / 1024
+		}
+
+		values.Home, _ = os.UserHomeDir()
+
+		if configInitProbe {
+			devices, err := backend.GetUSBDevices()
+			if err != nil {
+				return fmt.Errorf("Failed to probe USB disks: %s", err.Error())
+			}
+			values.Devices = devices
+		}
+
+		output, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer output.Close()
+
+		if err := configTemplate.Execute(output, values); err != nil {
+			return err
+		}
+
+		fmt.Printf("Configuration written to %s\n", file)
+		return nil
+	},
+}
+
+func init() {
+	configInitCmd.Flags().BoolVarP(&configInitForce, "force", "f", false, "overwrite an existing file")
+	configInitCmd.Flags().BoolVar(&configInitProbe, "probe", false, "probe the attached USB disks to fill in the raw device")
+
+	configCmd.AddCommand(configInitCmd)
+	RootCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lebauce/vlaunch/config"
+)
+
+func TestConfigTemplateValidates(t *testing.T) {
+	var output bytes.Buffer
+	values := configValues{DataPath: t.TempDir(), CPUs: 1, RAM: 1024, Home: t.TempDir()}
+	if err := configTemplate.Execute(&output, values); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.New()
+	if err := cfg.MergeConfig(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := config.Validate(cfg); err != nil {
+		t.Errorf("The generated configuration is not valid: %s", err)
+	}
+}
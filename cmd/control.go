@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lebauce/vlaunch/control"
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var stopForce bool
+
+func registerControlHandlers(server *control.Server, vm *vm.VirtualMachine) {
+	server.Handle("stop", func(args []string) (interface{}, error) {
+		if len(args) > 0 && args[0] == "force" {
+			return nil, vm.PowerOff()
+		}
+		return nil, vm.Stop()
+	})
+
+	server.Handle("pause", func(args []string) (interface{}, error) {
+		return nil, vm.Pause()
+	})
+
+	server.Handle("resume", func(args []string) (interface{}, error) {
+		return nil, vm.Resume()
+	})
+
+	server.Handle("share-add", func(args []string) (interface{}, error) {
+		if len(args) != 4 {
+			return nil, errors.New("Expected name, path, writable and automount")
+		}
+		return nil, vm.AddSharedFolder(args[0], args[1], args[2] == "true", args[3] == "true")
+	})
+
+	server.Handle("share-remove", func(args []string) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("Expected the name of the shared folder")
+		}
+		return nil, vm.RemoveSharedFolder(args[0])
+	})
+
+	server.Handle("cpu-cap", func(args []string) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("Expected the CPU execution cap")
+		}
+
+		cap, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return nil, vm.SetCPUExecutionCap(cap)
+	})
+
+	server.Handle("screenshot", func(args []string) (interface{}, error) {
+		return vm.CaptureScreen()
+	})
+
+	server.Handle("display", func(args []string) (interface{}, error) {
+		if len(args) != 3 {
+			return nil, errors.New("Expected mode, screen and host screen")
+		}
+
+		screen, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		hostScreen, err := strconv.Atoi(args[2])
+		if err != nil {
+			return nil, err
+		}
+		return nil, vm.SetDisplayMode(args[0], screen, hostScreen)
+	})
+
+	server.Handle("migrate", func(args []string) (interface{}, error) {
+		if len(args) != 4 {
+			return nil, errors.New("Expected host, port, password and maximum downtime")
+		}
+
+		port, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		maxDowntime, err := time.ParseDuration(args[3])
+		if err != nil {
+			return nil, err
+		}
+		return nil, vm.Teleport(context.Background(), args[0], port, args[2], maxDowntime)
+	})
+
+	server.Handle("resize", func(args []string) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, errors.New("Expected size and whether to notify the guest")
+		}
+
+		size, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return nil, vm.ResizeDisk(context.Background(), size, args[1] == "true")
+	})
+}
+
+func callControl(command string, args ...string) error {
+	_, err := control.Call(control.SocketPath(vmConfig.GetString("data_path")), command, args...)
+	return err
+}
+
+var stopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Shut down the machine of the running vlaunch instance",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if stopForce {
+			return callControl("stop", "force")
+		}
+		return callControl("stop")
+	},
+}
+
+var pauseCmd = &cobra.Command{
+	Use:   "pause",
+	Short: "Pause the machine of the running vlaunch instance",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return callControl("pause")
+	},
+}
+
+var resumeCmd = &cobra.Command{
+	Use:   "resume",
+	Short: "Resume the machine of the running vlaunch instance",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return callControl("resume")
+	},
+}
+
+var cpuCapCmd = &cobra.Command{
+	Use:   "cpu-cap <percent>",
+	Short: "Limit the share of host CPU time the running machine can use",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("The CPU execution cap is required")
+		}
+
+		if _, err := strconv.Atoi(args[0]); err != nil {
+			return fmt.Errorf("Invalid CPU execution cap '%s'", args[0])
+		}
+		return callControl("cpu-cap", args[0])
+	},
+}
+
+func init() {
+	stopCmd.Flags().BoolVarP(&stopForce, "force", "f", false, "power off the machine instead of an ACPI shutdown")
+
+	RootCmd.AddCommand(stopCmd)
+	RootCmd.AddCommand(pauseCmd)
+	RootCmd.AddCommand(resumeCmd)
+	RootCmd.AddCommand(cpuCapCmd)
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var cpRecursive bool
+
+// parseCopyPath splits a cp argument into its location and its path, paths
+// without prefix are on the host
+func parseCopyPath(arg string) (bool, string) {
+	if strings.HasPrefix(arg, "guest:") {
+		return true, strings.TrimPrefix(arg, "guest:")
+	}
+	return false, strings.TrimPrefix(arg, "host:")
+}
+
+var cpCmd = &cobra.Command{
+	Use:   "cp <source> <destination>",
+	Short: "Copy files between the host and the guest",
+	Long: `Copy files between the host and the guest using the Guest Control
+service of the Guest Additions. Guest paths are prefixed with 'guest:',
+host paths may be prefixed with 'host:', e.g.
+
+  vlaunch cp report.pdf guest:/home/user/
+  vlaunch cp -r guest:/var/log host:logs`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return errors.New("A source and a destination are required")
+		}
+
+		fromGuest, source := parseCopyPath(args[0])
+		toGuest, destination := parseCopyPath(args[1])
+		if fromGuest == toGuest {
+			return errors.New("Exactly one of the source and the destination must be prefixed with 'guest:'")
+		}
+		if source == "" || destination == "" {
+			return errors.New("The source and the destination can not be empty")
+		}
+
+		machine, err := vm.FindVM(vmConfig)
+		if err != nil {
+			return err
+		}
+
+		session, err := machine.NewGuestSession(guestCredentials())
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+
+		ctx := context.Background()
+		if bar := newProgressBar(); bar != nil {
+			ctx = vm.WithProgressReporter(ctx, bar)
+		}
+
+		if toGuest {
+			err = session.CopyToGuest(ctx, source, destination, cpRecursive)
+		} else {
+			err = session.CopyFromGuest(ctx, source, destination, cpRecursive)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to copy %s: %s", source, err.Error())
+		}
+		return nil
+	},
+}
+
+func init() {
+	cpCmd.Flags().BoolVarP(&cpRecursive, "recursive", "r", false, "copy directories recursively")
+	cpCmd.Flags().StringVarP(&execUser, "user", "u", "", "guest user name")
+	cpCmd.Flags().StringVarP(&execPassword, "password", "p", "", "guest user password")
+	cpCmd.Flags().StringVar(&execDomain, "domain", "", "guest user domain")
+	RootCmd.AddCommand(cpCmd)
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var devicesAll bool
+
+// describeDevice returns the path, size, bus, model and volumes of a disk
+func describeDevice(device backend.Device) string {
+	description := fmt.Sprintf("%s %.1f GB %s", device.Path, float64(device.Size)/1e9, device.Bus)
+	if device.Model != "" {
+		description += " " + device.Model
+	}
+	if device.Serial != "" {
+		description += " (" + device.Serial + ")"
+	}
+	for _, partition := range device.Partitions {
+		if partition.Label != "" {
+			description += " " + partition.Label
+		}
+	}
+	return description
+}
+
+func deviceDescription(device backend.USBDevice) string {
+	if disk, err := backend.GetDevice(device.Device); err == nil {
+		return describeDevice(disk)
+	}
+
+	description := device.Device
+	if size, err := backend.GetDeviceSize(device.Device); err == nil {
+		description += fmt.Sprintf(" %.1f GB", float64(size)/1e9)
+	}
+	if device.VolumeName != "" {
+		description += " " + device.VolumeName
+	}
+	return description
+}
+
+func isTerminal(file *os.File) bool {
+	fi, err := file.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// selectDevice asks which raw device to boot from when several USB disks
+// could hold the guest, the choice is only kept for this run
+func selectDevice(cfg *viper.Viper) error {
+	if cfg.GetString("disk_type") != "raw" || cfg.GetString("disk_location") != "" {
+		return nil
+	}
+
+	_, err := backend.FindDevice(cfg)
+
+	var multiple *backend.MultipleDevicesError
+	if !errors.As(err, &multiple) || !isTerminal(os.Stdin) {
+		return nil
+	}
+
+	fmt.Println("Several USB disks were found:")
+	for i, device := range multiple.Devices {
+		fmt.Printf("  %d) %s\n", i+1, deviceDescription(device))
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("Disk to boot from [1-%d]: ", len(multiple.Devices))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		if choice, err := strconv.Atoi(strings.TrimSpace(line)); err == nil && choice >= 1 && choice <= len(multiple.Devices) {
+			cfg.Set("device", multiple.Devices[choice-1].Device)
+			return nil
+		}
+	}
+}
+
+var devicesCmd = &cobra.Command{
+	Use:   "devices",
+	Short: "List the USB disks the machine can boot from",
+	Long:  "List the USB disks the machine can boot from, or all the disks of the host with --all, the one used by the machine being marked",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		disks, err := backend.ListDevices()
+		if err != nil {
+			return fmt.Errorf("Failed to list disks: %s", err.Error())
+		}
+
+		devices := []backend.Device{}
+		for _, device := range disks {
+			if devicesAll || device.Bus == "usb" {
+				devices = append(devices, device)
+			}
+		}
+
+		selected, _ := backend.FindDevice(vmConfig)
+
+		if jsonOutput() {
+			type deviceOutput struct {
+				backend.Device
+				Selected bool `json:"selected"`
+			}
+
+			result := []deviceOutput{}
+			for _, device := range devices {
+				result = append(result, deviceOutput{Device: device, Selected: device.Path == selected})
+			}
+			return printJSON(result)
+		}
+
+		if len(devices) == 0 {
+			fmt.Println("No USB disk found")
+			return nil
+		}
+
+		for _, device := range devices {
+			marker := " "
+			if device.Path == selected {
+				marker = "*"
+			}
+			fmt.Printf("%s %s\n", marker, describeDevice(device))
+			for _, partition := range device.Partitions {
+				fmt.Printf("    %s %.1f GB", partition.Path, float64(partition.Size)/1e9)
+				if partition.Mountpoint != "" {
+					fmt.Printf(" on %s", partition.Mountpoint)
+				}
+				fmt.Println()
+			}
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	devicesCmd.Flags().BoolVar(&devicesAll, "all", false, "list all the disks of the host, not only the USB ones")
+	RootCmd.AddCommand(devicesCmd)
+}
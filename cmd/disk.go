@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var (
+	diskSize   string
+	diskFormat string
+	diskFixed  bool
+
+	diskResizeSize  string
+	diskNotifyGuest bool
+)
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix
+func parseSize(s string) (uint64, error) {
+	size := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+
+	multiplier := uint64(1)
+	if n := len(size); n > 0 {
+		if i := strings.IndexByte("KMGT", size[n-1]); i >= 0 {
+			multiplier = 1 << (10 * uint(i+1))
+			size = size[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseUint(size, 10, 64)
+	if err != nil || value == 0 {
+		return 0, fmt.Errorf("Invalid size '%s'", s)
+	}
+	return value * multiplier, nil
+}
+
+var diskCmd = &cobra.Command{
+	Use:   "disk",
+	Short: "Manage disk images",
+}
+
+var diskCreateCmd = &cobra.Command{
+	Use:   "create <path>",
+	Short: "Create a blank disk image",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("The path of the disk image is required")
+		}
+
+		if diskSize == "" {
+			return errors.New("The size of the disk is required")
+		}
+
+		size, err := parseSize(diskSize)
+		if err != nil {
+			return err
+		}
+
+		return vm.CreateDisk(context.Background(), args[0], diskFormat, size, diskFixed)
+	},
+}
+
+var diskResizeCmd = &cobra.Command{
+	Use:   "resize [path]",
+	Short: "Grow a VDI or VHD disk image, the disk of the running machine if no path is given",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return errors.New("At most one disk image is expected")
+		}
+
+		if diskResizeSize == "" {
+			return errors.New("The new size of the disk is required")
+		}
+
+		size, err := parseSize(diskResizeSize)
+		if err != nil {
+			return err
+		}
+
+		if len(args) == 1 {
+			if diskNotifyGuest {
+				return errors.New("The guest can only be notified when resizing the disk of the running machine")
+			}
+			if err := vm.ResizeDisk(context.Background(), args[0], size); err != nil {
+				return err
+			}
+			return vm.ForgetDiskChecksum(vmConfig, args[0])
+		}
+
+		return callControl("resize", strconv.FormatUint(size, 10), strconv.FormatBool(diskNotifyGuest))
+	},
+}
+
+func init() {
+	diskCreateCmd.Flags().StringVar(&diskSize, "size", "", "size of the disk, e.g. 20G")
+	diskCreateCmd.Flags().StringVar(&diskFormat, "format", "vdi", "format of the disk (vdi, vmdk, vhd)")
+	diskCreateCmd.Flags().BoolVar(&diskFixed, "fixed", false, "allocate the whole disk on creation")
+
+	diskResizeCmd.Flags().StringVar(&diskResizeSize, "size", "", "new size of the disk, e.g. 40G")
+	diskResizeCmd.Flags().BoolVar(&diskNotifyGuest, "notify-guest", false, "set the /vlaunch/disk-resized guest property for the guest to grow its file systems")
+
+	diskCmd.AddCommand(diskCreateCmd)
+	diskCmd.AddCommand(diskResizeCmd)
+	RootCmd.AddCommand(diskCmd)
+}
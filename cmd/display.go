@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	displayScreen     int
+	displayHostScreen int
+)
+
+var displayCmd = &cobra.Command{
+	Use:   "display <window|fullscreen|seamless>",
+	Short: "Switch the window of the running machine to a display mode",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("The display mode is required")
+		}
+
+		return callControl("display", args[0], strconv.Itoa(displayScreen), strconv.Itoa(displayHostScreen))
+	},
+}
+
+func init() {
+	displayCmd.Flags().IntVar(&displayScreen, "screen", 0, "guest screen to switch")
+	displayCmd.Flags().IntVar(&displayHostScreen, "host-screen", -1, "host screen to show the guest screen on")
+
+	RootCmd.AddCommand(displayCmd)
+}
@@ -0,0 +1,283 @@
+package cmd
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/lebauce/vlaunch/config"
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+// minFreeDiskSpace is the free space below which the data path is reported,
+// saved states and overlays may not fit
+const minFreeDiskSpace = 1 << 30
+
+var doctorBundle string
+
+// checkResult is the outcome of a check of vlaunch doctor
+type checkResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+type doctorReport struct {
+	checks []checkResult
+}
+
+func (r *doctorReport) add(name, status, format string, args ...interface{}) {
+	r.checks = append(r.checks, checkResult{Name: name, Status: status, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *doctorReport) failed() bool {
+	for _, check := range r.checks {
+		if check.Status == "error" {
+			return true
+		}
+	}
+	return false
+}
+
+// majorVersion strips the revision from a VirtualBox version, 7.0.10r158379
+// becomes 7.0.10
+func majorVersion(version string) string {
+	if i := strings.IndexAny(version, "r_"); i >= 0 {
+		return version[:i]
+	}
+	return version
+}
+
+func checkVirtualBox(r *doctorReport) {
+	version, err := vm.InstalledVersion()
+	if err != nil {
+		r.add("virtualbox", "error", "%s", err.Error())
+		return
+	}
+	r.add("virtualbox", "ok", "VirtualBox %s", version)
+
+	if err := backend.CheckDriver(); err != nil {
+		r.add("driver", "error", "%s", err.Error())
+	} else {
+		r.add("driver", "ok", "Kernel driver loaded")
+	}
+
+	packs, err := vm.ExtensionPacks()
+	switch {
+	case err != nil:
+		r.add("extension_pack", "warning", "Failed to list extension packs: %s", err.Error())
+	case len(packs) == 0:
+		r.add("extension_pack", "warning", "No extension pack installed, USB 2.0/3.0 and VRDE are not available")
+	}
+	for _, pack := range packs {
+		switch {
+		case !pack.Usable:
+			r.add("extension_pack", "error", "%s %s is not usable", pack.Name, pack.Version)
+		case majorVersion(pack.Version) != majorVersion(version):
+			r.add("extension_pack", "warning", "%s %s does not match VirtualBox %s", pack.Name, pack.Version, version)
+		default:
+			r.add("extension_pack", "ok", "%s %s", pack.Name, pack.Version)
+		}
+	}
+}
+
+func checkDevice(r *doctorReport) {
+	if vmConfig.GetString("disk_type") != "raw" || vmConfig.GetString("disk_location") != "" {
+		return
+	}
+
+	device, err := backend.FindDevice(vmConfig)
+	if err != nil {
+		r.add("device", "error", "%s", err.Error())
+		return
+	}
+
+	file, err := backend.OpenDevice(device, os.O_RDONLY)
+	if err != nil {
+		if backend.IsAdmin() {
+			r.add("device", "error", "Failed to open %s: %s", device, err.Error())
+		} else {
+			r.add("device", "warning", "%s is not readable by the current user, vlaunch will ask for elevation", device)
+		}
+		return
+	}
+	file.Close()
+	r.add("device", "ok", "%s is readable", device)
+}
+
+func checkResources(r *doctorReport) {
+	if err := backend.CheckVirtualization(); err != nil {
+		r.add("virtualization", "error", "%s", err.Error())
+	} else {
+		r.add("virtualization", "ok", "Hardware virtualization enabled")
+	}
+
+	if freeRam, err := backend.GetFreeRam(); err != nil {
+		r.add("ram", "warning", "Failed to get the free memory: %s", err.Error())
+	} else if ram := uint64(vmConfig.GetInt("ram")); ram > freeRam/1024/1024 {
+		r.add("ram", "warning", "%d MB are configured but only %d MB are free", ram, freeRam/1024/1024)
+	} else {
+		r.add("ram", "ok", "%d MB free", freeRam/1024/1024)
+	}
+
+	dataPath := vmConfig.GetString("data_path")
+	if free, err := backend.GetFreeDiskSpace(dataPath); err != nil {
+		r.add("disk_space", "warning", "Failed to get the free space of %s: %s", dataPath, err.Error())
+	} else if free < minFreeDiskSpace {
+		r.add("disk_space", "warning", "Only %d MB free in %s", free/1024/1024, dataPath)
+	} else {
+		r.add("disk_space", "ok", "%d MB free in %s", free/1024/1024, dataPath)
+	}
+}
+
+// redactSecrets replaces the values of the settings holding passwords and
+// tokens
+func redactSecrets(settings map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{})
+	for key, value := range settings {
+		lower := strings.ToLower(key)
+		switch {
+		case strings.Contains(lower, "password") || strings.Contains(lower, "token"):
+			redacted[key] = "<redacted>"
+		default:
+			if m, ok := value.(map[string]interface{}); ok {
+				value = redactSecrets(m)
+			}
+			redacted[key] = value
+		}
+	}
+	return redacted
+}
+
+func addBundleFile(archive *zip.Writer, name, source string) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(output, input)
+	return err
+}
+
+func addBundleJSON(archive *zip.Writer, name string, v interface{}) error {
+	output, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeBundle zips the report, the configuration without its secrets, the
+// logs of vlaunch and the VirtualBox logs of the machine
+func writeBundle(filename string, report *doctorReport) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+
+	if err := addBundleJSON(archive, "doctor.json", report.checks); err != nil {
+		return err
+	}
+
+	if err := addBundleJSON(archive, "config.json", redactSecrets(vmConfig.AllSettings())); err != nil {
+		return err
+	}
+
+	dataPath := vmConfig.GetString("data_path")
+	var logs []string
+	for _, pattern := range []string{
+		filepath.Join(dataPath, "vlaunch.log*"),
+		filepath.Join(os.TempDir(), "vlaunch.log*"),
+		filepath.Join(dataPath, vmConfig.GetString("machine_name"), "Logs", "VBox.log*"),
+	} {
+		matches, _ := filepath.Glob(pattern)
+		logs = append(logs, matches...)
+	}
+
+	for _, log := range logs {
+		name := "logs/" + filepath.Base(log)
+		if strings.HasPrefix(filepath.Base(log), "VBox.log") {
+			name = "logs/virtualbox/" + filepath.Base(log)
+		} else if strings.HasPrefix(log, os.TempDir()) {
+			name = "logs/tmp/" + filepath.Base(log)
+		}
+
+		if err := addBundleFile(archive, name, log); err != nil {
+			return fmt.Errorf("Failed to add %s: %s", log, err.Error())
+		}
+	}
+
+	return archive.Close()
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the host setup and optionally collect a support bundle",
+	Long: `Check the VirtualBox installation, its kernel driver and extension
+pack, the configuration, the device to boot from and the free memory and disk
+space. With --bundle, the results are zipped with the configuration, whose
+passwords and tokens are redacted, and the logs of vlaunch and VirtualBox.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		report := &doctorReport{}
+
+		if vmConfig.GetString("hypervisor") == "virtualbox" {
+			checkVirtualBox(report)
+		}
+
+		if err := config.Validate(vmConfig); err != nil {
+			report.add("config", "error", "%s", err.Error())
+		} else {
+			report.add("config", "ok", "Configuration is valid")
+		}
+
+		checkDevice(report)
+		checkResources(report)
+
+		if jsonOutput() {
+			if err := printJSON(report.checks); err != nil {
+				return err
+			}
+		} else {
+			for _, check := range report.checks {
+				fmt.Printf("%-8s %-15s %s\n", "["+check.Status+"]", check.Name, check.Message)
+			}
+		}
+
+		if doctorBundle != "" {
+			if err := writeBundle(doctorBundle, report); err != nil {
+				return fmt.Errorf("Failed to write the support bundle: %s", err.Error())
+			}
+			if !jsonOutput() {
+				fmt.Printf("Support bundle written to %s\n", doctorBundle)
+			}
+		}
+
+		if report.failed() {
+			return &exitError{code: exitFailure}
+		}
+		return nil
+	},
+}
+
+func init() {
+	doctorCmd.Flags().StringVar(&doctorBundle, "bundle", "", "write a support bundle to this zip file")
+	RootCmd.AddCommand(doctorCmd)
+}
@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/lebauce/vlaunch/vm"
+)
+
+var (
+	// environmentFile is passed to the elevated process, as the elevation
+	// methods start it with a clean environment in another directory
+	environmentFile string
+	// rawSetup makes the elevated process exit once the raw disks are set up
+	rawSetup bool
+
+	invokingUID, invokingGID = -1, -1
+
+	// commandArgs are the arguments vlaunch runs with, the ones of an app
+	// bundle opened from the Finder are not on its command line
+	commandArgs []string
+)
+
+type elevatedEnvironment struct {
+	Dir string
+	Env []string
+	UID int
+	GID int
+}
+
+// elevate runs vlaunch again with administrator privileges, the given
+// arguments and the environment of the user, and returns its exit code
+func elevate(args []string) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := ioutil.TempFile("", "vlaunch-env")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+
+	err = json.NewEncoder(file).Encode(elevatedEnvironment{Dir: dir, Env: os.Environ(), UID: os.Getuid(), GID: os.Getgid()})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	args = append([]string{"--environment-file", file.Name()}, args...)
+	return backend.RunAsRoot(executable, args...)
+}
+
+// restoreEnvironment restores the environment and the working directory of
+// the user that started the elevation
+func restoreEnvironment() error {
+	if environmentFile == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(environmentFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read environment: %s", err.Error())
+	}
+	os.Remove(environmentFile)
+
+	var environment elevatedEnvironment
+	if err := json.Unmarshal(content, &environment); err != nil {
+		return fmt.Errorf("Failed to decode environment: %s", err.Error())
+	}
+
+	invokingUID, invokingGID = environment.UID, environment.GID
+
+	os.Clearenv()
+	for _, variable := range environment.Env {
+		if i := strings.Index(variable, "="); i > 0 {
+			os.Setenv(variable[:i], variable[i+1:])
+		}
+	}
+
+	if err := os.Chdir(environment.Dir); err != nil {
+		return fmt.Errorf("Failed to change directory: %s", err.Error())
+	}
+	return nil
+}
+
+// invokingUser returns the user that started vlaunch, if it was elevated
+func invokingUser() (uid, gid int, found bool) {
+	if invokingUID > 0 {
+		return invokingUID, invokingGID, true
+	}
+	return backend.InvokingUser()
+}
+
+// setupPrivileges elevates vlaunch when the whole process needs administrator
+// privileges, and sets up the raw disks when it is the elevated helper of
+// another vlaunch, which holds the lock. It returns whether this process is
+// done, with its exit code.
+func setupPrivileges() (bool, int, error) {
+	if backend.IsAdmin() {
+		if _, _, found := invokingUser(); !found || !backend.CanDropPrivileges || !rawSetup {
+			return false, 0, nil
+		}
+
+		if err := prepareRawDisks(); err != nil {
+			return true, 0, err
+		}
+		return true, 0, nil
+	}
+
+	if !vm.UsesRawDisks(vmConfig) || backend.CanDropPrivileges {
+		return false, 0, nil
+	}
+
+	slog.Info("Elevating privileges")
+	code, err := elevate(rawDiskArgs())
+	return true, code, err
+}
+
+// dropPrivileges sets up the raw disks and runs vlaunch as the user that
+// elevated it, where the platform allows it. It is called once the lock is
+// held.
+func dropPrivileges() error {
+	uid, gid, found := invokingUser()
+	if !found || !backend.CanDropPrivileges {
+		return nil
+	}
+
+	if err := prepareRawDisks(); err != nil {
+		return err
+	}
+
+	slog.Info("Dropping privileges", "uid", uid, "gid", gid)
+	return backend.DropPrivileges(uid, gid)
+}
+
+// setupRawDisks has an elevated helper set up the raw disks, so that the
+// machine runs as the user. It is called once the lock is held and the
+// orphaned machines are cleaned up, the cleanup would otherwise remove the
+// descriptors of the helper.
+func setupRawDisks() error {
+	if !vm.UsesRawDisks(vmConfig) || !backend.CanDropPrivileges {
+		return nil
+	}
+
+	slog.Info("Elevating privileges to set up raw disks")
+	code, err := elevate(append(rawDiskArgs(), "--raw-setup"))
+	if err == nil && code != 0 {
+		err = fmt.Errorf("Raw disk setup exited with code %d", code)
+	}
+	return err
+}
+
+// prepareRawDisks sets up the raw disks for the user that elevated vlaunch
+func prepareRawDisks() error {
+	uid, _, _ := invokingUser()
+	if vm.UsesRawDisks(vmConfig) {
+		if err := vm.PrepareRawDisks(vmConfig, uid); err != nil {
+			return fmt.Errorf("Failed to prepare raw disks: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// rawDiskArgs returns the arguments of the elevated vlaunch
+func rawDiskArgs() []string {
+	// The device may have been selected interactively
+	args := append([]string{}, commandArgs...)
+	if device := vmConfig.GetString("device"); device != "" {
+		args = append(args, "--device", device)
+	}
+	return args
+}
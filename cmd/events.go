@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var eventsSince string
+
+// parseSince parses a time given as a duration before now, such as 10m, or
+// as an RFC 3339 timestamp
+func parseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+
+	if duration, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time '%s', expected a duration such as 10m or an RFC 3339 timestamp", since)
+	}
+	return t, nil
+}
+
+var eventsCmd = &cobra.Command{
+	Use:   "events [pattern]",
+	Short: "Replay the guest property changes recorded in the journal of the machine",
+	Long: `Replay the guest property changes recorded in the journal of the machine,
+even once it stopped. The pattern is matched against the property names,
+'*' matches any sequence, including '/', and '|' separates alternatives.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return fmt.Errorf("Expected at most one pattern, got %d", len(args))
+		}
+
+		since, err := parseSince(eventsSince)
+		if err != nil {
+			return err
+		}
+
+		pattern := ""
+		if len(args) == 1 {
+			pattern = args[0]
+		}
+
+		props, err := vm.ReadJournal(vmConfig, since, pattern)
+		if err != nil {
+			return fmt.Errorf("Failed to read journal: %s", err.Error())
+		}
+
+		if jsonOutput() {
+			if props == nil {
+				props = []vm.GuestProperty{}
+			}
+			return printJSON(props)
+		}
+
+		for _, prop := range props {
+			timestamp := time.Unix(0, prop.Timestamp).Format(time.RFC3339Nano)
+			fmt.Printf("%s %s=%s", timestamp, prop.Name, prop.Value)
+			if prop.Flags != "" {
+				fmt.Printf(" (%s)", prop.Flags)
+			}
+			fmt.Println()
+		}
+		return nil
+	},
+}
+
+func init() {
+	eventsCmd.Flags().StringVar(&eventsSince, "since", "", "only replay the changes since a duration ago, e.g. 10m, or an RFC 3339 timestamp")
+	RootCmd.AddCommand(eventsCmd)
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var (
+	execUser     string
+	execPassword string
+	execDomain   string
+	execStdin    bool
+	execTimeout  time.Duration
+)
+
+func guestCredentials() (string, string, string) {
+	cfg := vmConfig
+	user, password, domain := execUser, execPassword, execDomain
+	if user == "" {
+		user = cfg.GetString("guest_control.user")
+	}
+	if password == "" {
+		password = cfg.GetString("guest_control.password")
+	}
+	if domain == "" {
+		domain = cfg.GetString("guest_control.domain")
+	}
+	return user, password, domain
+}
+
+var execCmd = &cobra.Command{
+	Use:   "exec -- <command> [args...]",
+	Short: "Execute a command inside the guest",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("A command is required")
+		}
+
+		vm, err := vm.FindVM(vmConfig)
+		if err != nil {
+			return err
+		}
+
+		session, err := vm.NewGuestSession(guestCredentials())
+		if err != nil {
+			return err
+		}
+
+		var stdin io.Reader
+		if execStdin {
+			stdin = os.Stdin
+		}
+
+		exitCode, err := session.Run(args[0], args[1:], stdin, os.Stdout, os.Stderr, execTimeout)
+		session.Close()
+		if err != nil {
+			return err
+		}
+
+		if exitCode != 0 {
+			return &exitError{code: exitCode}
+		}
+		return nil
+	},
+}
+
+func init() {
+	execCmd.Flags().StringVarP(&execUser, "user", "u", "", "guest user name")
+	execCmd.Flags().StringVarP(&execPassword, "password", "p", "", "guest user password")
+	execCmd.Flags().StringVar(&execDomain, "domain", "", "guest user domain")
+	execCmd.Flags().BoolVarP(&execStdin, "stdin", "i", false, "forward standard input to the guest process")
+	execCmd.Flags().DurationVar(&execTimeout, "timeout", 0, "maximum execution time of the guest process")
+	RootCmd.AddCommand(execCmd)
+}
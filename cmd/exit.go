@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/lebauce/vlaunch/vm"
+)
+
+// Exit codes of vlaunch, a signal making it exit with 128 plus its number
+const (
+	exitFailure    = 1
+	exitConfig     = 2
+	exitVirtualBox = 3
+	exitDevice     = 4
+	exitGuest      = 5
+	exitUnhealthy  = 6
+)
+
+// logFilePath is the log file the details of the failures are written to
+var logFilePath string
+
+// exitError makes vlaunch exit with the given code, printing the error
+// unless there is none
+type exitError struct {
+	code int
+	msg  string
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// exitCodeOf returns the exit code matching the cause of an error, or the
+// given code if the cause is not known
+func exitCodeOf(err error, code int) int {
+	var multiple *backend.MultipleDevicesError
+	switch {
+	case errors.Is(err, vm.VirtualBoxNotInstalled):
+		return exitVirtualBox
+	case errors.Is(err, backend.DeviceNotFound), errors.As(err, &multiple):
+		return exitDevice
+	}
+	return code
+}
+
+// fail logs an error and returns it with the exit code matching its cause
+func fail(code int, msg string, err error) error {
+	slog.Error(msg, "error", err)
+	return &exitError{code: exitCodeOf(err, code), msg: msg, err: err}
+}
+
+// Execute runs the command line and returns the exit code of vlaunch
+func Execute() int {
+	commandArgs = bundleArgs()
+	RootCmd.SetArgs(commandArgs)
+
+	err := RootCmd.Execute()
+	if signalExitCode != 0 {
+		return signalExitCode
+	}
+
+	if healthExitCode != 0 {
+		return healthExitCode
+	}
+
+	if err == nil {
+		return 0
+	}
+
+	code := exitFailure
+	var exit *exitError
+	if errors.As(err, &exit) {
+		code = exit.code
+		if exit.msg == "" {
+			return code
+		}
+	}
+
+	if jsonOutput() {
+		json.NewEncoder(os.Stderr).Encode(map[string]interface{}{"error": err.Error(), "code": code, "log": logFilePath})
+		return code
+	}
+
+	fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+	if logFilePath != "" {
+		fmt.Fprintf(os.Stderr, "See %s for details\n", logFilePath)
+	}
+	return code
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportShutdown bool
+	exportTimeout  time.Duration
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export <appliance.ova>",
+	Short: "Export the machine to an OVA appliance",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("A destination file is required")
+		}
+
+		vm, err := vm.FindVM(vmConfig)
+		if err != nil {
+			return err
+		}
+
+		if running, err := vm.IsRunning(); err != nil {
+			return err
+		} else if running {
+			if !exportShutdown {
+				return errors.New("The machine is running, use --shutdown to stop it first")
+			}
+
+			if err := callControl("stop"); err != nil {
+				return fmt.Errorf("Failed to stop the machine: %s", err.Error())
+			}
+
+			if err := vm.WaitUntilStopped(exportTimeout); err != nil {
+				return err
+			}
+		}
+
+		return vm.Export(args[0])
+	},
+}
+
+func init() {
+	exportCmd.Flags().BoolVar(&exportShutdown, "shutdown", false, "shut the machine down before exporting it")
+	exportCmd.Flags().DurationVar(&exportTimeout, "timeout", 5*time.Minute, "maximum time to wait for the machine to shut down")
+	RootCmd.AddCommand(exportCmd)
+}
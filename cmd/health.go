@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/lebauce/vlaunch/vm"
+)
+
+// healthExitCode is the exit code of vlaunch when the health watchdog stopped
+// an unresponsive guest
+var healthExitCode int
+
+// runHealthWatchdog applies health.action when the guest hangs: the machine
+// hit a Guru Meditation, or health.heartbeat_property was not updated for
+// health.timeout. The heartbeat is only checked once the guest updated it,
+// so that the boot is not mistaken for a hang
+func runHealthWatchdog(ctx context.Context, machine *vm.VirtualMachine) {
+	action := vmConfig.GetString("health.action")
+	if action == "none" {
+		return
+	}
+
+	timeout := vmConfig.GetDuration("health.timeout")
+	states := machine.Subscribe(vm.StateChangedEvent)
+	defer machine.Unsubscribe(states)
+
+	var heartbeats <-chan vm.Event
+	if property := vmConfig.GetString("health.heartbeat_property"); property != "" {
+		events, err := machine.SubscribeProperties(property)
+		if err != nil {
+			slog.Error("Guest heartbeat will not be checked", "error", err)
+		} else {
+			heartbeats = events
+			defer machine.Unsubscribe(events)
+		}
+	}
+
+	// The timer only runs once a heartbeat was received
+	timer := time.NewTimer(timeout)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		var reason string
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-states:
+			if !ok {
+				return
+			}
+			if vm.StateName(event.(vm.StateChanged).State) != "gurumeditation" {
+				continue
+			}
+			reason = "guru meditation"
+		case _, ok := <-heartbeats:
+			if !ok {
+				return
+			}
+			timer.Reset(timeout)
+			continue
+		case <-timer.C:
+			reason = "no heartbeat for " + timeout.String()
+		}
+
+		slog.Error("Guest is not responding", "reason", reason, "action", action)
+		timer.Stop()
+
+		var err error
+		switch action {
+		case "reset":
+			err = machine.Reset()
+		case "restore":
+			err = machine.RestartFromSnapshot()
+		case "exit":
+			healthExitCode = exitUnhealthy
+			sdNotify("STOPPING=1")
+			err = machine.PowerOff()
+		}
+		if err != nil {
+			slog.Error("Failed to recover the guest", "action", action, "error", err)
+		}
+	}
+}
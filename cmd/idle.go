@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/lebauce/vlaunch/vm"
+)
+
+// usageStateSuffix ends the guest properties where the Guest Additions
+// report whether a user is active, InUse, or Idle
+const usageStateSuffix = "/UsageState"
+
+// runIdleWatchdog applies idle.action when no user activity was reported
+// by the guest for idle.timeout. Activity is any change of a property
+// matching idle.properties, the Guest Additions usage states only being
+// activity while a user is in use, in which case the machine is never idle
+func runIdleWatchdog(ctx context.Context, machine *vm.VirtualMachine) {
+	action := vmConfig.GetString("idle.action")
+	if action == "none" {
+		return
+	}
+
+	timeout := vmConfig.GetDuration("idle.timeout")
+	var subscriptions []<-chan vm.Event
+	activity := make(chan vm.GuestPropertyChanged, 16)
+	for _, pattern := range vmConfig.GetStringSlice("idle.properties") {
+		events, err := machine.SubscribeProperties(pattern)
+		if err != nil {
+			slog.Error("Guest activity will not be watched", "pattern", pattern, "error", err)
+			continue
+		}
+		subscriptions = append(subscriptions, events)
+
+		go func(events <-chan vm.Event) {
+			for event := range events {
+				select {
+				case activity <- event.(vm.GuestPropertyChanged):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(events)
+	}
+	defer func() {
+		for _, events := range subscriptions {
+			machine.Unsubscribe(events)
+		}
+	}()
+
+	inUse := make(map[string]bool)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case prop := <-activity:
+			if strings.HasSuffix(prop.Name, usageStateSuffix) {
+				if prop.Value == "InUse" {
+					inUse[prop.Name] = true
+				} else {
+					delete(inUse, prop.Name)
+				}
+			}
+			timer.Reset(timeout)
+			continue
+		case <-timer.C:
+		}
+
+		if len(inUse) > 0 {
+			timer.Reset(timeout)
+			continue
+		}
+
+		slog.Info("Guest is idle", "timeout", timeout, "action", action)
+		sdNotify("STOPPING=1")
+
+		var err error
+		switch action {
+		case "save":
+			err = machine.SaveState()
+		case "shutdown":
+			err = machine.Stop()
+		case "poweroff":
+			err = machine.PowerOff()
+		}
+		if err != nil {
+			slog.Error("Failed to stop the idle guest", "action", action, "error", err)
+		}
+		return
+	}
+}
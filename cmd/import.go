@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import <appliance.ova>",
+	Short: "Import an OVA/OVF appliance as the managed machine",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("An appliance file is required")
+		}
+
+		if _, err := vm.FindVM(vmConfig); err == nil {
+			return fmt.Errorf("A machine named '%s' already exists", vmConfig.GetString("machine_name"))
+		}
+
+		if _, err := vm.Import(vmConfig, args[0]); err != nil {
+			return err
+		}
+
+		if jsonOutput() {
+			return printJSON(map[string]string{"appliance": args[0], "machine": vmConfig.GetString("machine_name")})
+		}
+
+		fmt.Printf("Imported %s as %s\n", args[0], vmConfig.GetString("machine_name"))
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(importCmd)
+}
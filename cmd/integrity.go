@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/lebauce/vlaunch/vm"
+)
+
+// confirm asks a yes or no question on the terminal, no being the default
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
+
+// verifyDisks refuses to boot a machine whose disk images are corrupted
+// unless, following integrity.on_failure, the current snapshot of the
+// machine is restored, which requires the corruption to be in the state
+// written since that snapshot
+func verifyDisks(machine *vm.VirtualMachine) error {
+	err := machine.VerifyDisks()
+
+	var corrupted *vm.CorruptedDiskError
+	if !errors.As(err, &corrupted) {
+		return err
+	}
+	slog.Error("Disk image is corrupted", "location", corrupted.Location, "reason", corrupted.Reason)
+
+	snapshot, snapshotErr := machine.CurrentSnapshot()
+	if snapshotErr != nil {
+		return err
+	}
+
+	switch vmConfig.GetString("integrity.on_failure") {
+	case "restore":
+	case "ask":
+		if !isTerminal(os.Stdin) || !confirm(fmt.Sprintf("Restore snapshot '%s', losing the changes made since ?", snapshot)) {
+			return fmt.Errorf("%s, it can be restored with 'vlaunch snapshot restore %s'", err.Error(), snapshot)
+		}
+	default:
+		return err
+	}
+
+	slog.Info("Restoring snapshot", "name", snapshot)
+	if err := machine.RestoreSnapshot(snapshot); err != nil {
+		return fmt.Errorf("Failed to restore snapshot %s: %s", snapshot, err.Error())
+	}
+	return machine.VerifyDisks()
+}
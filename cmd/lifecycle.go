@@ -0,0 +1,15 @@
+package cmd
+
+import (
+	"github.com/lebauce/vlaunch/hooks"
+)
+
+// runLifecycleHooks runs the hooks of a lifecycle event of the machine
+func runLifecycleHooks(hookList []hooks.Hook, event string) error {
+	return hooks.Run(hookList, &hooks.Payload{
+		Event:      event,
+		Machine:    vmConfig.GetString("machine_name"),
+		Hypervisor: vmConfig.GetString("hypervisor"),
+		DataPath:   vmConfig.GetString("data_path"),
+	})
+}
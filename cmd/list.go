@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the machines created by vlaunch on this host",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		machines, err := vm.ListMachines(vmConfig)
+		if err != nil {
+			return fmt.Errorf("Failed to list machines: %s", err.Error())
+		}
+
+		if jsonOutput() {
+			return printJSON(machines)
+		}
+
+		if len(machines) == 0 {
+			fmt.Println("No machine created by vlaunch")
+			return nil
+		}
+
+		fmt.Printf("%-20s %-12s %-22s %-30s %s\n", "NAME", "STATE", "CREATED", "DATA PATH", "DISKS")
+		for _, machine := range machines {
+			created := machine.Created
+			if created == "" {
+				created = "-"
+			}
+			fmt.Printf("%-20s %-12s %-22s %-30s %s\n", machine.Name, machine.State, created, machine.DataPath, strings.Join(machine.Disks, ", "))
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(listCmd)
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"io"
+	"log/slog"
+
+	"github.com/lebauce/vlaunch/logging"
+)
+
+var (
+	logLevel  string
+	logFormat string
+)
+
+// setupLogging makes the default logger write to the given writers using
+// the level and format requested on the command line
+func setupLogging(writers ...io.Writer) error {
+	level, err := logging.ParseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+
+	handler, err := logging.NewHandler(io.MultiWriter(writers...), level, logFormat)
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
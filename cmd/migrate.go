@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	migrateTo          string
+	migratePassword    string
+	migrateMaxDowntime time.Duration
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Teleport the running machine to a vlaunch instance started with --teleport-target on another host",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if migrateTo == "" {
+			return errors.New("The target host and port are required, e.g. --to host:6000")
+		}
+
+		host, port, err := net.SplitHostPort(migrateTo)
+		if err != nil {
+			return fmt.Errorf("Invalid target '%s': %s", migrateTo, err.Error())
+		}
+
+		if _, err := strconv.Atoi(port); err != nil {
+			return fmt.Errorf("Invalid target port '%s'", port)
+		}
+
+		password := migratePassword
+		if password == "" {
+			password = vmConfig.GetString("teleporter.password")
+		}
+
+		return callControl("migrate", host, port, password, migrateMaxDowntime.String())
+	},
+}
+
+func init() {
+	migrateCmd.Flags().StringVar(&migrateTo, "to", "", "host and port of the target, e.g. host:6000")
+	migrateCmd.Flags().StringVar(&migratePassword, "password", "", "password of the target, teleporter.password by default")
+	migrateCmd.Flags().DurationVar(&migrateMaxDowntime, "max-downtime", 250*time.Millisecond, "how long the machine may be paused while its last state is sent")
+
+	RootCmd.AddCommand(migrateCmd)
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// outputFormat is the format of the results printed by the commands
+var outputFormat string
+
+func validateOutputFormat() error {
+	switch outputFormat {
+	case "text", "json":
+		return nil
+	default:
+		return &exitError{code: exitConfig, msg: fmt.Sprintf("Invalid output format '%s', must be text or json", outputFormat)}
+	}
+}
+
+// jsonOutput returns whether the results are to be printed as JSON
+func jsonOutput() bool {
+	return outputFormat == "json"
+}
+
+// printJSON prints the result of a command as indented JSON
+func printJSON(v interface{}) error {
+	// Empty lists are printed as [] rather than null
+	if value := reflect.ValueOf(v); value.Kind() == reflect.Slice && value.IsNil() {
+		v = []interface{}{}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
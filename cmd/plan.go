@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/lebauce/vlaunch/vm"
+)
+
+func printSorted(values map[string]string, format string) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf(format, name, values[name])
+	}
+}
+
+// printPlan prints the machine that would be created, for --dry-run
+func printPlan() error {
+	plan, err := vm.NewPlan(vmConfig)
+	if err != nil {
+		return fail(exitConfig, "Failed to plan vm", err)
+	}
+
+	if jsonOutput() {
+		return printJSON(plan)
+	}
+
+	fmt.Printf("Name:       %s\n", plan.Name)
+	fmt.Printf("Hypervisor: %s\n", plan.Hypervisor)
+	if plan.CloneFrom != "" {
+		fmt.Printf("Clone of:   %s\n", plan.CloneFrom)
+	}
+	fmt.Printf("OS type:    %s\n", plan.OSType)
+	fmt.Printf("Firmware:   %s\n", plan.Firmware)
+	fmt.Printf("CPUs:       %d\n", plan.CPUs)
+	fmt.Printf("RAM:        %d MB\n", plan.RAM)
+
+	fmt.Println("Storage controllers:")
+	for _, controller := range plan.Controllers {
+		fmt.Printf("  %s (%s, %d ports)\n", controller.Name, controller.Type, controller.Ports)
+	}
+
+	fmt.Println("Media:")
+	for _, medium := range plan.Media {
+		location := medium.Location
+		if medium.Device != "" {
+			location = medium.Device
+		} else if medium.Error != "" {
+			location = "error: " + medium.Error
+		}
+
+		slot := ""
+		if medium.Controller != "" {
+			slot = " on " + medium.Controller
+		}
+		if medium.Port != nil {
+			slot += fmt.Sprintf(" port %d", *medium.Port)
+		}
+		fmt.Printf("  %s %s%s\n", medium.Type, location, slot)
+	}
+
+	fmt.Println("Network adapters:")
+	for i, adapter := range plan.Network {
+		fmt.Printf("  %d: %s", i, adapter.Mode)
+		if adapter.Network != "" {
+			fmt.Printf(" %s", adapter.Network)
+		}
+		if adapter.Type != "" {
+			fmt.Printf(" (%s)", adapter.Type)
+		}
+		if adapter.MACAddress != "" {
+			fmt.Printf(" %s", adapter.MACAddress)
+		}
+		fmt.Println()
+	}
+
+	if len(plan.SharedFolders) > 0 {
+		fmt.Println("Shared folders:")
+		printSorted(plan.SharedFolders, "  %s: %s\n")
+	}
+
+	fmt.Println("Global extra data:")
+	printSorted(plan.GlobalExtraData, "  %s = %s\n")
+	fmt.Println("Machine extra data:")
+	printSorted(plan.MachineExtraData, "  %s = %s\n")
+	return nil
+}
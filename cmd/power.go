@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/lebauce/vlaunch/vm"
+)
+
+// handlePowerEvents pauses the machine while the host sleeps and saves it or
+// shuts it down before the host does. It is only resumed on wake up if it
+// was paused by vlaunch, not by the user
+func handlePowerEvents(ctx context.Context, vm *vm.VirtualMachine, saveOnExit bool) {
+	var (
+		paused   bool
+		stopping sync.Once
+	)
+
+	err := backend.WatchPowerEvents(ctx, func(event backend.PowerEvent) {
+		slog.Info("Host power event", "event", event)
+
+		switch event {
+		case backend.HostSuspending:
+			if !vmConfig.GetBool("power.pause_on_sleep") {
+				return
+			}
+
+			// Pausing fails if the machine is not running, in which
+			// case there is nothing to resume either
+			if err := vm.Pause(); err != nil {
+				slog.Info("Machine not paused", "error", err)
+				return
+			}
+			paused = true
+		case backend.HostResumed:
+			if !paused {
+				return
+			}
+			paused = false
+			if err := vm.Resume(); err != nil {
+				slog.Error("Failed to resume the machine", "error", err)
+			}
+		case backend.HostShuttingDown:
+			if !vmConfig.GetBool("power.stop_on_shutdown") {
+				return
+			}
+
+			// The host only waits for the handler to return
+			stopping.Do(func() {
+				sdNotify("STOPPING=1")
+				shutDownVM(vm, saveOnExit, nil)
+			})
+		}
+	})
+	if err != nil {
+		slog.Warn("Host power events will not be handled", "error", err)
+	}
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const progressBarWidth = 30
+
+// progressBar displays the progress of the VM operations on a terminal
+type progressBar struct {
+	out       io.Writer
+	operation string
+	percent   uint32
+}
+
+func (p *progressBar) Update(operation string, percent uint32) {
+	if operation == p.operation && percent == p.percent {
+		return
+	}
+
+	if operation != p.operation && p.operation != "" {
+		fmt.Fprintln(p.out)
+	}
+	p.operation, p.percent = operation, percent
+
+	if percent > 100 {
+		percent = 100
+	}
+	filled := int(percent) * progressBarWidth / 100
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	fmt.Fprintf(p.out, "\r%s [%s] %3d%%", operation, bar, percent)
+
+	if percent == 100 {
+		fmt.Fprintln(p.out)
+		p.operation = ""
+	}
+}
+
+func (p *progressBar) Cancelled() bool {
+	return false
+}
+
+// newProgressBar returns a progress bar writing to stderr, or nil when
+// stderr is not a terminal
+func newProgressBar() *progressBar {
+	if fi, err := os.Stderr.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return &progressBar{out: os.Stderr}
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var propertyFlags string
+
+var propertyCmd = &cobra.Command{
+	Use:   "property",
+	Short: "Read and write guest properties",
+}
+
+var propertyGetCmd = &cobra.Command{
+	Use:   "get <name>",
+	Short: "Print the value of a guest property",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("A property name is required")
+		}
+
+		machine, err := vm.FindVM(vmConfig)
+		if err != nil {
+			// The journal keeps the properties of a machine that was deleted
+			prop, found, journalErr := vm.LastGuestProperty(vmConfig, args[0])
+			if journalErr != nil || !found {
+				return err
+			}
+			slog.Info("Using the last recorded value", "timestamp", time.Unix(0, prop.Timestamp))
+
+			if jsonOutput() {
+				return printJSON(map[string]string{"name": args[0], "value": prop.Value})
+			}
+			fmt.Println(prop.Value)
+			return nil
+		}
+
+		value, err := machine.GetGuestProperty(args[0])
+		if err != nil {
+			return fmt.Errorf("Failed to get property: %s", err.Error())
+		}
+
+		if jsonOutput() {
+			return printJSON(map[string]string{"name": args[0], "value": value})
+		}
+
+		fmt.Println(value)
+		return nil
+	},
+}
+
+var propertySetCmd = &cobra.Command{
+	Use:   "set <name> [value]",
+	Short: "Set a guest property, or delete it if no value is given",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("A property name and an optional value are required")
+		}
+
+		vm, err := vm.FindVM(vmConfig)
+		if err != nil {
+			return err
+		}
+
+		value := ""
+		if len(args) == 2 {
+			value = args[1]
+		}
+
+		if err := vm.SetGuestProperty(args[0], value, propertyFlags); err != nil {
+			return fmt.Errorf("Failed to set property: %s", err.Error())
+		}
+		return nil
+	},
+}
+
+var propertyListCmd = &cobra.Command{
+	Use:   "list [pattern]",
+	Short: "List the guest properties matching a pattern",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pattern := ""
+		if len(args) > 0 {
+			pattern = args[0]
+		}
+
+		vm, err := vm.FindVM(vmConfig)
+		if err != nil {
+			return err
+		}
+
+		properties, err := vm.GuestProperties(pattern)
+		if err != nil {
+			return fmt.Errorf("Failed to list properties: %s", err.Error())
+		}
+
+		if jsonOutput() {
+			return printJSON(properties)
+		}
+
+		for _, prop := range properties {
+			fmt.Printf("%s = %s\n", prop.Name, prop.Value)
+		}
+		return nil
+	},
+}
+
+func init() {
+	propertySetCmd.Flags().StringVarP(&propertyFlags, "flags", "f", "", "property flags (TRANSIENT, RDONLYGUEST, ...)")
+
+	propertyCmd.AddCommand(propertyGetCmd)
+	propertyCmd.AddCommand(propertySetCmd)
+	propertyCmd.AddCommand(propertyListCmd)
+	RootCmd.AddCommand(propertyCmd)
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/lebauce/vlaunch/config"
+	"github.com/lebauce/vlaunch/vm"
+)
+
+// watchConfig applies the changes of the configuration files to the
+// running machine, telling which ones need a restart
+func watchConfig(ctx context.Context, vm *vm.VirtualMachine) {
+	interval := vmConfig.GetDuration("reload_interval")
+	if len(cfgFiles) == 0 || interval <= 0 {
+		return
+	}
+
+	config.Watch(ctx, interval, func() {
+		cfg, err := config.GetProfile(profile)
+		if err != nil {
+			slog.Error("Failed to reload profile", "error", err)
+			return
+		}
+		applyFlagOverrides(cfg)
+
+		if err := config.Validate(cfg); err != nil {
+			slog.Error("Ignoring invalid configuration", "error", err)
+			return
+		}
+
+		restart, err := vm.Reconfigure(cfg)
+		if err != nil {
+			slog.Error("Failed to apply configuration", "error", err)
+		}
+
+		if len(restart) > 0 {
+			slog.Warn("Some settings changes require a restart of the VM", "settings", restart)
+		}
+	})
+}
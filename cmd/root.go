@@ -1,114 +1,488 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path"
+	"time"
 
 	"github.com/lebauce/vlaunch/backend"
 	"github.com/lebauce/vlaunch/config"
+	"github.com/lebauce/vlaunch/control"
 	"github.com/lebauce/vlaunch/gui"
+	"github.com/lebauce/vlaunch/hooks"
+	"github.com/lebauce/vlaunch/logging"
+	"github.com/lebauce/vlaunch/metrics"
 	"github.com/lebauce/vlaunch/vm"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"github.com/therecipe/qt/widgets"
 )
 
 var (
-	cfgFiles []string
-	keepVM   bool
+	cfgFiles         []string
+	profile          string
+	vmConfig         *viper.Viper
+	keepVM           bool
+	headless         bool
+	saveState        bool
+	record           bool
+	waitForIP        bool
+	ipTimeout        time.Duration
+	cloneFrom        string
+	metricsAddress   string
+	dryRun           bool
+	teleportTarget   bool
+	machineName      string
+	ram              int
+	cpus             int
+	disk             string
+	device           string
+	diskType         string
+	diskPasswordFile string
 )
 
 var RootCmd = &cobra.Command{
-	Use: "vlaunch",
-	Run: func(cmd *cobra.Command, args []string) {
-		dataPath := config.GetConfig().GetString("data_path")
-		logWriters := []io.Writer{}
-		if logFile, err := os.OpenFile(path.Join(dataPath, "vlaunch.log"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666); err == nil {
-			logWriters = append(logWriters, logFile)
-			defer logFile.Close()
-		} else if logFile, err := os.Create("/tmp/vlaunch.log"); err == nil {
-			logWriters = append(logWriters, logFile)
-			defer logFile.Close()
+	Use:           "vlaunch",
+	SilenceErrors: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := restoreEnvironment(); err != nil {
+			return err
 		}
 
-		logWriters = append(logWriters, os.Stdout)
-		logWriters = append(logWriters, os.Stderr)
+		if err := setupLogging(os.Stderr); err != nil {
+			return &exitError{code: exitConfig, msg: "Invalid logging options", err: err}
+		}
 
-		multiLogger := io.MultiWriter(logWriters...)
-		log.SetOutput(multiLogger)
+		if err := validateOutputFormat(); err != nil {
+			return err
+		}
 
-		if !backend.IsAdmin() {
-			log.Println("Elevating privileges")
+		// doctor reports an invalid configuration among its checks
+		return initConfig(cmd != doctorCmd)
+	},
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		// Failures past this point are not usage errors
+		cmd.SilenceUsage = true
 
-			executable, err := os.Executable()
-			if err != nil {
-				log.Panic(fmt.Sprintf("Failed to determine executable: %s", err.Error()))
+		dataPath := vmConfig.GetString("data_path")
+		logWriters := []io.Writer{os.Stderr}
+		for _, logPath := range []string{path.Join(dataPath, "vlaunch.log"), path.Join(os.TempDir(), "vlaunch.log")} {
+			logFile, err := logging.OpenRotatingFile(logPath,
+				int64(vmConfig.GetInt("log.max_size"))*1024*1024,
+				vmConfig.GetDuration("log.max_age"),
+				vmConfig.GetInt("log.max_files"))
+			if err == nil {
+				logWriters = append(logWriters, logFile)
+				logFilePath = logPath
+				defer logFile.Close()
+				break
 			}
+		}
+
+		if err := setupLogging(logWriters...); err != nil {
+			return fail(exitConfig, "Failed to setup logging", err)
+		}
+
+		if err := selectDevice(vmConfig); err != nil {
+			return fail(exitDevice, "Failed to select device", err)
+		}
+
+		if dryRun {
+			return printPlan()
+		}
+
+		done, code, err := setupPrivileges()
+		if err == backend.ElevationCancelled {
+			return &exitError{code: exitFailure, msg: err.Error()}
+		} else if err != nil {
+			return fail(exitFailure, "Failed to set up privileges", err)
+		}
+
+		if done {
+			return &exitError{code: code}
+		}
+
+		lock, err := control.AcquireLock(dataPath)
+		if err != nil {
+			return &exitError{code: exitFailure, msg: err.Error()}
+		}
+		defer lock.Release()
 
-			if err := backend.RunAsRoot(executable); err != nil {
-				log.Panic(fmt.Sprintf("Failed to run as root: %s", err.Error()))
+		// The raw disks are only set up once the lock is held, so that two
+		// vlaunch do not set up the same device
+		admin := backend.IsAdmin()
+		if admin {
+			if err := dropPrivileges(); err != nil {
+				return fail(exitFailure, "Failed to set up privileges", err)
 			}
+		}
+
+		saveOnExit := vmConfig.GetBool("save_state")
 
-			return
+		// The machine can run without its control commands
+		server, err := control.NewServer(control.SocketPath(dataPath))
+		if err != nil {
+			slog.Warn("Failed to create control socket", "error", err)
+		} else {
+			defer server.Close()
 		}
 
-		vm, err := vm.NewVM()
+		ctx := context.Background()
+		if bar := newProgressBar(); bar != nil {
+			ctx = vm.WithProgressReporter(ctx, bar)
+		}
 
-		useGui := config.GetConfig().GetBool("gui")
-		app := widgets.NewQApplication(len(os.Args), os.Args)
-		if useGui == true {
-			balloon, err := gui.NewBalloon(app, "The machine is starting", "Please wait...", true)
-			if err != nil {
-				log.Panic(err)
+		// Machines left behind by a previous run would prevent this one
+		if removed, err := vm.Cleanup(ctx, vmConfig, false); err != nil && err != vm.NotSupported {
+			slog.Warn("Failed to clean up orphaned machines", "error", err)
+		} else if len(removed) > 0 {
+			slog.Info("Cleaned up orphaned machines", "removed", removed)
+		}
+
+		if !admin {
+			if err := setupRawDisks(); err != nil {
+				return fail(exitFailure, "Failed to set up privileges", err)
 			}
-			vm.RegisterEventHandler(balloon)
 		}
 
+		hookList, err := hooks.Load(vmConfig)
 		if err != nil {
-			log.Panic(fmt.Sprintf("Failed to create vm: %s", err.Error()))
+			return fail(exitConfig, "Failed to load hooks", err)
+		}
+
+		vm, existing, err := getVM(ctx, vmConfig, saveOnExit)
+		if err != nil {
+			return fail(exitVirtualBox, "Failed to create vm", err)
 		}
 
 		defer func() {
-			if !keepVM {
-				if err := vm.Release(); err != nil {
-					log.Panic(fmt.Sprintf("Failed to release vm: %s", err.Error()))
+			func() {
+				// A saved machine is kept around so that it can be resumed
+				if saveOnExit {
+					if saved, err := vm.HasSavedState(); err == nil && saved {
+						slog.Info("Keeping VM in saved state")
+						return
+					}
+				}
+
+				if !keepVM && !vm.IsImported() {
+					if releaseErr := vm.Release(ctx); releaseErr != nil && err == nil {
+						err = fail(exitFailure, "Failed to release vm", releaseErr)
+					}
+				}
+
+				if vm.EjectRequested() {
+					if ejectErr := vm.EjectDevices(); ejectErr != nil {
+						slog.Error("Failed to eject the USB disk", "error", ejectErr)
+					}
 				}
+			}()
+
+			if hookErr := runLifecycleHooks(hookList, hooks.PostRelease); hookErr != nil && err == nil {
+				err = fail(exitFailure, "Failed to run hooks", hookErr)
 			}
 		}()
 
-		go func() {
-			log.Println("Creating VM")
-			if err := vm.Create(); err != nil {
-				log.Panic(fmt.Sprintf("Failed to create vm: %s", err.Error()))
+		vm.OnShutdown(func() error {
+			return runLifecycleHooks(hookList, hooks.PreShutdown)
+		})
+
+		runVM := func() error {
+			if !existing {
+				if err := vm.Preflight(); err != nil {
+					return fail(exitFailure, "Host can not run the vm", err)
+				}
+
+				if err := runLifecycleHooks(hookList, hooks.PreCreate); err != nil {
+					return fail(exitFailure, "Failed to run hooks", err)
+				}
+
+				slog.Info("Creating VM")
+				if err := vm.Create(ctx); err != nil {
+					return fail(exitVirtualBox, "Failed to create vm", err)
+				}
+			}
+
+			if err := verifyDisks(vm); err != nil {
+				return fail(exitFailure, "Disk image check failed", err)
+			}
+
+			slog.Info("Starting VM")
+			if err := vm.Start(ctx); err != nil {
+				return fail(exitGuest, "Failed to start vm", err)
+			}
+
+			if err := runLifecycleHooks(hookList, hooks.PostStart); err != nil {
+				if powerOffErr := vm.PowerOff(); powerOffErr != nil {
+					slog.Error("Failed to power off vm", "error", powerOffErr)
+				}
+				return fail(exitFailure, "Failed to run hooks", err)
+			}
+
+			watchCtx, stopWatching := context.WithCancel(ctx)
+			defer stopWatching()
+			go watchConfig(watchCtx, vm)
+			go runWatchdog(watchCtx, vm)
+			go runHealthWatchdog(watchCtx, vm)
+			go runIdleWatchdog(watchCtx, vm)
+			handlePowerEvents(watchCtx, vm, saveOnExit)
+			go applyBatteryPolicy(watchCtx, vm)
+			go vm.HotplugUSBDisks(watchCtx)
+			go vm.WatchRawDevices(watchCtx)
+			go vm.ServeRequests(watchCtx)
+
+			var hooksDone <-chan struct{}
+			if len(hookList) > 0 {
+				hooksDone = hooks.Start(vm, vmConfig.GetString("machine_name"), hookList)
 			}
 
-			log.Println("Starting VM")
-			if err := vm.Start(); err != nil {
-				log.Panic(fmt.Sprintf("Failed to start vm: %s", err.Error()))
+			if vmConfig.GetBool("guest_ip.wait") {
+				go reportGuestIP(ctx, vm)
 			}
 
-			log.Println("Running VM")
-			if err := vm.Run(); err != nil {
-				log.Panic(fmt.Sprintf("Error during vm execution: %s", err.Error()))
+			if err := vm.PublishProxy(); err != nil {
+				slog.Warn("Failed to publish the proxy settings", "error", err)
 			}
 
+			handleSignals(vm, saveOnExit)
+			if server != nil {
+				registerControlHandlers(server, vm)
+				registerWatchHandler(server, vm)
+				go server.Serve()
+			}
+
+			if address := vmConfig.GetString("metrics.address"); address != "" {
+				if listener, err := metrics.Serve(address, vm); err != nil {
+					slog.Error("Failed to serve metrics", "error", err)
+				} else {
+					defer listener.Close()
+				}
+			}
+
+			if err := sdNotify("READY=1"); err != nil {
+				slog.Warn("Failed to notify systemd", "error", err)
+			}
+
+			slog.Info("Running VM")
+			err = vm.Run(ctx)
+			sdNotify("STOPPING=1")
+			if err != nil {
+				return fail(exitGuest, "Error during vm execution", err)
+			}
+
+			if err := vm.RecordDiskChecksums(); err != nil {
+				slog.Warn("Failed to record the checksums of the disk images", "error", err)
+			}
+
+			if hooksDone != nil {
+				<-hooksDone
+			}
+			return nil
+		}
+
+		// There is no desktop to show the balloon on in headless mode
+		useGui := vmConfig.GetBool("gui") && vmConfig.GetString("frontend") != "headless"
+		if !useGui {
+			return runVM()
+		}
+
+		app := widgets.NewQApplication(len(os.Args), os.Args)
+		balloon, err := gui.NewBalloon(app, "The machine is starting", "Please wait...", true)
+		if err != nil {
+			return fail(exitFailure, "Failed to create balloon", err)
+		}
+		go updateBalloon(balloon, vm)
+		startTray(app, vm)
+
+		result := make(chan error, 1)
+		go func() {
+			result <- runVM()
 			app.QuitDefault()
 		}()
 
 		widgets.QApplication_Exec()
+		return <-result
 	},
 }
 
-func initConfig() {
+// getVM returns the machine to run, and whether it is an existing machine,
+// either imported from an appliance, resumed from a saved state or kept by
+// a previous run
+func getVM(ctx context.Context, cfg *viper.Viper, resumable bool) (*vm.VirtualMachine, bool, error) {
+	if existing, err := vm.FindVM(cfg); err == nil {
+		if existing.IsImported() {
+			return existing, true, nil
+		}
+
+		if resumable {
+			if hasSavedState, err := existing.HasSavedState(); err == nil && hasSavedState {
+				return existing, true, nil
+			}
+		}
+	}
+
+	machine, err := vm.NewVM(cfg)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch err := machine.Attach(ctx, cfg.GetString("machine_name")); err {
+	case nil:
+		slog.Info("Reusing existing VM")
+		return machine, true, nil
+	case vm.NoSuchMachine, vm.NotSupported:
+		return machine, false, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// reportGuestIP waits for the guest to report its IP address, prints it on
+// the standard output and writes it to the configured file
+func reportGuestIP(ctx context.Context, machine *vm.VirtualMachine) {
+	ctx, cancel := context.WithTimeout(ctx, vmConfig.GetDuration("guest_ip.timeout"))
+	defer cancel()
+
+	ip, err := machine.WaitForIP(ctx)
+	if err != nil {
+		slog.Warn("Failed to get the guest IP address", "error", err)
+		return
+	}
+
+	slog.Info("Guest reported its IP address", "ip", ip)
+	fmt.Println(ip)
+
+	if ipFile := vmConfig.GetString("guest_ip.file"); ipFile != "" {
+		if err := os.WriteFile(ipFile, []byte(ip+"\n"), 0644); err != nil {
+			slog.Error("Failed to write the guest IP address", "path", ipFile, "error", err)
+		}
+	}
+}
+
+// updateBalloon reports the guest boot progress on the balloon
+func updateBalloon(balloon *gui.Balloon, machine *vm.VirtualMachine) {
+	events, _ := machine.SubscribeProperties("/UFO/*")
+	for event := range events {
+		prop := event.(vm.GuestPropertyChanged)
+		balloon.OnGuestPropertyChanged(prop.Name, prop.Value, prop.Timestamp, prop.Flags)
+	}
+}
+
+// applyFlagOverrides sets the configuration keys given on the command line,
+// they take precedence over the configuration files for this run only
+func applyFlagOverrides(cfg *viper.Viper) {
+	if machineName != "" {
+		cfg.Set("machine_name", machineName)
+	}
+
+	if ram > 0 {
+		cfg.Set("ram", ram)
+	}
+
+	if cpus > 0 {
+		cfg.Set("cpus", cpus)
+	}
+
+	if diskType != "" {
+		cfg.Set("disk_type", diskType)
+	}
+
+	if disk != "" {
+		cfg.Set("disk_location", disk)
+	}
+
+	if device != "" {
+		cfg.Set("device", device)
+	}
+
+	if diskPasswordFile != "" {
+		cfg.Set("encryption.password_file", diskPasswordFile)
+	}
+
+	if headless {
+		cfg.Set("frontend", "headless")
+	}
+
+	if saveState {
+		cfg.Set("save_state", true)
+	}
+
+	if cloneFrom != "" {
+		cfg.Set("clone_from", cloneFrom)
+	}
+
+	if record {
+		cfg.Set("recording.enabled", true)
+	}
+
+	if waitForIP {
+		cfg.Set("guest_ip.wait", true)
+	}
+
+	if ipTimeout > 0 {
+		cfg.Set("guest_ip.timeout", ipTimeout)
+	}
+
+	if metricsAddress != "" {
+		cfg.Set("metrics.address", metricsAddress)
+	}
+
+	if teleportTarget {
+		cfg.Set("teleporter.enabled", true)
+	}
+}
+
+func initConfig(validate bool) error {
 	if err := config.InitConfig(cfgFiles); err != nil {
-		log.Panic(err)
+		return &exitError{code: exitConfig, msg: "Failed to load configuration", err: err}
+	}
+
+	var err error
+	if vmConfig, err = config.GetProfile(profile); err != nil {
+		return &exitError{code: exitConfig, msg: "Failed to load profile", err: err}
+	}
+
+	applyFlagOverrides(vmConfig)
+
+	if !validate {
+		return nil
+	}
+
+	if err := config.Validate(vmConfig); err != nil {
+		return &exitError{code: exitConfig, msg: err.Error()}
 	}
+	return nil
 }
 
 func init() {
-	cobra.OnInitialize(initConfig)
 	RootCmd.PersistentFlags().StringArrayVarP(&cfgFiles, "config", "c", []string{}, "location of Vlaunch configuration files")
+	RootCmd.PersistentFlags().StringVar(&profile, "profile", "", "name of the VM profile to use")
 	RootCmd.PersistentFlags().BoolVarP(&keepVM, "keep", "k", false, "do not destroy the VM when exiting")
+	RootCmd.PersistentFlags().StringVar(&machineName, "name", "", "name of the VirtualBox machine")
+	RootCmd.PersistentFlags().StringVar(&diskPasswordFile, "disk-password-file", "", "file containing the disk encryption password")
+	RootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "log level (debug, info, warn, error)")
+	RootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "log format (text, json)")
+	RootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", "text", "output format of the commands (text, json)")
+	RootCmd.PersistentFlags().StringVar(&environmentFile, "environment-file", "", "environment to run with, used when elevating privileges")
+	RootCmd.PersistentFlags().MarkHidden("environment-file")
+	RootCmd.Flags().BoolVar(&rawSetup, "raw-setup", false, "only set up the raw disks, used when elevating privileges")
+	RootCmd.Flags().MarkHidden("raw-setup")
+	RootCmd.Flags().IntVar(&ram, "ram", 0, "amount of RAM of the VM in MB")
+	RootCmd.Flags().IntVar(&cpus, "cpus", 0, "number of CPUs of the VM")
+	RootCmd.Flags().StringVar(&disk, "disk", "", "device or disk image to boot from")
+	RootCmd.Flags().StringVar(&device, "device", "", "raw device to boot from, see 'vlaunch devices'")
+	RootCmd.Flags().StringVar(&diskType, "disk-type", "", "type of the disk to boot from (raw, vdi, vmdk, vhd, none)")
+	RootCmd.Flags().BoolVar(&headless, "headless", false, "start the VM without a display")
+	RootCmd.Flags().StringVar(&cloneFrom, "clone-from", "", "create the VM as a linked clone of a registered machine")
+	RootCmd.Flags().BoolVar(&saveState, "save-state", false, "save the state of the VM on exit and resume it on next launch")
+	RootCmd.Flags().BoolVar(&record, "record", false, "record the display of the VM to a video file")
+	RootCmd.Flags().BoolVar(&waitForIP, "wait-for-ip", false, "print the IP address of the guest once it is reported")
+	RootCmd.Flags().DurationVar(&ipTimeout, "ip-timeout", 0, "how long --wait-for-ip waits for the IP address of the guest, overrides guest_ip.timeout")
+	RootCmd.Flags().StringVar(&metricsAddress, "metrics-address", "", "address to expose Prometheus metrics on, e.g. :9100")
+	RootCmd.Flags().BoolVar(&dryRun, "dry-run", false, "print the machine that would be created without creating it")
+	RootCmd.Flags().BoolVar(&teleportTarget, "teleport-target", false, "wait for a machine teleported from another host instead of booting")
 }
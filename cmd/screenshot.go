@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/lebauce/vlaunch/control"
+	"github.com/spf13/cobra"
+)
+
+var screenshotCmd = &cobra.Command{
+	Use:   "screenshot <file>",
+	Short: "Save the current screen of the running machine to a PNG file",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("The file to save the screenshot to is required")
+		}
+
+		// The image is written by this process so that it belongs to the
+		// user running the command
+		result, err := control.Call(control.SocketPath(vmConfig.GetString("data_path")), "screenshot")
+		if err != nil {
+			return err
+		}
+
+		var image []byte
+		if err := json.Unmarshal(result, &image); err != nil {
+			return err
+		}
+
+		return os.WriteFile(args[0], image, 0644)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(screenshotCmd)
+}
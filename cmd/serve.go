@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/lebauce/vlaunch/api"
+	"github.com/spf13/cobra"
+)
+
+var (
+	serveAddress string
+	serveToken   string
+)
+
+// tokenPath returns the file the generated API token is written to, only
+// readable by the user
+func tokenPath() string {
+	return filepath.Join(vmConfig.GetString("data_path"), "api.token")
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Expose the machine lifecycle over a REST API",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if serveAddress != "" {
+			vmConfig.Set("api.address", serveAddress)
+		}
+
+		if serveToken != "" {
+			vmConfig.Set("api.token", serveToken)
+		}
+
+		token := vmConfig.GetString("api.token")
+		if token == "" {
+			var err error
+			if token, err = generateToken(); err != nil {
+				return err
+			}
+
+			if err := os.MkdirAll(filepath.Dir(tokenPath()), 0700); err != nil {
+				return err
+			}
+
+			// The permissions of an existing file would be kept
+			os.Remove(tokenPath())
+			if err := ioutil.WriteFile(tokenPath(), []byte(token+"\n"), 0600); err != nil {
+				return fmt.Errorf("Failed to write API token: %s", err.Error())
+			}
+			slog.Info("Generated API token", "path", tokenPath())
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		server := &http.Server{
+			Addr:    vmConfig.GetString("api.address"),
+			Handler: api.NewServer(ctx, vmConfig, token),
+		}
+
+		go func() {
+			<-ctx.Done()
+			server.Shutdown(context.Background())
+		}()
+
+		slog.Info("Serving API", "address", server.Addr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	serveCmd.Flags().StringVar(&serveAddress, "address", "", "address to listen on (default 127.0.0.1:7480)")
+	serveCmd.Flags().StringVar(&serveToken, "token", "", "token required to access the API, generated in the data path if empty")
+	RootCmd.AddCommand(serveCmd)
+}
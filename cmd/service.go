@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const maxRestartDelay = 5 * time.Minute
+
+var serviceLogon bool
+
+// serviceName returns the name of the service running the machine
+func serviceName() string {
+	return "vlaunch-" + vmConfig.GetString("machine_name")
+}
+
+// instanceArgs returns the arguments selecting the configuration of this
+// instance, with absolute paths as services do not run in this folder
+func instanceArgs() []string {
+	var args []string
+	for _, file := range cfgFiles {
+		if absolute, err := filepath.Abs(file); err == nil {
+			file = absolute
+		}
+		args = append(args, "--config", file)
+	}
+
+	if profile != "" {
+		args = append(args, "--profile", profile)
+	}
+
+	if machineName != "" {
+		args = append(args, "--name", machineName)
+	}
+
+	return args
+}
+
+// supervise runs vlaunch until the context is done, running it again with
+// an increasing delay when it exits with an error. When the context is
+// done, the machine is shut down through the control socket.
+func supervise(ctx context.Context, headless bool) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	args := instanceArgs()
+	if headless {
+		args = append(args, "--headless")
+	}
+
+	delay := time.Second
+	for {
+		started := time.Now()
+		slog.Info("Starting vlaunch", "args", args)
+
+		cmd := exec.Command(executable, args...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		exited := make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+
+		select {
+		case <-ctx.Done():
+			return stopInstance(cmd, exited)
+		case err := <-exited:
+			if err == nil {
+				slog.Info("The machine stopped")
+				return nil
+			}
+
+			// A run that lasted a while is not a crash loop
+			if time.Since(started) > maxRestartDelay {
+				delay = time.Second
+			}
+
+			slog.Error("vlaunch exited, restarting it", "error", err, "delay", delay)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
+
+			if delay *= 2; delay > maxRestartDelay {
+				delay = maxRestartDelay
+			}
+		}
+	}
+}
+
+// stopInstance shuts down the machine of the supervised instance, and kills
+// the instance if it does not exit in time
+func stopInstance(cmd *exec.Cmd, exited chan error) error {
+	slog.Info("Shutting down the machine")
+	if err := callControl("stop"); err != nil {
+		slog.Error("Failed to shut down the machine", "error", err)
+	}
+
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(vmConfig.GetDuration("shutdown_handshake.timeout") + vmConfig.GetDuration("timeouts.shutdown") + 10*time.Second):
+		slog.Warn("vlaunch did not exit, killing it")
+		return cmd.Process.Kill()
+	}
+}
+
+var serviceCmd = &cobra.Command{
+	Use:   "service",
+	Short: "Run the machine as a Windows service, or when the user logs on",
+}
+
+var serviceInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install a service starting the machine with Windows",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return installService(serviceLogon)
+	},
+}
+
+var serviceUninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Remove the service of the machine",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return uninstallService()
+	},
+}
+
+var serviceRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Run and supervise the machine, called by the service",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runService()
+	},
+}
+
+func init() {
+	serviceInstallCmd.Flags().BoolVar(&serviceLogon, "logon", false, "start the machine with a display when the user logs on instead of with Windows")
+
+	serviceCmd.AddCommand(serviceInstallCmd)
+	serviceCmd.AddCommand(serviceUninstallCmd)
+	serviceCmd.AddCommand(serviceRunCmd)
+	RootCmd.AddCommand(serviceCmd)
+}
@@ -0,0 +1,19 @@
+// +build !windows
+
+package cmd
+
+import "errors"
+
+var errNoWindowsService = errors.New("Windows services are only available on Windows")
+
+func installService(logon bool) error {
+	return errNoWindowsService
+}
+
+func uninstallService() error {
+	return errNoWindowsService
+}
+
+func runService() error {
+	return errNoWindowsService
+}
@@ -0,0 +1,165 @@
+// +build windows
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// quoteArgs joins arguments into a Windows command line
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if strings.ContainsAny(arg, " \t\"") {
+			arg = `"` + strings.Replace(arg, `"`, `\"`, -1) + `"`
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+// installService registers a service started with Windows, or a scheduled
+// task started when the user logs on so that the machine can be displayed
+func installService(logon bool) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"service", "run"}, instanceArgs()...)
+
+	if logon {
+		output, err := exec.Command("schtasks.exe", "/Create", "/F", "/SC", "ONLOGON", "/RL", "HIGHEST",
+			"/TN", serviceName(), "/TR", quoteArgs(append([]string{executable}, args...))).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Failed to create scheduled task: %s", strings.TrimSpace(string(output)))
+		}
+		fmt.Printf("Scheduled task %s created\n", serviceName())
+		return nil
+	}
+
+	manager, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("Failed to connect to the service manager: %s", err.Error())
+	}
+	defer manager.Disconnect()
+
+	service, err := manager.CreateService(serviceName(), executable, mgr.Config{
+		DisplayName: "Vlaunch " + vmConfig.GetString("machine_name"),
+		Description: "Runs the " + vmConfig.GetString("machine_name") + " virtual machine",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("Failed to create service: %s", err.Error())
+	}
+	defer service.Close()
+
+	fmt.Printf("Service %s installed\n", serviceName())
+	return nil
+}
+
+func uninstallService() error {
+	manager, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("Failed to connect to the service manager: %s", err.Error())
+	}
+	defer manager.Disconnect()
+
+	if service, err := manager.OpenService(serviceName()); err == nil {
+		defer service.Close()
+		if err := service.Delete(); err != nil {
+			return fmt.Errorf("Failed to delete service: %s", err.Error())
+		}
+		fmt.Printf("Service %s removed\n", serviceName())
+		return nil
+	}
+
+	output, err := exec.Command("schtasks.exe", "/Delete", "/F", "/TN", serviceName()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("No service or scheduled task %s: %s", serviceName(), strings.TrimSpace(string(output)))
+	}
+	fmt.Printf("Scheduled task %s removed\n", serviceName())
+	return nil
+}
+
+// vlaunchService maps the service controls onto the machine life cycle
+type vlaunchService struct{}
+
+func (s *vlaunchService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		// Services have no desktop to display the machine on
+		done <- supervise(ctx, true)
+	}()
+
+	accepts := svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+
+	for {
+		select {
+		case err := <-done:
+			cancel()
+			if err != nil {
+				slog.Error("Service failed", "error", err)
+				return true, 1
+			}
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+				<-done
+				return false, 0
+			case svc.Pause:
+				if err := callControl("pause"); err != nil {
+					slog.Error("Failed to pause the machine", "error", err)
+				}
+				status <- svc.Status{State: svc.Paused, Accepts: accepts}
+			case svc.Continue:
+				if err := callControl("resume"); err != nil {
+					slog.Error("Failed to resume the machine", "error", err)
+				}
+				status <- svc.Status{State: svc.Running, Accepts: accepts}
+			}
+		}
+	}
+}
+
+func runService() error {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		return err
+	}
+
+	if !interactive {
+		return svc.Run(serviceName(), &vlaunchService{})
+	}
+
+	// Started by the scheduled task when the user logs on
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	return supervise(ctx, false)
+}
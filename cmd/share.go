@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	shareReadOnly  bool
+	shareAutomount bool
+)
+
+var shareCmd = &cobra.Command{
+	Use:   "share",
+	Short: "Manage the shared folders of the running machine",
+}
+
+var shareAddCmd = &cobra.Command{
+	Use:   "add <name> <path>",
+	Short: "Share a folder with the running machine until it stops",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return errors.New("The name and path of the shared folder are required")
+		}
+
+		// The path is resolved here as vlaunch may run in another folder
+		hostPath, err := filepath.Abs(args[1])
+		if err != nil {
+			return err
+		}
+
+		return callControl("share-add", args[0], hostPath, strconv.FormatBool(!shareReadOnly), strconv.FormatBool(shareAutomount))
+	},
+}
+
+var shareRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "Remove a shared folder from the running machine",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("The name of the shared folder is required")
+		}
+
+		return callControl("share-remove", args[0])
+	},
+}
+
+func init() {
+	shareAddCmd.Flags().BoolVar(&shareReadOnly, "readonly", false, "do not let the guest write to the folder")
+	shareAddCmd.Flags().BoolVar(&shareAutomount, "automount", true, "mount the folder automatically in the guest")
+
+	shareCmd.AddCommand(shareAddCmd)
+	shareCmd.AddCommand(shareRemoveCmd)
+	RootCmd.AddCommand(shareCmd)
+}
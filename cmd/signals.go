@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/lebauce/vlaunch/vm"
+)
+
+var signalExitCode int
+
+// handleSignals shuts the guest down gracefully when vlaunch is interrupted,
+// powering it off if it did not stop in time or on a second signal
+func handleSignals(vm *vm.VirtualMachine, saveOnExit bool) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		if s, ok := sig.(syscall.Signal); ok {
+			signalExitCode = 128 + int(s)
+		}
+		sdNotify("STOPPING=1")
+
+		slog.Info("Received signal", "signal", sig)
+		shutDownVM(vm, saveOnExit, signals)
+	}()
+}
+
+// shutDownVM saves the state of the guest or shuts it down, powering it off
+// if it did not stop in time or when a signal is received meanwhile
+func shutDownVM(vm *vm.VirtualMachine, saveOnExit bool, signals <-chan os.Signal) {
+	var err error
+	if saveOnExit {
+		slog.Info("Saving the VM state")
+		err = vm.SaveState()
+	} else {
+		slog.Info("Shutting down the VM")
+		err = vm.Stop()
+	}
+
+	if err == nil {
+		timeout := vm.Config().GetDuration("timeouts.shutdown")
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- vm.WaitUntilStopped(timeout)
+		}()
+
+		select {
+		case err = <-stopped:
+			if err == nil {
+				return
+			}
+			slog.Warn("Guest did not shut down", "error", err)
+		case sig := <-signals:
+			slog.Warn("Received signal again", "signal", sig)
+		}
+	} else {
+		slog.Error("Failed to shut down the VM", "error", err)
+	}
+
+	slog.Info("Powering off the VM")
+	if err := vm.PowerOff(); err != nil {
+		slog.Error("Failed to power off the VM", "error", err)
+	}
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var snapshotDescription string
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manage the snapshots of the machine",
+}
+
+var snapshotTakeCmd = &cobra.Command{
+	Use:   "take <name>",
+	Short: "Take a snapshot of the machine",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("A snapshot name is required")
+		}
+
+		vm, err := vm.FindVM(vmConfig)
+		if err != nil {
+			return err
+		}
+
+		if err := vm.Snapshot(args[0], snapshotDescription); err != nil {
+			return fmt.Errorf("Failed to take snapshot: %s", err.Error())
+		}
+		return nil
+	},
+}
+
+var snapshotRestoreCmd = &cobra.Command{
+	Use:   "restore <name>",
+	Short: "Restore the machine to a snapshot",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("A snapshot name is required")
+		}
+
+		vm, err := vm.FindVM(vmConfig)
+		if err != nil {
+			return err
+		}
+
+		if err := vm.RestoreSnapshot(args[0]); err != nil {
+			return fmt.Errorf("Failed to restore snapshot: %s", err.Error())
+		}
+		return nil
+	},
+}
+
+var snapshotDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete a snapshot",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("A snapshot name is required")
+		}
+
+		vm, err := vm.FindVM(vmConfig)
+		if err != nil {
+			return err
+		}
+
+		if err := vm.DeleteSnapshot(args[0]); err != nil {
+			return fmt.Errorf("Failed to delete snapshot: %s", err.Error())
+		}
+		return nil
+	},
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the snapshots of the machine",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		vm, err := vm.FindVM(vmConfig)
+		if err != nil {
+			return err
+		}
+
+		snapshots, err := vm.Snapshots()
+		if err != nil {
+			return fmt.Errorf("Failed to list snapshots: %s", err.Error())
+		}
+
+		if jsonOutput() {
+			return printJSON(snapshots)
+		}
+
+		for _, snapshot := range snapshots {
+			current := " "
+			if snapshot.Current {
+				current = "*"
+			}
+			fmt.Printf("%s %s\t%s\t%s\n", current, snapshot.Name, snapshot.TimeStamp.Format("2006-01-02 15:04:05"), snapshot.Description)
+		}
+		return nil
+	},
+}
+
+func init() {
+	snapshotTakeCmd.Flags().StringVarP(&snapshotDescription, "description", "d", "", "description of the snapshot")
+
+	snapshotCmd.AddCommand(snapshotTakeCmd)
+	snapshotCmd.AddCommand(snapshotRestoreCmd)
+	snapshotCmd.AddCommand(snapshotDeleteCmd)
+	snapshotCmd.AddCommand(snapshotListCmd)
+	RootCmd.AddCommand(snapshotCmd)
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var (
+	statsJSON     bool
+	statsWatch    bool
+	statsInterval time.Duration
+)
+
+func formatBytes(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func printStats(stats *vm.Stats) error {
+	// Each sample is printed on its own line when watching
+	if statsJSON || jsonOutput() {
+		return json.NewEncoder(os.Stdout).Encode(stats)
+	}
+
+	fmt.Printf("CPU:     %.1f%% user, %.1f%% kernel\n", stats.CPUUser, stats.CPUKernel)
+	fmt.Printf("RAM:     %s used of %s\n", formatBytes(stats.RAMTotal-stats.RAMFree), formatBytes(stats.RAMTotal))
+	fmt.Printf("Disk:    %s/s read, %s/s written\n", formatBytes(stats.DiskRead), formatBytes(stats.DiskWrite))
+	fmt.Printf("Network: %s/s received, %s/s sent\n", formatBytes(stats.NetRx), formatBytes(stats.NetTx))
+	return nil
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Print the resource usage of the guest",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		vm, err := vm.FindVM(vmConfig)
+		if err != nil {
+			return err
+		}
+
+		if statsInterval < time.Second {
+			return fmt.Errorf("Invalid interval %s, must be at least 1s", statsInterval)
+		}
+
+		if err := vm.EnableStats(statsInterval); err != nil {
+			return fmt.Errorf("Failed to enable statistics: %s", err.Error())
+		}
+
+		// The first sample is the baseline of the disk throughputs
+		if _, err := vm.Stats(); err != nil {
+			return fmt.Errorf("Failed to get statistics: %s", err.Error())
+		}
+
+		for {
+			time.Sleep(statsInterval)
+
+			stats, err := vm.Stats()
+			if err != nil {
+				return fmt.Errorf("Failed to get statistics: %s", err.Error())
+			}
+
+			if err := printStats(stats); err != nil {
+				return err
+			}
+
+			if !statsWatch {
+				return nil
+			}
+
+			if !statsJSON && !jsonOutput() {
+				fmt.Println()
+			}
+		}
+	},
+}
+
+func init() {
+	statsCmd.Flags().BoolVar(&statsJSON, "json", false, "print the statistics as JSON")
+	statsCmd.Flags().BoolVarP(&statsWatch, "watch", "w", false, "keep printing the statistics")
+	statsCmd.Flags().DurationVar(&statsInterval, "interval", 2*time.Second, "sampling interval")
+	RootCmd.AddCommand(statsCmd)
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var statusJSON bool
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Print the status of the machine",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		vm, err := vm.FindVM(vmConfig)
+		if err != nil {
+			return err
+		}
+
+		status, err := vm.Status()
+		if err != nil {
+			return fmt.Errorf("Failed to get status: %s", err.Error())
+		}
+
+		if statusJSON || jsonOutput() {
+			return printJSON(status)
+		}
+
+		fmt.Printf("Name:   %s\n", status.Name)
+		fmt.Printf("State:  %s\n", status.State)
+		if status.Uptime > 0 {
+			fmt.Printf("Uptime: %s\n", time.Duration(status.Uptime)*time.Second)
+		}
+		fmt.Printf("CPUs:   %d\n", status.CPUs)
+		fmt.Printf("RAM:    %d MB\n", status.RAM)
+		if status.IP != "" {
+			fmt.Printf("IP:     %s\n", status.IP)
+		}
+		fmt.Printf("Host key: %s (%s)\n", status.HostKey.Name, status.HostKey.Code)
+		if status.Keyboard != "" {
+			fmt.Printf("Keyboard: %s\n", status.Keyboard)
+		}
+
+		if len(status.Media) > 0 {
+			fmt.Println("Media:")
+			for _, medium := range status.Media {
+				fmt.Printf("  %s %d:%d %s %s\n", medium.Controller, medium.Port, medium.Device, medium.Type, medium.Location)
+			}
+		}
+
+		if len(status.Properties) > 0 {
+			fmt.Println("Guest properties:")
+			for _, prop := range status.Properties {
+				fmt.Printf("  %s = %s\n", prop.Name, prop.Value)
+			}
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "print the status as JSON")
+	RootCmd.AddCommand(statusCmd)
+}
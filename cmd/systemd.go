@@ -0,0 +1,247 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var (
+	systemdUser     bool
+	systemdWatchdog time.Duration
+)
+
+// sdNotify sends a state change to systemd when run as a Type=notify unit
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval systemd expects watchdog pings at,
+// or zero if the watchdog is not enabled for this process
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings the systemd watchdog as long as the event loop of the
+// machine keeps iterating, so that systemd restarts a stuck vlaunch
+func runWatchdog(ctx context.Context, machine *vm.VirtualMachine) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if heartbeat := machine.Heartbeat(); !heartbeat.IsZero() && time.Since(heartbeat) > interval/2 {
+				slog.Warn("Event loop is stuck, not pinging the watchdog", "since", heartbeat)
+				continue
+			}
+
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Error("Failed to ping the watchdog", "error", err)
+			}
+		}
+	}
+}
+
+var unitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=Vlaunch {{.Name}} virtual machine
+After=network.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart={{.ExecStart}}
+Restart=on-failure
+{{- if .Watchdog}}
+WatchdogSec={{.Watchdog}}
+{{- end}}
+TimeoutStopSec={{.StopTimeout}}
+KillMode=mixed
+
+[Install]
+WantedBy={{.WantedBy}}
+`))
+
+// systemdQuote quotes an argument of a unit command line
+func systemdQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\%$") {
+		return arg
+	}
+	arg = strings.Replace(arg, `\`, `\\`, -1)
+	arg = strings.Replace(arg, `"`, `\"`, -1)
+	arg = strings.Replace(arg, "%", "%%", -1)
+	arg = strings.Replace(arg, "$", "$$", -1)
+	return `"` + arg + `"`
+}
+
+// unitPath returns the path of the unit file of the machine
+func unitPath(user bool) (string, error) {
+	name := serviceName() + ".service"
+	if !user {
+		return filepath.Join("/etc/systemd/system", name), nil
+	}
+
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		configDir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configDir, "systemd", "user", name), nil
+}
+
+func systemctl(user bool, args ...string) error {
+	if user {
+		args = append([]string{"--user"}, args...)
+	}
+
+	output, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s failed: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+var systemdCmd = &cobra.Command{
+	Use:   "systemd",
+	Short: "Manage the machine as a systemd service",
+}
+
+var systemdInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Generate and enable a systemd unit running the machine",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if runtime.GOOS != "linux" {
+			return errors.New("systemd is only available on Linux")
+		}
+
+		executable, err := os.Executable()
+		if err != nil {
+			return err
+		}
+
+		command := []string{systemdQuote(executable)}
+		for _, arg := range append(instanceArgs(), "--headless") {
+			command = append(command, systemdQuote(arg))
+		}
+
+		wantedBy := "multi-user.target"
+		if systemdUser {
+			wantedBy = "default.target"
+		}
+
+		var unit bytes.Buffer
+		err = unitTemplate.Execute(&unit, map[string]interface{}{
+			"Name":        vmConfig.GetString("machine_name"),
+			"ExecStart":   strings.Join(command, " "),
+			"Watchdog":    int(systemdWatchdog.Seconds()),
+			"StopTimeout": int((vmConfig.GetDuration("shutdown_handshake.timeout") + vmConfig.GetDuration("timeouts.shutdown") + 30*time.Second).Seconds()),
+			"WantedBy":    wantedBy,
+		})
+		if err != nil {
+			return err
+		}
+
+		path, err := unitPath(systemdUser)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(path, unit.Bytes(), 0644); err != nil {
+			return fmt.Errorf("Failed to write unit: %s", err.Error())
+		}
+
+		if err := systemctl(systemdUser, "daemon-reload"); err != nil {
+			return err
+		}
+
+		if err := systemctl(systemdUser, "enable", filepath.Base(path)); err != nil {
+			return err
+		}
+
+		start := "systemctl start "
+		if systemdUser {
+			start = "systemctl --user start "
+		}
+		fmt.Printf("Unit %s installed, start it with '%s%s'\n", path, start, filepath.Base(path))
+		return nil
+	},
+}
+
+var systemdUninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Disable and remove the systemd unit of the machine",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := unitPath(systemdUser)
+		if err != nil {
+			return err
+		}
+
+		if err := systemctl(systemdUser, "disable", filepath.Base(path)); err != nil {
+			slog.Warn("Failed to disable unit", "error", err)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("Failed to remove unit: %s", err.Error())
+		}
+
+		return systemctl(systemdUser, "daemon-reload")
+	},
+}
+
+func init() {
+	systemdCmd.PersistentFlags().BoolVar(&systemdUser, "user", false, "manage a unit of the user service manager")
+	systemdInstallCmd.Flags().DurationVar(&systemdWatchdog, "watchdog", 30*time.Second, "restart vlaunch if its event loop is stuck for this long, 0 to disable")
+
+	systemdCmd.AddCommand(systemdInstallCmd)
+	systemdCmd.AddCommand(systemdUninstallCmd)
+	RootCmd.AddCommand(systemdCmd)
+}
@@ -0,0 +1,38 @@
+// +build tray
+
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/lebauce/vlaunch/gui"
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/therecipe/qt/widgets"
+)
+
+// startTray shows an icon in the system tray reporting the state of the
+// machine, with a menu to control it
+func startTray(app *widgets.QApplication, machine *vm.VirtualMachine) {
+	tray, err := gui.NewTray(app, vmConfig.GetString("machine_name"), gui.TrayActions{
+		Pause:    machine.Pause,
+		Resume:   machine.Resume,
+		Shutdown: machine.Stop,
+		Screenshot: func() (string, error) {
+			path := filepath.Join(vmConfig.GetString("data_path"), fmt.Sprintf("screenshot-%s.png", time.Now().Format("20060102-150405")))
+			return path, machine.Screenshot(path)
+		},
+	})
+	if err != nil {
+		slog.Warn("Failed to create tray icon", "error", err)
+		return
+	}
+
+	go func() {
+		for event := range machine.Subscribe(vm.StateChangedEvent) {
+			tray.SetState(vm.StateName(event.(vm.StateChanged).State))
+		}
+	}()
+}
@@ -0,0 +1,12 @@
+// +build !tray
+
+package cmd
+
+import (
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/therecipe/qt/widgets"
+)
+
+// startTray does nothing, vlaunch is built without the tray icon unless
+// the 'tray' build tag is given
+func startTray(app *widgets.QApplication, machine *vm.VirtualMachine) {}
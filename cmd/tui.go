@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+var tuiInterval time.Duration
+
+const (
+	ansiHome       = "\x1b[H"
+	ansiClearLine  = "\x1b[K"
+	ansiClearBelow = "\x1b[J"
+	ansiBold       = "\x1b[1m"
+	ansiReverse    = "\x1b[7m"
+	ansiReset      = "\x1b[0m"
+	ansiHideCursor = "\x1b[?25l"
+	ansiShowCursor = "\x1b[?25h"
+	ansiAltScreen  = "\x1b[?1049h"
+	ansiMainScreen = "\x1b[?1049l"
+)
+
+// maxTailSize bounds how much of the end of the log is read on each refresh
+const maxTailSize = 64 * 1024
+
+// dashboard is what the terminal UI displays, refreshed every interval
+type dashboard struct {
+	machine *vm.VirtualMachine
+	status  *vm.Status
+	stats   *vm.Stats
+	err     error
+	message string
+}
+
+func (d *dashboard) refresh() {
+	d.status, d.err = d.machine.Status()
+	if d.err != nil {
+		return
+	}
+
+	// Statistics are only collected while the machine runs
+	if stats, err := d.machine.Stats(); err == nil {
+		d.stats = stats
+	} else {
+		d.stats = nil
+	}
+}
+
+// tailFile returns the last lines of a file, at most count of them
+func tailFile(filename string, count int) ([]string, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := fi.Size() - maxTailSize
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 4096), maxTailSize)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	// The first line is likely truncated when not reading from the start
+	if offset > 0 && len(lines) > 0 {
+		lines = lines[1:]
+	}
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+	return lines, scanner.Err()
+}
+
+// fitLine cuts a line to the width of the terminal
+func fitLine(line string, width int) string {
+	line = strings.Replace(line, "\t", "    ", -1)
+	if runes := []rune(line); len(runes) > width {
+		return string(runes[:width])
+	}
+	return line
+}
+
+func (d *dashboard) render(w io.Writer, width, height int) {
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	name := vmConfig.GetString("machine_name")
+	if d.err != nil {
+		add("%s: %s", name, d.err.Error())
+	} else {
+		header := fmt.Sprintf("%s - %s", d.status.Name, d.status.State)
+		if d.status.Uptime > 0 {
+			header += fmt.Sprintf(" - up %s", time.Duration(d.status.Uptime)*time.Second)
+		}
+		if d.status.IP != "" {
+			header += " - " + d.status.IP
+		}
+		add("%s", header)
+		add("%d CPUs, %d MB of RAM", d.status.CPUs, d.status.RAM)
+		add("")
+
+		if stats := d.stats; stats != nil {
+			add("CPU:     %.1f%% user, %.1f%% kernel", stats.CPUUser, stats.CPUKernel)
+			add("RAM:     %s used of %s", formatBytes(stats.RAMTotal-stats.RAMFree), formatBytes(stats.RAMTotal))
+			add("Disk:    %s/s read, %s/s written", formatBytes(stats.DiskRead), formatBytes(stats.DiskWrite))
+			add("Network: %s/s received, %s/s sent", formatBytes(stats.NetRx), formatBytes(stats.NetTx))
+		} else {
+			add("No statistics available")
+		}
+		add("")
+
+		// Guest properties take at most a third of the screen, the log
+		// gets what is left
+		add("Guest properties:")
+		properties := d.status.Properties
+		if max := height / 3; len(properties) > max {
+			properties = properties[:max]
+		}
+		for _, prop := range properties {
+			add("  %s = %s", prop.Name, prop.Value)
+		}
+		add("")
+	}
+
+	// The last line is kept for the key bindings
+	logFile := path.Join(vmConfig.GetString("data_path"), "vlaunch.log")
+	add("Log %s:", logFile)
+	tail, err := tailFile(logFile, height-len(lines)-1)
+	if err != nil && !os.IsNotExist(err) {
+		add("  %s", err.Error())
+	}
+	for _, line := range tail {
+		add("  %s", line)
+	}
+
+	var screen strings.Builder
+	screen.WriteString(ansiHome)
+	for i, line := range lines {
+		if i >= height-1 {
+			break
+		}
+		line = fitLine(line, width)
+		if i == 0 {
+			line = ansiBold + line + ansiReset
+		}
+		screen.WriteString(line + ansiClearLine + "\r\n")
+	}
+	screen.WriteString(ansiClearBelow)
+
+	footer := "p pause/resume  s ACPI shutdown  n snapshot  q quit"
+	if d.message != "" {
+		footer += "  | " + d.message
+	}
+	screen.WriteString(ansiReverse + fitLine(footer, width) + ansiReset)
+	io.WriteString(w, screen.String())
+}
+
+// readKeys forwards the key presses of the terminal until it is closed
+func readKeys(input io.Reader, keys chan<- byte) {
+	buffer := make([]byte, 16)
+	for {
+		n, err := input.Read(buffer)
+		for _, key := range buffer[:n] {
+			keys <- key
+		}
+		if err != nil {
+			close(keys)
+			return
+		}
+	}
+}
+
+var tuiCmd = &cobra.Command{
+	Use:   "tui",
+	Short: "Show a live dashboard of the machine in the terminal",
+	Long: `Show the state, the resource usage and the guest properties of the
+machine along with the tail of the vlaunch log, refreshed continuously.
+Pausing and shutting down go through the running vlaunch instance.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+			return errors.New("The dashboard requires a terminal")
+		}
+
+		if tuiInterval < time.Second {
+			return fmt.Errorf("Invalid interval %s, must be at least 1s", tuiInterval)
+		}
+
+		machine, err := vm.FindVM(vmConfig)
+		if err != nil {
+			return err
+		}
+
+		// Statistics are not available until the machine is running,
+		// the dashboard just goes without them
+		if err := machine.EnableStats(tuiInterval); err == nil {
+			machine.Stats()
+		}
+
+		restore, err := makeRaw(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("Failed to configure the terminal: %s", err.Error())
+		}
+		defer restore()
+
+		fmt.Print(ansiAltScreen + ansiHideCursor)
+		defer fmt.Print(ansiShowCursor + ansiMainScreen)
+
+		interrupted := make(chan os.Signal, 1)
+		signal.Notify(interrupted, os.Interrupt)
+		defer signal.Stop(interrupted)
+
+		keys := make(chan byte)
+		go readKeys(os.Stdin, keys)
+
+		// Actions run in the background so that the dashboard keeps updating
+		results := make(chan string, 1)
+		run := func(d *dashboard, description string, action func() error) {
+			d.message = description + "..."
+			go func() {
+				if err := action(); err != nil {
+					results <- fmt.Sprintf("%s failed: %s", description, err.Error())
+				} else {
+					results <- description + " done"
+				}
+			}()
+		}
+
+		d := &dashboard{machine: machine}
+		ticker := time.NewTicker(tuiInterval)
+		defer ticker.Stop()
+
+		for {
+			width, height := terminalSize(os.Stdout)
+			d.render(os.Stdout, width, height)
+
+			select {
+			case <-ticker.C:
+				d.refresh()
+			case <-interrupted:
+				return nil
+			case d.message = <-results:
+				d.refresh()
+			case key, ok := <-keys:
+				if !ok {
+					return nil
+				}
+
+				switch key {
+				case 'q', 'Q', 3:
+					return nil
+				case 'p', 'P':
+					if d.status != nil && d.status.State == "paused" {
+						run(d, "Resuming", func() error { return callControl("resume") })
+					} else {
+						run(d, "Pausing", func() error { return callControl("pause") })
+					}
+				case 's', 'S':
+					run(d, "Shutting down", func() error { return callControl("stop") })
+				case 'n', 'N':
+					name := time.Now().Format("tui-20060102-150405")
+					run(d, "Taking snapshot "+name, func() error {
+						return machine.Snapshot(name, "Taken from the vlaunch dashboard")
+					})
+				}
+			}
+		}
+	},
+}
+
+func init() {
+	tuiCmd.Flags().DurationVarP(&tuiInterval, "interval", "i", 2*time.Second, "Refresh interval")
+	RootCmd.AddCommand(tuiCmd)
+}
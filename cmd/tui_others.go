@@ -0,0 +1,57 @@
+// +build !windows
+
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+func stty(file *os.File, args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = file
+	output, err := cmd.Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+// makeRaw disables the line buffering and the echo of the terminal, signals
+// are kept so that Ctrl+C still works. It returns a function restoring the
+// previous settings
+func makeRaw(file *os.File) (func() error, error) {
+	state, err := stty(file, "-g")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := stty(file, "-icanon", "-echo", "min", "1"); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		_, err := stty(file, state)
+		return err
+	}, nil
+}
+
+// terminalSize returns the number of columns and rows of the terminal,
+// assuming 80x24 when it can not be queried
+func terminalSize(file *os.File) (int, int) {
+	output, err := stty(file, "size")
+	if err != nil {
+		return 80, 24
+	}
+
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return 80, 24
+	}
+
+	rows, err1 := strconv.Atoi(fields[0])
+	columns, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil || rows <= 0 || columns <= 0 {
+		return 80, 24
+	}
+	return columns, rows
+}
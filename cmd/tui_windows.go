@@ -0,0 +1,100 @@
+// +build windows
+
+package cmd
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	enableProcessedInput            = 0x1
+	enableLineInput                 = 0x2
+	enableEchoInput                 = 0x4
+	enableVirtualTerminalProcessing = 0x4
+)
+
+var (
+	kernel32                       = windows.NewLazySystemDLL("kernel32.dll")
+	procGetConsoleMode             = kernel32.NewProc("GetConsoleMode")
+	procSetConsoleMode             = kernel32.NewProc("SetConsoleMode")
+	procGetConsoleScreenBufferInfo = kernel32.NewProc("GetConsoleScreenBufferInfo")
+)
+
+type coord struct {
+	x, y int16
+}
+
+type smallRect struct {
+	left, top, right, bottom int16
+}
+
+type consoleScreenBufferInfo struct {
+	size              coord
+	cursorPosition    coord
+	attributes        uint16
+	window            smallRect
+	maximumWindowSize coord
+}
+
+func getConsoleMode(file *os.File) (uint32, error) {
+	var mode uint32
+	if r, _, err := procGetConsoleMode.Call(file.Fd(), uintptr(unsafe.Pointer(&mode))); r == 0 {
+		return 0, err
+	}
+	return mode, nil
+}
+
+func setConsoleMode(file *os.File, mode uint32) error {
+	if r, _, err := procSetConsoleMode.Call(file.Fd(), uintptr(mode)); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// makeRaw disables the line buffering and the echo of the console and enables
+// the escape sequences on the standard output. It returns a function
+// restoring the previous modes
+func makeRaw(file *os.File) (func() error, error) {
+	inputMode, err := getConsoleMode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	outputMode, err := getConsoleMode(os.Stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setConsoleMode(file, (inputMode&^(enableLineInput|enableEchoInput))|enableProcessedInput); err != nil {
+		return nil, err
+	}
+
+	if err := setConsoleMode(os.Stdout, outputMode|enableVirtualTerminalProcessing); err != nil {
+		setConsoleMode(file, inputMode)
+		return nil, err
+	}
+
+	return func() error {
+		setConsoleMode(os.Stdout, outputMode)
+		return setConsoleMode(file, inputMode)
+	}, nil
+}
+
+// terminalSize returns the number of columns and rows of the console window,
+// assuming 80x25 when it can not be queried
+func terminalSize(file *os.File) (int, int) {
+	var info consoleScreenBufferInfo
+	if r, _, _ := procGetConsoleScreenBufferInfo.Call(file.Fd(), uintptr(unsafe.Pointer(&info))); r == 0 {
+		return 80, 25
+	}
+
+	columns := int(info.window.right-info.window.left) + 1
+	rows := int(info.window.bottom-info.window.top) + 1
+	if columns <= 0 || rows <= 0 {
+		return 80, 25
+	}
+	return columns, rows
+}
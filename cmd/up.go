@@ -0,0 +1,281 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/lebauce/vlaunch/config"
+	"github.com/lebauce/vlaunch/control"
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// upMachine is the machine of a profile started by vlaunch up
+type upMachine struct {
+	profile string
+	cfg     *viper.Viper
+	machine *vm.VirtualMachine
+	deps    []*upMachine
+	// started is closed once the machine runs, done once it stopped or
+	// failed to start
+	started chan struct{}
+	done    chan struct{}
+	err     error
+}
+
+// orderProfiles returns the profiles and the ones they depend on, each
+// after its depends_on
+func orderProfiles(names []string, configs map[string]*viper.Viper) ([]string, error) {
+	var order []string
+	visited := make(map[string]bool)
+	visiting := make(map[string]bool)
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if visited[name] {
+			return nil
+		}
+
+		cfg, found := configs[name]
+		if !found {
+			return fmt.Errorf("Unknown profile '%s'", name)
+		}
+
+		path = append(path, name)
+		if visiting[name] {
+			return fmt.Errorf("Circular dependency between profiles: %s", strings.Join(path, " -> "))
+		}
+		visiting[name] = true
+
+		for _, dep := range cfg.GetStringSlice("depends_on") {
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+
+		visited[name] = true
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// up creates and starts the machine once the ones it depends on run, and
+// runs it until it stops
+func (u *upMachine) up(ctx context.Context) (err error) {
+	defer close(u.done)
+	log := slog.With("profile", u.profile)
+
+	for _, dep := range u.deps {
+		select {
+		case <-dep.started:
+		case <-dep.done:
+			return fmt.Errorf("Profile %s did not start", dep.profile)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	dataPath := u.cfg.GetString("data_path")
+	lock, err := control.AcquireLock(dataPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	machine, existing, err := getVM(ctx, u.cfg, u.cfg.GetBool("save_state"))
+	if err != nil {
+		return fmt.Errorf("Failed to create vm: %s", err.Error())
+	}
+	u.machine = machine
+
+	if !existing {
+		if err := machine.Preflight(); err != nil {
+			return err
+		}
+
+		log.Info("Creating VM")
+		if err := machine.Create(ctx); err != nil {
+			return fmt.Errorf("Failed to create vm: %s", err.Error())
+		}
+	}
+
+	if err := machine.VerifyDisks(); err != nil {
+		return err
+	}
+
+	log.Info("Starting VM")
+	if err := machine.Start(ctx); err != nil {
+		return fmt.Errorf("Failed to start vm: %s", err.Error())
+	}
+
+	if server, err := control.NewServer(control.SocketPath(dataPath)); err != nil {
+		log.Warn("Failed to create control socket", "error", err)
+	} else {
+		defer server.Close()
+		registerControlHandlers(server, machine)
+		go server.Serve()
+	}
+
+	states := machine.Subscribe(vm.StateChangedEvent)
+	go func() {
+		for event := range states {
+			log.Info("Machine state changed", "state", vm.StateName(event.(vm.StateChanged).State))
+		}
+	}()
+
+	close(u.started)
+	return machine.Run(ctx)
+}
+
+// release deletes the machine unless it is kept or was saved to be resumed
+func (u *upMachine) release(ctx context.Context) error {
+	if u.machine == nil || keepVM || u.machine.IsImported() {
+		return nil
+	}
+
+	if u.cfg.GetBool("save_state") {
+		if saved, err := u.machine.HasSavedState(); err == nil && saved {
+			return nil
+		}
+	}
+	return u.machine.Release(ctx)
+}
+
+var upCmd = &cobra.Command{
+	Use:   "up [profile...]",
+	Short: "Start the machines of several profiles, all of them by default, and shut them down together",
+	Long:  "Start the machines of several profiles concurrently, a machine being started once the ones of the profiles listed in its depends_on run. On exit, the machines are shut down in the reverse order.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		names := args
+		if len(names) == 0 {
+			names = config.Profiles()
+		}
+
+		if len(names) == 0 {
+			return errors.New("No profile defined in the vms section of the configuration")
+		}
+
+		configs := make(map[string]*viper.Viper)
+		for _, name := range config.Profiles() {
+			cfg, err := config.GetProfile(name)
+			if err != nil {
+				return err
+			}
+			configs[name] = cfg
+		}
+
+		order, err := orderProfiles(names, configs)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range order {
+			if err := config.Validate(configs[name]); err != nil {
+				return fmt.Errorf("Invalid profile %s: %s", name, err.Error())
+			}
+		}
+
+		machines := make(map[string]*upMachine)
+		var ups []*upMachine
+		for _, name := range order {
+			u := &upMachine{
+				profile: name,
+				cfg:     configs[name],
+				started: make(chan struct{}),
+				done:    make(chan struct{}),
+			}
+			for _, dep := range configs[name].GetStringSlice("depends_on") {
+				u.deps = append(u.deps, machines[dep])
+			}
+			machines[name] = u
+			ups = append(ups, u)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		for _, u := range ups {
+			go func(u *upMachine) {
+				if u.err = u.up(ctx); u.err != nil {
+					slog.Error("Profile failed", "profile", u.profile, "error", u.err)
+				}
+			}(u)
+		}
+
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+
+		all := make(chan struct{})
+		go func() {
+			for _, u := range ups {
+				<-u.done
+			}
+			close(all)
+		}()
+
+		select {
+		case <-all:
+		case sig := <-signals:
+			slog.Info("Received signal", "signal", sig)
+
+			// The machines that did not start yet must not start anymore
+			cancel()
+
+			// Dependents are shut down before the machines they depend on
+			for i := len(ups) - 1; i >= 0; i-- {
+				u := ups[i]
+				select {
+				case <-u.started:
+				default:
+					continue
+				}
+
+				select {
+				case <-u.done:
+				default:
+					slog.Info("Shutting down profile", "profile", u.profile)
+					shutDownVM(u.machine, u.cfg.GetBool("save_state"), signals)
+					<-u.done
+				}
+			}
+			<-all
+		}
+
+		var failed []string
+		for i := len(ups) - 1; i >= 0; i-- {
+			u := ups[i]
+			if err := u.release(context.Background()); err != nil {
+				slog.Error("Failed to release vm", "profile", u.profile, "error", err)
+			}
+			if u.err != nil && u.err != context.Canceled {
+				failed = append(failed, u.profile)
+			}
+		}
+
+		if len(failed) > 0 {
+			return fmt.Errorf("Profiles failed: %s", strings.Join(failed, ", "))
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(upCmd)
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/lebauce/vlaunch/control"
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/cobra"
+)
+
+// registerWatchHandler streams the guest property changes matching the
+// optional pattern given as argument, all of them without one
+func registerWatchHandler(server *control.Server, machine *vm.VirtualMachine) {
+	server.HandleStream("watch", func(ctx context.Context, args []string, send func(interface{}) error) error {
+		// An empty pattern matches all the properties
+		pattern := ""
+		if len(args) > 0 {
+			pattern = args[0]
+		}
+
+		events, err := machine.SubscribeProperties(pattern)
+		if err != nil {
+			return err
+		}
+		defer machine.Unsubscribe(events)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case event, ok := <-events:
+				if !ok {
+					return nil
+				}
+
+				if err := send(vm.GuestProperty(event.(vm.GuestPropertyChanged))); err != nil {
+					return err
+				}
+			}
+		}
+	})
+}
+
+var watchCmd = &cobra.Command{
+	Use:   "watch [pattern]",
+	Short: "Stream the guest property changes of the running machine as JSON lines",
+	Long: `Stream the guest property changes of the running machine, one JSON
+object per line. The pattern is matched against the property names, '*'
+matches any sequence, including '/', and '|' separates alternatives, e.g.
+'/VirtualBox/GuestInfo/Net/*/V4/IP|/vlaunch/*'.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return fmt.Errorf("Expected at most one pattern, got %d", len(args))
+		}
+
+		return control.Stream(control.SocketPath(vmConfig.GetString("data_path")), "watch", func(result json.RawMessage) error {
+			_, err := fmt.Println(string(result))
+			return err
+		}, args...)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(watchCmd)
+}
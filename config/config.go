@@ -1,56 +1,317 @@
 package config
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"os"
 	"path"
+	"reflect"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/kardianos/osext"
+	"github.com/lebauce/vlaunch/logging"
 	"github.com/spf13/viper"
 )
 
-var cfg *viper.Viper
+var logger = logging.Module("config")
 
-func InitConfig(cfgFiles []string) error {
-	cfg = viper.New()
-	cfg.SetConfigType("yaml")
+var (
+	// loadedConfig is replaced as a whole when the configuration is reloaded,
+	// the previous one is still used by the goroutines that hold it
+	loadedConfig atomic.Pointer[viper.Viper]
+	loadedFiles  []string
+)
+
+// New returns a configuration holding the default value of every key, for
+// the programs embedding vlaunch without its configuration files
+func New() *viper.Viper {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	SetDefaults(v)
+	return v
+}
+
+// SetDefaults sets the default value of every key of the configuration
+func SetDefaults(cfg *viper.Viper) {
+	cfg.SetDefault("machine_name", "ufo")
+	cfg.SetDefault("hypervisor", "virtualbox")
+	cfg.SetDefault("qemu.binary", "qemu-system-x86_64")
+	cfg.SetDefault("qemu.efi_firmware", "/usr/share/ovmf/OVMF.fd")
+	cfg.SetDefault("hyperv.switch", "Default Switch")
 	cfg.SetDefault("distro_type", "Linux_64")
+	cfg.SetDefault("firmware", "bios")
+	cfg.SetDefault("serial.mode", "disabled")
+	cfg.SetDefault("recording.width", 1024)
+	cfg.SetDefault("recording.height", 768)
+	cfg.SetDefault("recording.fps", 25)
 	cfg.SetDefault("disk_type", "raw")
+	cfg.SetDefault("disk_mode", "normal")
+	cfg.SetDefault("storage.controller", "ide")
+	cfg.SetDefault("audio.enabled", true)
+	cfg.SetDefault("audio.controller", "hda")
+	cfg.SetDefault("audio.output", true)
 	cfg.SetDefault("gui", true)
+	cfg.SetDefault("frontend", "gui")
+	cfg.SetDefault("vrde.ports", "3389")
+	cfg.SetDefault("vrde.auth_type", "null")
 	cfg.SetDefault("menubar", false)
+	cfg.SetDefault("clipboard_mode", "bidirectional")
+	cfg.SetDefault("dnd_mode", "bidirectional")
+	cfg.SetDefault("cpu_execution_cap", 100)
+	cfg.SetDefault("display.vram", 32)
+	cfg.SetDefault("display.accelerate_3d", true)
+	cfg.SetDefault("display.monitors", 1)
+	cfg.SetDefault("display.mode", "window")
+	cfg.SetDefault("virtualization.paravirt_provider", "default")
+	cfg.SetDefault("virtualization.nested_paging", true)
+	cfg.SetDefault("virtualization.large_pages", true)
+	cfg.SetDefault("guest_additions.check", true)
+	cfg.SetDefault("guest_ip.timeout", "5m")
+	cfg.SetDefault("timeouts.launch", "50s")
+	cfg.SetDefault("timeouts.shutdown", "30s")
+	cfg.SetDefault("timeouts.delete", "5m")
+	cfg.SetDefault("events.polling_interval", "250ms")
+	cfg.SetDefault("events.failure_timeout", "30s")
+	cfg.SetDefault("log.max_size", 10)
+	cfg.SetDefault("log.max_age", "168h")
+	cfg.SetDefault("log.max_files", 5)
+	cfg.SetDefault("api.address", "127.0.0.1:7480")
+	cfg.SetDefault("reload_interval", "5s")
+	cfg.SetDefault("power.pause_on_sleep", true)
+	cfg.SetDefault("power.stop_on_shutdown", true)
+	cfg.SetDefault("power.on_battery", "none")
+	cfg.SetDefault("power.battery_cpu_cap", 50)
+	cfg.SetDefault("proxy.enabled", true)
+	cfg.SetDefault("time.rtc", "auto")
+	cfg.SetDefault("time.sync", true)
+	cfg.SetDefault("health.action", "none")
+	cfg.SetDefault("health.timeout", "60s")
+	cfg.SetDefault("usb.hotplug", "none")
+	cfg.SetDefault("preflight.enabled", true)
+	cfg.SetDefault("guest_requests.enabled", true)
+	cfg.SetDefault("extra_data.defaults", true)
+	cfg.SetDefault("teleporter.port", 6000)
+	cfg.SetDefault("shutdown_handshake.enabled", true)
+	cfg.SetDefault("shutdown_handshake.timeout", "10s")
+	cfg.SetDefault("device_removal.pause", true)
+	cfg.SetDefault("integrity.enabled", false)
+	cfg.SetDefault("integrity.on_failure", "ask")
+	cfg.SetDefault("journal.enabled", true)
+	cfg.SetDefault("journal.max_size", 10)
+	cfg.SetDefault("idle.action", "none")
+	cfg.SetDefault("idle.timeout", "30m")
+	cfg.SetDefault("idle.properties", []string{"/VirtualBox/GuestInfo/Users/*/UsageState", "/vlaunch/Guest/Activity"})
+}
+
+func InitConfig(cfgFiles []string) error {
+	loadedFiles = cfgFiles
+	cfg, err := load(cfgFiles)
+	loadedConfig.Store(cfg)
+	return err
+}
+
+// load reads the configuration files on top of the defaults and applies the
+// environment overrides
+func load(cfgFiles []string) (*viper.Viper, error) {
+	cfg := New()
 
 	for _, path := range cfgFiles {
 		configFile, err := os.Open(path)
 		if err != nil {
-			return err
+			return cfg, err
 		}
-		if err := cfg.MergeConfig(configFile); err != nil {
-			return err
+		err = cfg.MergeConfig(configFile)
+		configFile.Close()
+		if err != nil {
+			return cfg, err
 		}
 	}
 
-	replacer := strings.NewReplacer(".", "_", "-", "_")
-	cfg.SetEnvPrefix("VLAUNCH")
-	cfg.SetEnvKeyReplacer(replacer)
-	cfg.AutomaticEnv()
+	applyEnvOverrides(cfg)
 
 	dataPath := cfg.GetString("data_path")
 	if dataPath == "" {
 		if executableFolder, err := osext.ExecutableFolder(); err == nil {
 			dataPath = path.Join(executableFolder, ".vlaunch")
-			if err := os.MkdirAll(dataPath, 0755); err != nil {
-				return err
+
+			// An app bundle must not be modified, its signature would
+			// no longer match
+			if strings.HasSuffix(executableFolder, ".app/Contents/MacOS") {
+				if home, err := os.UserHomeDir(); err == nil {
+					dataPath = path.Join(home, "Library", "Application Support", "vlaunch")
+				}
 			}
 			cfg.Set("data_path", dataPath)
 		}
 	}
 
-	log.Printf("Using %s as data path\n", dataPath)
+	if dataPath != "" {
+		if err := os.MkdirAll(dataPath, 0755); err != nil {
+			return cfg, err
+		}
+	}
+
+	logger.Info("Using data path", "path", dataPath)
 	os.Setenv("VBOX_USER_HOME", dataPath)
-	return nil
+	return cfg, nil
+}
+
+func modTimes(files []string) []time.Time {
+	times := make([]time.Time, len(files))
+	for i, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			times[i] = fi.ModTime()
+		}
+	}
+	return times
+}
+
+// Watch polls the loaded configuration files and reloads the configuration
+// when one of them is modified, calling onChange once it is reloaded
+func Watch(ctx context.Context, interval time.Duration, onChange func()) {
+	files := loadedFiles
+	previous := modTimes(files)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := modTimes(files)
+		if reflect.DeepEqual(current, previous) {
+			continue
+		}
+		previous = current
+
+		logger.Info("Configuration changed, reloading")
+		cfg, err := load(files)
+		if err != nil {
+			logger.Error("Failed to reload configuration", "error", err)
+			continue
+		}
+		loadedConfig.Store(cfg)
+		onChange()
+	}
+}
+
+// envName returns the environment variable overriding a key, for instance
+// VLAUNCH_STORAGE_CONTROLLER for storage.controller
+func envName(key string) string {
+	return "VLAUNCH_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// applyEnvOverrides sets the keys for which a VLAUNCH_* environment
+// variable is defined, these take precedence over the configuration files
+func applyEnvOverrides(v *viper.Viper) {
+	for _, key := range knownKeys {
+		if strings.Contains(key, "*") {
+			continue
+		}
+
+		value, found := os.LookupEnv(envName(key))
+		if !found || isStructuredKey(key) {
+			continue
+		}
+
+		if isListKey(key) {
+			v.Set(key, splitList(value))
+		} else {
+			v.Set(key, value)
+		}
+	}
+}
+
+func isListKey(key string) bool {
+	for _, listKey := range listKeys {
+		if key == listKey {
+			return true
+		}
+	}
+	return false
+}
+
+func isStructuredKey(key string) bool {
+	for _, structuredKey := range structuredKeys {
+		if key == structuredKey {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits comma separated values, ignoring the empty ones
+func splitList(value string) []string {
+	values := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
 }
 
 func GetConfig() *viper.Viper {
-	return cfg
+	return loadedConfig.Load()
+}
+
+// Profiles returns the names of the VM profiles, sorted
+func Profiles() []string {
+	cfg := GetConfig()
+	var names []string
+	for name := range cfg.GetStringMap("vms") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetProfile returns the configuration of a VM profile, made of the global
+// configuration overridden by the keys of the 'vms.<name>' section
+func GetProfile(name string) (*viper.Viper, error) {
+	cfg := GetConfig()
+	if name == "" {
+		return cfg, nil
+	}
+
+	profileCfg := cfg.Sub("vms." + name)
+	if profileCfg == nil {
+		return nil, fmt.Errorf("Unknown profile '%s'", name)
+	}
+
+	profile := viper.New()
+	for _, key := range cfg.AllKeys() {
+		if !strings.HasPrefix(key, "vms.") {
+			profile.Set(key, cfg.Get(key))
+		}
+	}
+
+	for _, key := range profileCfg.AllKeys() {
+		profile.Set(key, profileCfg.Get(key))
+	}
+
+	// Environment variables also override the keys of the profile
+	applyEnvOverrides(profile)
+
+	// Profiles get their own machine and data path unless told otherwise
+	if !profileCfg.IsSet("machine_name") {
+		profile.Set("machine_name", cfg.GetString("machine_name")+"-"+name)
+	}
+
+	if !profileCfg.IsSet("data_path") {
+		dataPath := path.Join(cfg.GetString("data_path"), name)
+		if err := os.MkdirAll(dataPath, 0755); err != nil {
+			return nil, err
+		}
+		profile.Set("data_path", dataPath)
+	}
+
+	return profile, nil
 }
@@ -0,0 +1,420 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// knownKeys lists the configuration keys, '*' matching any name
+var knownKeys = []string{
+	"machine_name", "distro_type", "data_path", "device", "device_uuid",
+	"hypervisor", "qemu.binary", "qemu.args", "hyperv.switch", "hyperv.secure_boot",
+	"disk_type", "disk_location", "disk_url", "disk_sha256", "disk_mode", "disks", "iso_images", "raw_vmdk.split", "disk_partitions",
+	"cpus", "ram", "min_ram", "cpu_execution_cap", "cpu_hotplug",
+	"gui", "frontend", "menubar", "host_key", "save_state", "clone_from",
+	"clipboard_mode", "dnd_mode", "reload_interval", "display.vram", "display.accelerate_3d",
+	"display.monitors", "display.resolutions", "display.host_screens", "display.mode",
+	"virtualization.paravirt_provider", "virtualization.nested_paging", "virtualization.large_pages",
+	"virtualization.nested_hw_virt", "firmware", "boot_order", "qemu.efi_firmware",
+	"serial.mode", "serial.path",
+	"recording.enabled", "recording.path", "recording.width", "recording.height", "recording.fps", "recording.max_size",
+	"storage.controller", "storage.ports", "storage.controllers",
+	"audio.enabled", "audio.driver", "audio.controller", "audio.input", "audio.output",
+	"usb.controller", "usb.filters", "usb.hotplug",
+	"vrde.enabled", "vrde.auth_type", "vrde.multi_connection", "vrde.ports", "vrde.address",
+	"network.adapters", "network.type", "network.mode", "network.mac_address",
+	"network.cable_connected", "network.bridge_interface", "network.hostonly_interface",
+	"network.internal_network", "network.nat_network",
+	"port_forwards.*.protocol", "port_forwards.*.host_port", "port_forwards.*.guest_port",
+	"port_forwards.*.host_ip", "port_forwards.*.guest_ip",
+	"shared_folders.*.path", "shared_folders.*.persistent", "shared_folders.*.automount",
+	"guest_control.user", "guest_control.password", "guest_control.domain",
+	"guest_additions.attach", "guest_additions.check", "guest_additions.update",
+	"guest_ip.wait", "guest_ip.timeout", "guest_ip.file",
+	"timeouts.launch", "timeouts.shutdown", "timeouts.delete", "hooks", "events.polling_interval", "events.failure_timeout", "events.properties",
+	"log.max_size", "log.max_age", "log.max_files",
+	"power.pause_on_sleep", "power.stop_on_shutdown", "power.on_battery", "power.battery_cpu_cap",
+	"api.address", "api.token",
+	"proxy.enabled", "proxy.http", "proxy.https", "proxy.no_proxy",
+	"time.rtc", "time.sync", "time.offset",
+	"health.action", "health.heartbeat_property", "health.timeout",
+	"provision.user_data", "provision.meta_data", "provision.files",
+	"metrics.address", "preflight.enabled", "guest_requests.enabled", "guest_requests.verbs",
+	"extra_data.defaults", "extra_data.global", "extra_data.machine", "extra_data.suppress_messages",
+	"teleporter.enabled", "teleporter.port", "teleporter.address", "teleporter.password", "teleporter.timeout",
+	"shutdown_handshake.enabled", "shutdown_handshake.timeout", "bandwidth.disk", "bandwidth.network",
+	"idle.action", "idle.timeout", "idle.properties", "device_removal.pause",
+	"integrity.enabled", "integrity.on_failure", "depends_on",
+	"journal.enabled", "journal.max_size",
+	"encryption.password", "encryption.password_file", "encryption.id", "encryption.encrypt", "encryption.cipher",
+}
+
+var intKeys = []string{"cpus", "ram", "min_ram", "cpu_execution_cap", "storage.ports", "log.max_size", "log.max_files", "display.vram", "display.monitors", "journal.max_size",
+	"recording.width", "recording.height", "recording.fps", "recording.max_size", "power.battery_cpu_cap", "teleporter.port"}
+var boolKeys = []string{"cpu_hotplug", "gui", "menubar", "save_state", "audio.enabled", "audio.input", "audio.output", "vrde.enabled", "vrde.multi_connection", "encryption.encrypt", "raw_vmdk.split", "hyperv.secure_boot",
+	"guest_additions.attach", "guest_additions.check", "guest_additions.update", "display.accelerate_3d",
+	"virtualization.nested_paging", "virtualization.large_pages", "virtualization.nested_hw_virt", "recording.enabled", "guest_ip.wait",
+	"power.pause_on_sleep", "power.stop_on_shutdown", "proxy.enabled", "time.sync", "preflight.enabled", "guest_requests.enabled", "extra_data.defaults", "teleporter.enabled", "shutdown_handshake.enabled", "device_removal.pause", "integrity.enabled", "journal.enabled"}
+var durationKeys = []string{"events.polling_interval", "events.failure_timeout", "guest_ip.timeout", "timeouts.launch", "timeouts.shutdown", "timeouts.delete", "log.max_age", "reload_interval", "time.offset", "health.timeout", "teleporter.timeout", "shutdown_handshake.timeout", "idle.timeout"}
+
+// listKeys are the lists of values, given as comma separated values in the
+// environment. qemu.args is separated by spaces, as viper splits strings.
+var listKeys = []string{"iso_images", "disk_partitions", "display.resolutions", "display.host_screens", "boot_order", "depends_on",
+	"provision.files", "idle.properties", "guest_requests.verbs", "extra_data.suppress_messages", "extra_data.global", "extra_data.machine"}
+
+// structuredKeys are the lists of settings, they can not be given in the
+// environment
+var structuredKeys = []string{"disks", "hooks", "usb.filters", "storage.controllers", "network.adapters"}
+
+var enumKeys = map[string][]string{
+	"hypervisor":     {"virtualbox", "qemu", "hyperv"},
+	"frontend":       {"gui", "headless", "separate", "sdl"},
+	"disk_type":      {"raw", "vdi", "vmdk", "vhd", "none"},
+	"disk_mode":      {"normal", "immutable", "multiattach"},
+	"clipboard_mode": {"disabled", "host_to_guest", "guest_to_host", "bidirectional"},
+	"dnd_mode":       {"disabled", "host_to_guest", "guest_to_host", "bidirectional"},
+
+	"virtualization.paravirt_provider": {"default", "none", "kvm", "hyperv"},
+	"firmware":                         {"bios", "efi"},
+	"serial.mode":                      {"disabled", "file", "pipe"},
+	"power.on_battery":                 {"none", "cpu_cap", "pause", "warn"},
+	"time.rtc":                         {"auto", "utc", "local"},
+	"usb.hotplug":                      {"none", "raw"},
+	"health.action":                    {"none", "reset", "restore", "exit"},
+	"display.mode":                     {"window", "fullscreen", "seamless"},
+	"idle.action":                      {"none", "save", "shutdown", "poweroff"},
+	"integrity.on_failure":             {"ask", "restore", "refuse"},
+}
+
+// bandwidthPattern matches the limits of the bandwidth groups
+var bandwidthPattern = regexp.MustCompile(`^[0-9]+[KMGkmg]?$`)
+
+// resolutionPattern matches the resolutions given as WIDTHxHEIGHT
+var resolutionPattern = regexp.MustCompile(`^[1-9][0-9]*x[1-9][0-9]*$`)
+
+// ValidationError reports all the problems found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "Invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+func (e *ValidationError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+func matchKey(pattern, key string) bool {
+	patternParts, keyParts := strings.Split(pattern, "."), strings.Split(key, ".")
+	if len(patternParts) != len(keyParts) {
+		return false
+	}
+
+	for i, part := range patternParts {
+		if part != "*" && part != keyParts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func isKnownKey(key string) bool {
+	// Profiles accept the same keys as the global configuration
+	if parts := strings.SplitN(key, ".", 3); parts[0] == "vms" && len(parts) == 3 {
+		key = parts[2]
+	}
+
+	for _, pattern := range knownKeys {
+		if matchKey(pattern, key) || strings.HasPrefix(key, pattern+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func isInt(value interface{}) bool {
+	switch v := value.(type) {
+	case int, int32, int64, uint, uint32, uint64:
+		return true
+	case float64:
+		return v == float64(int64(v))
+	case string:
+		_, err := strconv.Atoi(v)
+		return err == nil
+	}
+	return false
+}
+
+func isBool(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return true
+	case string:
+		_, err := strconv.ParseBool(v)
+		return err == nil
+	}
+	return false
+}
+
+func isDuration(value interface{}) bool {
+	switch v := value.(type) {
+	case time.Duration, int, int64:
+		return true
+	case string:
+		_, err := time.ParseDuration(v)
+		return err == nil
+	}
+	return false
+}
+
+func checkPath(e *ValidationError, key, path string) {
+	if path == "" {
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		e.add("%s: '%s' does not exist", key, path)
+	}
+}
+
+// Validate checks the types, ranges and paths of a configuration and
+// reports all the errors at once
+func Validate(cfg *viper.Viper) error {
+	e := &ValidationError{}
+
+	for _, key := range cfg.AllKeys() {
+		if !isKnownKey(key) {
+			e.add("%s: unknown key", key)
+		}
+	}
+
+	for _, key := range structuredKeys {
+		if _, found := os.LookupEnv(envName(key)); found {
+			e.add("%s: can not be set from the environment, use a configuration file", envName(key))
+		}
+	}
+
+	for _, key := range intKeys {
+		if cfg.IsSet(key) && !isInt(cfg.Get(key)) {
+			e.add("%s: expected an integer, got '%v'", key, cfg.Get(key))
+		}
+	}
+
+	for _, key := range boolKeys {
+		if cfg.IsSet(key) && !isBool(cfg.Get(key)) {
+			e.add("%s: expected a boolean, got '%v'", key, cfg.Get(key))
+		}
+	}
+
+	for _, key := range durationKeys {
+		if cfg.IsSet(key) && !isDuration(cfg.Get(key)) {
+			e.add("%s: expected a duration such as '30s', got '%v'", key, cfg.Get(key))
+		}
+	}
+
+	for key, values := range enumKeys {
+		value := cfg.GetString(key)
+		valid := false
+		for _, v := range values {
+			valid = valid || v == value
+		}
+		if !valid {
+			e.add("%s: invalid value '%s', expected one of %s", key, value, strings.Join(values, ", "))
+		}
+	}
+
+	if cpus := cfg.GetInt("cpus"); cpus > runtime.NumCPU() {
+		e.add("cpus: %d CPUs requested but the host only has %d", cpus, runtime.NumCPU())
+	}
+
+	if ram, minRam := cfg.GetInt("ram"), cfg.GetInt("min_ram"); ram > 0 && ram < minRam {
+		e.add("ram: %d MB is less than min_ram (%d MB)", ram, minRam)
+	}
+
+	if cap := cfg.GetInt("cpu_execution_cap"); cap < 1 || cap > 100 {
+		e.add("cpu_execution_cap: %d is not between 1 and 100", cap)
+	}
+
+	if cap := cfg.GetInt("power.battery_cpu_cap"); cap < 1 || cap > 100 {
+		e.add("power.battery_cpu_cap: %d is not between 1 and 100", cap)
+	}
+
+	if port := cfg.GetInt("teleporter.port"); port < 1 || port > 65535 {
+		e.add("teleporter.port: %d is not between 1 and 65535", port)
+	}
+
+	if timeout := cfg.GetDuration("health.timeout"); timeout <= 0 {
+		e.add("health.timeout: %s is not a positive duration", timeout)
+	}
+
+	if cfg.GetString("idle.action") != "none" {
+		if timeout := cfg.GetDuration("idle.timeout"); timeout <= 0 {
+			e.add("idle.timeout: %s is not a positive duration", timeout)
+		}
+		if cfg.GetString("idle.action") == "save" && !cfg.GetBool("save_state") {
+			e.add("idle.action: save requires save_state to keep the saved machine")
+		}
+	}
+
+	if interval := cfg.GetDuration("events.polling_interval"); interval <= 0 {
+		e.add("events.polling_interval: %s is not a positive duration", interval)
+	}
+
+	if vram := cfg.GetInt("display.vram"); vram < 1 || vram > 256 {
+		e.add("display.vram: %d MB is not between 1 and 256", vram)
+	}
+
+	if monitors := cfg.GetInt("display.monitors"); monitors < 1 || monitors > 8 {
+		e.add("display.monitors: %d is not between 1 and 8", monitors)
+	} else {
+		if resolutions := cfg.GetStringSlice("display.resolutions"); len(resolutions) > monitors {
+			e.add("display.resolutions: %d resolutions given for %d monitors", len(resolutions), monitors)
+		}
+		if hostScreens := cfg.GetStringSlice("display.host_screens"); len(hostScreens) > monitors {
+			e.add("display.host_screens: %d host screens given for %d monitors", len(hostScreens), monitors)
+		}
+	}
+
+	for i, resolution := range cfg.GetStringSlice("display.resolutions") {
+		if !resolutionPattern.MatchString(resolution) {
+			e.add("display.resolutions[%d]: invalid resolution '%s', expected WIDTHxHEIGHT", i, resolution)
+		}
+	}
+
+	for i, hostScreen := range cfg.GetStringSlice("display.host_screens") {
+		if n, err := strconv.Atoi(hostScreen); err != nil || n < 0 {
+			e.add("display.host_screens[%d]: invalid host screen '%s'", i, hostScreen)
+		}
+	}
+
+	if cfg.GetBool("recording.enabled") {
+		if fps := cfg.GetInt("recording.fps"); fps < 1 || fps > 60 {
+			e.add("recording.fps: %d is not between 1 and 60", fps)
+		}
+		if cfg.GetInt("recording.width") < 1 || cfg.GetInt("recording.height") < 1 {
+			e.add("recording: invalid resolution %dx%d", cfg.GetInt("recording.width"), cfg.GetInt("recording.height"))
+		}
+	}
+
+	if order := cfg.GetStringSlice("boot_order"); len(order) > 4 {
+		e.add("boot_order: at most 4 devices can be set, got %d", len(order))
+	} else {
+		for i, device := range order {
+			switch device {
+			case "disk", "dvd", "net", "none":
+			default:
+				e.add("boot_order[%d]: invalid device '%s', expected one of disk, dvd, net, none", i, device)
+			}
+		}
+	}
+
+	if cfg.GetString("disk_type") == "none" {
+		if !cfg.IsSet("disks") && len(cfg.GetStringSlice("iso_images")) == 0 {
+			e.add("iso_images: at least one image is required without disk")
+		}
+	} else if diskURL := cfg.GetString("disk_url"); diskURL != "" {
+		switch cfg.GetString("disk_type") {
+		case "vdi", "vmdk", "vhd":
+		default:
+			e.add("disk_url: only vdi, vmdk and vhd images can be downloaded")
+		}
+
+		if checksum := cfg.GetString("disk_sha256"); len(checksum) != 64 {
+			e.add("disk_sha256: required with disk_url, expected a SHA-256 hex digest")
+		}
+	} else if cfg.GetString("disk_type") != "raw" {
+		if location := cfg.GetString("disk_location"); location == "" && !cfg.IsSet("disks") {
+			e.add("disk_location: required for %s disks", cfg.GetString("disk_type"))
+		} else {
+			checkPath(e, "disk_location", location)
+		}
+	}
+
+	var disks []map[string]interface{}
+	if err := cfg.UnmarshalKey("disks", &disks); err != nil {
+		e.add("disks: %s", err.Error())
+	}
+	for i, disk := range disks {
+		if location, ok := disk["location"].(string); ok && disk["type"] != "raw" {
+			checkPath(e, fmt.Sprintf("disks[%d].location", i), location)
+		}
+	}
+
+	var hooks []map[string]interface{}
+	if err := cfg.UnmarshalKey("hooks", &hooks); err != nil {
+		e.add("hooks: %s", err.Error())
+	}
+	for i, hook := range hooks {
+		switch hook["event"] {
+		case "vm-started", "vm-stopped", "property-changed", "device-removed", "device-returned",
+			"pre-create", "post-start", "pre-shutdown", "post-release":
+		default:
+			e.add("hooks[%d].event: invalid value '%v', expected one of vm-started, vm-stopped, property-changed, device-removed, device-returned, pre-create, post-start, pre-shutdown, post-release", i, hook["event"])
+		}
+		switch hook["on_failure"] {
+		case nil, "abort", "warn":
+		default:
+			e.add("hooks[%d].on_failure: invalid value '%v', expected abort or warn", i, hook["on_failure"])
+		}
+		if timeout, ok := hook["timeout"].(string); ok {
+			if _, err := time.ParseDuration(timeout); err != nil {
+				e.add("hooks[%d].timeout: %s", i, err.Error())
+			}
+		}
+		if hook["url"] == nil && hook["command"] == nil {
+			e.add("hooks[%d]: a url or a command is required", i)
+		}
+	}
+
+	checkPath(e, "encryption.password_file", cfg.GetString("encryption.password_file"))
+
+	for i, image := range cfg.GetStringSlice("iso_images") {
+		checkPath(e, fmt.Sprintf("iso_images[%d]", i), image)
+	}
+
+	checkPath(e, "provision.user_data", cfg.GetString("provision.user_data"))
+	checkPath(e, "provision.meta_data", cfg.GetString("provision.meta_data"))
+	for i, file := range cfg.GetStringSlice("provision.files") {
+		checkPath(e, fmt.Sprintf("provision.files[%d]", i), file)
+	}
+	if cfg.GetString("provision.user_data") == "" && (cfg.GetString("provision.meta_data") != "" || len(cfg.GetStringSlice("provision.files")) > 0) {
+		e.add("provision.user_data: required to provision the guest")
+	}
+
+	for _, key := range []string{"bandwidth.disk", "bandwidth.network"} {
+		if limit := cfg.GetString(key); limit != "" && !bandwidthPattern.MatchString(limit) {
+			e.add("%s: invalid limit '%s', expected a number followed by K, M or G for bytes or k, m or g for bits per second", key, limit)
+		}
+	}
+
+	for _, key := range []string{"extra_data.global", "extra_data.machine"} {
+		for i, entry := range cfg.GetStringSlice(key) {
+			if strings.Index(entry, "=") <= 0 {
+				e.add("%s[%d]: '%s' must be KEY=VALUE", key, i, entry)
+			}
+		}
+	}
+
+	for name := range cfg.GetStringMap("shared_folders") {
+		key := "shared_folders." + name + ".path"
+		if path := cfg.GetString(key); path == "" {
+			e.add("%s: required", key)
+		} else {
+			checkPath(e, key, path)
+		}
+	}
+
+	if len(e.Problems) > 0 {
+		sort.Strings(e.Problems)
+		return e
+	}
+	return nil
+}
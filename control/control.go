@@ -0,0 +1,200 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/lebauce/vlaunch/logging"
+)
+
+var logger = logging.Module("control")
+
+var AlreadyRunning = errors.New("Another vlaunch instance is already running")
+
+type Request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type HandlerFunc func(args []string) (interface{}, error)
+
+// StreamFunc sends results until it returns. The context is done when the
+// client disconnects.
+type StreamFunc func(ctx context.Context, args []string, send func(interface{}) error) error
+
+type Server struct {
+	listener net.Listener
+	lock     sync.RWMutex
+	handlers map[string]HandlerFunc
+	streams  map[string]StreamFunc
+}
+
+func (s *Server) Handle(command string, handler HandlerFunc) {
+	s.lock.Lock()
+	s.handlers[command] = handler
+	s.lock.Unlock()
+}
+
+// HandleStream registers a command sending a stream of results, one
+// response per result
+func (s *Server) HandleStream(command string, handler StreamFunc) {
+	s.lock.Lock()
+	s.streams[command] = handler
+	s.lock.Unlock()
+}
+
+func (s *Server) handleStream(conn net.Conn, handler StreamFunc, args []string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Clients do not send anything after the request, a read only returns
+	// once the connection is closed
+	go func() {
+		conn.Read(make([]byte, 1))
+		cancel()
+	}()
+
+	encoder := json.NewEncoder(conn)
+	send := func(result interface{}) error {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		return encoder.Encode(&Response{Result: data})
+	}
+
+	if err := handler(ctx, args, send); err != nil && ctx.Err() == nil {
+		encoder.Encode(&Response{Error: err.Error()})
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	var request Request
+	var response Response
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		response.Error = fmt.Sprintf("Invalid request: %s", err.Error())
+	} else {
+		s.lock.RLock()
+		stream, found := s.streams[request.Command]
+		s.lock.RUnlock()
+
+		if found {
+			s.handleStream(conn, stream, request.Args)
+			return
+		}
+
+		s.lock.RLock()
+		handler, found := s.handlers[request.Command]
+		s.lock.RUnlock()
+
+		if !found {
+			response.Error = fmt.Sprintf("Unknown command '%s'", request.Command)
+		} else if result, err := handler(request.Args); err != nil {
+			response.Error = err.Error()
+		} else if result != nil {
+			if response.Result, err = json.Marshal(result); err != nil {
+				response.Error = err.Error()
+			}
+		}
+	}
+
+	if err := json.NewEncoder(conn).Encode(&response); err != nil {
+		logger.Error("Failed to send control response", "error", err)
+	}
+}
+
+func (s *Server) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// NewServer listens on a Unix socket, or a named pipe on Windows
+func NewServer(socketPath string) (*Server, error) {
+	listener, err := listen(socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		listener: listener,
+		handlers: make(map[string]HandlerFunc),
+		streams:  make(map[string]StreamFunc),
+	}, nil
+}
+
+func Call(socketPath string, command string, args ...string) (json.RawMessage, error) {
+	conn, err := dial(socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to vlaunch, is it running ? (%s)", err.Error())
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(&Request{Command: command, Args: args}); err != nil {
+		return nil, err
+	}
+
+	var response Response
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+
+	return response.Result, nil
+}
+
+// Stream sends a command returning a stream of results and calls receive
+// for each of them, until the server ends the stream or receive fails
+func Stream(socketPath string, command string, receive func(json.RawMessage) error, args ...string) error {
+	conn, err := dial(socketPath)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to vlaunch, is it running ? (%s)", err.Error())
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(&Request{Command: command, Args: args}); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var response Response
+		if err := decoder.Decode(&response); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if response.Error != "" {
+			return errors.New(response.Error)
+		}
+
+		if err := receive(response.Result); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package control
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lebauce/vlaunch/backend"
+)
+
+// Lock prevents two instances from using the same data path, and thus
+// from generating descriptors for the same device at the same time
+type Lock struct {
+	path string
+}
+
+func LockPath(dataPath string) string {
+	return path.Join(dataPath, "vlaunch.lock")
+}
+
+func readPID(lockPath string) (int, error) {
+	content, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
+
+// waitPID reads the PID of the lock, giving its owner some time to write
+// it as the lock is created empty
+func waitPID(lockPath string) (int, error) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		pid, err := readPID(lockPath)
+		if err == nil || os.IsNotExist(err) || time.Now().After(deadline) {
+			return pid, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// AcquireLock creates the lock file of the data path holding the PID of
+// the current process. Locks left by processes that are not running
+// anymore are replaced.
+func AcquireLock(dataPath string) (*Lock, error) {
+	lockPath := LockPath(dataPath)
+	for {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(file, "%d\n", os.Getpid())
+			file.Close()
+			if err != nil {
+				os.Remove(lockPath)
+				return nil, err
+			}
+			return &Lock{path: lockPath}, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		// Only a lock whose process is known to be gone is stale
+		pid, err := waitPID(lockPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to read lock %s, remove it if no vlaunch is running: %s", lockPath, err.Error())
+		} else if backend.ProcessExists(pid) {
+			return nil, fmt.Errorf("%w (PID %d) with data path %s, use 'vlaunch status' or 'vlaunch stop' to control it",
+				AlreadyRunning, pid, dataPath)
+		}
+
+		logger.Warn("Removing stale lock", "path", lockPath, "pid", pid)
+		if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// Release removes the lock file if it is still held by this process
+func (l *Lock) Release() error {
+	if pid, err := readPID(l.path); err != nil || pid != os.Getpid() {
+		return err
+	}
+	return os.Remove(l.path)
+}
@@ -0,0 +1,31 @@
+// +build !windows
+
+package control
+
+import (
+	"net"
+	"os"
+	"path"
+)
+
+// SocketPath returns the Unix socket of the control server
+func SocketPath(dataPath string) string {
+	return path.Join(dataPath, "vlaunch.sock")
+}
+
+func listen(socketPath string) (net.Listener, error) {
+	if _, err := os.Stat(socketPath); err == nil {
+		// Only remove the socket if nobody is listening on it anymore
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, AlreadyRunning
+		}
+		os.Remove(socketPath)
+	}
+
+	return net.Listen("unix", socketPath)
+}
+
+func dial(socketPath string) (net.Conn, error) {
+	return net.Dial("unix", socketPath)
+}
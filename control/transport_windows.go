@@ -0,0 +1,241 @@
+// +build windows
+
+package control
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	pipeAccessDuplex          = 0x3
+	fileFlagFirstPipeInstance = 0x80000
+	pipeTypeByte              = 0x0
+	pipeRejectRemoteClients   = 0x8
+	pipeUnlimitedInstances    = 255
+	pipeBufferSize            = 65536
+
+	errorPipeBusy      = syscall.Errno(231)
+	errorNoData        = syscall.Errno(232)
+	errorPipeConnected = syscall.Errno(535)
+)
+
+var (
+	kernel32                = windows.NewLazySystemDLL("kernel32.dll")
+	procCreateNamedPipeW    = kernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe    = kernel32.NewProc("ConnectNamedPipe")
+	procWaitNamedPipeW      = kernel32.NewProc("WaitNamedPipeW")
+	procCreateEventW        = kernel32.NewProc("CreateEventW")
+	procGetOverlappedResult = kernel32.NewProc("GetOverlappedResult")
+)
+
+// SocketPath returns the named pipe of the control server, derived from the
+// data path as pipes live in their own namespace
+func SocketPath(dataPath string) string {
+	if absPath, err := filepath.Abs(dataPath); err == nil {
+		dataPath = absPath
+	}
+	sum := sha1.Sum([]byte(strings.ToLower(dataPath)))
+	return `\\.\pipe\vlaunch-` + hex.EncodeToString(sum[:8])
+}
+
+// overlappedIO runs an I/O on a handle opened for overlapped I/O and waits
+// for its completion, returning the number of bytes transferred
+func overlappedIO(handle syscall.Handle, start func(*syscall.Overlapped) error) (uint32, error) {
+	event, _, err := procCreateEventW.Call(0, 1, 0, 0)
+	if event == 0 {
+		return 0, err
+	}
+	defer syscall.CloseHandle(syscall.Handle(event))
+
+	overlapped := &syscall.Overlapped{HEvent: syscall.Handle(event)}
+	if err := start(overlapped); err != nil && err != syscall.ERROR_IO_PENDING {
+		return 0, err
+	}
+
+	var done uint32
+	if r, _, err := procGetOverlappedResult.Call(uintptr(handle), uintptr(unsafe.Pointer(overlapped)), uintptr(unsafe.Pointer(&done)), 1); r == 0 {
+		return done, err
+	}
+	return done, nil
+}
+
+// pipeAddr is the address of both ends of a named pipe
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn is a connected instance of a named pipe, opened for overlapped
+// I/O so that it can be read and written concurrently
+type pipeConn struct {
+	handle    syscall.Handle
+	name      string
+	closeOnce sync.Once
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	n, err := overlappedIO(c.handle, func(o *syscall.Overlapped) error {
+		return syscall.ReadFile(c.handle, p, nil, o)
+	})
+	if err == syscall.ERROR_BROKEN_PIPE || err == errorNoData || err == syscall.ERROR_OPERATION_ABORTED {
+		return int(n), io.EOF
+	}
+	return int(n), err
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	n, err := overlappedIO(c.handle, func(o *syscall.Overlapped) error {
+		return syscall.WriteFile(c.handle, p, nil, o)
+	})
+	return int(n), err
+}
+
+// Close cancels the pending reads and writes and closes the pipe
+func (c *pipeConn) Close() error {
+	err := errors.New("Pipe already closed")
+	c.closeOnce.Do(func() {
+		syscall.CancelIoEx(c.handle, nil)
+		err = syscall.CloseHandle(c.handle)
+	})
+	return err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr(c.name) }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr(c.name) }
+
+// The deadlines are not used by the control server and clients
+func (c *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// pipeListener accepts the clients of a named pipe, a new instance of the
+// pipe waiting for the next client
+type pipeListener struct {
+	name   string
+	lock   sync.Mutex
+	next   syscall.Handle
+	closed bool
+}
+
+func createPipe(name string, first bool) (syscall.Handle, error) {
+	pipeName, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return syscall.InvalidHandle, err
+	}
+
+	mode := uintptr(pipeAccessDuplex | syscall.FILE_FLAG_OVERLAPPED)
+	if first {
+		mode |= fileFlagFirstPipeInstance
+	}
+
+	handle, _, err := procCreateNamedPipeW.Call(uintptr(unsafe.Pointer(pipeName)), mode, pipeTypeByte|pipeRejectRemoteClients,
+		pipeUnlimitedInstances, pipeBufferSize, pipeBufferSize, 0, 0)
+	if syscall.Handle(handle) == syscall.InvalidHandle {
+		return syscall.InvalidHandle, err
+	}
+	return syscall.Handle(handle), nil
+}
+
+// listen creates the named pipe, only one vlaunch can own it
+func listen(name string) (net.Listener, error) {
+	handle, err := createPipe(name, true)
+	if err == syscall.ERROR_ACCESS_DENIED {
+		return nil, AlreadyRunning
+	} else if err != nil {
+		return nil, err
+	}
+	return &pipeListener{name: name, next: handle}, nil
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	for {
+		l.lock.Lock()
+		if l.closed {
+			l.lock.Unlock()
+			return nil, errors.New("Listener closed")
+		}
+		handle := l.next
+		l.lock.Unlock()
+
+		_, connectErr := overlappedIO(handle, func(o *syscall.Overlapped) error {
+			if r, _, err := procConnectNamedPipe.Call(uintptr(handle), uintptr(unsafe.Pointer(o))); r == 0 && err != errorPipeConnected {
+				return err
+			}
+			return nil
+		})
+
+		l.lock.Lock()
+		if l.closed {
+			l.lock.Unlock()
+			return nil, errors.New("Listener closed")
+		}
+
+		// The next client connects to a new instance of the pipe
+		next, err := createPipe(l.name, false)
+		if err != nil {
+			l.lock.Unlock()
+			return nil, err
+		}
+		l.next = next
+		l.lock.Unlock()
+
+		// A client may have disconnected before it was accepted
+		if connectErr != nil {
+			syscall.CloseHandle(handle)
+			continue
+		}
+		return &pipeConn{handle: handle, name: l.name}, nil
+	}
+}
+
+// Close stops the pending Accept
+func (l *pipeListener) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	syscall.CancelIoEx(l.next, nil)
+	return syscall.CloseHandle(l.next)
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr(l.name) }
+
+// dial connects to the named pipe, waiting for an instance if all of them
+// are busy
+func dial(name string) (net.Conn, error) {
+	pipeName, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		handle, err := syscall.CreateFile(pipeName, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+			syscall.OPEN_EXISTING, syscall.FILE_FLAG_OVERLAPPED, 0)
+		if err == nil {
+			return &pipeConn{handle: handle, name: name}, nil
+		}
+
+		if err != errorPipeBusy {
+			return nil, err
+		}
+
+		if r, _, err := procWaitNamedPipeW.Call(uintptr(unsafe.Pointer(pipeName)), 5000); r == 0 {
+			return nil, err
+		}
+	}
+}
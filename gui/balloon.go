@@ -2,14 +2,16 @@ package gui
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 
+	"github.com/lebauce/vlaunch/logging"
 	"github.com/therecipe/qt/core"
 	"github.com/therecipe/qt/gui"
 	"github.com/therecipe/qt/widgets"
 )
 
+var logger = logging.Module("gui")
+
 type Balloon struct {
 	widget        *widgets.QWidget
 	layout        *widgets.QHBoxLayout
@@ -22,7 +24,7 @@ func (b *Balloon) Show() {
 }
 
 func (b *Balloon) OnGuestPropertyChanged(name, value string, timestamp int64, flags string) {
-	log.Printf("OnGuestPropertyChanged %s => %s\n", name, value)
+	logger.Debug("Guest property changed", "name", name, "value", value)
 	switch name {
 	case "/UFO/Boot/Progress":
 		if b.progressBar != nil {
@@ -30,12 +32,12 @@ func (b *Balloon) OnGuestPropertyChanged(name, value string, timestamp int64, fl
 			if err != nil {
 				return
 			}
-			log.Printf("Updating progress bar: %d", int(percentage*100))
+			logger.Debug("Updating progress bar", "percent", int(percentage*100))
 			b.progressBar.SetValue(int(percentage * 100))
 		}
 	case "/UFO/State":
 		if value == "LOGGED_IN" {
-			log.Println("Closing balloon")
+			logger.Debug("Closing balloon")
 			b.widget.Hide()
 			b.widget.Close()
 		}
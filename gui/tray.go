@@ -0,0 +1,98 @@
+// +build tray
+
+package gui
+
+import (
+	"fmt"
+
+	"github.com/therecipe/qt/widgets"
+)
+
+// TrayActions are the operations on the machine offered by the menu of the
+// tray icon, Screenshot returns the file it wrote
+type TrayActions struct {
+	Pause      func() error
+	Resume     func() error
+	Shutdown   func() error
+	Screenshot func() (string, error)
+}
+
+// Tray is an icon in the system tray showing the state of the machine
+type Tray struct {
+	icon   *widgets.QSystemTrayIcon
+	name   string
+	pause  *widgets.QAction
+	resume *widgets.QAction
+}
+
+func (t *Tray) notify(title, msg string) {
+	t.icon.ShowMessage2(title, msg, widgets.QSystemTrayIcon__Information, 5000)
+}
+
+// run runs an action of the menu, reporting its failure in a notification
+func (t *Tray) run(name string, action func() error) {
+	go func() {
+		if err := action(); err != nil {
+			logger.Error("Tray action failed", "action", name, "error", err)
+			t.notify(fmt.Sprintf("Failed to %s %s", name, t.name), err.Error())
+		}
+	}()
+}
+
+// SetState updates the tooltip and the actions available for a state
+func (t *Tray) SetState(state string) {
+	t.icon.SetToolTip(fmt.Sprintf("%s (%s)", t.name, state))
+	t.pause.SetEnabled(state == "running")
+	t.resume.SetEnabled(state == "paused")
+}
+
+func NewTray(app *widgets.QApplication, name string, actions TrayActions) (*Tray, error) {
+	if !widgets.QSystemTrayIcon_IsSystemTrayAvailable() {
+		return nil, fmt.Errorf("No system tray available")
+	}
+
+	icon, err := IconFromBindata("tray.png")
+	if err != nil {
+		return nil, err
+	}
+
+	// The application quits when the machine stops, not when the balloon
+	// is closed
+	app.SetQuitOnLastWindowClosed(false)
+
+	t := &Tray{icon: widgets.NewQSystemTrayIcon(app), name: name}
+	t.icon.SetIcon(icon)
+
+	menu := widgets.NewQMenu(nil)
+	t.pause = menu.AddAction("Pause")
+	t.pause.ConnectTriggered(func(checked bool) {
+		t.run("pause", actions.Pause)
+	})
+
+	t.resume = menu.AddAction("Resume")
+	t.resume.ConnectTriggered(func(checked bool) {
+		t.run("resume", actions.Resume)
+	})
+
+	menu.AddSeparator()
+	menu.AddAction("Take a screenshot").ConnectTriggered(func(checked bool) {
+		t.run("take a screenshot of", func() error {
+			path, err := actions.Screenshot()
+			if err == nil {
+				t.notify("Screenshot saved", path)
+			}
+			return err
+		})
+	})
+
+	menu.AddSeparator()
+	menu.AddAction("Shut down").ConnectTriggered(func(checked bool) {
+		t.run("shut down", actions.Shutdown)
+	})
+
+	t.icon.SetContextMenu(menu)
+	t.SetState("starting")
+	t.icon.Show()
+
+	return t, nil
+}
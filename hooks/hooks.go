@@ -0,0 +1,232 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"github.com/lebauce/vlaunch/logging"
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/spf13/viper"
+)
+
+var logger = logging.Module("hooks")
+
+// Events that can trigger a hook
+const (
+	VMStarted       = "vm-started"
+	VMStopped       = "vm-stopped"
+	PropertyChanged = "property-changed"
+	DeviceRemoved   = "device-removed"
+	DeviceReturned  = "device-returned"
+)
+
+// Lifecycle events, whose hooks are run by Run before vlaunch goes on
+const (
+	PreCreate   = "pre-create"
+	PostStart   = "post-start"
+	PreShutdown = "pre-shutdown"
+	PostRelease = "post-release"
+)
+
+// hookTimeout bounds the execution of a command or webhook, unless the hook
+// has a timeout
+const hookTimeout = 30 * time.Second
+
+// Hook runs a command or calls a webhook when an event occurs
+type Hook struct {
+	Event string `mapstructure:"event"`
+	// Property is matched against the names of the changed properties,
+	// for property-changed hooks, see vm.MatchPropertyPattern
+	Property string `mapstructure:"property"`
+	URL      string `mapstructure:"url"`
+	Command  string `mapstructure:"command"`
+	// OnFailure is abort or warn, aborting a lifecycle event makes Run
+	// return an error
+	OnFailure string        `mapstructure:"on_failure"`
+	Timeout   time.Duration `mapstructure:"timeout"`
+}
+
+// Payload describes the event, it is posted as JSON to the webhooks and
+// given to the commands as VLAUNCH_* environment variables
+type Payload struct {
+	Event    string `json:"event"`
+	Machine  string `json:"machine"`
+	State    string `json:"state,omitempty"`
+	Property string `json:"property,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Device   string `json:"device,omitempty"`
+	// The hypervisor and the data path of the machine, for the lifecycle
+	// events
+	Hypervisor string `json:"hypervisor,omitempty"`
+	DataPath   string `json:"data_path,omitempty"`
+}
+
+// Load returns the hooks of the configuration
+func Load(cfg *viper.Viper) ([]Hook, error) {
+	var hooks []Hook
+	if err := cfg.UnmarshalKey("hooks", &hooks); err != nil {
+		return nil, fmt.Errorf("Invalid hooks: %s", err.Error())
+	}
+	return hooks, nil
+}
+
+func (h *Hook) matches(payload *Payload) bool {
+	if h.Event != payload.Event {
+		return false
+	}
+
+	if h.Event == PropertyChanged {
+		return vm.MatchPropertyPattern(h.Property, payload.Property)
+	}
+	return true
+}
+
+func (h *Hook) runCommand(ctx context.Context, payload *Payload) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", h.Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", h.Command)
+	}
+
+	cmd.Env = append(os.Environ(),
+		"VLAUNCH_EVENT="+payload.Event,
+		"VLAUNCH_MACHINE="+payload.Machine,
+		"VLAUNCH_STATE="+payload.State,
+		"VLAUNCH_PROPERTY="+payload.Property,
+		"VLAUNCH_VALUE="+payload.Value,
+		"VLAUNCH_DEVICE="+payload.Device,
+		"VLAUNCH_HYPERVISOR="+payload.Hypervisor,
+		"VLAUNCH_DATA_PATH="+payload.DataPath)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+func (h *Hook) callWebhook(ctx context.Context, payload *Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("Webhook returned %s", response.Status)
+	}
+	return nil
+}
+
+// run runs the command and calls the webhook of the hook, returning the
+// first failure
+func (h *Hook) run(payload *Payload) (err error) {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = hookTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if h.Command != "" {
+		if cmdErr := h.runCommand(ctx, payload); cmdErr != nil {
+			logger.Error("Hook command failed", "event", payload.Event, "command", h.Command, "error", cmdErr)
+			err = fmt.Errorf("Command '%s' failed: %s", h.Command, cmdErr.Error())
+		}
+	}
+
+	if h.URL != "" {
+		if webhookErr := h.callWebhook(ctx, payload); webhookErr != nil {
+			logger.Error("Webhook failed", "event", payload.Event, "url", h.URL, "error", webhookErr)
+			if err == nil {
+				err = fmt.Errorf("Webhook %s failed: %s", h.URL, webhookErr.Error())
+			}
+		}
+	}
+	return err
+}
+
+func trigger(hooks []Hook, payload *Payload) {
+	for i := range hooks {
+		if hooks[i].matches(payload) {
+			logger.Debug("Running hook", "event", payload.Event)
+			hooks[i].run(payload)
+		}
+	}
+}
+
+// Run runs the hooks of a lifecycle event one after the other and returns
+// the error of the first one failing with on_failure set to abort, the
+// others being only logged
+func Run(hooks []Hook, payload *Payload) error {
+	for i := range hooks {
+		if !hooks[i].matches(payload) {
+			continue
+		}
+
+		logger.Info("Running hook", "event", payload.Event)
+		if err := hooks[i].run(payload); err != nil && hooks[i].OnFailure == "abort" {
+			return fmt.Errorf("%s hook failed: %s", payload.Event, err.Error())
+		}
+	}
+	return nil
+}
+
+// Start runs the hooks on the events of the started machine. The returned
+// channel is closed once the hooks of the machine shutdown have run.
+func Start(machine *vm.VirtualMachine, name string, hooks []Hook) <-chan struct{} {
+	done := make(chan struct{})
+	events := machine.Subscribe(vm.StateChangedEvent, vm.GuestPropertyChangedEvent, vm.DeviceChangedEvent)
+
+	go func() {
+		defer close(done)
+
+		trigger(hooks, &Payload{Event: VMStarted, Machine: name, State: "running"})
+
+		stopped := false
+		for event := range events {
+			switch e := event.(type) {
+			case vm.StateChanged:
+				state := vm.StateName(e.State)
+				if !stopped && (state == "poweroff" || state == "saved" || state == "aborted") {
+					stopped = true
+					trigger(hooks, &Payload{Event: VMStopped, Machine: name, State: state})
+				}
+			case vm.GuestPropertyChanged:
+				trigger(hooks, &Payload{Event: PropertyChanged, Machine: name, Property: e.Name, Value: e.Value})
+			case vm.DeviceChanged:
+				event := DeviceRemoved
+				if e.Present {
+					event = DeviceReturned
+				}
+				trigger(hooks, &Payload{Event: event, Machine: name, Device: e.Device})
+			}
+		}
+
+		// The events stop when Run returns, even if no state change was seen
+		if !stopped {
+			trigger(hooks, &Payload{Event: VMStopped, Machine: name, State: "poweroff"})
+		}
+	}()
+
+	return done
+}
@@ -0,0 +1,230 @@
+// Package iso writes ISO 9660 images, such as the NoCloud seeds used to
+// provision cloud images
+package iso
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const sectorSize = 2048
+
+// The image starts with 16 unused sectors, followed by the volume
+// descriptors, the path tables and the root directory
+const (
+	primaryDescriptorSector = 16
+	terminatorSector        = 17
+	lPathTableSector        = 18
+	mPathTableSector        = 19
+	rootDirectorySector     = 20
+)
+
+// paddingSectors are added at the end of the image like mkisofs does, some
+// readers read ahead of the last file
+const paddingSectors = 150
+
+// File is a file stored at the root of an image
+type File struct {
+	Name string
+	Data []byte
+}
+
+func bothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func bothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+// padString fills a field with a string followed by spaces
+func padString(b []byte, s string) {
+	n := copy(b, s)
+	for i := n; i < len(b); i++ {
+		b[i] = ' '
+	}
+}
+
+func sectors(size int) uint32 {
+	return uint32((size + sectorSize - 1) / sectorSize)
+}
+
+// directoryRecord returns the record of a file or directory, named 0x00 for
+// the directory itself and 0x01 for its parent
+func directoryRecord(name string, sector, size uint32, directory bool, now time.Time) []byte {
+	length := 33 + len(name)
+	if length%2 != 0 {
+		length++
+	}
+
+	record := make([]byte, length)
+	record[0] = byte(length)
+	bothEndian32(record[2:], sector)
+	bothEndian32(record[10:], size)
+	record[18] = byte(now.Year() - 1900)
+	record[19] = byte(now.Month())
+	record[20] = byte(now.Day())
+	record[21] = byte(now.Hour())
+	record[22] = byte(now.Minute())
+	record[23] = byte(now.Second())
+	if directory {
+		record[25] = 2
+	}
+	bothEndian16(record[28:], 1)
+	record[32] = byte(len(name))
+	copy(record[33:], name)
+	return record
+}
+
+// isoName returns the name of a file as stored in the image. ISO 9660 names
+// are in upper case, Linux shows them in lower case without the version
+func isoName(name string) string {
+	name = strings.ToUpper(name)
+	if !strings.Contains(name, ".") {
+		name += "."
+	}
+	return name + ";1"
+}
+
+// Write writes an ISO 9660 image holding the files at its root. Only plain
+// names are supported, without directories.
+func Write(filename, volumeID string, files []File) error {
+	now := time.Now().UTC()
+
+	names := make(map[string]bool)
+	for _, file := range files {
+		if file.Name == "" || strings.ContainsAny(file.Name, `/\;`) {
+			return fmt.Errorf("Invalid file name '%s'", file.Name)
+		}
+
+		name := isoName(file.Name)
+		if len(name) > 222 {
+			return fmt.Errorf("File name '%s' is too long", file.Name)
+		}
+		if names[name] {
+			return fmt.Errorf("Duplicate file name '%s'", file.Name)
+		}
+		names[name] = true
+	}
+
+	// The length of the records does not depend on the location of the
+	// files, they are sized first to know where the files start
+	records := make([][]byte, len(files)+2)
+	layout := func() int {
+		size, used := 0, 0
+		for _, record := range records {
+			if used+len(record) > sectorSize {
+				size += sectorSize
+				used = 0
+			}
+			used += len(record)
+		}
+		return size + sectorSize
+	}
+
+	records[0] = directoryRecord("\x00", 0, 0, true, now)
+	records[1] = directoryRecord("\x01", 0, 0, true, now)
+	for i, file := range files {
+		records[i+2] = directoryRecord(isoName(file.Name), 0, 0, false, now)
+	}
+	directorySize := layout()
+
+	sector := rootDirectorySector + sectors(directorySize)
+	records[0] = directoryRecord("\x00", rootDirectorySector, uint32(directorySize), true, now)
+	records[1] = directoryRecord("\x01", rootDirectorySector, uint32(directorySize), true, now)
+	for i, file := range files {
+		records[i+2] = directoryRecord(isoName(file.Name), sector, uint32(len(file.Data)), false, now)
+		sector += sectors(len(file.Data))
+	}
+	totalSectors := sector + paddingSectors
+
+	// A record must not cross a sector boundary
+	directory := make([]byte, directorySize)
+	offset := 0
+	for _, record := range records {
+		if offset%sectorSize+len(record) > sectorSize {
+			offset += sectorSize - offset%sectorSize
+		}
+		copy(directory[offset:], record)
+		offset += len(record)
+	}
+
+	// The path tables only hold the root directory
+	lPathTable := make([]byte, sectorSize)
+	mPathTable := make([]byte, sectorSize)
+	lPathTable[0], mPathTable[0] = 1, 1
+	binary.LittleEndian.PutUint32(lPathTable[2:], rootDirectorySector)
+	binary.LittleEndian.PutUint16(lPathTable[6:], 1)
+	binary.BigEndian.PutUint32(mPathTable[2:], rootDirectorySector)
+	binary.BigEndian.PutUint16(mPathTable[6:], 1)
+
+	descriptor := make([]byte, sectorSize)
+	descriptor[0] = 1
+	copy(descriptor[1:], "CD001")
+	descriptor[6] = 1
+	padString(descriptor[8:40], "")
+	padString(descriptor[40:72], volumeID)
+	bothEndian32(descriptor[80:], totalSectors)
+	bothEndian16(descriptor[120:], 1)
+	bothEndian16(descriptor[124:], 1)
+	bothEndian16(descriptor[128:], sectorSize)
+	bothEndian32(descriptor[132:], 10)
+	binary.LittleEndian.PutUint32(descriptor[140:], lPathTableSector)
+	binary.BigEndian.PutUint32(descriptor[148:], mPathTableSector)
+	copy(descriptor[156:190], records[0])
+	padString(descriptor[190:318], "")
+	padString(descriptor[318:446], "")
+	padString(descriptor[446:574], "")
+	padString(descriptor[574:702], "VLAUNCH")
+	padString(descriptor[702:813], "")
+	date := now.Format("20060102150405") + "00"
+	copy(descriptor[813:], date)
+	copy(descriptor[830:], date)
+	copy(descriptor[847:], "0000000000000000")
+	copy(descriptor[864:], date)
+	descriptor[881] = 1
+
+	terminator := make([]byte, sectorSize)
+	terminator[0] = 255
+	copy(terminator[1:], "CD001")
+	terminator[6] = 1
+
+	output, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	write := func(w io.Writer) error {
+		for _, data := range [][]byte{make([]byte, primaryDescriptorSector*sectorSize), descriptor, terminator, lPathTable, mPathTable, directory} {
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+
+		for _, file := range files {
+			if _, err := w.Write(file.Data); err != nil {
+				return err
+			}
+			if padding := int(sectors(len(file.Data)))*sectorSize - len(file.Data); padding > 0 {
+				if _, err := w.Write(make([]byte, padding)); err != nil {
+					return err
+				}
+			}
+		}
+		_, err := w.Write(make([]byte, paddingSectors*sectorSize))
+		return err
+	}
+
+	if err := write(output); err != nil {
+		output.Close()
+		os.Remove(filename)
+		return err
+	}
+	return output.Close()
+}
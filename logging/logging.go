@@ -0,0 +1,105 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// ParseLevel converts a level name (debug, info, warn, error) to a slog level
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("Invalid log level '%s'", name)
+	}
+	return level, nil
+}
+
+// NewHandler returns a handler writing records of at least the given level
+// to w, either as text or as JSON
+func NewHandler(w io.Writer, level slog.Level, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("Invalid log format '%s'", format)
+	}
+}
+
+// moduleHandler resolves the default handler for every record so that
+// loggers created at package initialization follow slog.SetDefault
+type moduleHandler struct {
+	module string
+	wrap   func(slog.Handler) slog.Handler
+}
+
+// moduleOutput is the handler set by SetHandler, if any
+var moduleOutput atomic.Pointer[slog.Handler]
+
+// SetHandler makes the loggers returned by Module write to handler instead of
+// the default logger, for the programs embedding vlaunch. A nil handler
+// restores the default logger.
+func SetHandler(handler slog.Handler) {
+	if handler == nil {
+		moduleOutput.Store(nil)
+	} else {
+		moduleOutput.Store(&handler)
+	}
+}
+
+// output returns the handler the module loggers write to
+func output() slog.Handler {
+	if handler := moduleOutput.Load(); handler != nil {
+		return *handler
+	}
+	return slog.Default().Handler()
+}
+
+func (h *moduleHandler) handler() slog.Handler {
+	handler := output().WithAttrs([]slog.Attr{slog.String("module", h.module)})
+	if h.wrap != nil {
+		handler = h.wrap(handler)
+	}
+	return handler
+}
+
+func (h *moduleHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return output().Enabled(ctx, level)
+}
+
+func (h *moduleHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler().Handle(ctx, record)
+}
+
+func (h *moduleHandler) with(wrap func(slog.Handler) slog.Handler) *moduleHandler {
+	previous := h.wrap
+	return &moduleHandler{
+		module: h.module,
+		wrap: func(handler slog.Handler) slog.Handler {
+			if previous != nil {
+				handler = previous(handler)
+			}
+			return wrap(handler)
+		},
+	}
+}
+
+func (h *moduleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *moduleHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+// Module returns a logger adding the module name to its records and
+// writing them to the default logger, or to the handler set by SetHandler
+func Module(name string) *slog.Logger {
+	return slog.New(&moduleHandler{module: name})
+}
@@ -0,0 +1,116 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// RotatingFile is a log file that is rotated once it reaches a maximum
+// size or age, keeping a limited number of previous files around
+type RotatingFile struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	file     *os.File
+	size     int64
+	opened   time.Time
+}
+
+func (r *RotatingFile) backupPath(index int) string {
+	return fmt.Sprintf("%s.%d", r.path, index)
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = fi.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+
+	os.Remove(r.backupPath(r.maxFiles))
+	for i := r.maxFiles - 1; i > 0; i-- {
+		os.Rename(r.backupPath(i), r.backupPath(i+1))
+	}
+
+	if r.maxFiles > 0 {
+		if err := os.Rename(r.path, r.backupPath(1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return r.open()
+}
+
+func (r *RotatingFile) expired() bool {
+	return r.maxAge > 0 && time.Since(r.opened) > r.maxAge
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if (r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize && r.size > 0) || r.expired() {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.file.Close()
+}
+
+// OpenRotatingFile opens the log file at path, rotating it when it exceeds
+// maxSize bytes or is older than maxAge. Zero disables the corresponding
+// limit. At most maxFiles previous files are retained.
+func OpenRotatingFile(path string, maxSize int64, maxAge time.Duration, maxFiles int) (*RotatingFile, error) {
+	r := &RotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		maxFiles: maxFiles,
+	}
+
+	// The age of an existing file is given by its last modification
+	if fi, err := os.Stat(path); err == nil && maxAge > 0 && time.Since(fi.ModTime()) > maxAge {
+		if err := r.rotate(); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
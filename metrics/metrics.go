@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/lebauce/vlaunch/logging"
+	"github.com/lebauce/vlaunch/vm"
+)
+
+var logger = logging.Module("metrics")
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func writeMetric(w io.Writer, name, kind, help, labels string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(w, "%s{%s} %v\n", name, labels, value)
+}
+
+// WriteMetrics writes the machine metrics in the Prometheus text format
+func WriteMetrics(w io.Writer, m *vm.Metrics) {
+	labels := fmt.Sprintf(`name="%s"`, escapeLabel(m.Name))
+
+	writeMetric(w, "vlaunch_vm_state", "gauge", "Current state of the machine.",
+		fmt.Sprintf(`%s,state="%s"`, labels, m.State), 1)
+	writeMetric(w, "vlaunch_vm_uptime_seconds", "gauge", "Time since the machine was started.",
+		labels, m.Uptime.Seconds())
+	if m.BootDuration > 0 {
+		writeMetric(w, "vlaunch_vm_boot_duration_seconds", "gauge", "Time taken by the guest to boot to userland.",
+			labels, m.BootDuration.Seconds())
+	}
+	writeMetric(w, "vlaunch_event_loop_errors_total", "counter", "Number of errors in the event loop.",
+		labels, m.EventLoopErrors)
+	writeMetric(w, "vlaunch_guest_property_changes_total", "counter", "Number of guest property changes.",
+		labels, m.GuestPropertyChanges)
+	writeMetric(w, "vlaunch_vm_cpus", "gauge", "Number of CPUs allotted to the machine.",
+		labels, m.CPUs)
+	writeMetric(w, "vlaunch_vm_memory_bytes", "gauge", "Memory allotted to the machine.",
+		labels, uint64(m.RAM)*1024*1024)
+}
+
+// Handler returns an HTTP handler exposing the metrics of the machine
+func Handler(machine *vm.VirtualMachine) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m, err := machine.Metrics()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w, m)
+	})
+}
+
+// Serve exposes the metrics of the machine on /metrics at the given address
+func Serve(address string, machine *vm.VirtualMachine) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(machine))
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logger.Debug("Metrics listener stopped", "error", err)
+		}
+	}()
+
+	logger.Info("Serving metrics", "address", listener.Addr().String())
+	return listener, nil
+}
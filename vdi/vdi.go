@@ -0,0 +1,172 @@
+package vdi
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Signature is found after the text pre-header of VDI images
+const Signature = 0xbeda107f
+
+// preHeaderSize is the size of the text describing the image at the start of
+// the file
+const preHeaderSize = 64
+
+// Block map entries of blocks that are not allocated
+const (
+	blockFree = 0xffffffff
+	blockZero = 0xfffffffe
+)
+
+// Image types
+const (
+	TypeNormal = 1 + iota
+	TypeFixed
+	TypeUndo
+	TypeDiff
+)
+
+// Header is the header of a VDI image, version 1.1
+type Header struct {
+	Signature        uint32
+	Version          uint32
+	HeaderSize       uint32
+	Type             uint32
+	Flags            uint32
+	Comment          [256]byte
+	BlocksOffset     uint32
+	DataOffset       uint32
+	Cylinders        uint32
+	Heads            uint32
+	Sectors          uint32
+	SectorSize       uint32
+	_                uint32
+	DiskSize         uint64
+	BlockSize        uint32
+	BlockExtraSize   uint32
+	Blocks           uint32
+	BlocksAllocated  uint32
+	UUID             [16]byte
+	ModificationUUID [16]byte
+	ParentUUID       [16]byte
+	ParentModUUID    [16]byte
+}
+
+// ReadHeader reads the header of a VDI image
+func ReadHeader(r io.ReaderAt) (*Header, error) {
+	h := &Header{}
+	if err := binary.Read(io.NewSectionReader(r, preHeaderSize, int64(binary.Size(h))), binary.LittleEndian, h); err != nil {
+		return nil, fmt.Errorf("Failed to read VDI header: %s", err.Error())
+	}
+
+	if h.Signature != Signature {
+		return nil, errors.New("Not a VDI image")
+	}
+	return h, nil
+}
+
+// validate checks that the header is consistent with itself and with the
+// size of the image
+func (h *Header) validate(fileSize int64) error {
+	if h.Version>>16 != 1 {
+		return fmt.Errorf("Unsupported VDI version %d.%d", h.Version>>16, h.Version&0xffff)
+	}
+
+	if h.Type < TypeNormal || h.Type > TypeDiff {
+		return fmt.Errorf("Invalid image type %d", h.Type)
+	}
+
+	if h.BlockSize == 0 || h.BlockSize&(h.BlockSize-1) != 0 {
+		return fmt.Errorf("Invalid block size %d", h.BlockSize)
+	}
+
+	if blocks := (h.DiskSize + uint64(h.BlockSize) - 1) / uint64(h.BlockSize); uint64(h.Blocks) != blocks {
+		return fmt.Errorf("The image has %d blocks, %d expected for %d bytes", h.Blocks, blocks, h.DiskSize)
+	}
+
+	if h.BlocksAllocated > h.Blocks {
+		return fmt.Errorf("%d blocks allocated out of %d", h.BlocksAllocated, h.Blocks)
+	}
+
+	if uint64(h.DataOffset) < uint64(h.BlocksOffset)+uint64(h.Blocks)*4 {
+		return errors.New("The block map overlaps the data")
+	}
+
+	if size := uint64(h.DataOffset) + uint64(h.BlocksAllocated)*uint64(h.BlockSize+h.BlockExtraSize); uint64(fileSize) < size {
+		return fmt.Errorf("The image is truncated, %d bytes instead of at least %d", fileSize, size)
+	}
+	return nil
+}
+
+// checkBlockMap checks that the allocated blocks are in the image and that
+// no two blocks share the same data
+func (h *Header) checkBlockMap(r io.ReaderAt) error {
+	blocks := make([]uint32, h.Blocks)
+	if err := binary.Read(io.NewSectionReader(r, int64(h.BlocksOffset), int64(h.Blocks)*4), binary.LittleEndian, blocks); err != nil {
+		return fmt.Errorf("Failed to read block map: %s", err.Error())
+	}
+
+	used := make(map[uint32]bool)
+	for i, block := range blocks {
+		if block == blockFree || block == blockZero {
+			continue
+		}
+
+		if block >= h.BlocksAllocated {
+			return fmt.Errorf("Block %d is mapped to %d, only %d blocks are allocated", i, block, h.BlocksAllocated)
+		}
+
+		if used[block] {
+			return fmt.Errorf("Block %d is mapped to %d, which is already used", i, block)
+		}
+		used[block] = true
+	}
+	return nil
+}
+
+// Checksum returns a checksum of the metadata of the image that does not
+// change when the guest writes to it, only when it is resized
+func (h *Header) Checksum() string {
+	hash := sha256.New()
+	for _, field := range []interface{}{
+		h.Version, h.Type, h.BlocksOffset, h.DataOffset, h.DiskSize,
+		h.BlockSize, h.BlockExtraSize, h.Blocks, h.UUID, h.ParentUUID,
+	} {
+		binary.Write(hash, binary.LittleEndian, field)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Check reads the header of the VDI image at location and checks that it
+// and the block map are consistent
+func Check(location string) (*Header, error) {
+	f, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := ReadHeader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.validate(fi.Size()); err != nil {
+		return nil, err
+	}
+
+	if err := h.checkBlockMap(f); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
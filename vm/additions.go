@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/lebauce/vbox"
+)
+
+// additionsISO returns the location of the Guest Additions ISO shipped
+// with VirtualBox
+func additionsISO() (string, error) {
+	properties, err := vbox.GetSystemProperties()
+	if err != nil {
+		return "", err
+	}
+	defer properties.Release()
+
+	return properties.GetDefaultAdditionsISO()
+}
+
+// parseVersion returns the numbers of a version such as 7.0.10r158379
+// or 6.1.38_Ubuntu
+func parseVersion(version string) []int {
+	if i := strings.IndexFunc(version, func(r rune) bool { return r != '.' && (r < '0' || r > '9') }); i != -1 {
+		version = version[:i]
+	}
+
+	var numbers []int
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			break
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
+
+// olderVersion returns whether version a is older than version b
+func olderVersion(a, b string) bool {
+	va, vb := parseVersion(a), parseVersion(b)
+	for i := 0; i < len(va) && i < len(vb); i++ {
+		if va[i] != vb[i] {
+			return va[i] < vb[i]
+		}
+	}
+	return len(va) < len(vb)
+}
+
+// isoImages returns the ISO images to attach to the machine, including
+// the Guest Additions when requested
+func (vm *VirtualMachine) isoImages() []string {
+	images := vm.cfg.GetStringSlice("iso_images")
+	if !vm.cfg.GetBool("guest_additions.attach") || vm.requireVirtualBox() != nil {
+		return images
+	}
+
+	iso, err := additionsISO()
+	if err != nil || iso == "" {
+		logger.Warn("Failed to find the Guest Additions ISO", "error", err)
+		return images
+	}
+	return append(images, iso)
+}
+
+// checkAdditions warns when the Guest Additions of the guest are older
+// than VirtualBox, and updates them if configured to
+func (vm *VirtualMachine) checkAdditions() {
+	if !vm.cfg.GetBool("guest_additions.check") || vm.requireVirtualBox() != nil {
+		return
+	}
+
+	guestVersion, err := vm.GetGuestProperty("/VirtualBox/GuestAdd/Version")
+	if err != nil || guestVersion == "" {
+		logger.Debug("Failed to get the Guest Additions version", "error", err)
+		return
+	}
+
+	hostVersion, err := vbox.GetVersion()
+	if err != nil {
+		logger.Debug("Failed to get the VirtualBox version", "error", err)
+		return
+	}
+
+	if !olderVersion(guestVersion, hostVersion) {
+		return
+	}
+
+	logger.Warn("The Guest Additions are older than VirtualBox", "guest", guestVersion, "host", hostVersion)
+	if !vm.cfg.GetBool("guest_additions.update") {
+		return
+	}
+
+	iso, err := additionsISO()
+	if err != nil {
+		logger.Error("Failed to find the Guest Additions ISO", "error", err)
+		return
+	}
+
+	guest, err := vm.console.GetGuest()
+	if err != nil {
+		logger.Error("Failed to get guest", "error", err)
+		return
+	}
+	defer guest.Release()
+
+	logger.Info("Updating the Guest Additions", "version", hostVersion)
+	if err := waitForProgress(guest.UpdateGuestAdditions(iso, nil, nil)); err != nil {
+		logger.Error("Failed to update the Guest Additions", "error", err)
+		return
+	}
+	logger.Info("Guest Additions updated, they will be used after the next reboot")
+}
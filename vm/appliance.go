@@ -0,0 +1,155 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+var importedKey = "vlaunch/Imported"
+
+func Import(cfg *viper.Viper, location string) (*VirtualMachine, error) {
+	if err := initVirtualBox(); err != nil {
+		return nil, err
+	}
+
+	appliance, err := vbox.CreateAppliance()
+	if err != nil {
+		return nil, err
+	}
+	defer appliance.Release()
+
+	logger.Info("Reading appliance", "location", location)
+	if err := waitForProgress(appliance.Read(location)); err != nil {
+		return nil, fmt.Errorf("Failed to read appliance: %s", err.Error())
+	}
+
+	if err := appliance.Interpret(); err != nil {
+		return nil, fmt.Errorf("Failed to interpret appliance: %s", err.Error())
+	}
+
+	if warnings, err := appliance.GetWarnings(); err == nil {
+		for _, warning := range warnings {
+			logger.Warn("Appliance warning", "warning", warning)
+		}
+	}
+
+	logger.Info("Importing appliance")
+	if err := waitForProgress(appliance.ImportMachines(nil)); err != nil {
+		return nil, fmt.Errorf("Failed to import appliance: %s", err.Error())
+	}
+
+	ids, err := appliance.GetMachines()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) != 1 {
+		return nil, fmt.Errorf("The appliance contains %d machines, only one is supported", len(ids))
+	}
+
+	machine, err := vbox.FindMachine(ids[0])
+	if err != nil {
+		return nil, err
+	}
+
+	vm := &VirtualMachine{cfg: cfg, machine: machine}
+	vm.hypervisor = &virtualBox{vm: vm}
+
+	session, smachine, err := vm.lockMachine()
+	if err != nil {
+		return nil, err
+	}
+	defer session.UnlockMachine()
+
+	if err := smachine.SetName(cfg.GetString("machine_name")); err != nil {
+		return nil, fmt.Errorf("Failed to rename imported machine: %s", err.Error())
+	}
+
+	configureResources(cfg, smachine)
+	configureGlobalGUI(cfg)
+	configureGUI(cfg, smachine)
+	smachine.SetExtraData(importedKey, "true")
+
+	if err := smachine.SaveSettings(); err != nil {
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+// IsImported returns whether the machine comes from an imported appliance,
+// in which case it is reused across runs instead of being recreated
+func (vm *VirtualMachine) IsImported() bool {
+	if vm.requireVirtualBox() != nil {
+		return false
+	}
+
+	value, err := vm.machine.GetExtraData(importedKey)
+	return err == nil && value == "true"
+}
+
+func (vm *VirtualMachine) IsRunning() (bool, error) {
+	state, err := vm.hypervisor.State()
+	if err != nil {
+		return false, err
+	}
+	return state == vbox.MachineState_Running || state == vbox.MachineState_Paused, nil
+}
+
+func (vm *VirtualMachine) WaitUntilStopped(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := vm.hypervisor.State()
+		if err != nil {
+			return err
+		}
+
+		if isStopped(state) || state == vbox.MachineState_Aborted {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Machine still %s after %s", StateName(state), timeout)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+func (vm *VirtualMachine) Export(location string) error {
+	if err := vm.requireVirtualBox(); err != nil {
+		return err
+	}
+
+	running, err := vm.IsRunning()
+	if err != nil {
+		return err
+	}
+
+	if running {
+		return errors.New("The machine must be stopped to be exported")
+	}
+
+	appliance, err := vbox.CreateAppliance()
+	if err != nil {
+		return err
+	}
+	defer appliance.Release()
+
+	description, err := vm.machine.ExportTo(appliance, location)
+	if err != nil {
+		return err
+	}
+	defer description.Release()
+
+	logger.Info("Exporting machine", "location", location)
+	if err := waitForProgress(appliance.Write("ovf-1.0", nil, location)); err != nil {
+		return fmt.Errorf("Failed to export appliance: %s", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,258 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/lebauce/vbox"
+	"github.com/lebauce/vlaunch/vmdk"
+)
+
+var NoSuchMachine = errors.New("No such machine")
+
+func absPath(location string) string {
+	if absolute, err := filepath.Abs(location); err == nil {
+		return absolute
+	}
+	return location
+}
+
+// expectedMedia returns the locations of the media the configuration
+// attaches to the machine
+func (vm *VirtualMachine) expectedMedia(disks []Disk) []string {
+	var locations []string
+	for i, disk := range disks {
+		location := disk.Location
+		if disk.Type == "raw" {
+			location = rawDescriptorPath(vm.cfg, i)
+		}
+		locations = append(locations, absPath(location))
+	}
+
+	for _, image := range vm.isoImages() {
+		locations = append(locations, absPath(image))
+	}
+
+	sort.Strings(locations)
+	return locations
+}
+
+// updateSettings applies the resources, GUI and integration settings of
+// the configuration to the machine
+func (vm *VirtualMachine) updateSettings() error {
+	session, machine, err := vm.lockMachine()
+	if err != nil {
+		return err
+	}
+	defer session.UnlockMachine()
+
+	cpus, ram := resources(vm.cfg)
+	machine.SetCPUHotPlugEnabled(vm.cfg.GetBool("cpu_hotplug"))
+	if current, err := machine.GetCPUCount(); err == nil && current != uint32(cpus) {
+		logger.Info("Updating machine setting", "setting", "cpus", "from", current, "to", cpus)
+		machine.SetCPUCount(uint(cpus))
+	}
+
+	if current, err := machine.GetMemorySize(); err == nil && current != uint32(ram) {
+		logger.Info("Updating machine setting", "setting", "ram", "from", current, "to", ram)
+		machine.SetMemorySize(uint(ram))
+	}
+
+	if err := configureVirtualization(vm.cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureFirmware(vm.cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureTime(vm.cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureDisplay(vm.cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureSerial(vm.cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureRecording(vm.cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureTeleporter(vm.cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureBandwidth(vm.cfg, machine); err != nil {
+		return err
+	}
+
+	configureGlobalGUI(vm.cfg)
+	configureGUI(vm.cfg, machine)
+	tagMachine(vm.cfg, machine, false)
+
+	if err := configureIntegration(vm.cfg, machine); err != nil {
+		return err
+	}
+
+	for name := range vm.cfg.GetStringMap("shared_folders") {
+		machine.RemoveSharedFolder(name)
+	}
+	configureSharedFolders(vm.cfg, machine)
+
+	return machine.SaveSettings()
+}
+
+// detachMedia detaches and closes all the media of the machine
+func (vm *VirtualMachine) detachMedia(attachments []vbox.MediumAttachment) error {
+	session, machine, err := vm.lockMachine()
+	if err != nil {
+		return err
+	}
+	defer session.UnlockMachine()
+
+	for _, attachment := range attachments {
+		if err := machine.DetachDevice(attachment.Controller, int(attachment.Port), int(attachment.Device)); err != nil {
+			return err
+		}
+	}
+
+	if err := machine.SaveSettings(); err != nil {
+		return err
+	}
+
+	// Closing the media lets the raw VMDK descriptors be generated again
+	for _, attachment := range attachments {
+		attachment.Medium.Close()
+	}
+
+	return nil
+}
+
+// updateDisks attaches the disks again if they differ from the
+// configuration, and repairs the raw VMDK descriptors otherwise
+func (vm *VirtualMachine) updateDisks(ctx context.Context, disks []Disk) error {
+	attachments, err := vm.machine.GetMediumAttachments()
+	if err != nil {
+		return err
+	}
+
+	var current []string
+	for _, attachment := range attachments {
+		if location, err := attachment.Medium.GetLocation(); err == nil {
+			current = append(current, location)
+		}
+	}
+	sort.Strings(current)
+
+	vm.rawDisks = make(map[string]bool)
+	if reflect.DeepEqual(current, vm.expectedMedia(disks)) {
+		repaired := true
+		for i, disk := range disks {
+			if disk.Type != "raw" {
+				continue
+			}
+
+			// Device names may have changed since the previous run
+			if err := vmdk.Repair(rawDescriptorPath(vm.cfg, i)); err != nil {
+				logger.Warn("Failed to repair raw VMDK", "error", err)
+				repaired = false
+			}
+		}
+
+		if repaired {
+			for _, attachment := range attachments {
+				location, _ := attachment.Medium.GetLocation()
+				for i, disk := range disks {
+					if disk.Type == "raw" && location == absPath(rawDescriptorPath(vm.cfg, i)) {
+						if id, err := attachment.Medium.GetId(); err == nil {
+							vm.rawDisks[id] = true
+						}
+					}
+				}
+			}
+			return nil
+		}
+	}
+
+	logger.Info("Attaching the disks again")
+	if err := vm.detachMedia(attachments); err != nil {
+		return fmt.Errorf("Failed to detach disks: %s", err.Error())
+	}
+
+	return vm.attachDisks(ctx, disks)
+}
+
+// Attach reuses the registered machine with the given name, such as one
+// kept by a previous run, instead of creating it. The settings that differ
+// from the configuration are updated.
+func (vm *VirtualMachine) Attach(ctx context.Context, name string) error {
+	if err := vm.requireVirtualBox(); err != nil {
+		return err
+	}
+
+	if err := initVirtualBox(); err != nil {
+		return err
+	}
+	gateFeatures(vm.cfg)
+
+	machine, err := vbox.FindMachine(name)
+	if err != nil {
+		return NoSuchMachine
+	}
+
+	session := vbox.Session{}
+	if err := session.Init(); err != nil {
+		return err
+	}
+
+	vm.machine = machine
+	vm.session = session
+
+	if err := vm.recoverSession(ctx); err != nil {
+		return err
+	}
+
+	if err := downloadDisk(ctx, vm.cfg); err != nil {
+		return err
+	}
+
+	disks, err := getDisks(vm.cfg)
+	if err != nil {
+		return err
+	}
+
+	specs, err := getControllerSpecs(vm.cfg)
+	if err != nil {
+		return err
+	}
+
+	vm.controllers = nil
+	for _, spec := range specs {
+		controller, err := machine.GetStorageControllerByName(spec.name)
+		if err != nil {
+			return fmt.Errorf("Machine '%s' has no %s controller, delete it to change the storage controllers", name, spec.name)
+		}
+		vm.controllers = append(vm.controllers, controller)
+	}
+
+	vm.hypervisor.(*virtualBox).setControllers(specs)
+
+	if fp := settingsFingerprint(vm.cfg); setupUnchanged(vm.cfg, "settings", fp) {
+		logger.Debug("Skipping unchanged machine settings", "name", name)
+	} else {
+		if err := vm.updateSettings(); err != nil {
+			return fmt.Errorf("Failed to update machine '%s': %s", name, err.Error())
+		}
+		recordSetup(vm.cfg, "settings", fp)
+	}
+
+	return vm.updateDisks(ctx, disks)
+}
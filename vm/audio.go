@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lebauce/vbox"
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/spf13/viper"
+)
+
+var audioDrivers = map[string]uint32{
+	"null":      vbox.AudioDriverType_Null,
+	"winmm":     vbox.AudioDriverType_WinMM,
+	"oss":       vbox.AudioDriverType_OSS,
+	"alsa":      vbox.AudioDriverType_ALSA,
+	"dsound":    vbox.AudioDriverType_DirectSound,
+	"coreaudio": vbox.AudioDriverType_CoreAudio,
+	"pulse":     vbox.AudioDriverType_Pulse,
+}
+
+var audioControllers = map[string]uint32{
+	"ac97": vbox.AudioControllerType_AC97,
+	"sb16": vbox.AudioControllerType_SB16,
+	"hda":  vbox.AudioControllerType_HDA,
+}
+
+func configureAudio(cfg *viper.Viper, machine vbox.Machine) error {
+	adapter, err := machine.GetAudioAdapter()
+	if err != nil {
+		return err
+	}
+	defer adapter.Release()
+
+	if !cfg.GetBool("audio.enabled") {
+		return adapter.SetEnabled(false)
+	}
+
+	driverName := strings.ToLower(cfg.GetString("audio.driver"))
+	if driverName == "" {
+		driverName = backend.AudioDriver
+	}
+
+	driver, found := audioDrivers[driverName]
+	if !found {
+		return fmt.Errorf("Invalid audio driver '%s'", driverName)
+	}
+
+	controllerName := strings.ToLower(cfg.GetString("audio.controller"))
+	controller, found := audioControllers[controllerName]
+	if !found {
+		return fmt.Errorf("Invalid audio controller '%s'", controllerName)
+	}
+
+	if err := adapter.SetAudioDriver(driver); err != nil {
+		return err
+	}
+
+	if err := adapter.SetAudioController(controller); err != nil {
+		return err
+	}
+
+	if err := adapter.SetEnabledIn(cfg.GetBool("audio.input")); err != nil {
+		return err
+	}
+
+	if err := adapter.SetEnabledOut(cfg.GetBool("audio.output")); err != nil {
+		return err
+	}
+
+	return adapter.SetEnabled(true)
+}
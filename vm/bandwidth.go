@@ -0,0 +1,170 @@
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+// bandwidthGroups are the bandwidth groups of the machine, by configuration
+// key, limiting the throughput of its hard disks and network adapters
+var bandwidthGroups = map[string]struct {
+	name      string
+	groupType uint32
+}{
+	"bandwidth.disk":    {"vlaunch-disk", vbox.BandwidthGroupType_Disk},
+	"bandwidth.network": {"vlaunch-network", vbox.BandwidthGroupType_Network},
+}
+
+// bandwidthUnits are the suffixes of the limits, as for VBoxManage: bytes for
+// uppercase ones and bits for lowercase ones
+var bandwidthUnits = map[byte]int64{
+	'K': 1024, 'M': 1024 * 1024, 'G': 1024 * 1024 * 1024,
+	'k': 1000 / 8, 'm': 1000 * 1000 / 8, 'g': 1000 * 1000 * 1000 / 8,
+}
+
+// parseBandwidth returns the bytes per second of a limit such as 20M, 20
+// megabytes per second, or 100m, 100 megabits per second
+func parseBandwidth(limit string) (int64, error) {
+	limit = strings.TrimSpace(limit)
+	if limit == "" {
+		return 0, nil
+	}
+
+	unit, digits := int64(1), limit
+	if u, found := bandwidthUnits[limit[len(limit)-1]]; found {
+		unit, digits = u, limit[:len(limit)-1]
+	}
+
+	value, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("Invalid bandwidth limit '%s'", limit)
+	}
+	return value * unit, nil
+}
+
+// bandwidthGroup returns the bandwidth group of the machine for a
+// configuration key, if the limit is set and the group was created
+func bandwidthGroup(cfg *viper.Viper, machine vbox.Machine, key string) (vbox.BandwidthGroup, bool, error) {
+	if cfg.GetString(key) == "" {
+		return vbox.BandwidthGroup{}, false, nil
+	}
+
+	control, err := machine.GetBandwidthControl()
+	if err != nil {
+		return vbox.BandwidthGroup{}, false, err
+	}
+	defer control.Release()
+
+	group, err := control.GetBandwidthGroup(bandwidthGroups[key].name)
+	if err != nil {
+		return vbox.BandwidthGroup{}, false, nil
+	}
+	return group, true, nil
+}
+
+// setBandwidthLimits sets the limits of the bandwidth groups of the machine,
+// creating the missing ones if create is set. It returns whether some
+// groups are missing. A group whose limit is unset is left unlimited.
+func setBandwidthLimits(cfg *viper.Viper, machine vbox.Machine, create bool) (bool, error) {
+	control, err := machine.GetBandwidthControl()
+	if err != nil {
+		return false, err
+	}
+	defer control.Release()
+
+	missing := false
+	for key, spec := range bandwidthGroups {
+		limit, err := parseBandwidth(cfg.GetString(key))
+		if err != nil {
+			return false, err
+		}
+
+		if group, err := control.GetBandwidthGroup(spec.name); err == nil {
+			err = group.SetMaxBytesPerSec(limit)
+			group.Release()
+			if err != nil {
+				return false, fmt.Errorf("Failed to set limit of bandwidth group %s: %s", spec.name, err.Error())
+			}
+			continue
+		}
+
+		if limit == 0 {
+			continue
+		}
+
+		if !create {
+			missing = true
+			continue
+		}
+
+		if err := control.CreateBandwidthGroup(spec.name, spec.groupType, limit); err != nil {
+			return false, fmt.Errorf("Failed to create bandwidth group %s: %s", spec.name, err.Error())
+		}
+		logger.Info("Created bandwidth group", "name", spec.name, "limit", limit)
+	}
+	return missing, nil
+}
+
+// configureBandwidth creates the bandwidth groups of the machine and assigns
+// them to its network adapters and to the hard disks already attached,
+// AttachDisk assigning them to the others
+func configureBandwidth(cfg *viper.Viper, machine vbox.Machine) error {
+	if _, err := setBandwidthLimits(cfg, machine, true); err != nil {
+		return err
+	}
+
+	if group, found, err := bandwidthGroup(cfg, machine, "bandwidth.network"); err != nil {
+		return err
+	} else if found {
+		defer group.Release()
+
+		adapters, err := networkAdapters(cfg)
+		if err != nil {
+			return err
+		}
+
+		for i := range adapters {
+			adapter, err := machine.GetNetworkAdapter(uint32(i))
+			if err != nil {
+				return err
+			}
+			err = adapter.SetBandwidthGroup(group)
+			adapter.Release()
+			if err != nil {
+				return fmt.Errorf("Failed to limit network adapter %d: %s", i, err.Error())
+			}
+		}
+	}
+
+	attachments, err := machine.GetMediumAttachments()
+	if err != nil {
+		return err
+	}
+
+	for _, attachment := range attachments {
+		if attachment.Type == vbox.DeviceType_HardDisk {
+			if err := limitDisk(cfg, machine, attachment.Controller, int(attachment.Port), int(attachment.Device)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// limitDisk assigns the disk bandwidth group, if any, to a hard disk
+func limitDisk(cfg *viper.Viper, machine vbox.Machine, controller string, port, device int) error {
+	group, found, err := bandwidthGroup(cfg, machine, "bandwidth.disk")
+	if err != nil || !found {
+		return err
+	}
+	defer group.Release()
+
+	if err := machine.SetBandwidthGroupForDevice(controller, port, device, group); err != nil {
+		return fmt.Errorf("Failed to limit disk %s %d:%d: %s", controller, port, device, err.Error())
+	}
+	return nil
+}
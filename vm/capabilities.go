@@ -0,0 +1,115 @@
+package vm
+
+import (
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+// Capabilities are the features provided by the VirtualBox installation
+type Capabilities struct {
+	Version string
+	ExtPack bool
+}
+
+// feature is an optional feature that depends on the VirtualBox version or
+// on the extension pack. Unsupported features are skipped.
+type feature struct {
+	name       string
+	minVersion string
+	extPack    bool
+	// extPackUntil is the version from which the feature is provided
+	// without the extension pack
+	extPackUntil string
+	enabled      func(cfg *viper.Viper) bool
+	disable      func(cfg *viper.Viper)
+}
+
+var features = []feature{
+	{
+		name:       "recording",
+		minVersion: "6.0",
+		enabled:    func(cfg *viper.Viper) bool { return cfg.GetBool("recording.enabled") },
+		disable:    func(cfg *viper.Viper) { cfg.Set("recording.enabled", false) },
+	},
+	{
+		name:       "nested hardware virtualization",
+		minVersion: "6.0",
+		enabled:    func(cfg *viper.Viper) bool { return cfg.GetBool("virtualization.nested_hw_virt") },
+		disable:    func(cfg *viper.Viper) { cfg.Set("virtualization.nested_hw_virt", false) },
+	},
+	{
+		// The USB 1.1 controller is used instead
+		name:         "USB 2.0 and 3.0 controllers",
+		extPack:      true,
+		extPackUntil: "7.0",
+		enabled: func(cfg *viper.Viper) bool {
+			controller := cfg.GetString("usb.controller")
+			return controller == "ehci" || controller == "xhci"
+		},
+		disable: func(cfg *viper.Viper) { cfg.Set("usb.controller", "ohci") },
+	},
+	{
+		name:    "VRDE",
+		extPack: true,
+		enabled: func(cfg *viper.Viper) bool { return cfg.GetBool("vrde.enabled") },
+		disable: func(cfg *viper.Viper) { cfg.Set("vrde.enabled", false) },
+	},
+}
+
+// ProbeCapabilities returns the version of VirtualBox and whether the
+// extension pack is usable
+func ProbeCapabilities() (*Capabilities, error) {
+	if err := initVirtualBox(); err != nil {
+		return nil, err
+	}
+
+	version, err := vbox.GetVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	extPack, err := isExtPackUsable(extensionPackName)
+	if err != nil {
+		logger.Warn("Failed to query extension packs", "error", err)
+	}
+
+	return &Capabilities{Version: version, ExtPack: extPack}, nil
+}
+
+// unsupported returns why the feature is not available with this
+// installation, or an empty string if it is
+func (c *Capabilities) unsupported(f *feature) string {
+	if f.minVersion != "" && olderVersion(c.Version, f.minVersion) {
+		return "VirtualBox " + f.minVersion + " or later is required"
+	}
+
+	if f.extPack && !c.ExtPack && (f.extPackUntil == "" || olderVersion(c.Version, f.extPackUntil)) {
+		return "the " + extensionPackName + " is required"
+	}
+
+	return ""
+}
+
+// gateFeatures disables the enabled features of the configuration that
+// the installation does not support, instead of failing later on
+func gateFeatures(cfg *viper.Viper) {
+	capabilities, err := ProbeCapabilities()
+	if err != nil {
+		logger.Warn("Failed to probe VirtualBox capabilities", "error", err)
+		return
+	}
+
+	logger.Info("Detected VirtualBox", "version", capabilities.Version, "extpack", capabilities.ExtPack)
+
+	for i := range features {
+		f := &features[i]
+		if !f.enabled(cfg) {
+			continue
+		}
+
+		if reason := capabilities.unsupported(f); reason != "" {
+			logger.Warn("Skipping unsupported feature", "feature", f.name, "reason", reason)
+			f.disable(cfg)
+		}
+	}
+}
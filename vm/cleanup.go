@@ -0,0 +1,188 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+// Extra data set on the machines created by vlaunch
+var (
+	managedKey   = "vlaunch/Managed"
+	clonedKey    = "vlaunch/Cloned"
+	saveStateKey = "vlaunch/SaveState"
+	dataPathKey  = "vlaunch/DataPath"
+	createdKey   = "vlaunch/Created"
+)
+
+// tagMachine marks the machine as created by vlaunch so that it can be
+// listed, and cleaned up if vlaunch does not exit cleanly
+func tagMachine(cfg *viper.Viper, machine vbox.Machine, cloned bool) {
+	machine.SetExtraData(managedKey, "true")
+	if cloned {
+		machine.SetExtraData(clonedKey, "true")
+	}
+
+	machine.SetExtraData(dataPathKey, absPath(cfg.GetString("data_path")))
+	if created, err := machine.GetExtraData(createdKey); err == nil && created == "" {
+		machine.SetExtraData(createdKey, time.Now().UTC().Format(time.RFC3339))
+	}
+
+	saveState := ""
+	if cfg.GetBool("save_state") {
+		saveState = "true"
+	}
+	machine.SetExtraData(saveStateKey, saveState)
+}
+
+// isOrphan returns whether a machine created by vlaunch was left behind,
+// either aborted or saved while its state was not meant to be kept
+func isOrphan(machine vbox.Machine) (bool, error) {
+	if managed, err := machine.GetExtraData(managedKey); err != nil || managed != "true" {
+		return false, err
+	}
+
+	state, err := machine.GetState()
+	if err != nil {
+		return false, err
+	}
+
+	switch state {
+	case vbox.MachineState_Aborted:
+		return true, nil
+	case vbox.MachineState_Saved:
+		saveState, err := machine.GetExtraData(saveStateKey)
+		return err == nil && saveState != "true", err
+	default:
+		return false, nil
+	}
+}
+
+// isRawDescriptor returns whether the file is a raw VMDK descriptor, or
+// partition table copy, generated by vlaunch in the data path
+func isRawDescriptor(dataPath, location string) bool {
+	name := filepath.Base(location)
+	return filepath.Dir(absPath(location)) == absPath(dataPath) &&
+		strings.HasPrefix(name, "raw") && strings.HasSuffix(name, ".vmdk")
+}
+
+// removeMachine unregisters the machine and deletes its generated media
+func removeMachine(ctx context.Context, dataPath string, machine vbox.Machine) error {
+	cloned, _ := machine.GetExtraData(clonedKey)
+
+	media, err := machine.Unregister(vbox.CleanupMode_DetachAllReturnHardDisksOnly)
+	if err != nil {
+		return err
+	}
+
+	var generated []vbox.Medium
+	for _, medium := range media {
+		if location, err := medium.GetLocation(); err == nil && (cloned == "true" || isRawDescriptor(dataPath, location)) {
+			generated = append(generated, medium)
+		} else {
+			medium.Close()
+		}
+	}
+
+	progress, err := machine.DeleteConfig(generated)
+	return waitForProgressContext(ctx, progress, err)
+}
+
+// Cleanup unregisters the machines of the data path left behind by vlaunch
+// processes that did not exit cleanly, except the configured machine, and
+// deletes the raw VMDK descriptors of the data path that no machine uses.
+// It returns what was removed, nothing is removed in dry run mode.
+func Cleanup(ctx context.Context, cfg *viper.Viper, dryRun bool) ([]string, error) {
+	if cfg.GetString("hypervisor") != "virtualbox" {
+		return nil, NotSupported
+	}
+
+	if err := initVirtualBox(); err != nil {
+		return nil, err
+	}
+
+	machines, err := vbox.GetMachines()
+	if err != nil {
+		return nil, err
+	}
+
+	dataPath := cfg.GetString("data_path")
+	used := make(map[string]bool)
+
+	var removed []string
+	for _, machine := range machines {
+		name, _ := machine.GetName()
+
+		orphan, err := isOrphan(machine)
+		if err != nil {
+			logger.Warn("Failed to check machine", "name", name, "error", err)
+		}
+
+		// Only the machines of this data path are cleaned up, the current
+		// machine being recovered when it is attached
+		if orphan {
+			owner, _ := machine.GetExtraData(dataPathKey)
+			orphan = owner == absPath(dataPath) && name != cfg.GetString("machine_name")
+		}
+
+		if !orphan {
+			attachments, err := machine.GetMediumAttachments()
+			if err != nil {
+				return removed, err
+			}
+
+			for _, attachment := range attachments {
+				if location, err := attachment.Medium.GetLocation(); err == nil {
+					used[absPath(location)] = true
+				}
+			}
+			continue
+		}
+
+		if !dryRun {
+			logger.Info("Removing orphaned machine", "name", name)
+			if err := removeMachine(ctx, dataPath, machine); err != nil {
+				return removed, fmt.Errorf("Failed to remove machine '%s': %s", name, err.Error())
+			}
+		}
+		removed = append(removed, "machine "+name)
+	}
+
+	// The descriptors of this configuration may be set up before the machine
+	// is registered, by an elevated vlaunch
+	if disks, err := getDisks(cfg); err == nil {
+		for i, disk := range disks {
+			if disk.Type == "raw" {
+				used[absPath(rawDescriptorPath(cfg, i))] = true
+			}
+		}
+	}
+
+	descriptors, err := filepath.Glob(filepath.Join(dataPath, "raw*.vmdk"))
+	if err != nil {
+		return removed, err
+	}
+
+	for _, descriptor := range descriptors {
+		if strings.HasSuffix(descriptor, "-pt.vmdk") || used[absPath(descriptor)] {
+			continue
+		}
+
+		if !dryRun {
+			logger.Info("Removing stale raw VMDK", "path", descriptor)
+			os.Remove(strings.TrimSuffix(descriptor, ".vmdk") + "-pt.vmdk")
+			if err := os.Remove(descriptor); err != nil {
+				return removed, err
+			}
+		}
+		removed = append(removed, "file "+descriptor)
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,94 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lebauce/vbox"
+)
+
+var baseSnapshotName = "vlaunch-base"
+
+func getBaseSnapshot(base *VirtualMachine) (vbox.Snapshot, error) {
+	if count, err := base.machine.GetSnapshotCount(); err != nil {
+		return vbox.Snapshot{}, err
+	} else if count == 0 {
+		// Linked clones are made against a snapshot of the base machine
+		logger.Info("Taking snapshot of the base machine", "snapshot", baseSnapshotName)
+		if err := base.Snapshot(baseSnapshotName, "Base snapshot for vlaunch linked clones"); err != nil {
+			return vbox.Snapshot{}, err
+		}
+	}
+
+	return base.machine.GetCurrentSnapshot()
+}
+
+func (vm *VirtualMachine) createClone(ctx context.Context, baseName string) error {
+	cfg := vm.cfg
+
+	if err := initVirtualBox(); err != nil {
+		return err
+	}
+
+	baseMachine, err := vbox.FindMachine(baseName)
+	if err != nil {
+		return fmt.Errorf("Failed to find base machine '%s': %s", baseName, err.Error())
+	}
+	base := &VirtualMachine{cfg: cfg, machine: baseMachine}
+
+	snapshot, err := getBaseSnapshot(base)
+	if err != nil {
+		return fmt.Errorf("Failed to get snapshot of base machine: %s", err.Error())
+	}
+	defer snapshot.Release()
+
+	snapshotMachine, err := snapshot.GetMachine()
+	if err != nil {
+		return err
+	}
+
+	osType, err := baseMachine.GetOSTypeId()
+	if err != nil {
+		return err
+	}
+
+	machine, err := vbox.CreateMachine(cfg.GetString("data_path"), cfg.GetString("machine_name"), osType, "")
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Creating linked clone", "base", baseName)
+	progress, err := snapshotMachine.CloneTo(machine, vbox.CloneMode_MachineState, []uint32{vbox.CloneOptions_Link})
+	if err := waitForProgressContext(ctx, progress, err); err != nil {
+		return fmt.Errorf("Failed to clone machine: %s", err.Error())
+	}
+
+	if err := machine.Register(); err != nil {
+		return err
+	}
+
+	vm.machine = machine
+	vm.cloned = true
+
+	session, smachine, err := vm.lockMachine()
+	if err != nil {
+		return err
+	}
+
+	configureResources(cfg, smachine)
+	configureGlobalGUI(cfg)
+	configureGUI(cfg, smachine)
+	tagMachine(cfg, smachine, true)
+
+	if err := smachine.SaveSettings(); err != nil {
+		session.UnlockMachine()
+		return err
+	}
+
+	if err := session.UnlockMachine(); err != nil {
+		return err
+	}
+
+	vm.session = session
+	return nil
+}
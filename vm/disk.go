@@ -0,0 +1,145 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/lebauce/vbox"
+)
+
+var diskFormats = map[string]string{
+	"vdi":  "VDI",
+	"vmdk": "VMDK",
+	"vhd":  "VHD",
+}
+
+// CreateDisk creates a blank disk image of the given format and size in
+// bytes, dynamically allocated unless fixed is set
+func CreateDisk(ctx context.Context, location, format string, size uint64, fixed bool) error {
+	formatName, found := diskFormats[format]
+	if !found {
+		return fmt.Errorf("Invalid disk format '%s'", format)
+	}
+
+	if err := initVirtualBox(); err != nil {
+		return err
+	}
+
+	medium, err := vbox.CreateHardDisk(formatName, location)
+	if err != nil {
+		return err
+	}
+	defer medium.Release()
+
+	variant := vbox.MediumVariant_Standard
+	if fixed {
+		variant = vbox.MediumVariant_Fixed
+	}
+
+	logger.Info("Creating disk", "location", location, "format", formatName, "size", size)
+	progress, err := medium.CreateBaseStorage(size, []uint32{variant})
+	if err := waitForProgressContext(ctx, progress, err); err != nil {
+		return fmt.Errorf("Failed to create disk %s: %s", location, err.Error())
+	}
+
+	// The medium is registered on creation, it is closed so that it can be
+	// attached by another machine
+	return medium.Close()
+}
+
+// diskResizedProperty is set to the new size of the disk in bytes once it
+// was grown, for the guest to grow its partitions and file systems
+const diskResizedProperty = "/vlaunch/disk-resized"
+
+// resizeMedium grows a VDI or VHD disk image to the given size in bytes
+func resizeMedium(ctx context.Context, medium vbox.Medium, size uint64) error {
+	format, err := medium.GetFormat()
+	if err != nil {
+		return err
+	}
+
+	if format != "VDI" && format != "VHD" {
+		return fmt.Errorf("Only VDI and VHD disks can be resized, not %s", format)
+	}
+
+	current, err := medium.GetLogicalSize()
+	if err != nil {
+		return err
+	}
+
+	if size < current {
+		return fmt.Errorf("Disks can only be grown, the disk is already %d bytes", current)
+	} else if size == current {
+		return nil
+	}
+
+	location, _ := medium.GetLocation()
+	logger.Info("Resizing disk", "location", location, "size", size, "previous", current)
+	progress, err := medium.Resize(size)
+	if err := waitForProgressContext(ctx, progress, err); err != nil {
+		return fmt.Errorf("Failed to resize disk %s: %s", location, err.Error())
+	}
+	return nil
+}
+
+// ResizeDisk grows a disk image that no running machine uses to the given
+// size in bytes
+func ResizeDisk(ctx context.Context, location string, size uint64) error {
+	if err := initVirtualBox(); err != nil {
+		return err
+	}
+
+	medium, err := vbox.OpenMedium(location, vbox.DeviceType_HardDisk, vbox.AccessMode_ReadWrite, false)
+	if err != nil {
+		return fmt.Errorf("Failed to open disk %s: %s", location, err.Error())
+	}
+	defer medium.Close()
+
+	return resizeMedium(ctx, medium, size)
+}
+
+// ResizeDisk grows the first hard disk of the running machine that is not a
+// raw disk to the given size in bytes, setting the /vlaunch/disk-resized
+// guest property if notify is set
+func (vm *VirtualMachine) ResizeDisk(ctx context.Context, size uint64, notify bool) error {
+	if err := vm.requireVirtualBox(); err != nil {
+		return err
+	}
+
+	attachments, err := vm.machine.GetMediumAttachments()
+	if err != nil {
+		return err
+	}
+
+	for _, attachment := range attachments {
+		if attachment.Type != vbox.DeviceType_HardDisk {
+			continue
+		}
+
+		base, err := attachment.Medium.GetBase()
+		if err != nil {
+			return err
+		}
+
+		if id, err := base.GetId(); err != nil || vm.rawDisks[id] {
+			continue
+		}
+
+		// Immutable disks write to a differencing image dropped on exit
+		if mediumType, err := base.GetType(); err == nil && mediumType == vbox.MediumType_Immutable {
+			return errors.New("Immutable disks can not be resized")
+		}
+
+		if err := resizeMedium(ctx, attachment.Medium, size); err != nil {
+			return err
+		}
+
+		if notify {
+			return vm.SetGuestProperty(diskResizedProperty, strconv.FormatUint(size, 10), "RDONLYGUEST")
+		}
+		return nil
+	}
+	return errors.New("The machine has no disk image to resize")
+}
@@ -0,0 +1,110 @@
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+// displayModes are the extra data of the GUI switching the window of the
+// machine to each display mode
+var displayModes = map[string]map[string]string{
+	"window":     {"GUI/Fullscreen": "false", "GUI/Seamless": "off"},
+	"fullscreen": {"GUI/Fullscreen": "true", "GUI/Seamless": "off"},
+	"seamless":   {"GUI/Fullscreen": "false", "GUI/Seamless": "on"},
+}
+
+// screenKey returns the extra data of a guest screen, the key of the first
+// screen having no index
+func screenKey(key string, screen int) string {
+	if screen == 0 {
+		return key
+	}
+	return key + strconv.Itoa(screen)
+}
+
+// parseResolution parses a resolution given as WIDTHxHEIGHT
+func parseResolution(resolution string) (int, int, error) {
+	fields := strings.SplitN(resolution, "x", 2)
+	if len(fields) == 2 {
+		width, err1 := strconv.Atoi(fields[0])
+		height, err2 := strconv.Atoi(fields[1])
+		if err1 == nil && err2 == nil && width > 0 && height > 0 {
+			return width, height, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("Invalid resolution '%s', expected WIDTHxHEIGHT", resolution)
+}
+
+// displayExtraData returns the extra data of the GUI for the display mode,
+// the initial resolution of the guest screens and the host screens they are
+// shown on in full screen
+func displayExtraData(cfg *viper.Viper) map[string]string {
+	settings := make(map[string]string)
+	for name, value := range displayModes[cfg.GetString("display.mode")] {
+		settings[name] = value
+	}
+
+	for screen, resolution := range cfg.GetStringSlice("display.resolutions") {
+		width, height, err := parseResolution(resolution)
+		if err != nil {
+			logger.Warn("Ignoring resolution hint", "screen", screen, "error", err)
+			continue
+		}
+		settings[screenKey("GUI/LastGuestSizeHint", screen)] = fmt.Sprintf("%d,%d", width, height)
+	}
+
+	for screen, hostScreen := range cfg.GetStringSlice("display.host_screens") {
+		settings[screenKey("GUI/VirtualScreenToHostScreen", screen)] = hostScreen
+	}
+
+	return settings
+}
+
+// configureMonitors sets the number of screens of the guest
+func configureMonitors(cfg *viper.Viper, machine vbox.Machine) error {
+	if err := machine.SetMonitorCount(uint(cfg.GetInt("display.monitors"))); err != nil {
+		return fmt.Errorf("Failed to set monitor count: %s", err.Error())
+	}
+	return nil
+}
+
+// SetDisplayMode switches the window of the machine to a display mode,
+// window, fullscreen or seamless, showing the guest screen on a host screen
+// if hostScreen is not negative
+func (vm *VirtualMachine) SetDisplayMode(mode string, screen, hostScreen int) error {
+	if err := vm.requireVirtualBox(); err != nil {
+		return err
+	}
+
+	extraData, found := displayModes[mode]
+	if !found {
+		return fmt.Errorf("Invalid display mode '%s', expected window, fullscreen or seamless", mode)
+	}
+
+	if vm.cfg.GetString("frontend") == "headless" {
+		return fmt.Errorf("The machine has no window with the headless frontend")
+	}
+
+	if monitors := vm.cfg.GetInt("display.monitors"); screen < 0 || screen >= monitors {
+		return fmt.Errorf("Invalid screen %d, the machine has %d", screen, monitors)
+	}
+
+	if hostScreen >= 0 {
+		if err := vm.machine.SetExtraData(screenKey("GUI/VirtualScreenToHostScreen", screen), strconv.Itoa(hostScreen)); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range sortedExtraData(extraData) {
+		if err := vm.machine.SetExtraData(name, extraData[name]); err != nil {
+			return fmt.Errorf("Failed to set display mode: %s", err.Error())
+		}
+	}
+
+	logger.Info("Set display mode", "mode", mode, "screen", screen, "host_screen", hostScreen)
+	return nil
+}
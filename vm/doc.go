@@ -0,0 +1,23 @@
+// Package vm creates, runs and controls the machines of vlaunch. Programs
+// embedding vlaunch describe a machine with a Spec and create it with New:
+//
+//	machine, err := vm.New(vm.Spec{
+//		Name:     "ufo",
+//		DataPath: "/var/lib/launcher",
+//		Disks:    []vm.Disk{{Type: "vdi", Location: "/var/lib/launcher/ufo.vdi"}},
+//	}, vm.WithLogger(logger))
+//	if err == nil {
+//		err = machine.Create(ctx)
+//	}
+//	if err == nil {
+//		err = machine.Start(ctx)
+//	}
+//	if err == nil {
+//		err = machine.Run(ctx)
+//	}
+//
+// Spec, New, its options, Disk, Event and the exported methods of
+// VirtualMachine are kept compatible across releases. The configuration of a
+// machine can also be given as a vlaunch configuration through WithConfig,
+// whose keys may change between releases.
+package vm
@@ -0,0 +1,179 @@
+package vm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// downloadLocation returns where the disk image of disk_url is stored
+func downloadLocation(cfg *viper.Viper) (string, error) {
+	if location := cfg.GetString("disk_location"); location != "" {
+		return location, nil
+	}
+
+	u, err := url.Parse(cfg.GetString("disk_url"))
+	if err != nil {
+		return "", fmt.Errorf("Invalid disk URL: %s", err.Error())
+	}
+
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return "", fmt.Errorf("No file name in disk URL '%s', set disk_location", u)
+	}
+	return path.Join(cfg.GetString("data_path"), name), nil
+}
+
+func fileChecksum(location string) (string, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// progressWriter reports the advancement of a download
+type progressWriter struct {
+	ctx      context.Context
+	reporter ProgressReporter
+	written  int64
+	total    int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if w.reporter != nil {
+		if w.reporter.Cancelled() {
+			return 0, OperationCancelled
+		}
+
+		w.written += int64(len(p))
+		if w.total > 0 {
+			w.reporter.Update("Downloading disk image", uint32(w.written*100/w.total))
+		}
+	}
+	return len(p), nil
+}
+
+// fetch downloads url to the partial file, resuming a previous download
+func fetch(ctx context.Context, url, partial string) error {
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		logger.Info("Resuming download", "url", url, "offset", offset)
+	case http.StatusOK:
+		// The server does not support ranges, start over
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The previous download was complete
+		return nil
+	default:
+		return fmt.Errorf("Server returned %s", response.Status)
+	}
+
+	progress := &progressWriter{ctx: ctx, reporter: progressReporter(ctx), written: offset}
+	if response.ContentLength > 0 {
+		progress.total = offset + response.ContentLength
+	}
+
+	_, err = io.Copy(io.MultiWriter(file, progress), response.Body)
+	return err
+}
+
+// downloadDisk downloads the disk image of disk_url to the data path if it
+// is not there yet, and uses it as the disk location. The image is only
+// used once its checksum is verified.
+func downloadDisk(ctx context.Context, cfg *viper.Viper) error {
+	diskURL := cfg.GetString("disk_url")
+	if diskURL == "" {
+		return nil
+	}
+
+	location, err := downloadLocation(cfg)
+	if err != nil {
+		return err
+	}
+	cfg.Set("disk_location", location)
+
+	checksum := strings.ToLower(cfg.GetString("disk_sha256"))
+
+	// The checksum of a verified image is kept next to it so that it is
+	// not computed on every run
+	verified := location + ".sha256"
+	if content, err := os.ReadFile(verified); err == nil && strings.TrimSpace(string(content)) == checksum {
+		if _, err := os.Stat(location); err == nil {
+			return nil
+		}
+	}
+
+	partial := location + ".part"
+	logger.Info("Downloading disk image", "url", diskURL, "path", location)
+	if err := fetch(ctx, diskURL, partial); err != nil {
+		return fmt.Errorf("Failed to download disk image: %s", err.Error())
+	}
+
+	actual, err := fileChecksum(partial)
+	if err != nil {
+		return err
+	}
+
+	if actual != checksum {
+		os.Remove(partial)
+		return fmt.Errorf("Checksum mismatch for %s: expected %s, got %s", diskURL, checksum, actual)
+	}
+
+	if err := os.Rename(partial, location); err != nil {
+		return err
+	}
+
+	return os.WriteFile(verified, []byte(checksum+"\n"), 0644)
+}
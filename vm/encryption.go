@@ -0,0 +1,90 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+var defaultCipher = "AES-XTS256-PLAIN64"
+
+// encryptionPassword returns the disk encryption password, given either
+// directly or in a file, or an empty string if encryption is not used
+func encryptionPassword(cfg *viper.Viper) (string, error) {
+	if password := cfg.GetString("encryption.password"); password != "" {
+		return password, nil
+	}
+
+	passwordFile := cfg.GetString("encryption.password_file")
+	if passwordFile == "" {
+		return "", nil
+	}
+
+	content, err := ioutil.ReadFile(passwordFile)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read encryption password: %s", err.Error())
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// encryptionID returns the identifier the password is registered with
+func encryptionID(cfg *viper.Viper) string {
+	if id := cfg.GetString("encryption.id"); id != "" {
+		return id
+	}
+	return cfg.GetString("machine_name")
+}
+
+func isEncrypted(medium vbox.Medium) bool {
+	keyID, err := medium.GetProperty("CRYPT/KeyId")
+	return err == nil && keyID != ""
+}
+
+// encryptDisk encrypts a disk image with the configured password, unless
+// it is already encrypted
+func encryptDisk(ctx context.Context, cfg *viper.Viper, medium vbox.Medium) error {
+	if isEncrypted(medium) {
+		return nil
+	}
+
+	password, err := encryptionPassword(cfg)
+	if err != nil {
+		return err
+	}
+
+	if password == "" {
+		return fmt.Errorf("A password is required to encrypt disks")
+	}
+
+	cipher := cfg.GetString("encryption.cipher")
+	if cipher == "" {
+		cipher = defaultCipher
+	}
+
+	location, _ := medium.GetLocation()
+	logger.Info("Encrypting disk", "location", location, "cipher", cipher)
+
+	progress, err := medium.ChangeEncryption("", cipher, password, encryptionID(cfg))
+	if err := waitForProgressContext(ctx, progress, err); err != nil {
+		return fmt.Errorf("Failed to encrypt disk %s: %s", location, err.Error())
+	}
+	return nil
+}
+
+// unlockDisks gives the encryption password to the running machine so that
+// it can access its encrypted disks
+func (vm *VirtualMachine) unlockDisks() error {
+	password, err := encryptionPassword(vm.cfg)
+	if err != nil || password == "" {
+		return err
+	}
+
+	if err := vm.console.AddDiskEncryptionPassword(encryptionID(vm.cfg), password, false); err != nil {
+		return fmt.Errorf("Failed to unlock encrypted disks: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package vm
+
+import (
+	"fmt"
+	"sync"
+)
+
+type EventType int
+
+const (
+	StateChangedEvent EventType = iota
+	GuestPropertyChangedEvent
+	SessionStateChangedEvent
+	AdditionsStateChangedEvent
+	NetworkAdapterChangedEvent
+	SharedFolderChangedEvent
+	RuntimeErrorEvent
+	DeviceChangedEvent
+)
+
+// Event is implemented by all the events sent to subscribers
+type Event interface {
+	Type() EventType
+}
+
+type StateChanged struct {
+	State uint32
+}
+
+func (e StateChanged) Type() EventType { return StateChangedEvent }
+
+type GuestPropertyChanged struct {
+	Name      string
+	Value     string
+	Timestamp int64
+	Flags     string
+}
+
+func (e GuestPropertyChanged) Type() EventType { return GuestPropertyChangedEvent }
+
+type SessionStateChanged struct {
+	State uint32
+}
+
+func (e SessionStateChanged) Type() EventType { return SessionStateChangedEvent }
+
+type AdditionsStateChanged struct {
+	RunLevel uint32
+}
+
+func (e AdditionsStateChanged) Type() EventType { return AdditionsStateChangedEvent }
+
+type NetworkAdapterChanged struct {
+	Slot uint32
+}
+
+func (e NetworkAdapterChanged) Type() EventType { return NetworkAdapterChangedEvent }
+
+type SharedFolderChanged struct {
+	Scope uint32
+}
+
+func (e SharedFolderChanged) Type() EventType { return SharedFolderChangedEvent }
+
+type RuntimeError struct {
+	Fatal   bool
+	ID      string
+	Message string
+}
+
+func (e RuntimeError) Type() EventType { return RuntimeErrorEvent }
+
+// DeviceChanged is sent when a raw device of the machine is unplugged from
+// the host or plugged back
+type DeviceChanged struct {
+	Device  string
+	Present bool
+}
+
+func (e DeviceChanged) Type() EventType { return DeviceChangedEvent }
+
+type subscriber struct {
+	events  chan Event
+	types   map[EventType]bool
+	pattern string
+}
+
+// wants returns whether the event is of interest to the subscriber
+func (s *subscriber) wants(event Event) bool {
+	if len(s.types) != 0 && !s.types[event.Type()] {
+		return false
+	}
+
+	if prop, ok := event.(GuestPropertyChanged); ok {
+		return MatchPropertyPattern(s.pattern, prop.Name)
+	}
+	return true
+}
+
+type eventBus struct {
+	sync.Mutex
+	subscribers []*subscriber
+	counts      map[EventType]uint64
+}
+
+// Subscribe returns a channel receiving the events of the given types, or all
+// the events if no type is specified. The channel is closed when Run returns.
+func (vm *VirtualMachine) Subscribe(eventTypes ...EventType) <-chan Event {
+	return vm.subscribe("", eventTypes)
+}
+
+// SubscribeProperties returns a channel receiving the changes of the guest
+// properties whose name matches the pattern, see MatchPropertyPattern.
+// The channel is closed when Run returns.
+func (vm *VirtualMachine) SubscribeProperties(pattern string) (<-chan Event, error) {
+	return vm.subscribe(pattern, []EventType{GuestPropertyChangedEvent}), nil
+}
+
+func (vm *VirtualMachine) subscribe(pattern string, eventTypes []EventType) <-chan Event {
+	s := &subscriber{
+		events:  make(chan Event, 64),
+		types:   make(map[EventType]bool),
+		pattern: pattern,
+	}
+	for _, eventType := range eventTypes {
+		s.types[eventType] = true
+	}
+
+	vm.events.Lock()
+	vm.events.subscribers = append(vm.events.subscribers, s)
+	vm.events.Unlock()
+
+	return s.events
+}
+
+// Unsubscribe stops sending events to a channel returned by Subscribe and
+// closes it
+func (vm *VirtualMachine) Unsubscribe(events <-chan Event) {
+	vm.events.Lock()
+	defer vm.events.Unlock()
+
+	for i, s := range vm.events.subscribers {
+		if s.events == events {
+			close(s.events)
+			vm.events.subscribers = append(vm.events.subscribers[:i], vm.events.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *eventBus) publish(event Event) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.counts == nil {
+		b.counts = make(map[EventType]uint64)
+	}
+	b.counts[event.Type()]++
+
+	for _, s := range b.subscribers {
+		if !s.wants(event) {
+			continue
+		}
+
+		// A slow subscriber must not block the event loop
+		select {
+		case s.events <- event:
+		default:
+			logger.Warn("Dropping event, subscriber is not keeping up", "event", fmt.Sprintf("%T", event))
+		}
+	}
+}
+
+// count returns the number of events of the given type published so far
+func (b *eventBus) count(eventType EventType) uint64 {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.counts[eventType]
+}
+
+func (b *eventBus) close() {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, s := range b.subscribers {
+		close(s.events)
+	}
+	b.subscribers = nil
+}
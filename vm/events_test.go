@@ -0,0 +1,24 @@
+package vm
+
+import "testing"
+
+func TestSubscribePropertiesUnfiltered(t *testing.T) {
+	vm := &VirtualMachine{}
+
+	events, err := vm.SubscribeProperties("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Unsubscribe(events)
+
+	vm.events.publish(GuestPropertyChanged{Name: "/VirtualBox/GuestInfo/OS/Product", Value: "Linux"})
+
+	select {
+	case event := <-events:
+		if prop := event.(GuestPropertyChanged); prop.Name != "/VirtualBox/GuestInfo/OS/Product" {
+			t.Errorf("Expected /VirtualBox/GuestInfo/OS/Product, got %s", prop.Name)
+		}
+	default:
+		t.Error("An unfiltered subscription did not receive the property change")
+	}
+}
@@ -0,0 +1,136 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/spf13/viper"
+)
+
+// hostKeyExtraData is the extra data holding the codes of the host key
+// combination of the machine
+const hostKeyExtraData = "GUI/Input/HostKeyCombination"
+
+// defaultGlobalExtraData are the extra data of VirtualBox set unless
+// extra_data.defaults is disabled: the guest may use any resolution and
+// the GUI neither checks for updates nor shows its tray icon
+var defaultGlobalExtraData = map[string]string{
+	"GUI/MaxGuestResolution": "any",
+	"GUI/Input/AutoCapture":  "true",
+	"GUI/TrayIcon/Enabled":   "false",
+	"GUI/UpdateCheckCount":   "2",
+	"GUI/UpdateDate":         "never",
+	"GUI/RegistrationData":   "triesLeft=0",
+	"GUI/SUNOnlineData":      "0",
+}
+
+// defaultMachineExtraData are the extra data of the machine set unless
+// extra_data.defaults is disabled
+var defaultMachineExtraData = map[string]string{
+	"GUI/SaveMountedAtRuntime": "false",
+	"GUI/Seamless":             "off",
+	"GUI/AutoresizeGuest":      "on",
+}
+
+// defaultSuppressedMessages are the messages of the GUI that are not shown
+// unless extra_data.defaults is disabled
+var defaultSuppressedMessages = []string{
+	"remindAboutAutoCapture", "confirmInputCapture",
+	"remindAboutMouseIntegrationOn", "remindAboutMouseIntegrationOff",
+	"remindAboutInaccessibleMedia", "remindAboutWrongColorDepth", "confirmGoingFullscreen",
+	"showRuntimeError.warning.HostAudioNotResponding",
+	"showRuntimeError.warning.3DSupportIncompatibleAdditions",
+}
+
+// parseExtraData parses extra data given as KEY=VALUE, the keys of
+// VirtualBox being case sensitive unlike the ones of the configuration
+func parseExtraData(entries []string) (map[string]string, error) {
+	extraData := make(map[string]string)
+	for _, entry := range entries {
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid extra data '%s', expected KEY=VALUE", entry)
+		}
+		extraData[entry[:i]] = entry[i+1:]
+	}
+	return extraData, nil
+}
+
+// mergeExtraData returns the defaults, unless disabled, overridden by the
+// settings derived from the configuration and by the configured extra data
+func mergeExtraData(cfg *viper.Viper, defaults, settings map[string]string, key string) map[string]string {
+	extraData := make(map[string]string)
+	if cfg.GetBool("extra_data.defaults") {
+		for name, value := range defaults {
+			extraData[name] = value
+		}
+	}
+
+	for name, value := range settings {
+		extraData[name] = value
+	}
+
+	configured, err := parseExtraData(cfg.GetStringSlice(key))
+	if err != nil {
+		logger.Warn("Ignoring extra data", "key", key, "error", err)
+	}
+	for name, value := range configured {
+		extraData[name] = value
+	}
+	return extraData
+}
+
+// globalExtraData returns the extra data of VirtualBox, shared by all the
+// machines
+func globalExtraData(cfg *viper.Viper) map[string]string {
+	settings := make(map[string]string)
+	if !cfg.GetBool("menubar") {
+		settings["GUI/Customizations"] = "noMenuBar"
+		settings["GUI/ShowMiniToolBar"] = "no"
+	}
+
+	var messages []string
+	if cfg.GetBool("extra_data.defaults") {
+		messages = append(messages, defaultSuppressedMessages...)
+	}
+	messages = append(messages, cfg.GetStringSlice("extra_data.suppress_messages")...)
+	if len(messages) > 0 {
+		settings["GUI/SuppressMessages"] = "," + strings.Join(messages, ",")
+	}
+
+	return mergeExtraData(cfg, defaultGlobalExtraData, settings, "extra_data.global")
+}
+
+// machineExtraData returns the extra data of the machine
+func machineExtraData(cfg *viper.Viper) map[string]string {
+	settings := make(map[string]string)
+	if cfg.GetBool("save_state") {
+		settings["GUI/LastCloseAction"] = "SaveState"
+	} else {
+		settings["GUI/LastCloseAction"] = "shutdown"
+	}
+
+	if hostKey, err := backend.ResolveHostKey(cfg.GetString("host_key")); err != nil {
+		logger.Warn("Ignoring host key", "error", err)
+	} else {
+		settings[hostKeyExtraData] = hostKey.Code
+	}
+
+	for name, value := range displayExtraData(cfg) {
+		settings[name] = value
+	}
+
+	return mergeExtraData(cfg, defaultMachineExtraData, settings, "extra_data.machine")
+}
+
+// sortedExtraData returns the names of extra data in a stable order
+func sortedExtraData(extraData map[string]string) []string {
+	names := make([]string, 0, len(extraData))
+	for name := range extraData {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
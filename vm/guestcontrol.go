@@ -0,0 +1,177 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/lebauce/vbox"
+)
+
+var guestSessionTimeout = 30 * time.Second
+
+type GuestSession struct {
+	session      vbox.Session
+	guestSession vbox.GuestSession
+	env          []string
+}
+
+func (vm *VirtualMachine) NewGuestSession(user, password, domain string) (*GuestSession, error) {
+	session, _, err := vm.lockMachine()
+	if err != nil {
+		return nil, err
+	}
+
+	guestSession, err := func() (vbox.GuestSession, error) {
+		console, err := session.GetConsole()
+		if err != nil {
+			return vbox.GuestSession{}, err
+		}
+		defer console.Release()
+
+		guest, err := console.GetGuest()
+		if err != nil {
+			return vbox.GuestSession{}, err
+		}
+		defer guest.Release()
+
+		return guest.CreateSession(user, password, domain, "vlaunch")
+	}()
+	if err != nil {
+		session.UnlockMachine()
+		return nil, fmt.Errorf("Failed to create guest session: %s", err.Error())
+	}
+
+	result, err := guestSession.WaitForArray([]uint32{vbox.GuestSessionWaitForFlag_Start}, uint32(guestSessionTimeout/time.Millisecond))
+	if err == nil && result != vbox.GuestSessionWaitResult_Start {
+		err = errors.New("Guest session did not start, are the guest additions running ?")
+	}
+
+	if err != nil {
+		guestSession.Close()
+		guestSession.Release()
+		session.UnlockMachine()
+		return nil, err
+	}
+
+	return &GuestSession{session: session, guestSession: guestSession, env: vm.proxyEnvironment()}, nil
+}
+
+func readProcessOutput(process vbox.GuestProcess, handle uint32, w io.Writer) error {
+	for {
+		data, err := process.Read(handle, 65536, 0)
+		if err != nil {
+			return err
+		}
+
+		if len(data) == 0 {
+			return nil
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+func writeProcessInput(process vbox.GuestProcess, data []byte, eof bool) error {
+	flags := vbox.ProcessInputFlag_None
+	if eof {
+		flags = vbox.ProcessInputFlag_EndOfFile
+	}
+
+	for {
+		written, err := process.Write(0, flags, data, 1000)
+		if err != nil {
+			return err
+		}
+
+		if data = data[written:]; len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// Run executes a command inside the guest, forwarding stdin, stdout and stderr,
+// and returns the exit code of the guest process. A zero timeout means no timeout.
+func (s *GuestSession) Run(command string, args []string, stdin io.Reader, stdout, stderr io.Writer, timeout time.Duration) (int, error) {
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+
+	createFlags := []uint32{vbox.ProcessCreateFlag_WaitForStdOut, vbox.ProcessCreateFlag_WaitForStdErr}
+	processArgs := append([]string{command}, args...)
+	process, err := s.guestSession.ProcessCreate(command, processArgs, s.env, createFlags, uint32(timeout/time.Millisecond))
+	if err != nil {
+		return -1, fmt.Errorf("Failed to create guest process: %s", err.Error())
+	}
+	defer process.Release()
+
+	waitFlags := []uint32{vbox.ProcessWaitForFlag_Terminate, vbox.ProcessWaitForFlag_StdOut, vbox.ProcessWaitForFlag_StdErr}
+
+	var input chan []byte
+	if stdin != nil {
+		waitFlags = append(waitFlags, vbox.ProcessWaitForFlag_StdIn)
+		input = make(chan []byte)
+		go func() {
+			defer close(input)
+			for {
+				buffer := make([]byte, 32768)
+				n, err := stdin.Read(buffer)
+				if n > 0 {
+					input <- buffer[:n]
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		result, err := process.WaitForArray(waitFlags, 200)
+		if err != nil {
+			return -1, err
+		}
+
+		if input != nil {
+			select {
+			case data, ok := <-input:
+				if !ok {
+					input = nil
+				}
+				if err := writeProcessInput(process, data, !ok); err != nil {
+					return -1, err
+				}
+			default:
+			}
+		}
+
+		if err := readProcessOutput(process, 1, stdout); err != nil {
+			return -1, err
+		}
+
+		if err := readProcessOutput(process, 2, stderr); err != nil {
+			return -1, err
+		}
+
+		switch result {
+		case vbox.ProcessWaitResult_Terminate:
+			exitCode, err := process.GetExitCode()
+			return int(exitCode), err
+		case vbox.ProcessWaitResult_Error:
+			return -1, errors.New("Guest process failed")
+		}
+	}
+}
+
+func (s *GuestSession) Close() error {
+	s.guestSession.Close()
+	s.guestSession.Release()
+	return s.session.UnlockMachine()
+}
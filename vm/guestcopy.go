@@ -0,0 +1,95 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lebauce/vbox"
+)
+
+// guestBase returns the last element of a guest path, which may use either
+// separator depending on the guest OS
+func guestBase(name string) string {
+	name = strings.TrimRight(name, `/\`)
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// guestJoin appends a name to a guest directory, keeping the separator
+// already used by the directory
+func guestJoin(dir, name string) string {
+	separator := "/"
+	if strings.Contains(dir, `\`) && !strings.Contains(dir, "/") {
+		separator = `\`
+	}
+	return strings.TrimRight(dir, `/\`) + separator + name
+}
+
+func (s *GuestSession) guestDirectoryExists(name string) (bool, error) {
+	exists, err := s.guestSession.DirectoryExists(name, true)
+	if err != nil {
+		return false, fmt.Errorf("Failed to query guest path %s: %s", name, err.Error())
+	}
+	return exists, nil
+}
+
+// CopyToGuest copies a host file to the guest, or a whole directory when
+// recursive is set. Like cp, the source is copied inside the destination
+// if it is an existing directory
+func (s *GuestSession) CopyToGuest(ctx context.Context, source, destination string, recursive bool) error {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() && !recursive {
+		return fmt.Errorf("%s is a directory, a recursive copy is required", source)
+	}
+
+	isDir, err := s.guestDirectoryExists(destination)
+	if err != nil {
+		return err
+	}
+	if isDir {
+		destination = guestJoin(destination, filepath.Base(source))
+	}
+
+	var progress vbox.Progress
+	if fi.IsDir() {
+		progress, err = s.guestSession.DirectoryCopyToGuest(source, destination, []uint32{vbox.DirectoryCopyFlag_CopyIntoExisting})
+	} else {
+		progress, err = s.guestSession.FileCopyToGuest(source, destination, []uint32{vbox.FileCopyFlag_None})
+	}
+	return waitForProgressContext(ctx, progress, err)
+}
+
+// CopyFromGuest copies a guest file to the host, or a whole directory when
+// recursive is set. Like cp, the source is copied inside the destination
+// if it is an existing directory
+func (s *GuestSession) CopyFromGuest(ctx context.Context, source, destination string, recursive bool) error {
+	isDir, err := s.guestDirectoryExists(source)
+	if err != nil {
+		return err
+	}
+
+	if isDir && !recursive {
+		return fmt.Errorf("%s is a directory, a recursive copy is required", source)
+	}
+
+	if fi, err := os.Stat(destination); err == nil && fi.IsDir() {
+		destination = filepath.Join(destination, guestBase(source))
+	}
+
+	var progress vbox.Progress
+	if isDir {
+		progress, err = s.guestSession.DirectoryCopyFromGuest(source, destination, []uint32{vbox.DirectoryCopyFlag_CopyIntoExisting})
+	} else {
+		progress, err = s.guestSession.FileCopyFromGuest(source, destination, []uint32{vbox.FileCopyFlag_None})
+	}
+	return waitForProgressContext(ctx, progress, err)
+}
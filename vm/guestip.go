@@ -0,0 +1,37 @@
+package vm
+
+import (
+	"context"
+	"time"
+)
+
+// guestIPProperty is set by the Guest Additions to the IPv4 address of the
+// first network adapter
+const guestIPProperty = "/VirtualBox/GuestInfo/Net/0/V4/IP"
+
+// GuestIP returns the IPv4 address of the first network adapter of the
+// guest, or an empty string if the Guest Additions did not report it yet
+func (vm *VirtualMachine) GuestIP() (string, error) {
+	return vm.GetGuestProperty(guestIPProperty)
+}
+
+// WaitForIP waits until the guest reports its IPv4 address or the context
+// is done
+func (vm *VirtualMachine) WaitForIP(ctx context.Context) (string, error) {
+	for {
+		ip, err := vm.GuestIP()
+		if err != nil {
+			return "", err
+		}
+
+		if ip != "" {
+			return ip, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"context"
+	"errors"
+)
+
+// NoSnapshot is returned when restarting from a snapshot a machine that has
+// none
+var NoSnapshot = errors.New("The machine has no snapshot")
+
+// Reset resets the machine, like pressing the reset button
+func (vm *VirtualMachine) Reset() error {
+	if err := vm.requireVirtualBox(); err != nil {
+		return err
+	}
+	return vm.console.Reset()
+}
+
+// RestartFromSnapshot powers the machine off, Run then restores its current
+// snapshot and starts it again instead of returning
+func (vm *VirtualMachine) RestartFromSnapshot() error {
+	if err := vm.requireVirtualBox(); err != nil {
+		return err
+	}
+
+	if count, err := vm.machine.GetSnapshotCount(); err != nil {
+		return err
+	} else if count == 0 {
+		return NoSnapshot
+	}
+
+	vm.restarting.Store(true)
+	if err := vm.PowerOff(); err != nil {
+		vm.restarting.Store(false)
+		return err
+	}
+	return nil
+}
+
+func (vm *VirtualMachine) restoreCurrentSnapshot() error {
+	session, machine, err := vm.lockMachine()
+	if err != nil {
+		return err
+	}
+	defer session.UnlockMachine()
+
+	snapshot, err := machine.GetCurrentSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+
+	progress, err := machine.RestoreSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	defer progress.Release()
+
+	return progress.WaitForCompletion(-1)
+}
+
+// restart restores the current snapshot of the machine powered off by
+// RestartFromSnapshot and starts it again
+func (vm *VirtualMachine) restart(ctx context.Context) error {
+	logger.Info("Restoring the current snapshot")
+	if err := vm.restoreCurrentSnapshot(); err != nil {
+		return err
+	}
+
+	logger.Info("Restarting VM")
+	return vm.Start(ctx)
+}
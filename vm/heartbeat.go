@@ -0,0 +1,32 @@
+package vm
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+type heartbeatKey struct{}
+
+// withHeartbeat returns a context whose event loop records its iterations
+// into the given timestamp
+func withHeartbeat(ctx context.Context, heartbeat *atomic.Int64) context.Context {
+	return context.WithValue(ctx, heartbeatKey{}, heartbeat)
+}
+
+// beat is called by the event loops on every iteration, so that a stuck
+// loop can be told apart from a machine without events
+func beat(ctx context.Context) {
+	if heartbeat, ok := ctx.Value(heartbeatKey{}).(*atomic.Int64); ok {
+		heartbeat.Store(time.Now().UnixNano())
+	}
+}
+
+// Heartbeat returns the last time the event loop of the machine iterated,
+// or the zero time if it is not running
+func (vm *VirtualMachine) Heartbeat() time.Time {
+	if nanos := vm.heartbeat.Load(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
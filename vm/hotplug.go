@@ -0,0 +1,218 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/lebauce/vbox"
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/lebauce/vlaunch/vmdk"
+	"github.com/spf13/viper"
+)
+
+// hotplugInterval is how often the disks of the host are listed
+var hotplugInterval = 2 * time.Second
+
+// hotplugSpec is the controller added for the USB disks plugged while the
+// machine runs when no SATA controller is configured
+var hotplugSpec = controllerSpec{
+	name:           "Hotplug",
+	bus:            vbox.StorageBus_Sata,
+	controllerType: vbox.StorageControllerType_IntelAhci,
+	ports:          4,
+	maxPorts:       30,
+	devices:        1,
+}
+
+// hotplugController returns the SATA controller the USB disks are attached
+// to, the first configured one or else the dedicated one
+func hotplugController(specs []controllerSpec) (controllerSpec, bool) {
+	for _, spec := range specs {
+		if spec.bus == vbox.StorageBus_Sata {
+			return spec, false
+		}
+	}
+	return hotplugSpec, true
+}
+
+// addHotplugController adds the dedicated controller if the USB disks are
+// to be hot-plugged and no SATA controller is configured
+func addHotplugController(cfg *viper.Viper, machine vbox.Machine, specs []controllerSpec) ([]vbox.StorageController, error) {
+	if cfg.GetString("usb.hotplug") != "raw" {
+		return nil, nil
+	}
+
+	spec, dedicated := hotplugController(specs)
+	if !dedicated {
+		return nil, nil
+	}
+
+	controller, err := addStorageController(machine, spec)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to add hot-plug storage controller: %s", err.Error())
+	}
+	return []vbox.StorageController{controller}, nil
+}
+
+// hotpluggedDisk is a USB disk of the host attached to the running machine
+type hotpluggedDisk struct {
+	port     int
+	location string
+	medium   vbox.Medium
+}
+
+func hotplugDescriptorPath(cfg *viper.Viper, device string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r == '.' {
+			return '_'
+		}
+		return r
+	}, strings.TrimLeft(device, `/\.`))
+	return path.Join(cfg.GetString("data_path"), "hotplug-"+name+".vmdk")
+}
+
+// attachUSBDisk gives the guest access to a USB disk through a raw VMDK
+// attached to a free port of the hot-plug controller
+func (vm *VirtualMachine) attachUSBDisk(spec controllerSpec, device backend.Device) (*hotpluggedDisk, error) {
+	location := hotplugDescriptorPath(vm.cfg, device.Path)
+	if err := vmdk.WriteRawVMDK(location, device.Path, vmdk.RawOptions{Relative: backend.RelativeRawVMDK}); err != nil {
+		return nil, fmt.Errorf("Failed to create raw VMDK: %s", err.Error())
+	}
+
+	medium, err := vbox.OpenMedium(location, vbox.DeviceType_HardDisk, vbox.AccessMode_ReadWrite, false)
+	if err != nil {
+		os.Remove(location)
+		return nil, err
+	}
+
+	disk, err := func() (*hotpluggedDisk, error) {
+		session, machine, err := vm.lockMachine()
+		if err != nil {
+			return nil, err
+		}
+		defer session.UnlockMachine()
+
+		attachments, err := machine.GetMediumAttachments()
+		if err != nil {
+			return nil, err
+		}
+
+		used := make(map[int]bool)
+		for _, attachment := range attachments {
+			if attachment.Controller == spec.name {
+				used[int(attachment.Port)] = true
+			}
+		}
+
+		port := 0
+		for used[port] {
+			port++
+		}
+		if port >= spec.ports {
+			return nil, fmt.Errorf("No free port left on the %s controller", spec.name)
+		}
+
+		if err := machine.AttachDevice(spec.name, port, 0, vbox.DeviceType_HardDisk, medium); err != nil {
+			return nil, err
+		}
+
+		if err := limitDisk(vm.cfg, machine, spec.name, port, 0); err != nil {
+			logger.Warn("Failed to limit hotplugged disk", "device", device.Path, "error", err)
+		}
+		return &hotpluggedDisk{port: port, location: location, medium: medium}, machine.SaveSettings()
+	}()
+	if err != nil {
+		medium.Close()
+		os.Remove(location)
+		return nil, err
+	}
+	return disk, nil
+}
+
+// detachUSBDisk removes an unplugged USB disk from the machine
+func (vm *VirtualMachine) detachUSBDisk(spec controllerSpec, disk *hotpluggedDisk) error {
+	defer os.Remove(disk.location)
+	defer disk.medium.Close()
+
+	session, machine, err := vm.lockMachine()
+	if err != nil {
+		return err
+	}
+	defer session.UnlockMachine()
+
+	if err := machine.DetachDevice(spec.name, disk.port, 0); err != nil {
+		return err
+	}
+	return machine.SaveSettings()
+}
+
+// HotplugUSBDisks attaches the USB disks plugged into the host while the
+// machine runs, when usb.hotplug is 'raw', and detaches them once unplugged.
+// The disks present at startup, such as the one holding the guest, are
+// left alone.
+func (vm *VirtualMachine) HotplugUSBDisks(ctx context.Context) {
+	if vm.cfg.GetString("usb.hotplug") != "raw" {
+		return
+	}
+
+	if err := vm.requireVirtualBox(); err != nil {
+		logger.Warn("USB disks can only be hot-plugged with VirtualBox")
+		return
+	}
+
+	specs, err := getControllerSpecs(vm.cfg)
+	if err != nil {
+		logger.Error("Failed to get storage controllers", "error", err)
+		return
+	}
+	spec, _ := hotplugController(specs)
+
+	events, err := backend.WatchDevices(ctx, hotplugInterval)
+	if err != nil {
+		logger.Error("Failed to watch USB disks", "error", err)
+		return
+	}
+
+	attached := make(map[string]*hotpluggedDisk)
+	defer func() {
+		for _, disk := range attached {
+			vm.detachUSBDisk(spec, disk)
+		}
+	}()
+
+	for event := range events {
+		device := event.Device
+		if device.Bus != "usb" {
+			continue
+		}
+
+		if event.Type == backend.DeviceDetached {
+			if disk, found := attached[device.Path]; found {
+				delete(attached, device.Path)
+				if err := vm.detachUSBDisk(spec, disk); err != nil {
+					logger.Error("Failed to detach USB disk", "device", device.Path, "error", err)
+				} else {
+					logger.Info("Detached USB disk", "device", device.Path)
+				}
+			}
+			continue
+		}
+
+		// Nothing prevents the host from writing to it meanwhile
+		if mountpoints := device.Mountpoints(); len(mountpoints) > 0 {
+			logger.Warn("USB disk is mounted on the host", "device", device.Path, "mountpoints", mountpoints)
+		}
+
+		disk, err := vm.attachUSBDisk(spec, device)
+		if err != nil {
+			logger.Error("Failed to attach USB disk", "device", device.Path, "error", err)
+			continue
+		}
+		attached[device.Path] = disk
+		logger.Info("Attached USB disk", "device", device.Path, "model", device.Model, "controller", spec.name, "port", disk.port)
+	}
+}
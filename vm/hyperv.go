@@ -0,0 +1,316 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lebauce/vbox"
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/spf13/viper"
+)
+
+// hyperVStates maps the states of Hyper-V machines to VirtualBox states
+var hyperVStates = map[string]uint32{
+	"Off":         vbox.MachineState_PoweredOff,
+	"OffCritical": vbox.MachineState_Aborted,
+	"Running":     vbox.MachineState_Running,
+	"Paused":      vbox.MachineState_Paused,
+	"Saved":       vbox.MachineState_Saved,
+	"Starting":    vbox.MachineState_Starting,
+	"Stopping":    vbox.MachineState_Stopping,
+	"Saving":      vbox.MachineState_Saving,
+}
+
+// hyperV runs the machine as a generation 2 Hyper-V machine, using the
+// Hyper-V PowerShell module. Physical disks are taken offline on the host
+// while they are attached to the machine.
+type hyperV struct {
+	cfg          *viper.Viper
+	name         string
+	offlineDisks []int
+}
+
+// psQuote quotes a string for PowerShell
+func psQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func powershell(format string, args ...interface{}) (string, error) {
+	script := fmt.Sprintf(format, args...)
+	logger.Debug("Running PowerShell", "script", script)
+
+	output, err := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// diskNumber returns the number of a physical disk from its device name,
+// such as \\.\PHYSICALDRIVE1
+func diskNumber(device string) (int, error) {
+	prefix := `\\.\PHYSICALDRIVE`
+	if !strings.HasPrefix(strings.ToUpper(device), prefix) {
+		return 0, fmt.Errorf("Invalid physical disk '%s'", device)
+	}
+	return strconv.Atoi(device[len(prefix):])
+}
+
+func (h *hyperV) CreateMachine(ctx context.Context, cfg *viper.Viper) error {
+	if runtime.GOOS != "windows" {
+		return errors.New("Hyper-V is only available on Windows")
+	}
+
+	h.cfg = cfg
+	h.name = cfg.GetString("machine_name")
+	cpus, ram := resources(cfg)
+
+	script := fmt.Sprintf("New-VM -Name %s -Generation 2 -MemoryStartupBytes %dMB -Path %s -NoVHD",
+		psQuote(h.name), ram, psQuote(cfg.GetString("data_path")))
+	if networkSwitch := cfg.GetString("hyperv.switch"); networkSwitch != "" {
+		script += " -SwitchName " + psQuote(networkSwitch)
+	}
+
+	if _, err := powershell("%s | Out-Null", script); err != nil {
+		return fmt.Errorf("Failed to create Hyper-V machine: %s", err.Error())
+	}
+
+	// Only nested virtualization applies to Hyper-V machines
+	script = fmt.Sprintf("Set-VMProcessor -VMName %s -Count %d", psQuote(h.name), cpus)
+	if cfg.GetBool("virtualization.nested_hw_virt") {
+		script += " -ExposeVirtualizationExtensions $true"
+	}
+
+	if _, err := powershell("%s", script); err != nil {
+		return err
+	}
+
+	// Generation 2 machines always use EFI and boot from the first disk
+	if cfg.IsSet("boot_order") {
+		logger.Warn("The boot order is ignored with Hyper-V")
+	}
+
+	// The clock of Hyper-V machines is always in UTC
+	if cfg.GetString("time.rtc") == "local" || cfg.GetDuration("time.offset") != 0 {
+		logger.Warn("The real-time clock settings are ignored with Hyper-V")
+	}
+
+	if !cfg.GetBool("time.sync") {
+		if _, err := powershell("Disable-VMIntegrationService -VMName %s -Name 'Time Synchronization'", psQuote(h.name)); err != nil {
+			return fmt.Errorf("Failed to disable time synchronization: %s", err.Error())
+		}
+	}
+
+	// Hyper-V can only wire serial ports to named pipes
+	switch cfg.GetString("serial.mode") {
+	case "pipe":
+		if _, err := powershell("Set-VMComPort -VMName %s -Number 1 -Path %s", psQuote(h.name), psQuote(serialPath(cfg))); err != nil {
+			return fmt.Errorf("Failed to configure serial port: %s", err.Error())
+		}
+	case "file":
+		logger.Warn("Serial port output to a file is not supported with Hyper-V, use a pipe")
+	}
+
+	if cfg.GetBool("recording.enabled") {
+		logger.Warn("Recording is only supported with VirtualBox")
+	}
+
+	secureBoot := "Off"
+	if cfg.GetBool("hyperv.secure_boot") {
+		secureBoot = "On"
+	}
+
+	if _, err := powershell("Set-VMFirmware -VMName %s -EnableSecureBoot %s", psQuote(h.name), secureBoot); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// bringDisksOnline brings the disks taken offline by AttachDisk back online
+// on the host
+func (h *hyperV) bringDisksOnline() {
+	for _, number := range h.offlineDisks {
+		if _, err := powershell("Set-Disk -Number %d -IsOffline $false", number); err != nil {
+			logger.Error("Failed to bring disk back online", "disk", number, "error", err)
+		}
+	}
+	h.offlineDisks = nil
+}
+
+// AttachDisk brings the disks back online if it fails, as the machine is not
+// created then
+func (h *hyperV) AttachDisk(ctx context.Context, index int, disk Disk) (err error) {
+	defer func() {
+		if err != nil {
+			h.bringDisksOnline()
+		}
+	}()
+
+	var script string
+	switch disk.Type {
+	case "raw":
+		if len(disk.Partitions) > 0 {
+			return errors.New("Partition selection is not supported with Hyper-V")
+		}
+
+		device := disk.Location
+		if device == "" {
+			if device, err = backend.FindDevice(h.cfg); err != nil {
+				return err
+			}
+		}
+
+		number, err := diskNumber(device)
+		if err != nil {
+			return err
+		}
+
+		// Hyper-V only gives access to disks that are offline on the host
+		if _, err := powershell("Set-Disk -Number %d -IsOffline $true", number); err != nil {
+			return fmt.Errorf("Failed to take disk %d offline: %s", number, err.Error())
+		}
+		h.offlineDisks = append(h.offlineDisks, number)
+
+		script = fmt.Sprintf("Add-VMHardDiskDrive -VMName %s -ControllerType SCSI -DiskNumber %d", psQuote(h.name), number)
+	case "vhd":
+		if disk.Location == "" {
+			return fmt.Errorf("A location is required for %s disks", disk.Type)
+		}
+		script = fmt.Sprintf("Add-VMHardDiskDrive -VMName %s -ControllerType SCSI -Path %s", psQuote(h.name), psQuote(disk.Location))
+	case "iso":
+		script = fmt.Sprintf("Add-VMDvdDrive -VMName %s -Path %s", psQuote(h.name), psQuote(disk.Location))
+	default:
+		return fmt.Errorf("Disk type '%s' is not supported with Hyper-V", disk.Type)
+	}
+
+	if disk.mode() != "normal" {
+		logger.Warn("Immutable disks are not supported with Hyper-V", "disk", disk.Location)
+	}
+
+	if _, err := powershell("%s", script); err != nil {
+		return fmt.Errorf("Failed to attach disk %d: %s", index, err.Error())
+	}
+
+	// The machine boots from the first disk, or from the first ISO image
+	// when it has no disk
+	if index == 0 {
+		drive := "Get-VMHardDiskDrive"
+		if disk.Type == "iso" {
+			drive = "Get-VMDvdDrive"
+		}
+		_, err := powershell("Set-VMFirmware -VMName %[1]s -FirstBootDevice (%[2]s -VMName %[1]s)[0]", psQuote(h.name), drive)
+		return err
+	}
+
+	return nil
+}
+
+func (h *hyperV) Launch(ctx context.Context, frontend string) (err error) {
+	defer func() {
+		if err != nil {
+			h.bringDisksOnline()
+		}
+	}()
+
+	switch frontend {
+	case "gui", "headless":
+	default:
+		return fmt.Errorf("Frontend '%s' is not supported with Hyper-V", frontend)
+	}
+
+	if _, err := powershell("Start-VM -Name %s", psQuote(h.name)); err != nil {
+		return fmt.Errorf("Failed to start Hyper-V machine: %s", err.Error())
+	}
+
+	if frontend == "gui" {
+		if err := exec.Command("vmconnect.exe", "localhost", h.name).Start(); err != nil {
+			logger.Warn("Failed to open the machine console", "error", err)
+		}
+	}
+
+	return nil
+}
+
+// Events only reports the changes of state, polled every second
+func (h *hyperV) Events(ctx context.Context, publish func(Event)) error {
+	previousState, err := h.State()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+		beat(ctx)
+
+		state, err := h.State()
+		if err != nil {
+			return err
+		}
+
+		if state != previousState {
+			publish(StateChanged{State: state})
+			if isStopped(state) || state == vbox.MachineState_Aborted {
+				return nil
+			}
+		}
+		previousState = state
+	}
+}
+
+func (h *hyperV) GuestProperties(pattern string) ([]GuestProperty, error) {
+	return nil, NotSupported
+}
+
+func (h *hyperV) SetGuestProperty(name, value, flags string) error {
+	return NotSupported
+}
+
+func (h *hyperV) State() (uint32, error) {
+	output, err := powershell("(Get-VM -Name %s).State", psQuote(h.name))
+	if err != nil {
+		return 0, err
+	}
+
+	state, found := hyperVStates[output]
+	if !found {
+		return vbox.MachineState_Running, nil
+	}
+	return state, nil
+}
+
+// Stop shuts the guest down through the Hyper-V integration services
+func (h *hyperV) Stop() error {
+	_, err := powershell("Stop-VM -Name %s -Force", psQuote(h.name))
+	return err
+}
+
+func (h *hyperV) PowerOff() error {
+	_, err := powershell("Stop-VM -Name %s -TurnOff -Force", psQuote(h.name))
+	return err
+}
+
+// Release removes the machine, its disks are brought back online even if the
+// removal fails
+func (h *hyperV) Release(ctx context.Context) error {
+	defer h.bringDisksOnline()
+
+	if state, err := h.State(); err == nil && !isStopped(state) {
+		if err := h.PowerOff(); err != nil {
+			return err
+		}
+	}
+
+	_, err := powershell("Remove-VM -Name %s -Force", psQuote(h.name))
+	return err
+}
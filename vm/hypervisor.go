@@ -0,0 +1,57 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+var NotSupported = errors.New("Operation not supported by the hypervisor")
+
+// Hypervisor is implemented by the drivers creating and running the
+// machines. Machine states are reported using the VirtualBox states.
+// Snapshots, statistics, guest control and appliances are only provided
+// by the VirtualBox driver.
+type Hypervisor interface {
+	// CreateMachine creates the machine described by the configuration,
+	// without its disks
+	CreateMachine(ctx context.Context, cfg *viper.Viper) error
+	// AttachDisk attaches the disk number index of the machine
+	AttachDisk(ctx context.Context, index int, disk Disk) error
+	// Launch starts the machine with the given frontend
+	Launch(ctx context.Context, frontend string) error
+	// Events publishes the events of the machine until it stops or the
+	// context is done
+	Events(ctx context.Context, publish func(Event)) error
+	GuestProperties(pattern string) ([]GuestProperty, error)
+	SetGuestProperty(name, value, flags string) error
+	State() (uint32, error)
+	// Stop asks the guest to shut down
+	Stop() error
+	PowerOff() error
+	// Release deletes the machine
+	Release(ctx context.Context) error
+}
+
+func newHypervisor(vm *VirtualMachine) (Hypervisor, error) {
+	switch name := vm.cfg.GetString("hypervisor"); name {
+	case "virtualbox":
+		return &virtualBox{vm: vm}, nil
+	case "qemu":
+		return &qemu{}, nil
+	case "hyperv":
+		return &hyperV{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown hypervisor '%s'", name)
+	}
+}
+
+// requireVirtualBox fails for the features only provided by VirtualBox
+func (vm *VirtualMachine) requireVirtualBox() error {
+	if _, ok := vm.hypervisor.(*virtualBox); !ok {
+		return NotSupported
+	}
+	return nil
+}
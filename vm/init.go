@@ -0,0 +1,104 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/lebauce/vbox"
+	"github.com/lebauce/vlaunch/backend"
+)
+
+var VirtualBoxNotInstalled = errors.New("VirtualBox is not installed, download it from https://www.virtualbox.org")
+
+// initTimeout is how long to wait for the VirtualBox service, it may not be
+// started yet right after the installation or the login
+const initTimeout = 30 * time.Second
+
+// InstalledVersion returns the version of the installed VirtualBox
+func InstalledVersion() (string, error) {
+	vboxManage, err := backend.FindVBoxManage()
+	if err != nil {
+		return "", VirtualBoxNotInstalled
+	}
+
+	output, err := exec.Command(vboxManage, "--version").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// ExtensionPack is an extension pack installed in VirtualBox
+type ExtensionPack struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Usable  bool   `json:"usable"`
+}
+
+// ExtensionPacks returns the extension packs installed in VirtualBox, as
+// listed by VBoxManage
+func ExtensionPacks() ([]ExtensionPack, error) {
+	vboxManage, err := backend.FindVBoxManage()
+	if err != nil {
+		return nil, VirtualBoxNotInstalled
+	}
+
+	output, err := exec.Command(vboxManage, "list", "extpacks").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var packs []ExtensionPack
+	for _, line := range strings.Split(string(output), "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+
+		switch {
+		case strings.HasPrefix(key, "Pack no."):
+			packs = append(packs, ExtensionPack{Name: value})
+		case len(packs) == 0:
+		case key == "Version":
+			packs[len(packs)-1].Version = value
+		case key == "Usable":
+			packs[len(packs)-1].Usable = value == "true"
+		}
+	}
+	return packs, nil
+}
+
+// initVirtualBox initializes the VirtualBox API, retrying with an
+// exponential backoff while the VirtualBox service is not available
+func initVirtualBox() error {
+	version, err := InstalledVersion()
+	if err == VirtualBoxNotInstalled {
+		return err
+	} else if err != nil {
+		logger.Warn("Failed to get VirtualBox version", "error", err)
+	}
+
+	delay := 500 * time.Millisecond
+	deadline := time.Now().Add(initTimeout)
+	for {
+		err := vbox.Init()
+		if err == nil {
+			logger.Debug("Initialized VirtualBox API", "version", version)
+			return nil
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("VirtualBox %s is installed but its service is not available (%s), start VirtualBox once or restart the computer", version, err.Error())
+		}
+
+		logger.Info("VirtualBox service not available, retrying", "delay", delay, "error", err)
+		time.Sleep(delay)
+		if delay *= 2; delay > 5*time.Second {
+			delay = 5 * time.Second
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package vm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/lebauce/vbox"
+	"github.com/lebauce/vlaunch/vdi"
+	"github.com/lebauce/vlaunch/vmdk"
+	"github.com/spf13/viper"
+)
+
+// CorruptedDiskError reports a disk image that is visibly corrupted
+type CorruptedDiskError struct {
+	Location string
+	Reason   string
+}
+
+func (e *CorruptedDiskError) Error() string {
+	return fmt.Sprintf("Disk image %s is corrupted: %s", e.Location, e.Reason)
+}
+
+// integrityPath is the file holding the checksums of the metadata of the VDI
+// images, recorded when the machine stopped cleanly
+func integrityPath(cfg *viper.Viper) string {
+	return path.Join(cfg.GetString("data_path"), cfg.GetString("machine_name")+".integrity.json")
+}
+
+func readChecksums(cfg *viper.Viper) map[string]string {
+	checksums := make(map[string]string)
+	if data, err := os.ReadFile(integrityPath(cfg)); err == nil {
+		json.Unmarshal(data, &checksums)
+	}
+	return checksums
+}
+
+func writeChecksums(cfg *viper.Viper, checksums map[string]string) error {
+	data, err := json.Marshal(checksums)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(integrityPath(cfg), data, 0644)
+}
+
+// ForgetDiskChecksum removes the checksum recorded for a disk image whose
+// metadata changed on purpose, such as when it was resized
+func ForgetDiskChecksum(cfg *viper.Viper, location string) error {
+	checksums := readChecksums(cfg)
+	if absolute, err := filepath.Abs(location); err == nil {
+		location = absolute
+	}
+
+	if _, found := checksums[location]; !found {
+		return nil
+	}
+
+	delete(checksums, location)
+	return writeChecksums(cfg, checksums)
+}
+
+// diskImages returns the disk images of the machine: with VirtualBox, the
+// images attached to it and their base, otherwise the configured ones
+func (vm *VirtualMachine) diskImages() ([]string, error) {
+	var images []string
+	if vm.cfg.GetString("hypervisor") != "virtualbox" {
+		disks, err := getDisks(vm.cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, disk := range disks {
+			if disk.Type != "raw" && disk.Location != "" {
+				images = append(images, disk.Location)
+			}
+		}
+		return images, nil
+	}
+
+	attachments, err := vm.machine.GetMediumAttachments()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, attachment := range attachments {
+		if attachment.Type != vbox.DeviceType_HardDisk {
+			continue
+		}
+
+		base, err := attachment.Medium.GetBase()
+		if err != nil {
+			return nil, err
+		}
+
+		// Raw disks are checked against their device when created
+		if id, err := base.GetId(); err != nil || vm.rawDisks[id] {
+			continue
+		}
+
+		for _, medium := range []vbox.Medium{attachment.Medium, base} {
+			if location, err := medium.GetLocation(); err == nil && location != "" && !seen[location] {
+				seen[location] = true
+				images = append(images, location)
+			}
+		}
+	}
+	return images, nil
+}
+
+// checkImage checks the header of a VDI or VMDK image and returns the
+// checksum of the metadata of VDI images
+func checkImage(location string) (string, error) {
+	switch strings.ToLower(filepath.Ext(location)) {
+	case ".vdi":
+		header, err := vdi.Check(location)
+		if err != nil {
+			return "", err
+		}
+		return header.Checksum(), nil
+	case ".vmdk":
+		return "", vmdk.Check(location)
+	default:
+		return "", nil
+	}
+}
+
+// VerifyDisks checks, when integrity.enabled is set, that the disk images of
+// the machine are not visibly corrupted and that the metadata of the VDI
+// images did not change since the machine last stopped cleanly. It returns
+// a CorruptedDiskError for the first corrupted image.
+func (vm *VirtualMachine) VerifyDisks() error {
+	if !vm.cfg.GetBool("integrity.enabled") {
+		return nil
+	}
+
+	images, err := vm.diskImages()
+	if err != nil {
+		return err
+	}
+
+	checksums := readChecksums(vm.cfg)
+	for _, location := range images {
+		logger.Debug("Checking disk image", "location", location)
+		checksum, err := checkImage(location)
+		if err != nil {
+			return &CorruptedDiskError{Location: location, Reason: err.Error()}
+		}
+
+		if recorded := checksums[location]; recorded != "" && checksum != "" && recorded != checksum {
+			return &CorruptedDiskError{Location: location, Reason: "its metadata changed since the machine last stopped"}
+		}
+	}
+	return nil
+}
+
+// RecordDiskChecksums records the checksums of the metadata of the VDI
+// images, once the machine stopped cleanly
+func (vm *VirtualMachine) RecordDiskChecksums() error {
+	if !vm.cfg.GetBool("integrity.enabled") {
+		return nil
+	}
+
+	images, err := vm.diskImages()
+	if err != nil {
+		return err
+	}
+
+	checksums := make(map[string]string)
+	for _, location := range images {
+		checksum, err := checkImage(location)
+		if err != nil {
+			return &CorruptedDiskError{Location: location, Reason: err.Error()}
+		}
+
+		if checksum != "" {
+			checksums[location] = checksum
+		}
+	}
+	return writeChecksums(vm.cfg, checksums)
+}
+
+// CurrentSnapshot returns the name of the snapshot the current state of the
+// machine derives from
+func (vm *VirtualMachine) CurrentSnapshot() (string, error) {
+	snapshots, err := vm.Snapshots()
+	if err != nil {
+		return "", err
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.Current {
+			return snapshot.Name, nil
+		}
+	}
+	return "", errors.New("The machine has no snapshot")
+}
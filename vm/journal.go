@@ -0,0 +1,109 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/lebauce/vlaunch/logging"
+	"github.com/spf13/viper"
+)
+
+// journalFiles is the number of previous journals kept once rotated
+const journalFiles = 1
+
+// journalPath is the file the guest property changes are appended to, one
+// JSON object per line, so that they can be looked at once the machine
+// stopped
+func journalPath(cfg *viper.Viper) string {
+	return path.Join(cfg.GetString("data_path"), cfg.GetString("machine_name")+".properties.jsonl")
+}
+
+// openJournal opens the journal of the guest property changes, if
+// journal.enabled is set
+func openJournal(cfg *viper.Viper) (*logging.RotatingFile, error) {
+	if !cfg.GetBool("journal.enabled") {
+		return nil, nil
+	}
+	return logging.OpenRotatingFile(journalPath(cfg), int64(cfg.GetInt("journal.max_size"))*1024*1024, 0, journalFiles)
+}
+
+// recordProperty appends a guest property change to the journal
+func recordProperty(journal *logging.RotatingFile, prop GuestPropertyChanged) {
+	if prop.Timestamp == 0 {
+		prop.Timestamp = time.Now().UnixNano()
+	}
+
+	data, err := json.Marshal(GuestProperty(prop))
+	if err == nil {
+		_, err = journal.Write(append(data, '\n'))
+	}
+	if err != nil {
+		logger.Debug("Failed to record guest property", "name", prop.Name, "error", err)
+	}
+}
+
+// ReadJournal returns the guest property changes recorded since the given
+// time, oldest first, whose name matches the pattern, see
+// MatchPropertyPattern.
+func ReadJournal(cfg *viper.Viper, since time.Time, pattern string) ([]GuestProperty, error) {
+	var props []GuestProperty
+	location := journalPath(cfg)
+	for i := journalFiles; i >= 0; i-- {
+		file := location
+		if i > 0 {
+			file = fmt.Sprintf("%s.%d", location, i)
+		}
+
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var prop GuestProperty
+			// A line may have been cut by a crash of vlaunch
+			if err := json.Unmarshal(scanner.Bytes(), &prop); err != nil {
+				continue
+			}
+
+			if prop.Timestamp < since.UnixNano() {
+				continue
+			}
+
+			if !MatchPropertyPattern(pattern, prop.Name) {
+				continue
+			}
+			props = append(props, prop)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return props, nil
+}
+
+// LastGuestProperty returns the last recorded value of a guest property,
+// which remains known after the machine stopped or was deleted
+func LastGuestProperty(cfg *viper.Viper, name string) (GuestProperty, bool, error) {
+	props, err := ReadJournal(cfg, time.Time{}, "")
+	if err != nil {
+		return GuestProperty{}, false, err
+	}
+
+	for i := len(props) - 1; i >= 0; i-- {
+		if props[i].Name == name {
+			return props[i], true, nil
+		}
+	}
+	return GuestProperty{}, false, nil
+}
@@ -0,0 +1,88 @@
+package vm
+
+import (
+	"github.com/lebauce/vbox"
+	"github.com/lebauce/vlaunch/vmdk"
+	"github.com/spf13/viper"
+)
+
+// ManagedMachine describes a machine created by vlaunch
+type ManagedMachine struct {
+	Name     string   `json:"name"`
+	State    string   `json:"state"`
+	DataPath string   `json:"data_path"`
+	Disks    []string `json:"disks"`
+	Created  string   `json:"created,omitempty"`
+}
+
+// diskBacking returns what a hard disk of a machine is stored on, the device
+// for a raw disk
+func diskBacking(medium vbox.Medium) (string, error) {
+	location, err := medium.GetLocation()
+	if err != nil {
+		return "", err
+	}
+
+	if descriptor, err := vmdk.ReadFile(location); err == nil {
+		if device := descriptor.Device(); device != "" {
+			return device, nil
+		}
+	}
+	return location, nil
+}
+
+// ListMachines returns the machines registered in VirtualBox that were
+// created by vlaunch, kept ones and orphans included
+func ListMachines(cfg *viper.Viper) ([]ManagedMachine, error) {
+	if cfg.GetString("hypervisor") != "virtualbox" {
+		return nil, NotSupported
+	}
+
+	if err := initVirtualBox(); err != nil {
+		return nil, err
+	}
+
+	machines, err := vbox.GetMachines()
+	if err != nil {
+		return nil, err
+	}
+
+	managed := []ManagedMachine{}
+	for _, machine := range machines {
+		if tag, err := machine.GetExtraData(managedKey); err != nil || tag != "true" {
+			continue
+		}
+
+		name, err := machine.GetName()
+		if err != nil {
+			continue
+		}
+
+		state, err := machine.GetState()
+		if err != nil {
+			logger.Warn("Failed to get machine state", "name", name, "error", err)
+		}
+
+		m := ManagedMachine{Name: name, State: StateName(state), Disks: []string{}}
+		m.DataPath, _ = machine.GetExtraData(dataPathKey)
+		m.Created, _ = machine.GetExtraData(createdKey)
+
+		attachments, err := machine.GetMediumAttachments()
+		if err != nil {
+			logger.Warn("Failed to get machine media", "name", name, "error", err)
+		}
+
+		for _, attachment := range attachments {
+			if attachment.Type != vbox.DeviceType_HardDisk {
+				continue
+			}
+
+			if disk, err := diskBacking(attachment.Medium); err == nil {
+				m.Disks = append(m.Disks, disk)
+			}
+		}
+
+		managed = append(managed, m)
+	}
+	return managed, nil
+}
@@ -0,0 +1,85 @@
+package vm
+
+import (
+	"time"
+
+	"github.com/lebauce/vbox"
+)
+
+// Metrics are the counters and gauges exposed to monitoring systems
+type Metrics struct {
+	Name                 string
+	State                string
+	Uptime               time.Duration
+	BootDuration         time.Duration
+	EventLoopErrors      uint64
+	GuestPropertyChanges uint64
+	CPUs                 uint32
+	RAM                  uint32
+}
+
+// uptime returns for how long the machine has been running
+func (vm *VirtualMachine) uptime(state uint32) (time.Duration, error) {
+	if state != vbox.MachineState_Running && state != vbox.MachineState_Paused {
+		return 0, nil
+	}
+
+	if vm.requireVirtualBox() != nil {
+		return time.Since(vm.launched), nil
+	}
+
+	lastChange, err := vm.machine.GetLastStateChange()
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(time.Unix(0, lastChange*int64(time.Millisecond))), nil
+}
+
+// onAdditionsRunLevel records the boot duration and checks the version of
+// the guest additions the first time they report that the userland is up
+func (vm *VirtualMachine) onAdditionsRunLevel(runLevel uint32) {
+	if runLevel >= vbox.AdditionsRunLevelType_Userland && !vm.launched.IsZero() {
+		if vm.bootDuration.CompareAndSwap(0, int64(time.Since(vm.launched))) {
+			go vm.checkAdditions()
+		}
+	}
+}
+
+func (vm *VirtualMachine) Metrics() (*Metrics, error) {
+	var err error
+	metrics := &Metrics{
+		BootDuration:         time.Duration(vm.bootDuration.Load()),
+		EventLoopErrors:      vm.eventLoopErrors.Load(),
+		GuestPropertyChanges: vm.events.count(GuestPropertyChangedEvent),
+	}
+
+	state, err := vm.hypervisor.State()
+	if err != nil {
+		return nil, err
+	}
+	metrics.State = StateName(state)
+
+	if metrics.Uptime, err = vm.uptime(state); err != nil {
+		return nil, err
+	}
+
+	// The other drivers do not report the machine settings
+	if vm.requireVirtualBox() != nil {
+		metrics.Name = vm.cfg.GetString("machine_name")
+		return metrics, nil
+	}
+
+	if metrics.Name, err = vm.machine.GetName(); err != nil {
+		return nil, err
+	}
+
+	if metrics.CPUs, err = vm.machine.GetCPUCount(); err != nil {
+		return nil, err
+	}
+
+	if metrics.RAM, err = vm.machine.GetMemorySize(); err != nil {
+		return nil, err
+	}
+
+	return metrics, nil
+}
@@ -0,0 +1,230 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+var attachmentTypes = map[string]uint32{
+	"nat":        vbox.NetworkAttachmentType_NAT,
+	"bridged":    vbox.NetworkAttachmentType_Bridged,
+	"hostonly":   vbox.NetworkAttachmentType_HostOnly,
+	"internal":   vbox.NetworkAttachmentType_Internal,
+	"natnetwork": vbox.NetworkAttachmentType_NATNetwork,
+}
+
+var adapterTypes = map[string]uint32{
+	"am79c970a": vbox.NetworkAdapterType_Am79C970A,
+	"am79c973":  vbox.NetworkAdapterType_Am79C973,
+	"82540em":   vbox.NetworkAdapterType_I82540EM,
+	"82543gc":   vbox.NetworkAdapterType_I82543GC,
+	"82545em":   vbox.NetworkAdapterType_I82545EM,
+	"virtio":    vbox.NetworkAdapterType_Virtio,
+}
+
+var natProtocols = map[string]uint32{
+	"tcp": vbox.NATProtocol_TCP,
+	"udp": vbox.NATProtocol_UDP,
+}
+
+type adapterSettings struct {
+	Type              string
+	Mode              string
+	MACAddress        string `mapstructure:"mac_address"`
+	CableConnected    *bool  `mapstructure:"cable_connected"`
+	BridgeInterface   string `mapstructure:"bridge_interface"`
+	HostOnlyInterface string `mapstructure:"hostonly_interface"`
+	InternalNetwork   string `mapstructure:"internal_network"`
+	NATNetwork        string `mapstructure:"nat_network"`
+}
+
+func (s adapterSettings) mode() string {
+	if s.Mode == "" {
+		return "nat"
+	}
+	return strings.ToLower(s.Mode)
+}
+
+func setAttachment(adapter vbox.NetworkAdapter, settings adapterSettings) error {
+	mode := settings.mode()
+	attachmentType, found := attachmentTypes[mode]
+	if !found {
+		return fmt.Errorf("Invalid network mode '%s'", settings.Mode)
+	}
+
+	if err := adapter.SetAttachmentType(attachmentType); err != nil {
+		return err
+	}
+
+	switch mode {
+	case "bridged":
+		if settings.BridgeInterface == "" {
+			return errors.New("A bridge interface is required for bridged networking")
+		}
+		return adapter.SetBridgedInterface(settings.BridgeInterface)
+	case "hostonly":
+		if settings.HostOnlyInterface == "" {
+			return errors.New("A host-only interface is required for host-only networking")
+		}
+		return adapter.SetHostOnlyInterface(settings.HostOnlyInterface)
+	case "internal":
+		if settings.InternalNetwork == "" {
+			settings.InternalNetwork = "intnet"
+		}
+		return adapter.SetInternalNetwork(settings.InternalNetwork)
+	case "natnetwork":
+		if settings.NATNetwork == "" {
+			return errors.New("A NAT network name is required for NAT network mode")
+		}
+		return adapter.SetNATNetwork(settings.NATNetwork)
+	}
+
+	return nil
+}
+
+func normalizeMACAddress(address string) (string, error) {
+	mac := strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(address))
+	if len(mac) != 12 || strings.Trim(mac, "0123456789ABCDEF") != "" {
+		return "", fmt.Errorf("Invalid MAC address '%s'", address)
+	}
+	return mac, nil
+}
+
+func configureAdapter(adapter vbox.NetworkAdapter, settings adapterSettings) error {
+	adapterType := vbox.NetworkAdapterType_I82540EM
+	if settings.Type != "" {
+		var found bool
+		if adapterType, found = adapterTypes[strings.ToLower(settings.Type)]; !found {
+			return fmt.Errorf("Invalid network adapter type '%s'", settings.Type)
+		}
+	}
+
+	if err := adapter.SetEnabled(true); err != nil {
+		return err
+	}
+
+	if err := adapter.SetAdapterType(adapterType); err != nil {
+		return err
+	}
+
+	if err := setAttachment(adapter, settings); err != nil {
+		return err
+	}
+
+	if settings.MACAddress != "" {
+		mac, err := normalizeMACAddress(settings.MACAddress)
+		if err != nil {
+			return err
+		}
+		if err := adapter.SetMACAddress(mac); err != nil {
+			return err
+		}
+	}
+
+	if settings.CableConnected != nil {
+		if err := adapter.SetCableConnected(*settings.CableConnected); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// networkAdapters returns the settings of the network adapters, the ones of
+// network.adapters or else the single one of network
+func networkAdapters(cfg *viper.Viper) ([]adapterSettings, error) {
+	var adapters []adapterSettings
+	if cfg.IsSet("network.adapters") {
+		if err := cfg.UnmarshalKey("network.adapters", &adapters); err != nil {
+			return nil, fmt.Errorf("Invalid network adapters configuration: %s", err.Error())
+		}
+		return adapters, nil
+	}
+
+	var network adapterSettings
+	if err := cfg.UnmarshalKey("network", &network); err != nil {
+		return nil, fmt.Errorf("Invalid network configuration: %s", err.Error())
+	}
+	return append(adapters, network), nil
+}
+
+func configureNetwork(cfg *viper.Viper, machine vbox.Machine) error {
+	adapters, err := networkAdapters(cfg)
+	if err != nil {
+		return err
+	}
+
+	portForwarded := false
+	for i, settings := range adapters {
+		adapter, err := machine.GetNetworkAdapter(uint32(i))
+		if err != nil {
+			return err
+		}
+
+		if err := configureAdapter(adapter, settings); err != nil {
+			return fmt.Errorf("Failed to configure network adapter %d: %s", i, err.Error())
+		}
+
+		// Port forwards are set up on the first NAT adapter
+		if !portForwarded && settings.mode() == "nat" {
+			if err := addPortForwards(cfg, adapter); err != nil {
+				return err
+			}
+			portForwarded = true
+		}
+	}
+
+	if !portForwarded && len(cfg.GetStringMap("port_forwards")) > 0 {
+		logger.Warn("Ignoring port forwards as no adapter is in NAT mode")
+	}
+
+	return nil
+}
+
+func addPortForwards(cfg *viper.Viper, adapter vbox.NetworkAdapter) error {
+	forwards := cfg.GetStringMap("port_forwards")
+	if len(forwards) == 0 {
+		return nil
+	}
+
+	natEngine, err := adapter.GetNATEngine()
+	if err != nil {
+		return err
+	}
+	defer natEngine.Release()
+
+	for name := range forwards {
+		forward := cfg.Sub("port_forwards." + name)
+
+		protocolName := strings.ToLower(forward.GetString("protocol"))
+		if protocolName == "" {
+			protocolName = "tcp"
+		}
+
+		protocol, found := natProtocols[protocolName]
+		if !found {
+			return fmt.Errorf("Invalid protocol '%s' for port forward %s", protocolName, name)
+		}
+
+		hostPort := forward.GetInt("host_port")
+		guestPort := forward.GetInt("guest_port")
+		if hostPort <= 0 || hostPort > 65535 || guestPort <= 0 || guestPort > 65535 {
+			return fmt.Errorf("Invalid ports for port forward %s", name)
+		}
+
+		hostIP := forward.GetString("host_ip")
+		guestIP := forward.GetString("guest_ip")
+		if err := natEngine.AddRedirect(name, protocol, hostIP, uint16(hostPort), guestIP, uint16(guestPort)); err != nil {
+			logger.Error("Failed to create port forward", "name", name, "error", err)
+			continue
+		}
+
+		logger.Info("Forwarding port", "protocol", protocolName, "host_port", hostPort, "guest_port", guestPort)
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lebauce/vbox"
+)
+
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j] + 1
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+			if previous[j-1]+cost < current[j] {
+				current[j] = previous[j-1] + cost
+			}
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func validateOSType(osType string) error {
+	osTypes, err := vbox.GetGuestOSTypes()
+	if err != nil {
+		return fmt.Errorf("Failed to retrieve guest OS types: %s", err.Error())
+	}
+
+	var ids []string
+	for _, t := range osTypes {
+		id, err := t.GetId()
+		t.Release()
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	suggestion, distance := "", -1
+	for _, id := range ids {
+		if id == osType {
+			return nil
+		}
+
+		d := levenshtein(strings.ToLower(osType), strings.ToLower(id))
+		if distance == -1 || d < distance {
+			suggestion, distance = id, d
+		}
+	}
+
+	if suggestion != "" {
+		return fmt.Errorf("Invalid distro type '%s', did you mean '%s' ?", osType, suggestion)
+	}
+	return fmt.Errorf("Invalid distro type '%s'", osType)
+}
@@ -0,0 +1,64 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lebauce/vbox"
+)
+
+// diskModes maps the disk modes to medium types. The changes made to
+// immutable and multi-attach disks are written to a differencing disk
+// that is reset on every boot.
+var diskModes = map[string]uint32{
+	"normal":      vbox.MediumType_Normal,
+	"immutable":   vbox.MediumType_Immutable,
+	"multiattach": vbox.MediumType_MultiAttach,
+}
+
+// mode returns the mode of the disk, the immutable flag being a shorthand
+// for the immutable mode
+func (d *Disk) mode() string {
+	if d.Mode == "" && d.Immutable {
+		return "immutable"
+	}
+	if d.Mode == "" {
+		return "normal"
+	}
+	return d.Mode
+}
+
+// resetOverlays discards the changes written to the differencing disks of
+// the multi-attach disks. VirtualBox already resets the differencing disks
+// of immutable disks when the machine starts.
+func (vm *VirtualMachine) resetOverlays(ctx context.Context) error {
+	attachments, err := vm.machine.GetMediumAttachments()
+	if err != nil {
+		return err
+	}
+
+	for _, attachment := range attachments {
+		if attachment.Type != vbox.DeviceType_HardDisk {
+			continue
+		}
+
+		base, err := attachment.Medium.GetBase()
+		if err != nil {
+			return err
+		}
+
+		if mediumType, err := base.GetType(); err != nil || mediumType != vbox.MediumType_MultiAttach {
+			continue
+		}
+
+		location, _ := attachment.Medium.GetLocation()
+		logger.Info("Resetting differencing disk", "path", location)
+
+		progress, err := attachment.Medium.Reset()
+		if err := waitForProgressContext(ctx, progress, err); err != nil {
+			return fmt.Errorf("Failed to reset %s: %s", location, err.Error())
+		}
+	}
+
+	return nil
+}
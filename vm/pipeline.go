@@ -0,0 +1,147 @@
+package vm
+
+// eventPipeline turns what the event loops observe into events, so that
+// subscribers get the same events whether the machine is polled or listened
+// to: only actual changes are published, and a property that disappears is
+// published with an empty value and flags.
+type eventPipeline struct {
+	vm         *VirtualMachine
+	publish    func(Event)
+	pattern    string
+	state      uint32
+	session    uint32
+	runLevel   uint32
+	properties map[string]GuestPropertyChanged
+}
+
+// newEventPipeline records the current state of the machine, which is not
+// published
+func (vm *VirtualMachine) newEventPipeline(publish func(Event)) (*eventPipeline, error) {
+	p := &eventPipeline{
+		vm:      vm,
+		publish: publish,
+		pattern: vm.cfg.GetString("events.properties"),
+	}
+
+	var err error
+	if p.state, err = vm.machine.GetState(); err != nil {
+		return nil, err
+	}
+	p.session, _ = vm.machine.GetSessionState()
+	p.runLevel, _ = vm.additionsRunLevel()
+
+	if p.properties, err = p.enumerateProperties(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// enumerateProperties returns the guest properties matching
+// events.properties, by name
+func (p *eventPipeline) enumerateProperties() (map[string]GuestPropertyChanged, error) {
+	properties, err := p.vm.machine.EnumerateGuestProperties(p.pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]GuestPropertyChanged)
+	for _, prop := range properties {
+		m[prop.Name] = GuestPropertyChanged{
+			Name:      prop.Name,
+			Value:     prop.Value,
+			Timestamp: prop.Timestamp,
+			Flags:     prop.Flags,
+		}
+	}
+	return m, nil
+}
+
+// setState publishes a machine state change and returns whether the machine
+// stopped
+func (p *eventPipeline) setState(state uint32) bool {
+	if state == p.state {
+		return false
+	}
+	p.state = state
+
+	p.publish(StateChanged{State: state})
+	return isStopped(state)
+}
+
+func (p *eventPipeline) setSessionState(state uint32) {
+	if state == p.session {
+		return
+	}
+	p.session = state
+
+	p.publish(SessionStateChanged{State: state})
+}
+
+func (p *eventPipeline) setRunLevel(runLevel uint32) {
+	if runLevel == p.runLevel {
+		return
+	}
+	p.runLevel = runLevel
+
+	p.publish(AdditionsStateChanged{RunLevel: runLevel})
+	p.vm.onAdditionsRunLevel(runLevel)
+}
+
+// setProperty publishes the change of a single guest property, an empty value
+// meaning that the property was deleted
+func (p *eventPipeline) setProperty(prop GuestPropertyChanged) {
+	if !MatchPropertyPattern(p.pattern, prop.Name) {
+		return
+	}
+
+	previous, ok := p.properties[prop.Name]
+	if prop.Value == "" {
+		if ok {
+			delete(p.properties, prop.Name)
+			p.publish(GuestPropertyChanged{Name: prop.Name, Timestamp: prop.Timestamp})
+		}
+		return
+	}
+
+	// A property is only rewritten if its timestamp changed
+	if ok && previous.Timestamp == prop.Timestamp {
+		return
+	}
+	p.properties[prop.Name] = prop
+
+	p.publish(prop)
+}
+
+// setProperties publishes the differences between the guest properties and
+// the previous ones
+func (p *eventPipeline) setProperties(properties map[string]GuestPropertyChanged) {
+	for _, prop := range properties {
+		p.setProperty(prop)
+	}
+
+	for name := range p.properties {
+		if _, ok := properties[name]; !ok {
+			p.setProperty(GuestPropertyChanged{Name: name})
+		}
+	}
+}
+
+// additionsChanged publishes the new run level of the guest additions
+func (p *eventPipeline) additionsChanged() {
+	if runLevel, err := p.vm.additionsRunLevel(); err == nil {
+		p.setRunLevel(runLevel)
+	}
+}
+
+func (p *eventPipeline) networkAdapterChanged(slot uint32) {
+	p.publish(NetworkAdapterChanged{Slot: slot})
+}
+
+func (p *eventPipeline) sharedFolderChanged(scope uint32) {
+	p.publish(SharedFolderChanged{Scope: scope})
+}
+
+func (p *eventPipeline) runtimeError(fatal bool, id, message string) {
+	logger.Error("Runtime error", "id", id, "message", message, "fatal", fatal)
+	p.publish(RuntimeError{Fatal: fatal, ID: id, Message: message})
+}
@@ -0,0 +1,168 @@
+package vm
+
+import (
+	"os"
+
+	"github.com/spf13/viper"
+)
+
+// PlannedController is a storage controller the machine would be created
+// with
+type PlannedController struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Ports int    `json:"ports"`
+}
+
+// PlannedMedium is a disk or ISO image the machine would be created with.
+// Error tells why the device of a raw disk could not be found.
+type PlannedMedium struct {
+	Type       string `json:"type"`
+	Location   string `json:"location,omitempty"`
+	Device     string `json:"device,omitempty"`
+	Controller string `json:"controller,omitempty"`
+	Port       *int   `json:"port,omitempty"`
+	Mode       string `json:"mode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// PlannedAdapter is a network adapter the machine would be created with
+type PlannedAdapter struct {
+	Mode       string `json:"mode"`
+	Type       string `json:"type,omitempty"`
+	MACAddress string `json:"mac_address,omitempty"`
+	Network    string `json:"network,omitempty"`
+}
+
+// Plan is the specification of the machine the configuration describes
+type Plan struct {
+	Name             string              `json:"name"`
+	Hypervisor       string              `json:"hypervisor"`
+	CloneFrom        string              `json:"clone_from,omitempty"`
+	OSType           string              `json:"os_type"`
+	Firmware         string              `json:"firmware"`
+	CPUs             int                 `json:"cpus"`
+	RAM              int                 `json:"ram"`
+	Controllers      []PlannedController `json:"controllers"`
+	Media            []PlannedMedium     `json:"media"`
+	Network          []PlannedAdapter    `json:"network"`
+	SharedFolders    map[string]string   `json:"shared_folders"`
+	GlobalExtraData  map[string]string   `json:"global_extra_data"`
+	MachineExtraData map[string]string   `json:"machine_extra_data"`
+}
+
+// controllerType returns the storage.controller value of a controller
+func controllerType(spec controllerSpec) string {
+	for kind, s := range controllerSpecs {
+		if s.controllerType == spec.controllerType {
+			return kind
+		}
+	}
+	return "unknown"
+}
+
+// adapterNetwork returns the interface or network an adapter is attached
+// to in its mode
+func adapterNetwork(settings adapterSettings) string {
+	switch settings.mode() {
+	case "bridged":
+		return settings.BridgeInterface
+	case "hostonly":
+		return settings.HostOnlyInterface
+	case "internal":
+		return settings.InternalNetwork
+	case "natnetwork":
+		return settings.NATNetwork
+	}
+	return ""
+}
+
+// NewPlan returns the specification of the machine the configuration
+// describes, without using the hypervisor. The Guest Additions ISO, whose
+// location is only known to VirtualBox, is not listed.
+func NewPlan(cfg *viper.Viper) (*Plan, error) {
+	cpus, ram := resources(cfg)
+	plan := &Plan{
+		Name:             cfg.GetString("machine_name"),
+		Hypervisor:       cfg.GetString("hypervisor"),
+		CloneFrom:        cfg.GetString("clone_from"),
+		OSType:           cfg.GetString("distro_type"),
+		Firmware:         cfg.GetString("firmware"),
+		CPUs:             cpus,
+		RAM:              ram,
+		Controllers:      []PlannedController{},
+		Media:            []PlannedMedium{},
+		Network:          []PlannedAdapter{},
+		SharedFolders:    make(map[string]string),
+		GlobalExtraData:  globalExtraData(cfg),
+		MachineExtraData: machineExtraData(cfg),
+	}
+
+	specs, err := getControllerSpecs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if spec, dedicated := hotplugController(specs); dedicated && cfg.GetString("usb.hotplug") == "raw" {
+		specs = append(specs, spec)
+	}
+
+	for _, spec := range specs {
+		plan.Controllers = append(plan.Controllers, PlannedController{Name: spec.name, Type: controllerType(spec), Ports: spec.ports})
+	}
+
+	disks, err := getDisks(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, disk := range disks {
+		medium := PlannedMedium{
+			Type:       disk.Type,
+			Location:   disk.Location,
+			Controller: disk.Controller,
+			Port:       disk.Port,
+			Mode:       disk.Mode,
+		}
+
+		if disk.Type == "raw" {
+			if device, err := rawDevice(cfg, disk); err != nil {
+				medium.Error = err.Error()
+			} else {
+				medium.Device = device
+			}
+		}
+
+		plan.Media = append(plan.Media, medium)
+	}
+
+	for _, image := range cfg.GetStringSlice("iso_images") {
+		plan.Media = append(plan.Media, PlannedMedium{Type: "iso", Location: image})
+	}
+
+	if cfg.GetString("provision.user_data") != "" {
+		if _, err := os.Stat(provisionedPath(cfg)); err != nil {
+			plan.Media = append(plan.Media, PlannedMedium{Type: "iso", Location: seedPath(cfg)})
+		}
+	}
+
+	adapters, err := networkAdapters(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, settings := range adapters {
+		plan.Network = append(plan.Network, PlannedAdapter{
+			Mode:       settings.mode(),
+			Type:       settings.Type,
+			MACAddress: settings.MACAddress,
+			Network:    adapterNetwork(settings),
+		})
+	}
+
+	for name := range cfg.GetStringMap("shared_folders") {
+		plan.SharedFolders[name] = cfg.GetString("shared_folders." + name + ".path")
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,69 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lebauce/vlaunch/backend"
+)
+
+// preflightLogSpace is the free space in MB kept in the data path for the
+// logs and the settings of the machine
+const preflightLogSpace = 512
+
+// PreflightError reports all the host resources missing to run the machine
+type PreflightError struct {
+	Problems []string
+}
+
+func (e *PreflightError) Error() string {
+	return "Preflight checks failed:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+func (e *PreflightError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// Preflight checks that the host can run the machine before it is created:
+// enough free RAM for its memory, enough free space in the data path for
+// the logs and the saved state, and hardware virtualization enabled. The
+// resources that can not be measured are not checked.
+func (vm *VirtualMachine) Preflight() error {
+	cfg := vm.cfg
+	if !cfg.GetBool("preflight.enabled") {
+		return nil
+	}
+
+	e := &PreflightError{}
+
+	_, ram := resources(cfg)
+	if freeRam, err := backend.GetFreeRam(); err != nil {
+		logger.Debug("Failed to get the free memory", "error", err)
+	} else if free := int(freeRam / 1024 / 1024); ram > free {
+		e.add("%d MB of RAM are required but only %d MB are free", ram, free)
+	}
+
+	required := preflightLogSpace
+	if cfg.GetBool("save_state") {
+		required += ram
+	}
+
+	dataPath := cfg.GetString("data_path")
+	if freeSpace, err := backend.GetFreeDiskSpace(dataPath); err != nil {
+		logger.Debug("Failed to get the free disk space", "path", dataPath, "error", err)
+	} else if free := int(freeSpace / 1024 / 1024); required > free {
+		e.add("%d MB of disk space are required in %s but only %d MB are free", required, dataPath, free)
+	}
+
+	if err := backend.CheckVirtualization(); err != nil {
+		e.add("%s", err.Error())
+	}
+
+	if len(e.Problems) > 0 {
+		for _, problem := range e.Problems {
+			logger.Error("Preflight check failed", "problem", problem)
+		}
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lebauce/vbox"
+)
+
+var OperationCancelled = errors.New("Operation cancelled")
+
+// ProgressReporter is notified of the advancement of long operations such
+// as the machine launch, cloning or the deletion of its media
+type ProgressReporter interface {
+	// Update is called with the description of the current operation
+	// and the completion percentage of the whole task
+	Update(operation string, percent uint32)
+	// Cancelled is polled while the operation is running, returning true
+	// aborts it
+	Cancelled() bool
+}
+
+type progressReporterKey struct{}
+
+// WithProgressReporter returns a context reporting the progress of the
+// operations it is passed to
+func WithProgressReporter(ctx context.Context, reporter ProgressReporter) context.Context {
+	return context.WithValue(ctx, progressReporterKey{}, reporter)
+}
+
+func progressReporter(ctx context.Context) ProgressReporter {
+	reporter, _ := ctx.Value(progressReporterKey{}).(ProgressReporter)
+	return reporter
+}
+
+func reportProgress(reporter ProgressReporter, progress vbox.Progress) {
+	if reporter == nil {
+		return
+	}
+
+	description, _ := progress.GetOperationDescription()
+	percent, _ := progress.GetPercent()
+	reporter.Update(description, percent)
+}
+
+// progressError describes an operation that failed or did not complete in
+// time, with the error reported by VirtualBox if any
+func progressError(progress vbox.Progress, reason string) error {
+	description, _ := progress.GetOperationDescription()
+	if description == "" {
+		description = "Operation"
+	}
+
+	if info, err := progress.GetErrorInfo(); err == nil {
+		if text, err := info.GetText(); err == nil && text != "" {
+			return fmt.Errorf("%s %s: %s", description, reason, text)
+		}
+	}
+	return fmt.Errorf("%s %s", description, reason)
+}
+
+// withTimeout returns a context done after the given timeout, or never if
+// the timeout is zero
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func waitForProgress(progress vbox.Progress, err error) error {
+	return waitForProgressContext(context.Background(), progress, err)
+}
+
+// waitForProgressContext waits for an operation to complete, cancelling it
+// if the context is done first
+func waitForProgressContext(ctx context.Context, progress vbox.Progress, err error) error {
+	if err != nil {
+		return err
+	}
+	defer progress.Release()
+
+	reporter := progressReporter(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			progress.Cancel()
+			if ctx.Err() == context.DeadlineExceeded {
+				percent, _ := progress.GetPercent()
+				return progressError(progress, fmt.Sprintf("timed out at %d%%", percent))
+			}
+			return ctx.Err()
+		default:
+		}
+
+		if reporter != nil && reporter.Cancelled() {
+			progress.Cancel()
+			return OperationCancelled
+		}
+
+		if err := progress.WaitForCompletion(250); err != nil {
+			return err
+		}
+
+		completed, err := progress.GetCompleted()
+		if err != nil {
+			return err
+		}
+
+		reportProgress(reporter, progress)
+
+		if completed {
+			if err := progress.WaitForCompletion(-1); err != nil {
+				return err
+			}
+
+			if code, err := progress.GetResultCode(); err == nil && code != 0 {
+				return progressError(progress, fmt.Sprintf("failed with code %#x", uint32(code)))
+			}
+			return nil
+		}
+	}
+}
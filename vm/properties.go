@@ -0,0 +1,75 @@
+package vm
+
+import "strings"
+
+type GuestProperty struct {
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	Timestamp int64  `json:"timestamp"`
+	Flags     string `json:"flags"`
+}
+
+func (vm *VirtualMachine) SetGuestProperty(name, value, flags string) error {
+	return vm.hypervisor.SetGuestProperty(name, value, flags)
+}
+
+func (vm *VirtualMachine) GetGuestProperty(name string) (string, error) {
+	properties, err := vm.hypervisor.GuestProperties(name)
+	if err != nil {
+		return "", err
+	}
+
+	for _, prop := range properties {
+		if prop.Name == name {
+			return prop.Value, nil
+		}
+	}
+	return "", nil
+}
+
+func (vm *VirtualMachine) GuestProperties(pattern string) ([]GuestProperty, error) {
+	return vm.hypervisor.GuestProperties(pattern)
+}
+
+// MatchPropertyPattern matches a guest property name against a pattern with
+// the syntax of EnumerateGuestProperties: alternatives separated by '|',
+// '*' matching any sequence, including '/', and '?' any character. An empty
+// pattern matches all the names. The hooks, the subscriptions and the
+// journal all use it.
+func MatchPropertyPattern(pattern, name string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	var match func(pattern, name string) bool
+	match = func(pattern, name string) bool {
+		for pattern != "" {
+			switch pattern[0] {
+			case '*':
+				for i := 0; i <= len(name); i++ {
+					if match(pattern[1:], name[i:]) {
+						return true
+					}
+				}
+				return false
+			case '?':
+				if name == "" {
+					return false
+				}
+			default:
+				if name == "" || name[0] != pattern[0] {
+					return false
+				}
+			}
+			pattern, name = pattern[1:], name[1:]
+		}
+		return name == ""
+	}
+
+	for _, alternative := range strings.Split(pattern, "|") {
+		if match(alternative, name) {
+			return true
+		}
+	}
+	return false
+}
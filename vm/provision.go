@@ -0,0 +1,96 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/lebauce/vlaunch/iso"
+	"github.com/spf13/viper"
+)
+
+// seedVolumeID is the volume label cloud-init looks for to find a NoCloud
+// seed
+const seedVolumeID = "cidata"
+
+func seedPath(cfg *viper.Viper) string {
+	return path.Join(cfg.GetString("data_path"), cfg.GetString("machine_name")+"-seed.iso")
+}
+
+// provisionedPath is the file marking that the guest booted with its seed,
+// removing it provisions the guest again
+func provisionedPath(cfg *viper.Viper) string {
+	return path.Join(cfg.GetString("data_path"), cfg.GetString("machine_name")+".provisioned")
+}
+
+// seedFiles returns the files of the NoCloud seed: the user-data, the
+// meta-data, generated from the machine name if not given, and the extra
+// files such as network-config
+func seedFiles(cfg *viper.Viper) ([]iso.File, error) {
+	userData, err := os.ReadFile(cfg.GetString("provision.user_data"))
+	if err != nil {
+		return nil, err
+	}
+	files := []iso.File{{Name: "user-data", Data: userData}}
+
+	var metaData []byte
+	if metaDataPath := cfg.GetString("provision.meta_data"); metaDataPath != "" {
+		if metaData, err = os.ReadFile(metaDataPath); err != nil {
+			return nil, err
+		}
+	} else {
+		name := cfg.GetString("machine_name")
+		metaData = []byte(fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", name, name))
+	}
+	files = append(files, iso.File{Name: "meta-data", Data: metaData})
+
+	for _, filename := range cfg.GetStringSlice("provision.files") {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, iso.File{Name: filepath.Base(filename), Data: data})
+	}
+	return files, nil
+}
+
+// seedImage writes the NoCloud seed ISO of the provision settings and returns
+// its path, empty when there is nothing to provision or the guest already
+// booted with it
+func (vm *VirtualMachine) seedImage() (string, error) {
+	if vm.cfg.GetString("provision.user_data") == "" {
+		return "", nil
+	}
+
+	if _, err := os.Stat(provisionedPath(vm.cfg)); err == nil {
+		logger.Debug("Guest already provisioned", "marker", provisionedPath(vm.cfg))
+		return "", nil
+	}
+
+	files, err := seedFiles(vm.cfg)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read the provisioning files: %s", err.Error())
+	}
+
+	location := seedPath(vm.cfg)
+	if err := iso.Write(location, seedVolumeID, files); err != nil {
+		return "", fmt.Errorf("Failed to write the provisioning seed: %s", err.Error())
+	}
+
+	logger.Info("Created provisioning seed", "image", location)
+	vm.seeded = true
+	return location, nil
+}
+
+// markProvisioned records that the guest booted with its seed so that it is
+// not attached anymore
+func (vm *VirtualMachine) markProvisioned() {
+	if !vm.seeded {
+		return
+	}
+
+	if err := os.WriteFile(provisionedPath(vm.cfg), nil, 0644); err != nil {
+		logger.Warn("Failed to mark the guest as provisioned", "error", err)
+	}
+}
@@ -0,0 +1,84 @@
+package vm
+
+import (
+	"github.com/lebauce/vlaunch/backend"
+)
+
+// Guest properties the host proxy is published as, empty when unset
+const (
+	proxyHTTPProperty    = "/vlaunch/Host/Proxy/HTTP"
+	proxyHTTPSProperty   = "/vlaunch/Host/Proxy/HTTPS"
+	proxyNoProxyProperty = "/vlaunch/Host/Proxy/NoProxy"
+)
+
+// proxy returns the proxy the guest should use, the one of the configuration
+// if set or else the one of the host, nil if disabled or there is none
+func (vm *VirtualMachine) proxy() (*backend.Proxy, error) {
+	if !vm.cfg.GetBool("proxy.enabled") {
+		return nil, nil
+	}
+
+	if http, https := vm.cfg.GetString("proxy.http"), vm.cfg.GetString("proxy.https"); http != "" || https != "" {
+		return &backend.Proxy{HTTP: http, HTTPS: https, NoProxy: vm.cfg.GetString("proxy.no_proxy")}, nil
+	}
+
+	proxy, err := backend.GetProxy()
+	if err != nil || proxy == nil {
+		return nil, err
+	}
+
+	if noProxy := vm.cfg.GetString("proxy.no_proxy"); noProxy != "" {
+		proxy.NoProxy = noProxy
+	}
+	return proxy, nil
+}
+
+// PublishProxy sets the proxy the guest should use as guest properties, so
+// that a script in the guest can configure it
+func (vm *VirtualMachine) PublishProxy() error {
+	proxy, err := vm.proxy()
+	if err != nil {
+		return err
+	}
+
+	if proxy == nil {
+		proxy = &backend.Proxy{}
+	} else {
+		logger.Info("Publishing proxy", "http", proxy.HTTP, "https", proxy.HTTPS, "no_proxy", proxy.NoProxy)
+	}
+
+	for name, value := range map[string]string{
+		proxyHTTPProperty:    proxy.HTTP,
+		proxyHTTPSProperty:   proxy.HTTPS,
+		proxyNoProxyProperty: proxy.NoProxy,
+	} {
+		// Only VirtualBox has guest properties
+		if err := vm.SetGuestProperty(name, value, "RDONLYGUEST"); err == NotSupported {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// proxyEnvironment returns the variables setting the proxy of the processes
+// started in the guest
+func (vm *VirtualMachine) proxyEnvironment() []string {
+	proxy, err := vm.proxy()
+	if err != nil || proxy == nil {
+		return nil
+	}
+
+	var env []string
+	if proxy.HTTP != "" {
+		env = append(env, "http_proxy="+proxy.HTTP, "HTTP_PROXY="+proxy.HTTP)
+	}
+	if proxy.HTTPS != "" {
+		env = append(env, "https_proxy="+proxy.HTTPS, "HTTPS_PROXY="+proxy.HTTPS)
+	}
+	if proxy.NoProxy != "" {
+		env = append(env, "no_proxy="+proxy.NoProxy, "NO_PROXY="+proxy.NoProxy)
+	}
+	return env
+}
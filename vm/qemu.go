@@ -0,0 +1,454 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lebauce/vbox"
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/spf13/viper"
+)
+
+// qemuDisplays maps the frontends to QEMU displays
+var qemuDisplays = map[string]string{
+	"gui":      "gtk",
+	"sdl":      "sdl",
+	"headless": "none",
+}
+
+// qemuBootDevices maps the boot_order values to QEMU boot devices
+var qemuBootDevices = map[string]string{
+	"disk": "c",
+	"dvd":  "d",
+	"net":  "n",
+}
+
+// qemu runs the machine with QEMU, using KVM when available. The machine
+// is controlled through the QEMU Machine Protocol (QMP).
+type qemu struct {
+	cfg    *viper.Viper
+	args   []string
+	socket string
+	cmd    *exec.Cmd
+	exited chan struct{}
+	err    error
+}
+
+// qmpClient is a connection to the QMP socket of a machine
+type qmpClient struct {
+	conn    net.Conn
+	decoder *json.Decoder
+}
+
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+type qmpResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *qmpError       `json:"error"`
+	Event  string          `json:"event"`
+}
+
+func dialQMP(socket string) (*qmpClient, error) {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &qmpClient{conn: conn, decoder: json.NewDecoder(conn)}
+
+	// QEMU greets the client before accepting commands
+	var greeting map[string]interface{}
+	if err := client.decoder.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := client.execute("qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func (c *qmpClient) execute(command string, arguments interface{}, result interface{}) error {
+	request := map[string]interface{}{"execute": command}
+	if arguments != nil {
+		request["arguments"] = arguments
+	}
+
+	if err := json.NewEncoder(c.conn).Encode(request); err != nil {
+		return err
+	}
+
+	for {
+		var response qmpResponse
+		if err := c.decoder.Decode(&response); err != nil {
+			return err
+		}
+
+		// Asynchronous events may come before the response
+		if response.Event != "" {
+			continue
+		}
+
+		if response.Error != nil {
+			return fmt.Errorf("%s failed: %s", command, response.Error.Desc)
+		}
+
+		if result != nil {
+			return json.Unmarshal(response.Return, result)
+		}
+		return nil
+	}
+}
+
+func (c *qmpClient) Close() error {
+	return c.conn.Close()
+}
+
+func (q *qemu) execute(command string, arguments interface{}, result interface{}) error {
+	client, err := dialQMP(q.socket)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.execute(command, arguments, result)
+}
+
+func (q *qemu) running() bool {
+	if q.cmd == nil {
+		return false
+	}
+
+	select {
+	case <-q.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// qemuNetworkArgs returns the arguments of a user mode network adapter,
+// with the configured port forwards
+func qemuNetworkArgs(cfg *viper.Viper) ([]string, error) {
+	if cfg.IsSet("network.adapters") || (cfg.IsSet("network.mode") && cfg.GetString("network.mode") != "nat") {
+		logger.Warn("Only NAT networking is supported with QEMU")
+	}
+
+	nic := "user,model=virtio-net-pci"
+
+	forwards := cfg.GetStringMap("port_forwards")
+	for name := range forwards {
+		forward := cfg.Sub("port_forwards." + name)
+
+		protocol := strings.ToLower(forward.GetString("protocol"))
+		if protocol == "" {
+			protocol = "tcp"
+		}
+
+		if _, found := natProtocols[protocol]; !found {
+			return nil, fmt.Errorf("Invalid protocol '%s' for port forward %s", protocol, name)
+		}
+
+		hostPort := forward.GetInt("host_port")
+		guestPort := forward.GetInt("guest_port")
+		if hostPort <= 0 || hostPort > 65535 || guestPort <= 0 || guestPort > 65535 {
+			return nil, fmt.Errorf("Invalid ports for port forward %s", name)
+		}
+
+		nic += fmt.Sprintf(",hostfwd=%s:%s:%d-%s:%d", protocol,
+			forward.GetString("host_ip"), hostPort, forward.GetString("guest_ip"), guestPort)
+	}
+
+	return []string{"-nic", nic}, nil
+}
+
+func (q *qemu) CreateMachine(ctx context.Context, cfg *viper.Viper) error {
+	if _, err := exec.LookPath(cfg.GetString("qemu.binary")); err != nil {
+		return fmt.Errorf("Failed to find QEMU: %s", err.Error())
+	}
+
+	name := cfg.GetString("machine_name")
+	cpus, ram := resources(cfg)
+
+	q.cfg = cfg
+	q.socket = path.Join(cfg.GetString("data_path"), name+".qmp")
+	q.args = []string{
+		"-name", name,
+		"-smp", strconv.Itoa(cpus),
+		"-m", strconv.Itoa(ram),
+		"-qmp", "unix:" + q.socket + ",server,nowait",
+	}
+
+	if kvm, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0); err == nil {
+		kvm.Close()
+		q.args = append(q.args, "-enable-kvm", "-cpu", "host")
+	} else {
+		logger.Warn("KVM is not available, the machine will be emulated", "error", err)
+	}
+
+	if cfg.GetString("firmware") == "efi" {
+		firmware := cfg.GetString("qemu.efi_firmware")
+		if _, err := os.Stat(firmware); err != nil {
+			return fmt.Errorf("Failed to find EFI firmware: %s", err.Error())
+		}
+		q.args = append(q.args, "-bios", firmware)
+	}
+
+	if cfg.IsSet("boot_order") {
+		order := ""
+		for _, device := range cfg.GetStringSlice("boot_order") {
+			order += qemuBootDevices[device]
+		}
+		if order != "" {
+			q.args = append(q.args, "-boot", "order="+order)
+		}
+	}
+
+	// The clock can only start at a given date, which gives the offset
+	base := "localtime"
+	if rtcUseUTC(cfg) {
+		base = "utc"
+	}
+	if offset := cfg.GetDuration("time.offset"); offset != 0 {
+		start := time.Now().Add(offset)
+		if base == "utc" {
+			start = start.UTC()
+		}
+		base = start.Format("2006-01-02T15:04:05")
+	}
+	q.args = append(q.args, "-rtc", "base="+base)
+
+	if !cfg.GetBool("time.sync") {
+		logger.Warn("The time of QEMU guests is never synchronized with the host")
+	}
+
+	switch cfg.GetString("serial.mode") {
+	case "file":
+		q.args = append(q.args, "-serial", "file:"+serialPath(cfg))
+	case "pipe":
+		q.args = append(q.args, "-serial", "unix:"+serialPath(cfg)+",server,nowait")
+	}
+
+	if cfg.GetBool("recording.enabled") {
+		logger.Warn("Recording is only supported with VirtualBox")
+	}
+
+	networkArgs, err := qemuNetworkArgs(cfg)
+	if err != nil {
+		return err
+	}
+	q.args = append(q.args, networkArgs...)
+
+	q.args = append(q.args, cfg.GetStringSlice("qemu.args")...)
+	return nil
+}
+
+func (q *qemu) AttachDisk(ctx context.Context, index int, disk Disk) error {
+	file, format := disk.Location, disk.Type
+	switch disk.Type {
+	case "raw":
+		if len(disk.Partitions) > 0 {
+			return fmt.Errorf("Partition selection is not supported with QEMU")
+		}
+
+		// QEMU accesses the device directly, no descriptor is needed
+		if file == "" {
+			var err error
+			if file, err = backend.FindDevice(q.cfg); err != nil {
+				return err
+			}
+		}
+	case "vdi", "vmdk":
+		if file == "" {
+			return fmt.Errorf("A location is required for %s disks", disk.Type)
+		}
+	case "iso":
+		format = "raw"
+	default:
+		return fmt.Errorf("Invalid disk type '%s'", disk.Type)
+	}
+
+	// Commas are escaped by doubling them
+	drive := fmt.Sprintf("file=%s,format=%s", strings.Replace(file, ",", ",,", -1), format)
+	if disk.Type == "iso" {
+		drive += ",media=cdrom,readonly=on"
+	} else {
+		specs, err := getControllerSpecs(q.cfg)
+		if err != nil {
+			return err
+		}
+
+		spec, err := findController(specs, disk)
+		if err != nil {
+			return err
+		}
+
+		if spec.bus == vbox.StorageBus_Ide {
+			drive += ",if=ide"
+		} else {
+			drive += ",if=virtio"
+		}
+	}
+
+	// Changes are discarded when QEMU exits
+	if disk.mode() != "normal" {
+		drive += ",snapshot=on"
+	}
+
+	q.args = append(q.args, "-drive", drive)
+	return nil
+}
+
+func (q *qemu) Launch(ctx context.Context, frontend string) error {
+	display, found := qemuDisplays[frontend]
+	if !found {
+		return fmt.Errorf("Frontend '%s' is not supported with QEMU", frontend)
+	}
+
+	os.Remove(q.socket)
+
+	args := append(q.args, "-display", display)
+	logger.Info("Running QEMU", "args", strings.Join(args, " "))
+
+	q.cmd = exec.Command(q.cfg.GetString("qemu.binary"), args...)
+	q.cmd.Stdout = os.Stderr
+	q.cmd.Stderr = os.Stderr
+	if err := q.cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to run QEMU: %s", err.Error())
+	}
+
+	q.exited = make(chan struct{})
+	go func() {
+		q.err = q.cmd.Wait()
+		close(q.exited)
+	}()
+
+	// The machine is started once its QMP socket accepts connections
+	for {
+		if client, err := dialQMP(q.socket); err == nil {
+			return client.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			q.cmd.Process.Kill()
+			return ctx.Err()
+		case <-q.exited:
+			return fmt.Errorf("QEMU exited: %v", q.err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Events only reports the changes of state, QEMU has no guest properties
+func (q *qemu) Events(ctx context.Context, publish func(Event)) error {
+	previousState, err := q.State()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.exited:
+		case <-time.After(250 * time.Millisecond):
+		}
+		beat(ctx)
+
+		state, err := q.State()
+		if err != nil {
+			return err
+		}
+
+		if state != previousState {
+			publish(StateChanged{State: state})
+			if isStopped(state) {
+				return nil
+			}
+		}
+		previousState = state
+	}
+}
+
+func (q *qemu) GuestProperties(pattern string) ([]GuestProperty, error) {
+	return nil, NotSupported
+}
+
+func (q *qemu) SetGuestProperty(name, value, flags string) error {
+	return NotSupported
+}
+
+func (q *qemu) State() (uint32, error) {
+	if !q.running() {
+		return vbox.MachineState_PoweredOff, nil
+	}
+
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := q.execute("query-status", nil, &status); err != nil {
+		// The socket is closed when QEMU is exiting
+		if !q.running() {
+			return vbox.MachineState_PoweredOff, nil
+		}
+		return 0, err
+	}
+
+	switch status.Status {
+	case "paused", "suspended":
+		return vbox.MachineState_Paused, nil
+	case "prelaunch":
+		return vbox.MachineState_Starting, nil
+	case "shutdown":
+		return vbox.MachineState_Stopping, nil
+	case "internal-error", "guest-panicked":
+		return vbox.MachineState_Aborted, nil
+	default:
+		return vbox.MachineState_Running, nil
+	}
+}
+
+func (q *qemu) Stop() error {
+	return q.execute("system_powerdown", nil, nil)
+}
+
+func (q *qemu) PowerOff() error {
+	if !q.running() {
+		return nil
+	}
+
+	if err := q.execute("quit", nil, nil); err != nil {
+		logger.Warn("Failed to quit QEMU, killing it", "error", err)
+		q.cmd.Process.Kill()
+	}
+
+	<-q.exited
+	return nil
+}
+
+// Release only removes the QMP socket as QEMU machines are not registered
+func (q *qemu) Release(ctx context.Context) error {
+	if err := q.PowerOff(); err != nil {
+		return err
+	}
+
+	if q.socket != "" {
+		os.Remove(q.socket)
+	}
+	return nil
+}
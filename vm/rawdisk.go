@@ -0,0 +1,166 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/lebauce/vlaunch/vmdk"
+	"github.com/spf13/viper"
+)
+
+// UsesRawDisks returns whether the machine boots from raw devices, which
+// requires administrator privileges to set up
+func UsesRawDisks(cfg *viper.Viper) bool {
+	disks, err := getDisks(cfg)
+	if err != nil {
+		return false
+	}
+
+	for _, disk := range disks {
+		if disk.Type == "raw" {
+			return true
+		}
+	}
+	return false
+}
+
+// rawDevice returns the device of a raw disk, found from the configuration
+// unless the disk has a location
+func rawDevice(cfg *viper.Viper, settings Disk) (string, error) {
+	if settings.Location != "" {
+		return settings.Location, nil
+	}
+	return backend.FindDevice(cfg)
+}
+
+// rawDescriptorFingerprint identifies a descriptor by the device it maps,
+// the size of the device, the options it was written with and the file
+// itself, empty if one of them is not known
+func rawDescriptorFingerprint(device, location string, opts vmdk.RawOptions) string {
+	fi, err := os.Stat(location)
+	if err != nil {
+		return ""
+	}
+
+	size, err := backend.GetDeviceSize(device)
+	if err != nil {
+		return ""
+	}
+	return fingerprint(device, size, opts, fi.Size(), fi.ModTime())
+}
+
+// writeRawDescriptor writes the VMDK descriptor giving access to a raw disk
+// and returns its location
+func writeRawDescriptor(cfg *viper.Viper, settings Disk, index int) (string, error) {
+	device, err := rawDevice(cfg, settings)
+	if err != nil {
+		return "", err
+	}
+
+	location := rawDescriptorPath(cfg, index)
+	opts := vmdk.RawOptions{
+		Partitions: true,
+		Relative:   backend.RelativeRawVMDK,
+		Split:      cfg.GetBool("raw_vmdk.split"),
+		Selected:   settings.Partitions,
+	}
+
+	step := fmt.Sprintf("raw_vmdk.%d", index)
+	if setupUnchanged(cfg, step, rawDescriptorFingerprint(device, location, opts)) {
+		logger.Info("Using existing raw VMDK", "device", device)
+		return location, nil
+	}
+
+	// Keep the descriptor of a previous run, and its UUID, if it still
+	// maps the device once repaired and was written with the same options
+	if previous := setupFingerprint(cfg, step+".options"); previous == "" || previous == fingerprint(opts) {
+		if err := vmdk.Repair(location); err == nil {
+			if descriptor, err := vmdk.ReadFile(location); err == nil && descriptor.Device() == device {
+				logger.Info("Using existing raw VMDK", "device", device)
+				recordRawDescriptor(cfg, step, device, location, opts)
+				return location, nil
+			}
+		}
+	}
+
+	logger.Info("Creating raw VMDK", "device", device)
+	if err := vmdk.WriteRawVMDK(location, device, opts); err != nil {
+		return "", err
+	}
+	recordRawDescriptor(cfg, step, device, location, opts)
+	return location, nil
+}
+
+func recordRawDescriptor(cfg *viper.Viper, step, device, location string, opts vmdk.RawOptions) {
+	recordSetup(cfg, step, rawDescriptorFingerprint(device, location, opts))
+	recordSetup(cfg, step+".options", fingerprint(opts))
+}
+
+// PrepareRawDisks is the step that requires administrator privileges: it
+// writes the descriptors of the raw disks of the machine, then gives them
+// and the devices they map to owner, so that the machine can be created and
+// launched as this user.
+func PrepareRawDisks(cfg *viper.Viper, owner int) error {
+	disks, err := getDisks(cfg)
+	if err != nil {
+		return err
+	}
+
+	for i, settings := range disks {
+		if settings.Type != "raw" {
+			continue
+		}
+
+		// QEMU opens the device itself
+		if cfg.GetString("hypervisor") != "virtualbox" {
+			device, err := rawDevice(cfg, settings)
+			if err != nil {
+				return err
+			}
+
+			if err := backend.GrantDeviceAccess(device, owner); err != nil {
+				return err
+			}
+			continue
+		}
+
+		location, err := writeRawDescriptor(cfg, settings, i)
+		if err != nil {
+			return err
+		}
+
+		descriptor, err := vmdk.ReadFile(location)
+		if err != nil {
+			return err
+		}
+
+		files := []string{location}
+		for _, extent := range descriptor.Extents {
+			if path.Ext(extent.Path) == ".vmdk" {
+				files = append(files, filepath.Join(filepath.Dir(location), extent.Path))
+			}
+		}
+
+		for _, file := range files {
+			if err := os.Chown(file, owner, -1); err != nil {
+				return err
+			}
+		}
+
+		for _, device := range descriptor.DevicePaths() {
+			if err := backend.GrantDeviceAccess(device, owner); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The fingerprints of the descriptors were recorded by this process
+	if err := os.Chown(setupCachePath(cfg), owner, -1); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
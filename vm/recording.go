@@ -0,0 +1,69 @@
+package vm
+
+import (
+	"path"
+	"time"
+
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+// recordingPath returns the file the session is recorded to. By default,
+// each session is recorded to a new file of the data path.
+func recordingPath(cfg *viper.Viper) string {
+	if recordingPath := cfg.GetString("recording.path"); recordingPath != "" {
+		return recordingPath
+	}
+
+	name := cfg.GetString("machine_name") + "-" + time.Now().Format("20060102-150405") + ".webm"
+	return path.Join(cfg.GetString("data_path"), name)
+}
+
+// configureRecording enables the recording of the display of the machine
+// to a WebM file
+func configureRecording(cfg *viper.Viper, machine vbox.Machine) error {
+	settings, err := machine.GetRecordingSettings()
+	if err != nil {
+		return err
+	}
+	defer settings.Release()
+
+	if !cfg.GetBool("recording.enabled") {
+		return settings.SetEnabled(false)
+	}
+
+	screen, err := settings.GetScreenSettings(0)
+	if err != nil {
+		return err
+	}
+	defer screen.Release()
+
+	filename := recordingPath(cfg)
+	if err := screen.SetFilename(filename); err != nil {
+		return err
+	}
+
+	if err := screen.SetVideoWidth(uint32(cfg.GetInt("recording.width"))); err != nil {
+		return err
+	}
+
+	if err := screen.SetVideoHeight(uint32(cfg.GetInt("recording.height"))); err != nil {
+		return err
+	}
+
+	if err := screen.SetVideoFPS(uint32(cfg.GetInt("recording.fps"))); err != nil {
+		return err
+	}
+
+	// A maximum size of 0 means no limit
+	if err := screen.SetMaxFileSize(uint32(cfg.GetInt("recording.max_size"))); err != nil {
+		return err
+	}
+
+	if err := screen.SetEnabled(true); err != nil {
+		return err
+	}
+
+	logger.Info("Recording session", "path", filename)
+	return settings.SetEnabled(true)
+}
@@ -0,0 +1,132 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lebauce/vbox"
+)
+
+// sessionUnlockTimeout is how long VirtualBox is given to notice that the
+// process holding the lock of a machine exited
+const sessionUnlockTimeout = 10 * time.Second
+
+// activeStates are the states of a machine that has a process running it
+var activeStates = map[uint32]bool{
+	vbox.MachineState_Running:          true,
+	vbox.MachineState_Paused:           true,
+	vbox.MachineState_Stuck:            true,
+	vbox.MachineState_Starting:         true,
+	vbox.MachineState_Stopping:         true,
+	vbox.MachineState_Saving:           true,
+	vbox.MachineState_Restoring:        true,
+	vbox.MachineState_LiveSnapshotting: true,
+}
+
+// emergencyPowerOff powers off a machine through a new session, as the one
+// that launched it belonged to a process that crashed
+func (vm *VirtualMachine) emergencyPowerOff(ctx context.Context) error {
+	session := vbox.Session{}
+	if err := session.Init(); err != nil {
+		return err
+	}
+	defer session.Release()
+
+	if err := session.LockMachine(vm.machine, vbox.LockType_Shared); err != nil {
+		return err
+	}
+	defer session.UnlockMachine()
+
+	console, err := session.GetConsole()
+	if err != nil {
+		return err
+	}
+	defer console.Release()
+
+	progress, err := console.PowerDown()
+	return waitForProgressContext(ctx, progress, err)
+}
+
+// discardSavedState discards the saved state of a machine that was not
+// meant to be kept, so that its settings can be updated
+func (vm *VirtualMachine) discardSavedState() error {
+	session := vbox.Session{}
+	if err := session.Init(); err != nil {
+		return err
+	}
+	defer session.Release()
+
+	if err := session.LockMachine(vm.machine, vbox.LockType_Write); err != nil {
+		return err
+	}
+	defer session.UnlockMachine()
+
+	machine, err := session.GetMachine()
+	if err != nil {
+		return err
+	}
+
+	return machine.DiscardSavedState(true)
+}
+
+// waitForUnlock waits for VirtualBox to release the lock a crashed process
+// held on the machine
+func (vm *VirtualMachine) waitForUnlock(ctx context.Context) error {
+	deadline := time.Now().Add(sessionUnlockTimeout)
+	for {
+		sessionState, err := vm.machine.GetSessionState()
+		if err != nil {
+			return err
+		}
+
+		if sessionState == vbox.SessionState_Unlocked {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			name, _ := vm.machine.GetName()
+			return fmt.Errorf("Machine '%s' is locked by another process", name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// recoverSession brings a machine left behind by a vlaunch process that
+// crashed back to a state it can be started from. The lock of the data path
+// guarantees that no other vlaunch process runs it, so a machine created by
+// vlaunch that is still running is powered off. A machine in guru
+// meditation is powered off whoever started it.
+func (vm *VirtualMachine) recoverSession(ctx context.Context) error {
+	state, err := vm.machine.GetState()
+	if err != nil {
+		return err
+	}
+
+	name, _ := vm.machine.GetName()
+	managed, _ := vm.machine.GetExtraData(managedKey)
+
+	switch {
+	case state == vbox.MachineState_Stuck || (activeStates[state] && managed == "true"):
+		logger.Warn("Powering off machine left behind by a previous run", "name", name, "state", StateName(state))
+		if err := vm.emergencyPowerOff(ctx); err != nil {
+			return fmt.Errorf("Failed to power off machine '%s' in state %s: %s", name, StateName(state), err.Error())
+		}
+	case activeStates[state]:
+		return fmt.Errorf("Machine '%s' is %s, it is used by another program", name, StateName(state))
+	case state == vbox.MachineState_Saved && managed == "true" && !vm.cfg.GetBool("save_state"):
+		logger.Warn("Discarding saved state left behind by a previous run", "name", name)
+		if err := vm.discardSavedState(); err != nil {
+			return fmt.Errorf("Failed to discard the saved state of machine '%s': %s", name, err.Error())
+		}
+	case state == vbox.MachineState_Aborted:
+		logger.Info("Machine was aborted by a previous run", "name", name)
+	}
+
+	return vm.waitForUnlock(ctx)
+}
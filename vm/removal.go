@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"context"
+
+	"github.com/lebauce/vlaunch/backend"
+)
+
+// deviceRemovedProperty is set to the path of a raw device unplugged while
+// the machine runs, and cleared once it is plugged back
+const deviceRemovedProperty = "/vlaunch/device-removed"
+
+// rawDevices returns the host disks backing the raw disks of the machine,
+// by path
+func (vm *VirtualMachine) rawDevices() (map[string]backend.Device, error) {
+	disks, err := getDisks(vm.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make(map[string]backend.Device)
+	for _, disk := range disks {
+		if disk.Type != "raw" {
+			continue
+		}
+
+		path, err := rawDevice(vm.cfg, disk)
+		if err != nil {
+			return nil, err
+		}
+
+		device, err := backend.GetDevice(path)
+		if err != nil {
+			device = backend.Device{Path: path}
+		}
+		devices[path] = device
+	}
+	return devices, nil
+}
+
+// WatchRawDevices pauses the machine when one of its raw devices is
+// unplugged from the host, when device_removal.pause is set, before the
+// guest fails on I/O errors. The removal is published as a DeviceChanged
+// event and set in the /vlaunch/device-removed guest property. The machine
+// is resumed once all the devices are plugged back, a device being the same
+// if it has the same serial number and path.
+func (vm *VirtualMachine) WatchRawDevices(ctx context.Context) {
+	if !vm.cfg.GetBool("device_removal.pause") {
+		return
+	}
+
+	devices, err := vm.rawDevices()
+	if err != nil {
+		logger.Error("Failed to get raw devices", "error", err)
+		return
+	}
+
+	if len(devices) == 0 {
+		return
+	}
+
+	events, err := backend.WatchDevices(ctx, hotplugInterval)
+	if err != nil {
+		logger.Error("Raw device removal will not be detected", "error", err)
+		return
+	}
+
+	removed := make(map[string]bool)
+	paused := false
+	for event := range events {
+		expected, found := devices[event.Device.Path]
+		if !found {
+			// The descriptor maps the path, the disk can not be used from
+			// another one
+			for path, device := range devices {
+				if removed[path] && device.Serial != "" && device.Serial == event.Device.Serial && event.Type == backend.DeviceAttached {
+					logger.Error("Raw device was plugged back under another path, the machine stays paused", "device", path, "path", event.Device.Path)
+				}
+			}
+			continue
+		}
+
+		if event.Type == backend.DeviceDetached {
+			if removed[expected.Path] {
+				continue
+			}
+			removed[expected.Path] = true
+			logger.Error("Raw device was unplugged", "device", expected.Path, "model", expected.Model)
+
+			if !paused {
+				if err := vm.Pause(); err != nil {
+					logger.Error("Failed to pause machine", "error", err)
+				} else {
+					paused = true
+				}
+			}
+			vm.SetGuestProperty(deviceRemovedProperty, expected.Path, "RDONLYGUEST")
+			vm.events.publish(DeviceChanged{Device: expected.Path, Present: false})
+			continue
+		}
+
+		if !removed[expected.Path] {
+			continue
+		}
+
+		if expected.Serial != "" && event.Device.Serial != expected.Serial {
+			logger.Error("Another disk was plugged in place of the raw device", "device", expected.Path, "serial", event.Device.Serial, "expected", expected.Serial)
+			continue
+		}
+
+		delete(removed, expected.Path)
+		logger.Info("Raw device was plugged back", "device", expected.Path)
+		vm.events.publish(DeviceChanged{Device: expected.Path, Present: true})
+
+		if len(removed) == 0 {
+			vm.SetGuestProperty(deviceRemovedProperty, "", "")
+			if paused {
+				if err := vm.Resume(); err != nil {
+					logger.Error("Failed to resume machine", "error", err)
+				}
+				paused = false
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/lebauce/vlaunch/backend"
+)
+
+// The guest requests a host action by setting /vlaunch/request/<id> to the
+// verb of the action, followed by a space and its argument if any. The host
+// answers in /vlaunch/response/<id> with 'ok', or 'error', followed by the
+// result or the error message. The guest deletes the request once it read
+// the response, the host then deletes the response. The ids must not be
+// reused while the machine runs.
+const (
+	requestPrefix  = "/vlaunch/request/"
+	responsePrefix = "/vlaunch/response/"
+)
+
+// ActionHandler performs a host action requested by the guest with the given
+// argument, and returns its result
+type ActionHandler func(vm *VirtualMachine, argument string) (string, error)
+
+// defaultActions are the actions the guest can request unless replaced with
+// HandleAction
+var defaultActions = map[string]ActionHandler{
+	"open_url": openURLAction,
+	"eject":    ejectAction,
+	"shutdown": shutdownAction,
+}
+
+// openURLAction opens a web page in the browser of the host
+func openURLAction(vm *VirtualMachine, argument string) (string, error) {
+	u, err := url.Parse(argument)
+	if err != nil {
+		return "", err
+	}
+
+	// The guest must not run programs on the host
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("Unsupported URL scheme '%s'", u.Scheme)
+	}
+	return "", backend.OpenURL(u.String())
+}
+
+// ejectAction makes vlaunch eject the raw disks of the machine once it
+// stopped, see EjectDevices
+func ejectAction(vm *VirtualMachine, argument string) (string, error) {
+	if !UsesRawDisks(vm.cfg) {
+		return "", errors.New("The machine does not boot from a USB disk")
+	}
+	vm.ejectRequested.Store(true)
+	return "", nil
+}
+
+// shutdownAction shuts the machine down, which ends the session of vlaunch
+func shutdownAction(vm *VirtualMachine, argument string) (string, error) {
+	return "", vm.Stop()
+}
+
+// HandleAction registers the handler of a verb the guest can request, or
+// replaces the default one
+func (vm *VirtualMachine) HandleAction(verb string, handler ActionHandler) {
+	vm.actionsLock.Lock()
+	defer vm.actionsLock.Unlock()
+
+	if vm.actions == nil {
+		vm.actions = make(map[string]ActionHandler)
+	}
+	vm.actions[verb] = handler
+}
+
+// actionHandler returns the handler of a verb allowed by
+// guest_requests.verbs
+func (vm *VirtualMachine) actionHandler(verb string) (ActionHandler, bool) {
+	if verbs := vm.cfg.GetStringSlice("guest_requests.verbs"); len(verbs) > 0 {
+		allowed := false
+		for _, v := range verbs {
+			if v == verb {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, false
+		}
+	}
+
+	vm.actionsLock.Lock()
+	handler, found := vm.actions[verb]
+	vm.actionsLock.Unlock()
+	if found {
+		return handler, true
+	}
+
+	handler, found = defaultActions[verb]
+	return handler, found
+}
+
+// handleRequest performs a request of the guest and writes its response
+func (vm *VirtualMachine) handleRequest(id, request string) {
+	verb, argument := request, ""
+	if i := strings.Index(request, " "); i >= 0 {
+		verb, argument = request[:i], request[i+1:]
+	}
+
+	response := "ok"
+	if handler, found := vm.actionHandler(verb); !found {
+		response = "error Unknown action '" + verb + "'"
+	} else if result, err := handler(vm, argument); err != nil {
+		logger.Warn("Guest request failed", "id", id, "verb", verb, "error", err)
+		response = "error " + err.Error()
+	} else {
+		logger.Info("Performed guest request", "id", id, "verb", verb)
+		if result != "" {
+			response += " " + result
+		}
+	}
+
+	if err := vm.SetGuestProperty(responsePrefix+id, response, "RDONLYGUEST"); err != nil {
+		logger.Error("Failed to answer guest request", "id", id, "error", err)
+	}
+}
+
+// ServeRequests performs the host actions requested by the guest until the
+// context is done or the machine stopped
+func (vm *VirtualMachine) ServeRequests(ctx context.Context) {
+	if !vm.cfg.GetBool("guest_requests.enabled") {
+		return
+	}
+
+	events, err := vm.SubscribeProperties(requestPrefix + "*")
+	if err != nil {
+		logger.Error("Failed to subscribe to guest requests", "error", err)
+		return
+	}
+
+	// The requests made before the subscription are not published
+	if properties, err := vm.GuestProperties(requestPrefix + "*"); err == nil {
+		for _, prop := range properties {
+			go vm.handleRequest(strings.TrimPrefix(prop.Name, requestPrefix), prop.Value)
+		}
+	} else if err == NotSupported {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			prop := event.(GuestPropertyChanged)
+			id := strings.TrimPrefix(prop.Name, requestPrefix)
+			if prop.Value == "" {
+				// The guest read the response
+				vm.SetGuestProperty(responsePrefix+id, "", "")
+				continue
+			}
+
+			go vm.handleRequest(id, prop.Value)
+		}
+	}
+}
+
+// EjectRequested returns whether the guest requested the USB disks holding
+// the machine to be ejected once it stopped
+func (vm *VirtualMachine) EjectRequested() bool {
+	return vm.ejectRequested.Load()
+}
+
+// EjectDevices ejects the devices of the raw disks of the machine, so that
+// they can be unplugged safely. The machine must be released.
+func (vm *VirtualMachine) EjectDevices() error {
+	disks, err := getDisks(vm.cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, disk := range disks {
+		if disk.Type != "raw" {
+			continue
+		}
+
+		device, err := rawDevice(vm.cfg, disk)
+		if err != nil {
+			return err
+		}
+
+		logger.Info("Ejecting device", "device", device)
+		if err := backend.EjectDevice(device); err != nil {
+			return fmt.Errorf("Failed to eject %s: %s", device, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+var transferModes = map[string]uint32{
+	"disabled":      vbox.ClipboardMode_Disabled,
+	"host_to_guest": vbox.ClipboardMode_HostToGuest,
+	"guest_to_host": vbox.ClipboardMode_GuestToHost,
+	"bidirectional": vbox.ClipboardMode_Bidirectional,
+}
+
+var dndModes = map[string]uint32{
+	"disabled":      vbox.DnDMode_Disabled,
+	"host_to_guest": vbox.DnDMode_HostToGuest,
+	"guest_to_host": vbox.DnDMode_GuestToHost,
+	"bidirectional": vbox.DnDMode_Bidirectional,
+}
+
+// runtimeKeys are the settings that can be changed while the machine runs
+var runtimeKeys = []string{"shared_folders", "clipboard_mode", "dnd_mode", "cpu_execution_cap", "bandwidth"}
+
+// restartKeys are the settings only applied when the machine is created
+var restartKeys = []string{
+	"distro_type", "cpus", "ram", "min_ram", "disk_type", "disk_location", "disks",
+	"iso_images", "storage", "network", "audio", "usb", "vrde", "host_key", "menubar",
+	"cpu_hotplug",
+}
+
+func configureIntegration(cfg *viper.Viper, machine vbox.Machine) error {
+	clipboardMode, found := transferModes[cfg.GetString("clipboard_mode")]
+	if !found {
+		return fmt.Errorf("Invalid clipboard mode '%s'", cfg.GetString("clipboard_mode"))
+	}
+
+	dndMode, found := dndModes[cfg.GetString("dnd_mode")]
+	if !found {
+		return fmt.Errorf("Invalid drag and drop mode '%s'", cfg.GetString("dnd_mode"))
+	}
+
+	if err := machine.SetClipboardMode(clipboardMode); err != nil {
+		return err
+	}
+
+	if err := machine.SetDnDMode(dndMode); err != nil {
+		return err
+	}
+
+	cap := cfg.GetInt("cpu_execution_cap")
+	if cap < 1 || cap > 100 {
+		return fmt.Errorf("Invalid CPU execution cap %d, must be between 1 and 100", cap)
+	}
+	return machine.SetCPUExecutionCap(uint(cap))
+}
+
+func configureSharedFolders(cfg *viper.Viper, machine vbox.Machine) {
+	for name := range cfg.GetStringMap("shared_folders") {
+		sharedFolder := cfg.Sub("shared_folders." + name)
+		path := sharedFolder.GetString("path")
+		persistent := sharedFolder.GetBool("persistent")
+		automount := sharedFolder.GetBool("automount")
+		if err := machine.CreateSharedFolder(name, path, persistent, automount); err != nil {
+			logger.Error("Failed to create shared folder", "name", name, "error", err)
+		}
+	}
+}
+
+// AddSharedFolder shares a host folder with the running guest. The folder
+// is transient, it is removed when the machine stops.
+func (vm *VirtualMachine) AddSharedFolder(name, hostPath string, writable, automount bool) error {
+	if err := vm.requireVirtualBox(); err != nil {
+		return err
+	}
+
+	if fi, err := os.Stat(hostPath); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s is not a folder", hostPath)
+	}
+
+	if err := vm.console.CreateSharedFolder(name, hostPath, writable, automount); err != nil {
+		return fmt.Errorf("Failed to share %s: %s", hostPath, err.Error())
+	}
+
+	logger.Info("Added shared folder", "name", name, "path", hostPath)
+	return nil
+}
+
+// RemoveSharedFolder removes a transient shared folder from the running guest
+func (vm *VirtualMachine) RemoveSharedFolder(name string) error {
+	if err := vm.requireVirtualBox(); err != nil {
+		return err
+	}
+
+	if err := vm.console.RemoveSharedFolder(name); err != nil {
+		return fmt.Errorf("Failed to remove shared folder %s: %s", name, err.Error())
+	}
+
+	logger.Info("Removed shared folder", "name", name)
+	return nil
+}
+
+// SetCPUExecutionCap limits the share of host CPU time the running
+// machine can use, in percent
+func (vm *VirtualMachine) SetCPUExecutionCap(cap int) error {
+	if cap < 1 || cap > 100 {
+		return fmt.Errorf("Invalid CPU execution cap %d, must be between 1 and 100", cap)
+	}
+
+	session, machine, err := vm.lockMachine()
+	if err != nil {
+		return err
+	}
+	defer session.UnlockMachine()
+
+	if err := machine.SetCPUExecutionCap(uint(cap)); err != nil {
+		return fmt.Errorf("Failed to set CPU execution cap: %s", err.Error())
+	}
+
+	if err := machine.SaveSettings(); err != nil {
+		return err
+	}
+
+	logger.Info("Set CPU execution cap", "cap", cap)
+	vm.cfg.Set("cpu_execution_cap", cap)
+	return nil
+}
+
+// Reconfigure applies the runtime settings of cfg to the machine and
+// returns the changed settings that require a restart to be applied
+func (vm *VirtualMachine) Reconfigure(cfg *viper.Viper) ([]string, error) {
+	if err := vm.requireVirtualBox(); err != nil {
+		return nil, err
+	}
+
+	var restart []string
+	for _, key := range restartKeys {
+		if !reflect.DeepEqual(vm.cfg.Get(key), cfg.Get(key)) {
+			restart = append(restart, key)
+		}
+	}
+
+	changed := false
+	for _, key := range runtimeKeys {
+		if !reflect.DeepEqual(vm.cfg.Get(key), cfg.Get(key)) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return restart, nil
+	}
+
+	session, machine, err := vm.lockMachine()
+	if err != nil {
+		return restart, err
+	}
+	defer session.UnlockMachine()
+
+	if err := configureIntegration(cfg, machine); err != nil {
+		return restart, err
+	}
+
+	for name := range vm.cfg.GetStringMap("shared_folders") {
+		if err := machine.RemoveSharedFolder(name); err != nil {
+			logger.Error("Failed to remove shared folder", "name", name, "error", err)
+		}
+	}
+	configureSharedFolders(cfg, machine)
+
+	// The groups can only be assigned to the devices of a stopped machine
+	if missing, err := setBandwidthLimits(cfg, machine, false); err != nil {
+		return restart, err
+	} else if missing {
+		restart = append(restart, "bandwidth")
+	}
+
+	if err := machine.SaveSettings(); err != nil {
+		return restart, err
+	}
+
+	for _, key := range runtimeKeys {
+		vm.cfg.Set(key, cfg.Get(key))
+	}
+
+	return restart, nil
+}
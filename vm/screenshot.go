@@ -0,0 +1,48 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/lebauce/vbox"
+)
+
+// CaptureScreen returns the current screen of the guest as a PNG image
+func (vm *VirtualMachine) CaptureScreen() ([]byte, error) {
+	if err := vm.requireVirtualBox(); err != nil {
+		return nil, err
+	}
+
+	display, err := vm.console.GetDisplay()
+	if err != nil {
+		return nil, err
+	}
+	defer display.Release()
+
+	width, height, _, _, _, _, err := display.GetScreenResolution(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if width == 0 || height == 0 {
+		return nil, errors.New("The guest screen is not available")
+	}
+
+	image, err := display.TakeScreenShotToArray(0, width, height, vbox.BitmapFormat_PNG)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to take screenshot: %s", err.Error())
+	}
+
+	return image, nil
+}
+
+// Screenshot writes the current screen of the guest to a PNG file
+func (vm *VirtualMachine) Screenshot(path string) error {
+	image, err := vm.CaptureScreen()
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, image, 0644)
+}
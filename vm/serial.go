@@ -0,0 +1,69 @@
+package vm
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+var serialModes = map[string]uint32{
+	"file": vbox.PortMode_RawFile,
+	"pipe": vbox.PortMode_HostPipe,
+}
+
+// serialPath returns the host file or pipe the serial port is wired to,
+// the output is written to the data path by default
+func serialPath(cfg *viper.Viper) string {
+	if serialPath := cfg.GetString("serial.path"); serialPath != "" {
+		return serialPath
+	}
+	return path.Join(cfg.GetString("data_path"), cfg.GetString("machine_name")+"-serial.log")
+}
+
+// configureSerial wires the first serial port (COM1) of the guest to a host
+// file or pipe, to capture the kernel and console output
+func configureSerial(cfg *viper.Viper, machine vbox.Machine) error {
+	port, err := machine.GetSerialPort(0)
+	if err != nil {
+		return err
+	}
+	defer port.Release()
+
+	modeName := cfg.GetString("serial.mode")
+	if modeName == "disabled" {
+		return port.SetEnabled(false)
+	}
+
+	mode, found := serialModes[modeName]
+	if !found {
+		return fmt.Errorf("Invalid serial port mode '%s'", modeName)
+	}
+
+	if err := port.SetIOBase(0x3f8); err != nil {
+		return err
+	}
+
+	if err := port.SetIRQ(4); err != nil {
+		return err
+	}
+
+	if err := port.SetPath(serialPath(cfg)); err != nil {
+		return err
+	}
+
+	if err := port.SetHostMode(mode); err != nil {
+		return err
+	}
+
+	// VirtualBox creates the pipe, the host connects to it
+	if mode == vbox.PortMode_HostPipe {
+		if err := port.SetServer(true); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Wiring serial port", "mode", modeName, "path", serialPath(cfg))
+	return port.SetEnabled(true)
+}
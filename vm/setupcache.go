@@ -0,0 +1,79 @@
+package vm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// setupCacheLock serializes the updates of the setup cache, the steps may
+// run concurrently
+var setupCacheLock sync.Mutex
+
+// setupCachePath is the file holding the fingerprints of the inputs of the
+// setup steps that succeeded, removing it makes vlaunch redo them all
+func setupCachePath(cfg *viper.Viper) string {
+	return path.Join(cfg.GetString("data_path"), cfg.GetString("machine_name")+".setup.json")
+}
+
+// fingerprint returns a hash of the inputs of a setup step
+func fingerprint(inputs ...interface{}) string {
+	data, err := json.Marshal(inputs)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func readSetupCache(cfg *viper.Viper) map[string]string {
+	steps := make(map[string]string)
+	if data, err := os.ReadFile(setupCachePath(cfg)); err == nil {
+		json.Unmarshal(data, &steps)
+	}
+	return steps
+}
+
+// setupFingerprint returns the fingerprint recorded for a setup step, empty
+// if it never succeeded
+func setupFingerprint(cfg *viper.Viper, step string) string {
+	setupCacheLock.Lock()
+	defer setupCacheLock.Unlock()
+
+	return readSetupCache(cfg)[step]
+}
+
+// setupUnchanged returns whether a setup step already succeeded with the same
+// inputs
+func setupUnchanged(cfg *viper.Viper, step, fingerprint string) bool {
+	return fingerprint != "" && setupFingerprint(cfg, step) == fingerprint
+}
+
+// recordSetup stores the fingerprint of the inputs of a setup step that
+// succeeded
+func recordSetup(cfg *viper.Viper, step, fingerprint string) {
+	setupCacheLock.Lock()
+	defer setupCacheLock.Unlock()
+
+	steps := readSetupCache(cfg)
+	steps[step] = fingerprint
+
+	data, err := json.Marshal(steps)
+	if err == nil {
+		err = os.WriteFile(setupCachePath(cfg), data, 0644)
+	}
+	if err != nil {
+		logger.Debug("Failed to write setup cache", "error", err)
+	}
+}
+
+// settingsFingerprint identifies the effective configuration the settings
+// of a machine were applied from
+func settingsFingerprint(cfg *viper.Viper) string {
+	return fingerprint(cfg.AllSettings())
+}
@@ -0,0 +1,90 @@
+package vm
+
+import (
+	"time"
+
+	"github.com/lebauce/vbox"
+)
+
+// Before the machine is shut down or powered off, the host sets
+// /vlaunch/shutdown-requested and waits for the guest to set
+// /vlaunch/shutdown-acknowledged once it flushed its data, which matters for
+// raw disks that an abrupt power off can corrupt
+const (
+	shutdownRequestedProperty    = "/vlaunch/shutdown-requested"
+	shutdownAcknowledgedProperty = "/vlaunch/shutdown-acknowledged"
+)
+
+// OnShutdown registers a function called before the machine is shut down or
+// powered off. If it fails, Stop returns its error and leaves the machine
+// running while PowerOff proceeds anyway.
+func (vm *VirtualMachine) OnShutdown(hook func() error) {
+	vm.onShutdown = hook
+}
+
+// runShutdownHook calls the function registered with OnShutdown, once unless
+// it failed
+func (vm *VirtualMachine) runShutdownHook() error {
+	if vm.onShutdown == nil || vm.shutdownHooked.Swap(true) {
+		return nil
+	}
+
+	if err := vm.onShutdown(); err != nil {
+		vm.shutdownHooked.Store(false)
+		return err
+	}
+	return nil
+}
+
+// shutdownHandshake warns the guest that the machine is about to stop and
+// waits for its acknowledgement, for at most shutdown_handshake.timeout. It
+// is only done once, the guest not being asked again when the machine is
+// powered off because it did not shut down in time.
+func (vm *VirtualMachine) shutdownHandshake() {
+	if !vm.cfg.GetBool("shutdown_handshake.enabled") || vm.shutdownWarned.Swap(true) {
+		return
+	}
+
+	// Without the Guest Additions, nothing in the guest can acknowledge
+	if vm.cfg.GetString("hypervisor") == "virtualbox" {
+		if runLevel, err := vm.additionsRunLevel(); err != nil || runLevel == vbox.AdditionsRunLevelType_None {
+			return
+		}
+	}
+
+	events, err := vm.SubscribeProperties(shutdownAcknowledgedProperty)
+	if err != nil {
+		logger.Warn("Failed to subscribe to shutdown acknowledgement", "error", err)
+		return
+	}
+	defer vm.Unsubscribe(events)
+
+	// An acknowledgement left by a previous session must not be taken
+	// for this one
+	vm.SetGuestProperty(shutdownAcknowledgedProperty, "", "")
+
+	if err := vm.SetGuestProperty(shutdownRequestedProperty, time.Now().UTC().Format(time.RFC3339), "RDONLYGUEST"); err != nil {
+		if err != NotSupported {
+			logger.Warn("Failed to request guest shutdown", "error", err)
+		}
+		return
+	}
+
+	logger.Info("Waiting for the guest to acknowledge shutdown")
+	timeout := time.After(vm.cfg.GetDuration("shutdown_handshake.timeout"))
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.(GuestPropertyChanged).Value != "" {
+				logger.Info("Guest acknowledged shutdown")
+				return
+			}
+		case <-timeout:
+			logger.Warn("Guest did not acknowledge shutdown, stopping anyway")
+			return
+		}
+	}
+}
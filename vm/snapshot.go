@@ -0,0 +1,156 @@
+package vm
+
+import (
+	"time"
+
+	"github.com/lebauce/vbox"
+)
+
+type SnapshotInfo struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	TimeStamp   time.Time `json:"timestamp"`
+	Online      bool      `json:"online"`
+	Current     bool      `json:"current"`
+}
+
+func (vm *VirtualMachine) Snapshot(name, description string) error {
+	session, machine, err := vm.lockMachine()
+	if err != nil {
+		return err
+	}
+	defer session.UnlockMachine()
+
+	progress, _, err := machine.TakeSnapshot(name, description, false)
+	if err != nil {
+		return err
+	}
+	defer progress.Release()
+
+	return progress.WaitForCompletion(-1)
+}
+
+func (vm *VirtualMachine) RestoreSnapshot(name string) error {
+	session, machine, err := vm.lockMachine()
+	if err != nil {
+		return err
+	}
+	defer session.UnlockMachine()
+
+	snapshot, err := machine.FindSnapshot(name)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+
+	progress, err := machine.RestoreSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	defer progress.Release()
+
+	return progress.WaitForCompletion(-1)
+}
+
+func (vm *VirtualMachine) DeleteSnapshot(name string) error {
+	session, machine, err := vm.lockMachine()
+	if err != nil {
+		return err
+	}
+	defer session.UnlockMachine()
+
+	snapshot, err := machine.FindSnapshot(name)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+
+	id, err := snapshot.GetId()
+	if err != nil {
+		return err
+	}
+
+	progress, err := machine.DeleteSnapshot(id)
+	if err != nil {
+		return err
+	}
+	defer progress.Release()
+
+	return progress.WaitForCompletion(-1)
+}
+
+func (vm *VirtualMachine) Snapshots() ([]SnapshotInfo, error) {
+	if err := vm.requireVirtualBox(); err != nil {
+		return nil, err
+	}
+
+	count, err := vm.machine.GetSnapshotCount()
+	if err != nil || count == 0 {
+		return nil, err
+	}
+
+	current, err := vm.machine.GetCurrentSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer current.Release()
+
+	currentID, err := current.GetId()
+	if err != nil {
+		return nil, err
+	}
+
+	// Looking up an empty name returns the root of the snapshot tree
+	root, err := vm.machine.FindSnapshot("")
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []SnapshotInfo
+	var walk func(snapshot vbox.Snapshot) error
+	walk = func(snapshot vbox.Snapshot) error {
+		defer snapshot.Release()
+
+		var err error
+		info := SnapshotInfo{}
+		if info.ID, err = snapshot.GetId(); err != nil {
+			return err
+		}
+		if info.Name, err = snapshot.GetName(); err != nil {
+			return err
+		}
+		if info.Description, err = snapshot.GetDescription(); err != nil {
+			return err
+		}
+		if info.Online, err = snapshot.GetOnline(); err != nil {
+			return err
+		}
+
+		timestamp, err := snapshot.GetTimeStamp()
+		if err != nil {
+			return err
+		}
+		info.TimeStamp = time.Unix(0, timestamp*int64(time.Millisecond))
+		info.Current = info.ID == currentID
+		snapshots = append(snapshots, info)
+
+		children, err := snapshot.GetChildren()
+		if err != nil {
+			return err
+		}
+
+		for _, child := range children {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := walk(root); err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
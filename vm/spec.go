@@ -0,0 +1,181 @@
+package vm
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+
+	"github.com/lebauce/vlaunch/config"
+	"github.com/spf13/viper"
+)
+
+// Spec describes a machine for the programs embedding vlaunch. The fields
+// left empty keep the default of the matching configuration key, any other
+// key being set through Settings.
+type Spec struct {
+	// Name is the name of the machine, machine_name
+	Name string
+	// Hypervisor is virtualbox, qemu or hyperv
+	Hypervisor string
+	// OSType is the type of the guest, distro_type
+	OSType string
+	// CPUs is the number of virtual CPUs
+	CPUs int
+	// RAM is the memory of the machine in megabytes
+	RAM int
+	// DataPath is the directory holding the files of the machine, it is
+	// created if needed
+	DataPath string
+	// Firmware is bios or efi
+	Firmware string
+	// Frontend is gui, headless or sdl
+	Frontend string
+	// Disks are the disks of the machine, in boot order
+	Disks []Disk
+	// ISOImages are attached to the optical drives of the machine
+	ISOImages []string
+	// Settings sets any configuration key, such as "network.type", the
+	// fields above taking precedence
+	Settings map[string]interface{}
+}
+
+// options are the settings of New that do not describe the machine
+type options struct {
+	cfg        *viper.Viper
+	hypervisor Hypervisor
+	logger     *slog.Logger
+}
+
+// Option changes how New creates the machine
+type Option func(*options)
+
+// WithConfig starts from a configuration, such as one read from a vlaunch
+// configuration file, instead of the defaults. The spec is applied on a
+// copy of it.
+func WithConfig(cfg *viper.Viper) Option {
+	return func(o *options) { o.cfg = cfg }
+}
+
+// WithHypervisor makes the machine run on the given hypervisor instead of
+// the one named by the spec. The features only provided by VirtualBox then
+// return NotSupported.
+func WithHypervisor(hypervisor Hypervisor) Option {
+	return func(o *options) { o.hypervisor = hypervisor }
+}
+
+// WithLogger makes the vlaunch packages log to the handler of logger instead
+// of the default logger. The handler is shared by all the machines of the
+// process.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// diskSettings returns a disk as found in the disks configuration key
+func diskSettings(disk Disk) map[string]interface{} {
+	settings := map[string]interface{}{"type": disk.Type, "location": disk.Location}
+	if disk.Controller != "" {
+		settings["controller"] = disk.Controller
+	}
+	if disk.Port != nil {
+		settings["port"] = *disk.Port
+	}
+	if disk.Device != nil {
+		settings["device"] = *disk.Device
+	}
+	if disk.Mode != "" {
+		settings["mode"] = disk.Mode
+	} else if disk.Immutable {
+		settings["mode"] = "immutable"
+	}
+	if len(disk.Partitions) > 0 {
+		settings["partitions"] = disk.Partitions
+	}
+	return settings
+}
+
+// configure returns the configuration of the machine described by the spec
+func (spec Spec) configure(base *viper.Viper) *viper.Viper {
+	cfg := config.New()
+	if base != nil {
+		for _, key := range base.AllKeys() {
+			cfg.Set(key, base.Get(key))
+		}
+	}
+
+	for key, value := range spec.Settings {
+		cfg.Set(key, value)
+	}
+
+	for key, value := range map[string]string{
+		"machine_name": spec.Name,
+		"hypervisor":   spec.Hypervisor,
+		"distro_type":  spec.OSType,
+		"data_path":    spec.DataPath,
+		"firmware":     spec.Firmware,
+		"frontend":     spec.Frontend,
+	} {
+		if value != "" {
+			cfg.Set(key, value)
+		}
+	}
+
+	if spec.CPUs > 0 {
+		cfg.Set("cpus", spec.CPUs)
+	}
+
+	if spec.RAM > 0 {
+		cfg.Set("ram", spec.RAM)
+	}
+
+	if len(spec.Disks) > 0 {
+		disks := make([]map[string]interface{}, len(spec.Disks))
+		for i, disk := range spec.Disks {
+			disks[i] = diskSettings(disk)
+		}
+		cfg.Set("disks", disks)
+	}
+
+	if len(spec.ISOImages) > 0 {
+		cfg.Set("iso_images", spec.ISOImages)
+	}
+	return cfg
+}
+
+// New returns the machine described by the spec, which is validated as a
+// configuration file would be. Create, Start and Run then behave as for the
+// vlaunch command, without reading its configuration files.
+func New(spec Spec, opts ...Option) (*VirtualMachine, error) {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.logger != nil {
+		SetLogger(o.logger)
+	}
+
+	cfg := spec.configure(o.cfg)
+	if err := config.Validate(cfg); err != nil {
+		return nil, err
+	}
+
+	dataPath := cfg.GetString("data_path")
+	if dataPath == "" {
+		return nil, errors.New("The data path of the machine is required")
+	}
+
+	if err := os.MkdirAll(dataPath, 0755); err != nil {
+		return nil, err
+	}
+
+	if o.hypervisor == nil {
+		return NewVM(cfg)
+	}
+	return &VirtualMachine{cfg: cfg, hypervisor: o.hypervisor}, nil
+}
+
+// Config returns the configuration of the machine, which is not to be
+// modified once the machine was created
+func (vm *VirtualMachine) Config() *viper.Viper {
+	return vm.cfg
+}
@@ -0,0 +1,171 @@
+package vm
+
+import (
+	"encoding/xml"
+	"strings"
+	"time"
+
+	"github.com/lebauce/vbox"
+)
+
+var statsMetrics = []string{
+	"Guest/CPU/Load/User",
+	"Guest/CPU/Load/Kernel",
+	"Guest/RAM/Usage/Total",
+	"Guest/RAM/Usage/Free",
+	"Guest/Net/Rate/Rx",
+	"Guest/Net/Rate/Tx",
+}
+
+// Stats holds the resource usage of the guest, CPU loads are percentages,
+// memory sizes are in bytes and throughputs in bytes per second
+type Stats struct {
+	CPUUser   float64 `json:"cpu_user"`
+	CPUKernel float64 `json:"cpu_kernel"`
+	RAMTotal  uint64  `json:"ram_total"`
+	RAMFree   uint64  `json:"ram_free"`
+	DiskRead  uint64  `json:"disk_read"`
+	DiskWrite uint64  `json:"disk_write"`
+	NetRx     uint64  `json:"net_rx"`
+	NetTx     uint64  `json:"net_tx"`
+}
+
+// diskSample is a reading of the storage counters, throughputs are
+// computed from the difference between two samples
+type diskSample struct {
+	time    time.Time
+	read    uint64
+	written uint64
+}
+
+type debuggerStats struct {
+	Counters []struct {
+		Name  string `xml:"name,attr"`
+		Value uint64 `xml:"c,attr"`
+	} `xml:"Counter"`
+}
+
+// EnableStats sets up the VirtualBox performance collector to sample the
+// guest metrics at the given period
+func (vm *VirtualMachine) EnableStats(period time.Duration) error {
+	if err := vm.requireVirtualBox(); err != nil {
+		return err
+	}
+
+	collector, err := vbox.GetPerformanceCollector()
+	if err != nil {
+		return err
+	}
+	defer collector.Release()
+
+	seconds := uint32(period.Seconds())
+	if seconds == 0 {
+		seconds = 1
+	}
+	return collector.SetupMetrics(statsMetrics, vm.machine, seconds, 1)
+}
+
+func (vm *VirtualMachine) readDiskSample() (diskSample, error) {
+	sample := diskSample{time: time.Now()}
+
+	session, _, err := vm.lockMachine()
+	if err != nil {
+		return sample, err
+	}
+	defer session.UnlockMachine()
+
+	console, err := session.GetConsole()
+	if err != nil {
+		return sample, err
+	}
+	defer console.Release()
+
+	debugger, err := console.GetDebugger()
+	if err != nil {
+		return sample, err
+	}
+	defer debugger.Release()
+
+	data, err := debugger.GetStats("/Public/Storage/*/Bytes*", false)
+	if err != nil {
+		return sample, err
+	}
+
+	var stats debuggerStats
+	if err := xml.Unmarshal([]byte(data), &stats); err != nil {
+		return sample, err
+	}
+
+	for _, counter := range stats.Counters {
+		switch {
+		case strings.HasSuffix(counter.Name, "/BytesRead"):
+			sample.read += counter.Value
+		case strings.HasSuffix(counter.Name, "/BytesWritten"):
+			sample.written += counter.Value
+		}
+	}
+
+	return sample, nil
+}
+
+// Stats returns the latest resource usage of the guest. EnableStats must
+// have been called at least one period before. Disk throughputs are
+// averaged since the previous call.
+func (vm *VirtualMachine) Stats() (*Stats, error) {
+	if err := vm.requireVirtualBox(); err != nil {
+		return nil, err
+	}
+
+	collector, err := vbox.GetPerformanceCollector()
+	if err != nil {
+		return nil, err
+	}
+	defer collector.Release()
+
+	data, err := collector.QueryMetricsData(statsMetrics, vm.machine)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{}
+	for _, metric := range data {
+		if len(metric.Values) == 0 {
+			continue
+		}
+
+		value := float64(metric.Values[len(metric.Values)-1])
+		if metric.Scale > 1 {
+			value /= float64(metric.Scale)
+		}
+
+		switch metric.Name {
+		case "Guest/CPU/Load/User":
+			stats.CPUUser = value
+		case "Guest/CPU/Load/Kernel":
+			stats.CPUKernel = value
+		case "Guest/RAM/Usage/Total":
+			stats.RAMTotal = uint64(value) * 1024
+		case "Guest/RAM/Usage/Free":
+			stats.RAMFree = uint64(value) * 1024
+		case "Guest/Net/Rate/Rx":
+			stats.NetRx = uint64(value)
+		case "Guest/Net/Rate/Tx":
+			stats.NetTx = uint64(value)
+		}
+	}
+
+	sample, err := vm.readDiskSample()
+	if err != nil {
+		return nil, err
+	}
+
+	if previous := vm.lastDiskSample; !previous.time.IsZero() {
+		if elapsed := sample.time.Sub(previous.time).Seconds(); elapsed > 0 && sample.read >= previous.read && sample.written >= previous.written {
+			stats.DiskRead = uint64(float64(sample.read-previous.read) / elapsed)
+			stats.DiskWrite = uint64(float64(sample.written-previous.written) / elapsed)
+		}
+	}
+	vm.lastDiskSample = sample
+
+	return stats, nil
+}
@@ -0,0 +1,132 @@
+package vm
+
+import (
+	"github.com/lebauce/vbox"
+	"github.com/lebauce/vlaunch/backend"
+)
+
+var stateNames = map[uint32]string{
+	vbox.MachineState_PoweredOff:       "poweroff",
+	vbox.MachineState_Saved:            "saved",
+	vbox.MachineState_Teleported:       "teleported",
+	vbox.MachineState_Aborted:          "aborted",
+	vbox.MachineState_Running:          "running",
+	vbox.MachineState_Paused:           "paused",
+	vbox.MachineState_Stuck:            "gurumeditation",
+	vbox.MachineState_Teleporting:      "teleporting",
+	vbox.MachineState_LiveSnapshotting: "livesnapshotting",
+	vbox.MachineState_Starting:         "starting",
+	vbox.MachineState_Stopping:         "stopping",
+	vbox.MachineState_Saving:           "saving",
+	vbox.MachineState_Restoring:        "restoring",
+	vbox.MachineState_SettingUp:        "settingup",
+	vbox.MachineState_Snapshotting:     "snapshotting",
+}
+
+func StateName(state uint32) string {
+	if name, found := stateNames[state]; found {
+		return name
+	}
+	return "unknown"
+}
+
+type MediumStatus struct {
+	Controller string `json:"controller"`
+	Port       int    `json:"port"`
+	Device     int    `json:"device"`
+	Type       string `json:"type"`
+	Location   string `json:"location"`
+}
+
+type Status struct {
+	Name       string          `json:"name"`
+	State      string          `json:"state"`
+	Uptime     int64           `json:"uptime"`
+	CPUs       uint32          `json:"cpus"`
+	RAM        uint32          `json:"ram"`
+	IP         string          `json:"ip,omitempty"`
+	HostKey    backend.HostKey `json:"host_key"`
+	Keyboard   string          `json:"keyboard_layout,omitempty"`
+	Media      []MediumStatus  `json:"media"`
+	Properties []GuestProperty `json:"properties"`
+}
+
+func (vm *VirtualMachine) Status() (*Status, error) {
+	if err := vm.requireVirtualBox(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	status := &Status{}
+
+	if status.Name, err = vm.machine.GetName(); err != nil {
+		return nil, err
+	}
+
+	state, err := vm.machine.GetState()
+	if err != nil {
+		return nil, err
+	}
+	status.State = StateName(state)
+
+	uptime, err := vm.uptime(state)
+	if err != nil {
+		return nil, err
+	}
+	status.Uptime = int64(uptime.Seconds())
+
+	if status.CPUs, err = vm.machine.GetCPUCount(); err != nil {
+		return nil, err
+	}
+
+	if status.RAM, err = vm.machine.GetMemorySize(); err != nil {
+		return nil, err
+	}
+
+	attachments, err := vm.machine.GetMediumAttachments()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range attachments {
+		medium := MediumStatus{
+			Controller: attachment.Controller,
+			Port:       int(attachment.Port),
+			Device:     int(attachment.Device),
+			Type:       "disk",
+		}
+
+		if attachment.Type == vbox.DeviceType_DVD {
+			medium.Type = "dvd"
+		}
+
+		// Empty drives have no medium
+		if location, err := attachment.Medium.GetLocation(); err == nil {
+			medium.Location = location
+		}
+
+		status.Media = append(status.Media, medium)
+	}
+
+	if status.Properties, err = vm.GuestProperties(""); err != nil {
+		return nil, err
+	}
+
+	for _, prop := range status.Properties {
+		if prop.Name == guestIPProperty {
+			status.IP = prop.Value
+		}
+	}
+
+	// The host key may have been changed in the GUI
+	code, _ := vm.machine.GetExtraData(hostKeyExtraData)
+	if code == "" {
+		code = vm.cfg.GetString("host_key")
+	}
+	if status.HostKey, err = backend.ResolveHostKey(code); err != nil {
+		status.HostKey = backend.HostKey{Name: code, Code: code}
+	}
+	status.Keyboard = backend.KeyboardLayout()
+
+	return status, nil
+}
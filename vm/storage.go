@@ -0,0 +1,303 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+type controllerSpec struct {
+	name           string
+	bus            uint32
+	controllerType uint32
+	ports          int
+	maxPorts       int
+	devices        int
+	dvd            bool
+}
+
+var controllerSpecs = map[string]controllerSpec{
+	"ide": {
+		name:           "IDE",
+		bus:            vbox.StorageBus_Ide,
+		controllerType: vbox.StorageControllerType_Ich6,
+		ports:          2,
+		maxPorts:       2,
+		devices:        2,
+		dvd:            true,
+	},
+	"sata": {
+		name:           "SATA",
+		bus:            vbox.StorageBus_Sata,
+		controllerType: vbox.StorageControllerType_IntelAhci,
+		ports:          4,
+		maxPorts:       30,
+		devices:        1,
+		dvd:            true,
+	},
+	"nvme": {
+		name:           "NVMe",
+		bus:            vbox.StorageBus_PCIe,
+		controllerType: vbox.StorageControllerType_NVMe,
+		ports:          1,
+		maxPorts:       255,
+		devices:        1,
+	},
+	"virtio-scsi": {
+		name:           "VirtioSCSI",
+		bus:            vbox.StorageBus_VirtioSCSI,
+		controllerType: vbox.StorageControllerType_VirtioSCSI,
+		ports:          16,
+		maxPorts:       256,
+		devices:        1,
+		dvd:            true,
+	},
+}
+
+// StorageController is a storage controller of storage.controllers, named
+// after its type by default
+type StorageController struct {
+	Name  string
+	Type  string
+	Ports int
+}
+
+func newControllerSpec(controller StorageController) (controllerSpec, error) {
+	kind := strings.ToLower(controller.Type)
+	spec, found := controllerSpecs[kind]
+	if !found {
+		return spec, fmt.Errorf("Invalid storage controller '%s'", kind)
+	}
+
+	if controller.Name != "" {
+		spec.name = controller.Name
+	}
+
+	if ports := controller.Ports; ports > 0 {
+		if ports > spec.maxPorts {
+			return spec, fmt.Errorf("The %s controller supports at most %d ports", spec.name, spec.maxPorts)
+		}
+		spec.ports = ports
+	}
+
+	return spec, nil
+}
+
+// getControllerSpecs returns the storage controllers of the machine, the
+// ones of storage.controllers or else the one of storage.controller
+func getControllerSpecs(cfg *viper.Viper) ([]controllerSpec, error) {
+	if !cfg.IsSet("storage.controllers") {
+		spec, err := newControllerSpec(StorageController{
+			Type:  cfg.GetString("storage.controller"),
+			Ports: cfg.GetInt("storage.ports"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []controllerSpec{spec}, nil
+	}
+
+	var controllers []StorageController
+	if err := cfg.UnmarshalKey("storage.controllers", &controllers); err != nil {
+		return nil, fmt.Errorf("Invalid storage controllers: %s", err.Error())
+	}
+
+	if len(controllers) == 0 {
+		return nil, errors.New("At least one storage controller is required")
+	}
+
+	var specs []controllerSpec
+	names := make(map[string]bool)
+	for _, controller := range controllers {
+		spec, err := newControllerSpec(controller)
+		if err != nil {
+			return nil, err
+		}
+
+		if names[spec.name] {
+			return nil, fmt.Errorf("Several storage controllers are named '%s'", spec.name)
+		}
+		names[spec.name] = true
+		specs = append(specs, spec)
+	}
+
+	return specs, nil
+}
+
+// findController returns the controller a disk is attached to, the one named
+// in its settings or else the first one that can hold it
+func findController(specs []controllerSpec, disk Disk) (controllerSpec, error) {
+	for _, spec := range specs {
+		if disk.Controller != "" && spec.name != disk.Controller {
+			continue
+		}
+
+		if disk.Type == "iso" && !spec.dvd {
+			if disk.Controller != "" {
+				return spec, errors.New("ISO images can not be attached to a " + spec.name + " controller")
+			}
+			continue
+		}
+
+		return spec, nil
+	}
+
+	if disk.Controller != "" {
+		return controllerSpec{}, fmt.Errorf("Unknown storage controller '%s'", disk.Controller)
+	}
+	return controllerSpec{}, errors.New("No storage controller can hold ISO images")
+}
+
+func addStorageController(machine vbox.Machine, spec controllerSpec) (vbox.StorageController, error) {
+	controller, err := machine.AddStorageController(spec.name, spec.bus)
+	if err != nil {
+		return controller, err
+	}
+
+	if err := controller.SetType(spec.controllerType); err != nil {
+		return controller, err
+	}
+
+	// The port count of IDE controllers is fixed
+	if spec.bus != vbox.StorageBus_Ide {
+		if err := controller.SetPortCount(uint32(spec.ports)); err != nil {
+			return controller, err
+		}
+	}
+
+	return controller, nil
+}
+
+type storageSlot struct {
+	port   int
+	device int
+}
+
+type slotAllocator struct {
+	spec controllerSpec
+	used map[storageSlot]bool
+}
+
+func newSlotAllocator(spec controllerSpec) *slotAllocator {
+	return &slotAllocator{spec: spec, used: make(map[storageSlot]bool)}
+}
+
+func (a *slotAllocator) reserve(slot storageSlot) error {
+	if slot.port < 0 || slot.port >= a.spec.ports || slot.device < 0 || slot.device >= a.spec.devices {
+		return fmt.Errorf("Port %d, device %d does not exist on the %s controller", slot.port, slot.device, a.spec.name)
+	}
+
+	if a.used[slot] {
+		return fmt.Errorf("Port %d, device %d of the %s controller is already used", slot.port, slot.device, a.spec.name)
+	}
+
+	a.used[slot] = true
+	return nil
+}
+
+func (a *slotAllocator) next() (storageSlot, error) {
+	for port := 0; port < a.spec.ports; port++ {
+		for device := 0; device < a.spec.devices; device++ {
+			slot := storageSlot{port: port, device: device}
+			if !a.used[slot] {
+				a.used[slot] = true
+				return slot, nil
+			}
+		}
+	}
+	return storageSlot{}, fmt.Errorf("No free slot left on the %s controller", a.spec.name)
+}
+
+// Disk is a disk of the machine, ISO images being 'iso' disks
+type Disk struct {
+	Type     string
+	Location string
+	// Controller is the name of the storage controller holding the disk,
+	// the first one by default
+	Controller string
+	Port       *int
+	Device     *int
+	Immutable  bool
+	// Mode is normal, immutable or multiattach
+	Mode string
+	// Partitions of a raw disk the guest has access to, all by default
+	Partitions []int
+}
+
+func getDisks(cfg *viper.Viper) ([]Disk, error) {
+	if !cfg.IsSet("disks") {
+		// Live systems boot from the ISO images only
+		if cfg.GetString("disk_type") == "none" {
+			return nil, nil
+		}
+
+		settings := Disk{
+			Type:     cfg.GetString("disk_type"),
+			Location: cfg.GetString("disk_location"),
+			Mode:     cfg.GetString("disk_mode"),
+		}
+		if err := cfg.UnmarshalKey("disk_partitions", &settings.Partitions); err != nil {
+			return nil, fmt.Errorf("Invalid disk partitions: %s", err.Error())
+		}
+		return []Disk{settings}, nil
+	}
+
+	var disks []Disk
+	if err := cfg.UnmarshalKey("disks", &disks); err != nil {
+		return nil, fmt.Errorf("Invalid disks configuration: %s", err.Error())
+	}
+
+	if len(disks) == 0 {
+		return nil, errors.New("At least one disk is required")
+	}
+
+	return disks, nil
+}
+
+// rawDescriptorPath returns the location of the VMDK descriptor generated
+// for the raw disk number index
+func rawDescriptorPath(cfg *viper.Viper, index int) string {
+	if index > 0 {
+		return path.Join(cfg.GetString("data_path"), fmt.Sprintf("raw-%d.vmdk", index))
+	}
+	return path.Join(cfg.GetString("data_path"), "raw.vmdk")
+}
+
+func openDisk(cfg *viper.Viper, settings Disk, index int) (vbox.Medium, error) {
+	location := settings.Location
+	switch settings.Type {
+	case "raw":
+		var err error
+		if location, err = writeRawDescriptor(cfg, settings, index); err != nil {
+			return vbox.Medium{}, err
+		}
+	case "vdi", "vmdk", "vhd":
+		if location == "" {
+			return vbox.Medium{}, fmt.Errorf("A location is required for %s disks", settings.Type)
+		}
+	default:
+		return vbox.Medium{}, fmt.Errorf("Invalid disk type '%s'", settings.Type)
+	}
+
+	disk, err := vbox.OpenMedium(location, vbox.DeviceType_HardDisk, vbox.AccessMode_ReadWrite, false)
+	if err != nil {
+		return disk, err
+	}
+
+	mediumType, found := diskModes[settings.mode()]
+	if !found {
+		return disk, fmt.Errorf("Invalid disk mode '%s'", settings.Mode)
+	}
+
+	if mediumType != vbox.MediumType_Normal {
+		if err := disk.SetType(mediumType); err != nil {
+			return disk, fmt.Errorf("Failed to make %s %s: %s", location, settings.mode(), err.Error())
+		}
+	}
+
+	return disk, nil
+}
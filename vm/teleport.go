@@ -0,0 +1,64 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+// configureTeleporter makes the machine wait, when started, for a machine
+// teleported from another host instead of booting if teleporter.enabled
+func configureTeleporter(cfg *viper.Viper, machine vbox.Machine) error {
+	enabled := cfg.GetBool("teleporter.enabled")
+	if err := machine.SetTeleporterEnabled(enabled); err != nil {
+		return err
+	}
+
+	if !enabled {
+		return nil
+	}
+
+	if err := machine.SetTeleporterPort(uint(cfg.GetInt("teleporter.port"))); err != nil {
+		return err
+	}
+
+	if err := machine.SetTeleporterAddress(cfg.GetString("teleporter.address")); err != nil {
+		return err
+	}
+
+	return machine.SetTeleporterPassword(cfg.GetString("teleporter.password"))
+}
+
+// launchTimeout returns how long to wait for the machine to start, a
+// teleportation target waiting for teleporter.timeout
+func launchTimeout(cfg *viper.Viper) time.Duration {
+	if cfg.GetBool("teleporter.enabled") && cfg.GetString("hypervisor") == "virtualbox" {
+		return cfg.GetDuration("teleporter.timeout")
+	}
+	return cfg.GetDuration("timeouts.launch")
+}
+
+// Teleport moves the running machine to the vlaunch instance of another host
+// waiting for it on the port, pausing it for at most maxDowntime. The
+// machine is then in the teleported state, which ends the session.
+func (vm *VirtualMachine) Teleport(ctx context.Context, host string, port int, password string, maxDowntime time.Duration) error {
+	if err := vm.requireVirtualBox(); err != nil {
+		return err
+	}
+
+	running, err := vm.IsRunning()
+	if err != nil {
+		return err
+	}
+
+	if !running {
+		return errors.New("The machine must be running to be teleported")
+	}
+
+	logger.Info("Teleporting machine", "host", host, "port", port)
+	progress, err := vm.console.Teleport(host, uint(port), password, uint(maxDowntime/time.Millisecond))
+	return waitForProgressContext(ctx, progress, err)
+}
@@ -0,0 +1,119 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+type usbFilterSettings struct {
+	Name      string
+	VendorID  string `mapstructure:"vendor_id"`
+	ProductID string `mapstructure:"product_id"`
+	Serial    string
+}
+
+func addUSBController(machine vbox.Machine, name string, controllerType uint32) error {
+	controller, err := machine.AddUSBController(name, controllerType)
+	if err != nil {
+		return fmt.Errorf("Failed to add %s USB controller: %s", name, err.Error())
+	}
+	return controller.Release()
+}
+
+func configureUSB(cfg *viper.Viper, machine vbox.Machine) error {
+	controller := strings.ToLower(cfg.GetString("usb.controller"))
+	switch controller {
+	case "":
+		return nil
+	case "ohci":
+		if err := addUSBController(machine, "OHCI", vbox.USBControllerType_OHCI); err != nil {
+			return err
+		}
+	case "ehci", "xhci":
+		// Before VirtualBox 7.0, these controllers are provided by the
+		// extension pack, see gateFeatures
+		if controller == "ehci" {
+			// EHCI needs a companion OHCI controller for low and full speed devices
+			if err := addUSBController(machine, "OHCI", vbox.USBControllerType_OHCI); err != nil {
+				return err
+			}
+			if err := addUSBController(machine, "EHCI", vbox.USBControllerType_EHCI); err != nil {
+				return err
+			}
+		} else if err := addUSBController(machine, "xHCI", vbox.USBControllerType_XHCI); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Invalid USB controller '%s'", controller)
+	}
+
+	var filters []usbFilterSettings
+	if err := cfg.UnmarshalKey("usb.filters", &filters); err != nil {
+		return fmt.Errorf("Invalid USB filters configuration: %s", err.Error())
+	}
+
+	if len(filters) == 0 {
+		return nil
+	}
+
+	deviceFilters, err := machine.GetUSBDeviceFilters()
+	if err != nil {
+		return err
+	}
+	defer deviceFilters.Release()
+
+	for i, settings := range filters {
+		if settings.VendorID == "" && settings.ProductID == "" && settings.Serial == "" {
+			return errors.New("USB filters need at least a vendor ID, a product ID or a serial number")
+		}
+
+		name := settings.Name
+		if name == "" {
+			name = fmt.Sprintf("vlaunch-%d", i)
+		}
+
+		if err := addUSBFilter(deviceFilters, uint32(i), name, settings); err != nil {
+			return fmt.Errorf("Failed to create USB filter %s: %s", name, err.Error())
+		}
+
+		logger.Info("Added USB filter", "name", name)
+	}
+
+	return nil
+}
+
+func addUSBFilter(deviceFilters vbox.USBDeviceFilters, position uint32, name string, settings usbFilterSettings) error {
+	filter, err := deviceFilters.CreateDeviceFilter(name)
+	if err != nil {
+		return err
+	}
+	defer filter.Release()
+
+	if settings.VendorID != "" {
+		if err := filter.SetVendorId(settings.VendorID); err != nil {
+			return err
+		}
+	}
+
+	if settings.ProductID != "" {
+		if err := filter.SetProductId(settings.ProductID); err != nil {
+			return err
+		}
+	}
+
+	if settings.Serial != "" {
+		if err := filter.SetSerialNumber(settings.Serial); err != nil {
+			return err
+		}
+	}
+
+	if err := filter.SetActive(true); err != nil {
+		return err
+	}
+
+	return deviceFilters.InsertDeviceFilter(position, filter)
+}
@@ -0,0 +1,370 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+// virtualBox is the default hypervisor driver, it uses the fields of the
+// machine as most features are only available with VirtualBox
+type virtualBox struct {
+	vm          *VirtualMachine
+	controllers []controllerSpec
+	slots       map[string]*slotAllocator
+}
+
+// setControllers resets the slots available on the storage controllers
+func (v *virtualBox) setControllers(specs []controllerSpec) {
+	v.controllers = specs
+	v.slots = make(map[string]*slotAllocator)
+	for _, spec := range specs {
+		v.slots[spec.name] = newSlotAllocator(spec)
+	}
+}
+
+func (v *virtualBox) CreateMachine(ctx context.Context, cfg *viper.Viper) error {
+	vm := v.vm
+	settingsPath := cfg.GetString("data_path")
+
+	if err := initVirtualBox(); err != nil {
+		return err
+	}
+	gateFeatures(cfg)
+
+	configureGlobalGUI(cfg)
+
+	osType := cfg.GetString("distro_type")
+	if err := validateOSType(osType); err != nil {
+		return err
+	}
+
+	machine, err := vbox.CreateMachine(settingsPath, cfg.GetString("machine_name"), osType, "")
+	if err != nil {
+		return err
+	}
+
+	configureResources(cfg, machine)
+
+	if err := configureVirtualization(cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureDisplay(cfg, machine); err != nil {
+		return err
+	}
+
+	biosSettings, err := machine.GetBiosSettings()
+	if err != nil {
+		return err
+	}
+
+	biosSettings.SetACPIEnabled(true)
+	biosSettings.SetIOAPICEnabled(true)
+	biosSettings.SetBootMenuMode(vbox.BootMenuMode_Disabled)
+
+	if err := configureFirmware(cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureTime(cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureNetwork(cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureBandwidth(cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureVRDE(cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureAudio(cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureUSB(cfg, machine); err != nil {
+		return err
+	}
+
+	if err := configureSerial(cfg, machine); err != nil {
+		return fmt.Errorf("Failed to configure serial port: %s", err.Error())
+	}
+
+	if err := configureRecording(cfg, machine); err != nil {
+		return fmt.Errorf("Failed to configure recording: %s", err.Error())
+	}
+
+	if err := configureTeleporter(cfg, machine); err != nil {
+		return fmt.Errorf("Failed to configure teleporter: %s", err.Error())
+	}
+
+	configureGUI(cfg, machine)
+	tagMachine(cfg, machine, false)
+
+	if err := configureIntegration(cfg, machine); err != nil {
+		return err
+	}
+
+	configureSharedFolders(cfg, machine)
+
+	specs, err := getControllerSpecs(cfg)
+	if err != nil {
+		return err
+	}
+
+	var controllers []vbox.StorageController
+	for _, spec := range specs {
+		controller, err := addStorageController(machine, spec)
+		if err != nil {
+			return fmt.Errorf("Failed to add storage controller %s: %s", spec.name, err.Error())
+		}
+		controllers = append(controllers, controller)
+	}
+
+	hotplug, err := addHotplugController(cfg, machine, specs)
+	if err != nil {
+		return err
+	}
+	controllers = append(controllers, hotplug...)
+
+	if err := machine.SaveSettings(); err != nil {
+		return err
+	}
+
+	if err := machine.Register(); err != nil {
+		return err
+	}
+
+	session := vbox.Session{}
+	if err := session.Init(); err != nil {
+		return err
+	}
+
+	vm.machine = machine
+	vm.controllers = controllers
+	vm.session = session
+	vm.rawDisks = make(map[string]bool)
+	v.setControllers(specs)
+
+	recordSetup(cfg, "settings", settingsFingerprint(cfg))
+
+	return nil
+}
+
+func (v *virtualBox) AttachDisk(ctx context.Context, index int, disk Disk) error {
+	vm := v.vm
+	deviceType := vbox.DeviceType_HardDisk
+
+	spec, err := findController(v.controllers, disk)
+	if err != nil {
+		return err
+	}
+	slots := v.slots[spec.name]
+
+	var medium vbox.Medium
+	if disk.Type == "iso" {
+		if medium, err = vbox.OpenMedium(disk.Location, vbox.DeviceType_DVD, vbox.AccessMode_ReadOnly, false); err != nil {
+			return fmt.Errorf("Failed to open ISO image %s: %s", disk.Location, err.Error())
+		}
+		deviceType = vbox.DeviceType_DVD
+	} else {
+		if medium, err = openDisk(vm.cfg, disk, index); err != nil {
+			return err
+		}
+		vm.disks = append(vm.disks, medium)
+
+		if disk.Type == "vdi" && vm.cfg.GetBool("encryption.encrypt") {
+			if err := encryptDisk(ctx, vm.cfg, medium); err != nil {
+				return err
+			}
+		}
+
+		if disk.Type == "raw" {
+			id, err := medium.GetId()
+			if err != nil {
+				return err
+			}
+			vm.rawDisks[id] = true
+		}
+	}
+
+	var slot storageSlot
+	if disk.Port == nil && disk.Device == nil {
+		if slot, err = slots.next(); err != nil {
+			return err
+		}
+	} else {
+		if disk.Port != nil {
+			slot.port = *disk.Port
+		}
+		if disk.Device != nil {
+			slot.device = *disk.Device
+		}
+
+		if err := slots.reserve(slot); err != nil {
+			return err
+		}
+	}
+
+	if err := vm.session.LockMachine(vm.machine, vbox.LockType_Write); err != nil {
+		return err
+	}
+	defer vm.session.UnlockMachine()
+
+	// NOTE: Machine modifications require the mutable instance obtained from
+	// the session
+	machine, err := vm.session.GetMachine()
+	if err != nil {
+		return err
+	}
+
+	if err := machine.AttachDevice(spec.name, slot.port, slot.device, deviceType, medium); err != nil {
+		return err
+	}
+
+	if deviceType == vbox.DeviceType_HardDisk {
+		if err := limitDisk(vm.cfg, machine, spec.name, slot.port, slot.device); err != nil {
+			return err
+		}
+	}
+
+	if disk.Type == "iso" {
+		logger.Info("Attached ISO image", "image", disk.Location, "controller", spec.name, "port", slot.port, "device", slot.device)
+	}
+
+	return machine.SaveSettings()
+}
+
+func (v *virtualBox) Launch(ctx context.Context, frontend string) error {
+	vm := v.vm
+
+	if err := vm.recoverSession(ctx); err != nil {
+		return err
+	}
+
+	if err := vm.resetOverlays(ctx); err != nil {
+		return err
+	}
+
+	progress, err := vm.machine.Launch(vm.session, frontend, "")
+	if err := waitForProgressContext(ctx, progress, err); err != nil {
+		return err
+	}
+
+	console, err := vm.session.GetConsole()
+	if err != nil {
+		return err
+	}
+
+	vm.console = console
+
+	return vm.unlockDisks()
+}
+
+func (v *virtualBox) Events(ctx context.Context, publish func(Event)) error {
+	return v.vm.eventLoop(ctx, publish)
+}
+
+func (v *virtualBox) GuestProperties(pattern string) ([]GuestProperty, error) {
+	properties, err := v.vm.machine.EnumerateGuestProperties(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []GuestProperty
+	for _, prop := range properties {
+		result = append(result, GuestProperty{
+			Name:      prop.Name,
+			Value:     prop.Value,
+			Timestamp: prop.Timestamp,
+			Flags:     prop.Flags,
+		})
+	}
+	return result, nil
+}
+
+func (v *virtualBox) SetGuestProperty(name, value, flags string) error {
+	session, machine, err := v.vm.lockMachine()
+	if err != nil {
+		return err
+	}
+	defer session.UnlockMachine()
+
+	return machine.SetGuestProperty(name, value, flags)
+}
+
+func (v *virtualBox) State() (uint32, error) {
+	return v.vm.machine.GetState()
+}
+
+func (v *virtualBox) Stop() error {
+	return v.vm.console.PowerButton()
+}
+
+func (v *virtualBox) PowerOff() error {
+	progress, err := v.vm.console.PowerDown()
+	if err != nil {
+		return err
+	}
+	defer progress.Release()
+
+	return progress.WaitForCompletion(-1)
+}
+
+func (v *virtualBox) Release(ctx context.Context) error {
+	vm := v.vm
+
+	if err := vm.session.UnlockMachine(); err != nil {
+		return err
+	}
+	time.Sleep(time.Second)
+
+	for _, controller := range vm.controllers {
+		if err := controller.Release(); err != nil {
+			return err
+		}
+	}
+
+	// Only hard disks are returned so that attached ISO images are not deleted
+	media, err := vm.machine.Unregister(vbox.CleanupMode_DetachAllReturnHardDisksOnly)
+	if err != nil {
+		return err
+	}
+
+	// Only the raw VMDK descriptors generated by vlaunch and the differencing
+	// disks of linked clones are deleted, the disk images provided by the
+	// user are only closed
+	var generated []vbox.Medium
+	for _, medium := range media {
+		if id, err := medium.GetId(); err == nil && (vm.cloned || vm.rawDisks[id]) {
+			generated = append(generated, medium)
+		} else {
+			medium.Close()
+		}
+	}
+
+	progress, err := vm.machine.DeleteConfig(generated)
+	if err := waitForProgressContext(ctx, progress, err); err != nil {
+		return err
+	}
+
+	if err := vm.machine.Release(); err != nil {
+		return err
+	}
+
+	/*
+		if err := vm.session.Release(); err != nil {
+			return err
+		}
+	*/
+
+	return nil
+}
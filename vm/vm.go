@@ -1,56 +1,94 @@
 package vm
 
 import (
+	"context"
 	"fmt"
-	"log"
-	"path"
+	"log/slog"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lebauce/vbox"
 	"github.com/lebauce/vlaunch/backend"
-	"github.com/lebauce/vlaunch/config"
-	"github.com/lebauce/vlaunch/vmdk"
+	"github.com/lebauce/vlaunch/logging"
+	"github.com/spf13/viper"
 )
 
-var controllerName = "IDE"
+var logger = logging.Module("vm")
 
-type EventHandler interface {
-	OnGuestPropertyChanged(name, value string, timestamp int64, flags string)
+// SetLogger makes the vlaunch packages log to the handler of the given
+// logger instead of the default one, as WithLogger does
+func SetLogger(l *slog.Logger) {
+	logging.SetHandler(l.Handler())
 }
 
 type VirtualMachine struct {
-	machine       vbox.Machine
-	console       vbox.Console
-	controller    vbox.StorageController
-	session       vbox.Session
-	dd            vbox.Medium
-	wg            sync.WaitGroup
-	eventHandlers []EventHandler
+	cfg         *viper.Viper
+	hypervisor  Hypervisor
+	machine     vbox.Machine
+	console     vbox.Console
+	controllers []vbox.StorageController
+	session     vbox.Session
+	disks       []vbox.Medium
+	rawDisks    map[string]bool
+	cloned      bool
+	seeded      bool
+	wg          sync.WaitGroup
+	events      eventBus
+	actionsLock sync.Mutex
+	actions     map[string]ActionHandler
+	onShutdown  func() error
+
+	launched        time.Time
+	bootDuration    atomic.Int64
+	eventLoopErrors atomic.Uint64
+	heartbeat       atomic.Int64
+	restarting      atomic.Bool
+	ejectRequested  atomic.Bool
+	shutdownWarned  atomic.Bool
+	shutdownHooked  atomic.Bool
+	lastDiskSample  diskSample
 }
 
-func (vm *VirtualMachine) OnStateChanged(event vbox.Event) {
+func isStopped(state uint32) bool {
+	return state == vbox.MachineState_PoweredOff || state == vbox.MachineState_Saved || state == vbox.MachineState_Teleported
 }
 
-func (vm *VirtualMachine) RegisterEventHandler(handler EventHandler) {
-	vm.eventHandlers = append(vm.eventHandlers, handler)
+func (vm *VirtualMachine) additionsRunLevel() (uint32, error) {
+	guest, err := vm.console.GetGuest()
+	if err != nil {
+		return 0, err
+	}
+	defer guest.Release()
+
+	return guest.GetAdditionsRunLevel()
+}
+
+// eventListener is a passive listener registered on the console events
+type eventListener struct {
+	eventSource vbox.EventSource
+	listener    vbox.EventListener
 }
 
-func (vm *VirtualMachine) passiveListenerLoop() error {
-	log.Println("Using passive listener loop")
+func (l *eventListener) release() {
+	l.eventSource.UnregisterListener(l.listener)
+	l.listener.Release()
+	l.eventSource.Release()
+}
 
+func (vm *VirtualMachine) registerEventListener() (*eventListener, error) {
 	eventSource, err := vm.console.GetEventSource()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer eventSource.Release()
 
 	listener, err := eventSource.CreateListener()
 	if err != nil {
-		return err
+		eventSource.Release()
+		return nil, err
 	}
-	defer listener.Release()
 
 	interestingEvents := []uint32{
 		vbox.EventType_OnMachineStateChanged,
@@ -58,14 +96,51 @@ func (vm *VirtualMachine) passiveListenerLoop() error {
 		vbox.EventType_MachineEvent,
 		vbox.EventType_OnSessionStateChanged,
 		vbox.EventType_OnGuestPropertyChanged,
+		vbox.EventType_OnAdditionsStateChanged,
+		vbox.EventType_OnNetworkAdapterChanged,
+		vbox.EventType_OnSharedFolderChanged,
+		vbox.EventType_OnRuntimeError,
 	}
 	if err := eventSource.RegisterListener(listener, interestingEvents, false); err != nil {
+		listener.Release()
+		eventSource.Release()
+		return nil, err
+	}
+
+	return &eventListener{eventSource: eventSource, listener: listener}, nil
+}
+
+// eventLoop publishes the machine events until it stops, listening to them
+// when the platform supports it and polling the machine otherwise or when the
+// listener can not be registered
+func (vm *VirtualMachine) eventLoop(ctx context.Context, publish func(Event)) error {
+	pipeline, err := vm.newEventPipeline(publish)
+	if err != nil {
 		return err
 	}
-	defer eventSource.UnregisterListener(listener)
+
+	if backend.SupportPassiveListener {
+		listener, err := vm.registerEventListener()
+		if err == nil {
+			defer listener.release()
+			return vm.passiveListenerLoop(ctx, pipeline, listener)
+		}
+		logger.Warn("Failed to register event listener, falling back to polling", "error", err)
+	}
+
+	return vm.pollingLoop(ctx, pipeline)
+}
+
+func (vm *VirtualMachine) passiveListenerLoop(ctx context.Context, pipeline *eventPipeline, l *eventListener) error {
+	logger.Debug("Using passive listener loop")
 
 	for {
-		event, err := eventSource.GetEvent(listener, 250)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		beat(ctx)
+
+		event, err := l.eventSource.GetEvent(l.listener, 250)
 		if err != nil {
 			return err
 		}
@@ -79,34 +154,76 @@ func (vm *VirtualMachine) passiveListenerLoop() error {
 			return err
 		}
 
-		state, err := vm.machine.GetState()
-		if err != nil {
-			return err
-		}
-
 		switch eventType {
-		case vbox.EventType_OnStateChanged:
-			vm.OnStateChanged(*event)
+		case vbox.EventType_OnStateChanged, vbox.EventType_OnMachineStateChanged:
+			state, err := vm.machine.GetState()
+			if err != nil {
+				return err
+			}
+
+			if pipeline.setState(state) || (eventType == vbox.EventType_OnStateChanged && isStopped(state)) {
+				return nil
+			}
 		case vbox.EventType_OnGuestPropertyChanged:
 			guestPropEvent, err := vbox.NewGuestPropertyChangedEvent(event)
 			if err != nil {
 				return err
 			}
-			for _, handler := range vm.eventHandlers {
-				name, _ := guestPropEvent.GetName()
-				value, _ := guestPropEvent.GetValue()
-				flags, _ := guestPropEvent.GetFlags()
+			name, _ := guestPropEvent.GetName()
+			value, _ := guestPropEvent.GetValue()
+			flags, _ := guestPropEvent.GetFlags()
+
+			pipeline.setProperty(GuestPropertyChanged{
+				Name:      name,
+				Value:     value,
+				Timestamp: time.Now().UnixNano(),
+				Flags:     flags,
+			})
+		case vbox.EventType_OnSessionStateChanged:
+			sessionEvent, err := vbox.NewSessionStateChangedEvent(event)
+			if err != nil {
+				return err
+			}
+			sessionState, _ := sessionEvent.GetState()
 
-				handler.OnGuestPropertyChanged(name, value, time.Now().UnixNano(), flags)
+			pipeline.setSessionState(sessionState)
+		case vbox.EventType_OnAdditionsStateChanged:
+			pipeline.additionsChanged()
+		case vbox.EventType_OnNetworkAdapterChanged:
+			adapterEvent, err := vbox.NewNetworkAdapterChangedEvent(event)
+			if err != nil {
+				return err
 			}
-		default:
-		}
+			adapter, err := adapterEvent.GetNetworkAdapter()
+			if err != nil {
+				return err
+			}
+			slot, _ := adapter.GetSlot()
+			adapter.Release()
 
-		if eventType == vbox.EventType_OnStateChanged && state == vbox.MachineState_PoweredOff {
-			return nil
+			pipeline.networkAdapterChanged(slot)
+		case vbox.EventType_OnSharedFolderChanged:
+			folderEvent, err := vbox.NewSharedFolderChangedEvent(event)
+			if err != nil {
+				return err
+			}
+			scope, _ := folderEvent.GetScope()
+
+			pipeline.sharedFolderChanged(scope)
+		case vbox.EventType_OnRuntimeError:
+			errorEvent, err := vbox.NewRuntimeErrorEvent(event)
+			if err != nil {
+				return err
+			}
+			fatal, _ := errorEvent.GetFatal()
+			id, _ := errorEvent.GetId()
+			message, _ := errorEvent.GetMessage()
+
+			pipeline.runtimeError(fatal, id, message)
+		default:
 		}
 
-		err = eventSource.EventProcessed(listener, *event)
+		err = l.eventSource.EventProcessed(l.listener, *event)
 		if err != nil {
 			return err
 		}
@@ -115,196 +232,236 @@ func (vm *VirtualMachine) passiveListenerLoop() error {
 	}
 }
 
-func (vm *VirtualMachine) pollingLoop() error {
-	log.Println("Using polling loop")
+// maxPollingDelay bounds the delay between retries when polling fails
+const maxPollingDelay = 5 * time.Second
+
+// pollingLoop only detects the changes of machine state, session state,
+// additions run level and guest properties. Only the guest properties
+// matching events.properties are enumerated. Failures are retried with an
+// exponential backoff, the loop only fails if they last longer than
+// events.failure_timeout.
+func (vm *VirtualMachine) pollingLoop(ctx context.Context, pipeline *eventPipeline) error {
+	logger.Debug("Using polling loop")
 
-	getPropertyMap := func() (map[string]vbox.GuestProperty, error) {
-		properties, err := vm.machine.EnumerateGuestProperties("")
+	// poll publishes the changes since the previous call and returns
+	// whether the machine stopped
+	poll := func() (bool, error) {
+		state, err := vm.machine.GetState()
 		if err != nil {
-			return nil, err
+			return false, err
 		}
 
-		m := make(map[string]vbox.GuestProperty)
-		for _, prop := range properties {
-			m[prop.Name] = prop
+		properties, err := pipeline.enumerateProperties()
+		if err != nil {
+			return false, err
 		}
-		return m, nil
-	}
 
-	previousState, err := vm.machine.GetState()
-	if err != nil {
-		return err
-	}
+		if pipeline.setState(state) {
+			return true, nil
+		}
 
-	previousProperties, err := getPropertyMap()
-	if err != nil {
-		return err
+		if sessionState, err := vm.machine.GetSessionState(); err == nil {
+			pipeline.setSessionState(sessionState)
+		}
+
+		pipeline.additionsChanged()
+		pipeline.setProperties(properties)
+
+		return false, nil
 	}
 
-	for {
-		state, err := vm.machine.GetState()
-		if err != nil || (state == vbox.MachineState_PoweredOff && state != previousState) {
-			return nil
-		}
-		previousState = state
+	interval := vm.cfg.GetDuration("events.polling_interval")
+	delay := interval
 
-		properties, err := getPropertyMap()
+	var failingSince time.Time
+	for {
+		beat(ctx)
+		stopped, err := poll()
 		if err != nil {
-			return err
-		}
-
-		for name, prop := range properties {
-			if previousProperty, ok := previousProperties[name]; !ok || previousProperty.Value != prop.Value {
-				for _, handler := range vm.eventHandlers {
-					handler.OnGuestPropertyChanged(prop.Name, prop.Value, prop.Timestamp, prop.Flags)
-				}
+			vm.eventLoopErrors.Add(1)
+			if failingSince.IsZero() {
+				failingSince = time.Now()
+			} else if failure := time.Since(failingSince); failure > vm.cfg.GetDuration("events.failure_timeout") {
+				return fmt.Errorf("Failed to poll the machine for %s: %s", failure.Round(time.Second), err.Error())
 			}
-		}
 
-		for name, prop := range previousProperties {
-			if _, ok := properties[name]; !ok {
-				for _, handler := range vm.eventHandlers {
-					handler.OnGuestPropertyChanged(prop.Name, "", 0, "")
-				}
+			logger.Warn("Failed to poll the machine, retrying", "delay", delay, "error", err)
+			if delay *= 2; delay > maxPollingDelay {
+				delay = maxPollingDelay
+			}
+		} else {
+			if stopped {
+				return nil
 			}
+			failingSince = time.Time{}
+			delay = interval
 		}
 
-		time.Sleep(250 * time.Millisecond)
-
-		previousProperties = properties
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
 	}
 }
 
-func (vm *VirtualMachine) Run() (err error) {
+// Run processes the machine events until it stops or the context is done.
+// A machine stopped by RestartFromSnapshot is started again.
+func (vm *VirtualMachine) Run(ctx context.Context) (err error) {
 	var wg sync.WaitGroup
+	defer vm.events.close()
+
+	ctx = withHeartbeat(ctx, &vm.heartbeat)
+	defer vm.heartbeat.Store(0)
+
+	publish := vm.events.publish
+	if journal, err := openJournal(vm.cfg); err != nil {
+		logger.Warn("Guest property changes will not be recorded", "error", err)
+	} else if journal != nil {
+		defer journal.Close()
+		publish = func(event Event) {
+			if prop, ok := event.(GuestPropertyChanged); ok {
+				recordProperty(journal, prop)
+			}
+			vm.events.publish(event)
+		}
+	}
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
-		if backend.SupportPassiveListener {
-			err = vm.passiveListenerLoop()
-		} else {
-			err = vm.pollingLoop()
+		for {
+			err = vm.hypervisor.Events(ctx, publish)
+			if err != nil && err != ctx.Err() {
+				vm.eventLoopErrors.Add(1)
+			}
+
+			if err != nil || !vm.restarting.CompareAndSwap(true, false) {
+				break
+			}
+
+			if err = vm.restart(ctx); err != nil {
+				break
+			}
 		}
 
-		log.Println("Exited main loop")
+		logger.Debug("Exited main loop")
 	}()
 
 	wg.Wait()
 	return err
 }
 
-func (vm *VirtualMachine) Start() error {
-	progress, err := vm.machine.Launch(vm.session, "gui", "")
-	if err != nil {
-		return err
+func (vm *VirtualMachine) Start(ctx context.Context) error {
+	frontend := vm.cfg.GetString("frontend")
+	switch frontend {
+	case "gui", "headless", "separate", "sdl":
+	default:
+		return fmt.Errorf("Invalid frontend '%s'", frontend)
 	}
 
-	if err = progress.WaitForCompletion(50000); err != nil {
-		return err
+	if saved, err := vm.HasSavedState(); err == nil && saved {
+		logger.Info("Resuming VM from saved state")
 	}
-	progress.Release()
 
-	console, err := vm.session.GetConsole()
-	if err != nil {
+	if vm.cfg.GetBool("teleporter.enabled") {
+		logger.Info("Waiting for teleported machine", "port", vm.cfg.GetInt("teleporter.port"))
+	}
+
+	vm.launched = time.Now()
+	ctx, cancel := withTimeout(ctx, launchTimeout(vm.cfg))
+	defer cancel()
+
+	if err := vm.hypervisor.Launch(ctx, frontend); err != nil {
 		return err
 	}
 
-	vm.console = console
+	vm.markProvisioned()
 	return nil
 }
 
+// Stop asks the guest to shut down by pressing the ACPI power button, once
+// it acknowledged the shutdown, see shutdownHandshake
 func (vm *VirtualMachine) Stop() error {
-	return nil
+	if err := vm.runShutdownHook(); err != nil {
+		return err
+	}
+	vm.shutdownHandshake()
+	return vm.hypervisor.Stop()
 }
 
-func (vm *VirtualMachine) Release() error {
-	if err := vm.session.UnlockMachine(); err != nil {
-		return err
+func (vm *VirtualMachine) PowerOff() error {
+	if err := vm.runShutdownHook(); err != nil {
+		logger.Warn("Powering off despite the shutdown hook failure", "error", err)
 	}
-	time.Sleep(time.Second)
+	vm.shutdownHandshake()
+	return vm.hypervisor.PowerOff()
+}
 
-	if err := vm.controller.Release(); err != nil {
+func (vm *VirtualMachine) Pause() error {
+	if err := vm.requireVirtualBox(); err != nil {
 		return err
 	}
+	return vm.console.Pause()
+}
 
-	media, err := vm.machine.Unregister(vbox.CleanupMode_Full)
-	if err != nil {
+func (vm *VirtualMachine) Resume() error {
+	if err := vm.requireVirtualBox(); err != nil {
 		return err
 	}
+	return vm.console.Resume()
+}
 
-	progress, err := vm.machine.DeleteConfig(media)
-	if err != nil {
+func (vm *VirtualMachine) SaveState() error {
+	if err := vm.requireVirtualBox(); err != nil {
 		return err
 	}
-	defer progress.Release()
 
-	if err = progress.WaitForCompletion(-1); err != nil {
+	machine, err := vm.session.GetMachine()
+	if err != nil {
 		return err
 	}
 
-	if err := vm.machine.Release(); err != nil {
+	progress, err := machine.SaveState()
+	if err != nil {
 		return err
 	}
+	defer progress.Release()
 
-	/*
-		if err := vm.session.Release(); err != nil {
-			return err
-		}
-	*/
-
-	return nil
+	return progress.WaitForCompletion(-1)
 }
 
-func (vm *VirtualMachine) Create() error {
-	cfg := config.GetConfig()
-	settingsPath := path.Join(cfg.GetString("data_path"))
-
-	if err := vbox.Init(); err != nil {
-		return fmt.Errorf("Failed to initialize VirtualBox API: %s", err.Error())
-	}
-
-	diskLocation := ""
-	diskType := cfg.GetString("disk_type")
-	switch diskType {
-	case "raw":
-		device, err := backend.FindDevice()
-		if err != nil {
-			return err
-		}
-
-		log.Printf("Creating raw VMDK for device %s\n", device)
-		diskLocation = path.Join(settingsPath, "raw.vmdk")
-		if err := vmdk.CreateRawVMDK(diskLocation, device, true, backend.RelativeRawVMDK); err != nil {
-			return err
-		}
-	case "vdi":
-		diskLocation = cfg.GetString("disk_location")
-	default:
-		return fmt.Errorf("Invalid disk type '%s'", diskType)
+func (vm *VirtualMachine) HasSavedState() (bool, error) {
+	if err := vm.requireVirtualBox(); err != nil {
+		return false, err
 	}
 
-	dd, err := vbox.OpenMedium(diskLocation, vbox.DeviceType_HardDisk,
-		vbox.AccessMode_ReadWrite, false)
+	state, err := vm.machine.GetState()
 	if err != nil {
-		return err
+		return false, err
 	}
+	return state == vbox.MachineState_Saved, nil
+}
 
-	machine, err := vbox.CreateMachine(settingsPath, "ufo", cfg.GetString("distro_type"), "")
-	if err != nil {
-		return err
-	}
+func (vm *VirtualMachine) Release(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, vm.cfg.GetDuration("timeouts.delete"))
+	defer cancel()
 
-	cpus := cfg.GetInt("cpus")
+	return vm.hypervisor.Release(ctx)
+}
+
+// resources returns the number of CPUs and the RAM in MB of the machine,
+// half of the host CPUs and two thirds of its free RAM unless configured
+func resources(cfg *viper.Viper) (cpus int, ram int) {
+	cpus = cfg.GetInt("cpus")
 	if cpus <= 0 {
 		if cpus = runtime.NumCPU(); cpus > 1 {
 			cpus /= 2
 		}
 	}
-	machine.SetCPUCount(uint(cpus))
 
-	ram := cfg.GetInt("ram")
+	ram = cfg.GetInt("ram")
 	if ram <= 0 {
 		if freeRam, err := backend.GetFreeRam(); err == nil {
 			ram = (int(freeRam) * 2 / 3) / 1024 / 1024
@@ -314,11 +471,122 @@ func (vm *VirtualMachine) Create() error {
 			ram = minRam
 		}
 	}
-	log.Printf("Setting RAM to %d\n", ram)
+	return cpus, ram
+}
+
+func configureResources(cfg *viper.Viper, machine vbox.Machine) {
+	cpus, ram := resources(cfg)
+	machine.SetCPUHotPlugEnabled(cfg.GetBool("cpu_hotplug"))
+	machine.SetCPUCount(uint(cpus))
+
+	logger.Info("Setting RAM", "size", ram)
 	machine.SetMemorySize(uint(ram))
+}
 
-	if err := machine.SetVramSize(32); err != nil {
-		return err
+// paravirtProviders maps the configuration values to paravirtualization
+// providers
+var paravirtProviders = map[string]uint32{
+	"default": vbox.ParavirtProvider_Default,
+	"none":    vbox.ParavirtProvider_None,
+	"kvm":     vbox.ParavirtProvider_KVM,
+	"hyperv":  vbox.ParavirtProvider_HyperV,
+}
+
+// configureVirtualization sets the paravirtualization provider and the
+// hardware virtualization features exposed to the guest
+func configureVirtualization(cfg *viper.Viper, machine vbox.Machine) error {
+	provider, found := paravirtProviders[cfg.GetString("virtualization.paravirt_provider")]
+	if !found {
+		return fmt.Errorf("Invalid paravirtualization provider '%s'", cfg.GetString("virtualization.paravirt_provider"))
+	}
+
+	if err := machine.SetParavirtProvider(provider); err != nil {
+		return fmt.Errorf("Failed to set paravirtualization provider: %s", err.Error())
+	}
+
+	if err := machine.SetHWVirtExProperty(vbox.HWVirtExPropertyType_NestedPaging, cfg.GetBool("virtualization.nested_paging")); err != nil {
+		return fmt.Errorf("Failed to set nested paging: %s", err.Error())
+	}
+
+	if err := machine.SetHWVirtExProperty(vbox.HWVirtExPropertyType_LargePages, cfg.GetBool("virtualization.large_pages")); err != nil {
+		return fmt.Errorf("Failed to set large pages: %s", err.Error())
+	}
+
+	if err := machine.SetCPUProperty(vbox.CPUPropertyType_HWVirt, cfg.GetBool("virtualization.nested_hw_virt")); err != nil {
+		return fmt.Errorf("Failed to set nested hardware virtualization: %s", err.Error())
+	}
+
+	return nil
+}
+
+// bootDevices maps the boot_order values to device types
+var bootDevices = map[string]uint32{
+	"disk": vbox.DeviceType_HardDisk,
+	"dvd":  vbox.DeviceType_DVD,
+	"net":  vbox.DeviceType_Network,
+	"none": vbox.DeviceType_Null,
+}
+
+// configureFirmware sets the firmware type and the boot order. The default
+// boot order of VirtualBox is kept if none is configured.
+func configureFirmware(cfg *viper.Viper, machine vbox.Machine) error {
+	firmware := vbox.FirmwareType_BIOS
+	if cfg.GetString("firmware") == "efi" {
+		firmware = vbox.FirmwareType_EFI
+	}
+
+	if err := machine.SetFirmwareType(firmware); err != nil {
+		return fmt.Errorf("Failed to set firmware: %s", err.Error())
+	}
+
+	if !cfg.IsSet("boot_order") {
+		return nil
+	}
+
+	order := cfg.GetStringSlice("boot_order")
+	if len(order) > 4 {
+		return fmt.Errorf("At most 4 boot devices can be set, got %d", len(order))
+	}
+
+	for position := 0; position < 4; position++ {
+		device := vbox.DeviceType_Null
+		if position < len(order) {
+			var found bool
+			if device, found = bootDevices[order[position]]; !found {
+				return fmt.Errorf("Invalid boot device '%s'", order[position])
+			}
+		}
+
+		if err := machine.SetBootOrder(uint32(position+1), device); err != nil {
+			return fmt.Errorf("Failed to set boot order: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// hostTimeDisabledKey disables the synchronization of the guest clock with
+// the host by the Guest Additions
+const hostTimeDisabledKey = "VBoxInternal/Devices/VMMDev/0/Config/GetHostTimeDisabled"
+
+// rtcUseUTC returns whether the real-time clock of the guest is in UTC,
+// Windows expects it in local time unlike the other systems
+func rtcUseUTC(cfg *viper.Viper) bool {
+	switch cfg.GetString("time.rtc") {
+	case "utc":
+		return true
+	case "local":
+		return false
+	default:
+		return !strings.HasPrefix(cfg.GetString("distro_type"), "Windows")
+	}
+}
+
+// configureTime sets the time zone and the offset of the real-time clock of
+// the guest and whether its time is synchronized with the host
+func configureTime(cfg *viper.Viper, machine vbox.Machine) error {
+	if err := machine.SetRTCUseUTC(rtcUseUTC(cfg)); err != nil {
+		return fmt.Errorf("Failed to set the real-time clock mode: %s", err.Error())
 	}
 
 	biosSettings, err := machine.GetBiosSettings()
@@ -326,116 +594,193 @@ func (vm *VirtualMachine) Create() error {
 		return err
 	}
 
-	biosSettings.SetACPIEnabled(true)
-	biosSettings.SetIOAPICEnabled(true)
-	biosSettings.SetBootMenuMode(vbox.BootMenuMode_Disabled)
+	offset := cfg.GetDuration("time.offset")
+	if err := biosSettings.SetTimeOffset(int64(offset / time.Millisecond)); err != nil {
+		return fmt.Errorf("Failed to set the time offset: %s", err.Error())
+	}
 
-	adapter, err := machine.GetNetworkAdapter(0)
-	if err != nil {
-		return err
+	disabled := ""
+	if !cfg.GetBool("time.sync") {
+		disabled = "1"
 	}
+	return machine.SetExtraData(hostTimeDisabledKey, disabled)
+}
 
-	if err := adapter.SetAdapterType(vbox.NetworkAdapterType_I82540EM); err != nil {
+// configureDisplay sets the video memory and 3D acceleration of the machine
+func configureDisplay(cfg *viper.Viper, machine vbox.Machine) error {
+	if err := machine.SetVramSize(uint(cfg.GetInt("display.vram"))); err != nil {
+		return fmt.Errorf("Failed to set video memory: %s", err.Error())
+	}
+
+	if err := configureMonitors(cfg, machine); err != nil {
 		return err
 	}
 
-	// TODO: set audio adapter
+	return machine.SetAccelerate3DEnabled(cfg.GetBool("display.accelerate_3d"))
+}
 
-	vbox.SetExtraData("GUI/MaxGuestResolution", "any")
-	vbox.SetExtraData("GUI/MaxGuestResolution", "any")
+// configureGlobalGUI sets the extra data shared by all the machines, unless
+// they were already set to the same values for this VirtualBox version
+func configureGlobalGUI(cfg *viper.Viper) {
+	version, err := vbox.GetVersion()
+	if err != nil {
+		version = ""
+	}
 
-	vbox.SetExtraData("GUI/Input/AutoCapture", "true")
-	vbox.SetExtraData("GUI/TrayIcon/Enabled", "false")
-	vbox.SetExtraData("GUI/UpdateCheckCount", "2")
-	vbox.SetExtraData("GUI/UpdateDate", "never")
-	vbox.SetExtraData("GUI/RegistrationData", "triesLeft=0")
-	vbox.SetExtraData("GUI/SUNOnlineData", "0")
-	vbox.SetExtraData("GUI/SuppressMessages", ",remindAboutAutoCapture,confirmInputCapture,"+
-		"remindAboutMouseIntegrationOn,remindAboutMouseIntegrationOff,"+
-		"remindAboutInaccessibleMedia,remindAboutWrongColorDepth,confirmGoingFullscreen,"+
-		"showRuntimeError.warning.HostAudioNotResponding,"+
-		"showRuntimeError.warning.3DSupportIncompatibleAdditions")
+	extraData := globalExtraData(cfg)
+	fp := fingerprint(version, extraData)
+	if version != "" && setupUnchanged(cfg, "gui", fp) {
+		logger.Debug("Skipping unchanged GUI settings")
+		return
+	}
 
-	if cfg.GetBool("menubar") == false {
-		vbox.SetExtraData("GUI/Customizations", "noMenuBar")
-		vbox.SetExtraData("GUI/ShowMiniToolBar", "no")
+	for _, name := range sortedExtraData(extraData) {
+		vbox.SetExtraData(name, extraData[name])
 	}
 
-	machine.SetExtraData("GUI/SaveMountedAtRuntime", "false")
-	machine.SetExtraData("GUI/Seamless", "off")
-	machine.SetExtraData("GUI/LastCloseAction", "shutdown")
-	machine.SetExtraData("GUI/AutoresizeGuest", "on")
+	if version != "" {
+		recordSetup(cfg, "gui", fp)
+	}
+}
 
-	if hostKey := cfg.GetString("host_key"); hostKey != "" {
-		machine.SetExtraData("GUI/Input/HostKey", hostKey)
+func configureGUI(cfg *viper.Viper, machine vbox.Machine) {
+	extraData := machineExtraData(cfg)
+	for _, name := range sortedExtraData(extraData) {
+		machine.SetExtraData(name, extraData[name])
 	}
+}
+
+func (vm *VirtualMachine) Create(ctx context.Context) error {
+	cfg := vm.cfg
 
-	machine.SetAccelerate3DEnabled(true)
-	machine.SetDnDMode(vbox.DnDMode_Bidirectional)
-	machine.SetClipboardMode(vbox.ClipboardMode_Bidirectional)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	for name := range cfg.GetStringMap("shared_folders") {
-		sharedFolder := cfg.Sub("shared_folders." + name)
-		path := sharedFolder.GetString("path")
-		persistent := sharedFolder.GetBool("persistent")
-		automount := sharedFolder.GetBool("automount")
-		if err := machine.CreateSharedFolder(name, path, persistent, automount); err != nil {
-			log.Printf("Failed to create shared folder %s: %s", name, err.Error())
+	if baseName := cfg.GetString("clone_from"); baseName != "" {
+		if err := vm.requireVirtualBox(); err != nil {
+			return err
 		}
+		return vm.createClone(ctx, baseName)
 	}
 
-	controller, err := machine.AddStorageController(controllerName, vbox.StorageBus_Ide)
-	if err != nil {
+	if err := downloadDisk(ctx, cfg); err != nil {
 		return err
 	}
 
-	if err = controller.SetType(vbox.StorageControllerType_Ich6); err != nil {
+	disks, err := getDisks(cfg)
+	if err != nil {
 		return err
 	}
 
-	if err := machine.SaveSettings(); err != nil {
+	if _, ok := vm.hypervisor.(*virtualBox); ok {
+		for i, disk := range disks {
+			if disk.Type != "raw" {
+				continue
+			}
+
+			if _, err := writeRawDescriptor(cfg, disk, i); err != nil {
+				return fmt.Errorf("Failed to prepare raw VMDK: %s", err.Error())
+			}
+		}
+	}
+
+	if err := vm.hypervisor.CreateMachine(ctx, cfg); err != nil {
 		return err
 	}
 
-	if err := machine.Register(); err != nil {
+	return vm.attachDisks(ctx, disks)
+}
+
+func (vm *VirtualMachine) attachDisks(ctx context.Context, disks []Disk) error {
+	// Disks with an explicit slot are attached first so that the other
+	// ones get the remaining slots
+	for _, explicit := range []bool{true, false} {
+		for i, disk := range disks {
+			if (disk.Port != nil || disk.Device != nil) != explicit {
+				continue
+			}
+
+			if err := vm.hypervisor.AttachDisk(ctx, i, disk); err != nil {
+				return err
+			}
+		}
+	}
+
+	images := vm.isoImages()
+	seed, err := vm.seedImage()
+	if err != nil {
 		return err
 	}
+	if seed != "" {
+		images = append(images, seed)
+	}
+
+	for _, image := range images {
+		if err := vm.hypervisor.AttachDisk(ctx, len(disks), Disk{Type: "iso", Location: image}); err != nil {
+			return err
+		}
+	}
 
+	return nil
+}
+
+func (vm *VirtualMachine) lockMachine() (vbox.Session, vbox.Machine, error) {
 	session := vbox.Session{}
+	if err := vm.requireVirtualBox(); err != nil {
+		return session, vbox.Machine{}, err
+	}
+
 	if err := session.Init(); err != nil {
-		return err
+		return session, vbox.Machine{}, err
 	}
 
-	if err := session.LockMachine(machine, vbox.LockType_Write); err != nil {
-		return err
+	if err := session.LockMachine(vm.machine, vbox.LockType_Shared); err != nil {
+		return session, vbox.Machine{}, err
 	}
 
-	// NOTE: Machine modifications require the mutable instance obtained from
-	smachine, err := session.GetMachine()
+	machine, err := session.GetMachine()
 	if err != nil {
-		return err
+		session.UnlockMachine()
+		return session, vbox.Machine{}, err
 	}
 
-	if err := smachine.AttachDevice(controllerName, 0, 0, vbox.DeviceType_HardDisk, dd); err != nil {
-		return err
+	return session, machine, nil
+}
+
+func FindVM(cfg *viper.Viper) (*VirtualMachine, error) {
+	if hypervisor := cfg.GetString("hypervisor"); hypervisor != "virtualbox" {
+		return nil, NotSupported
 	}
 
-	if err = smachine.SaveSettings(); err != nil {
-		return err
+	if err := initVirtualBox(); err != nil {
+		return nil, err
 	}
 
-	if err := session.UnlockMachine(); err != nil {
-		return err
+	machineName := cfg.GetString("machine_name")
+	machine, err := vbox.FindMachine(machineName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find machine '%s': %s", machineName, err.Error())
 	}
 
-	vm.machine = machine
-	vm.controller = controller
-	vm.session = session
-	vm.dd = dd
+	session := vbox.Session{}
+	if err := session.Init(); err != nil {
+		return nil, err
+	}
 
-	return nil
+	vm := &VirtualMachine{cfg: cfg, machine: machine, session: session}
+	vm.hypervisor = &virtualBox{vm: vm}
+	return vm, nil
 }
 
-func NewVM() (*VirtualMachine, error) {
-	return &VirtualMachine{}, nil
+func NewVM(cfg *viper.Viper) (*VirtualMachine, error) {
+	vm := &VirtualMachine{cfg: cfg}
+
+	hypervisor, err := newHypervisor(vm)
+	if err != nil {
+		return nil, err
+	}
+	vm.hypervisor = hypervisor
+
+	return vm, nil
 }
@@ -0,0 +1,86 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lebauce/vbox"
+	"github.com/spf13/viper"
+)
+
+var extensionPackName = "Oracle VM VirtualBox Extension Pack"
+
+var ExtPackNotInstalled = errors.New("VRDE requires the " + extensionPackName + ", please install it from https://www.virtualbox.org/wiki/Downloads")
+
+var authTypes = map[string]uint32{
+	"null":     vbox.AuthType_Null,
+	"external": vbox.AuthType_External,
+	"guest":    vbox.AuthType_Internal,
+}
+
+func isExtPackUsable(name string) (bool, error) {
+	manager, err := vbox.GetExtPackManager()
+	if err != nil {
+		return false, err
+	}
+	defer manager.Release()
+
+	return manager.IsExtPackUsable(name)
+}
+
+func configureVRDE(cfg *viper.Viper, machine vbox.Machine) error {
+	if !cfg.GetBool("vrde.enabled") {
+		return nil
+	}
+
+	usable, err := isExtPackUsable(extensionPackName)
+	if err != nil {
+		return fmt.Errorf("Failed to query extension packs: %s", err.Error())
+	}
+	if !usable {
+		return ExtPackNotInstalled
+	}
+
+	authName := strings.ToLower(cfg.GetString("vrde.auth_type"))
+	authType, found := authTypes[authName]
+	if !found {
+		return fmt.Errorf("Invalid VRDE authentication type '%s'", authName)
+	}
+
+	server, err := machine.GetVRDEServer()
+	if err != nil {
+		return err
+	}
+	defer server.Release()
+
+	if err := server.SetVRDEExtPack(extensionPackName); err != nil {
+		return err
+	}
+
+	if err := server.SetAuthType(authType); err != nil {
+		return err
+	}
+
+	if err := server.SetAllowMultiConnection(cfg.GetBool("vrde.multi_connection")); err != nil {
+		return err
+	}
+
+	ports := cfg.GetString("vrde.ports")
+	if err := server.SetVRDEProperty("TCP/Ports", ports); err != nil {
+		return err
+	}
+
+	if address := cfg.GetString("vrde.address"); address != "" {
+		if err := server.SetVRDEProperty("TCP/Address", address); err != nil {
+			return err
+		}
+	}
+
+	if err := server.SetEnabled(true); err != nil {
+		return err
+	}
+
+	logger.Info("Enabled VRDE", "ports", ports)
+	return nil
+}
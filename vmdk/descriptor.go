@@ -0,0 +1,303 @@
+// Package vmdk writes, parses and repairs VMDK descriptors, such as the
+// ones giving a machine access to a raw device of the host
+package vmdk
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/google/uuid"
+)
+
+// Descriptor create types
+const (
+	MonolithicFlat       = "monolithicFlat"
+	MonolithicSparse     = "monolithicSparse"
+	TwoGbMaxExtentFlat   = "twoGbMaxExtentFlat"
+	TwoGbMaxExtentSparse = "twoGbMaxExtentSparse"
+	FullDevice           = "fullDevice"
+	PartitionedDevice    = "partitionedDevice"
+	VMFS                 = "vmfs"
+	VMFSRawDeviceMap     = "vmfsRawDeviceMap"
+)
+
+// maxExtentSize is the size in sectors of the extents of split disks, so
+// that they fit on FAT32 file systems
+var maxExtentSize uint64 = 2 * 1024 * 1024 * 1024 / blockSize
+
+var headerTemplate = template.Must(template.New("VMDK").Parse(`# Disk DescriptorFile
+version=1
+CID=8902101c
+parentCID=ffffffff
+createType="{{.Type}}"
+{{range .Extents}}{{.AccessMode}} {{.Size}} {{.Type}}{{if .Path}} "{{.Path}}"{{end}}{{if eq .Type "FLAT"}} {{.Offset}}{{end}}
+{{end}}ddb.virtualHWVersion = "{{.HWVersion}}"
+ddb.adapterType="{{.AdapterType}}"
+ddb.geometry.cylinders="{{.Cylinders}}"
+ddb.geometry.heads="{{.Heads}}"
+ddb.geometry.sectors="{{.Sectors}}"
+ddb.geometry.biosCylinders="{{.BIOSCylinders}}"
+ddb.geometry.biosHeads="{{.BIOSHeads}}"
+ddb.geometry.biosSectors="{{.BIOSSectors}}"
+ddb.uuid.image="{{.UUID}}"
+ddb.uuid.parent="00000000-0000-0000-0000-000000000000"
+ddb.uuid.modification="b0004a36-2323-433e-9bbc-103368bc5e41"
+ddb.uuid.parentmodification="00000000-0000-0000-0000-000000000000"`))
+
+// Extent is a part of the disk, its size and offset are in sectors
+type Extent struct {
+	AccessMode string
+	Size       uint64
+	Type       string
+	Path       string
+	Offset     uint64
+}
+
+// Descriptor describes a VMDK disk made of one or several extents. The
+// geometry is the physical one of the emulated disk, the BIOS one being the
+// logical geometry the firmware of the guest translates CHS addresses with.
+type Descriptor struct {
+	UUID          uuid.UUID
+	Type          string
+	AdapterType   string
+	HWVersion     int
+	Cylinders     uint64
+	Heads         uint64
+	Sectors       uint64
+	BIOSCylinders uint64
+	BIOSHeads     uint64
+	BIOSSectors   uint64
+	Extents       []Extent
+}
+
+// NewDescriptor returns a descriptor for a disk of the given size in
+// sectors. ESX descriptors use the geometry and adapter expected by ESX.
+func NewDescriptor(createType string, size uint64, esx bool) *Descriptor {
+	d := &Descriptor{
+		UUID:        uuid.New(),
+		Type:        createType,
+		AdapterType: "ide",
+		HWVersion:   4,
+		Heads:       16,
+		Sectors:     63,
+	}
+
+	if esx {
+		d.AdapterType = "lsilogic"
+		d.Heads = 255
+	}
+
+	d.Cylinders = size / d.Heads / d.Sectors
+	if !esx && d.Cylinders > 16383 {
+		d.Cylinders = 16383
+	}
+
+	d.BIOSCylinders, d.BIOSHeads, d.BIOSSectors = d.Cylinders, d.Heads, d.Sectors
+	return d
+}
+
+// splitExtent splits a flat extent in extents of at most max sectors
+func splitExtent(e Extent, max uint64) []Extent {
+	if e.Type != "FLAT" || e.Size <= max {
+		return []Extent{e}
+	}
+
+	var extents []Extent
+	for remaining, offset := e.Size, e.Offset; remaining > 0; {
+		size := remaining
+		if size > max {
+			size = max
+		}
+
+		part := e
+		part.Size = size
+		part.Offset = offset
+		extents = append(extents, part)
+
+		remaining -= size
+		offset += size
+	}
+	return extents
+}
+
+// Split splits the flat extents so that none exceeds 2GB
+func (d *Descriptor) Split() {
+	var extents []Extent
+	for _, e := range d.Extents {
+		extents = append(extents, splitExtent(e, maxExtentSize)...)
+	}
+	d.Extents = extents
+}
+
+// NewImageDescriptor returns the descriptor of a disk image stored in
+// files next to the descriptor, base being the name of the descriptor
+// without extension. Size is in sectors.
+func NewImageDescriptor(base string, size uint64, createType string) (*Descriptor, error) {
+	esx := createType == VMFS
+	d := NewDescriptor(createType, size, esx)
+
+	switch createType {
+	case MonolithicFlat:
+		d.Extents = []Extent{{AccessMode: "RW", Size: size, Type: "FLAT", Path: base + "-flat.vmdk"}}
+	case VMFS:
+		d.Extents = []Extent{{AccessMode: "RW", Size: size, Type: "VMFS", Path: base + "-flat.vmdk"}}
+	case MonolithicSparse:
+		d.Extents = []Extent{{AccessMode: "RW", Size: size, Type: "SPARSE", Path: base + ".vmdk"}}
+	case TwoGbMaxExtentFlat, TwoGbMaxExtentSparse:
+		extentType, suffix := "FLAT", "f"
+		if createType == TwoGbMaxExtentSparse {
+			extentType, suffix = "SPARSE", "s"
+		}
+
+		for i, remaining := 1, size; remaining > 0; i++ {
+			extentSize := remaining
+			if extentSize > maxExtentSize {
+				extentSize = maxExtentSize
+			}
+
+			d.Extents = append(d.Extents, Extent{
+				AccessMode: "RW",
+				Size:       extentSize,
+				Type:       extentType,
+				Path:       fmt.Sprintf("%s-%s%03d.vmdk", base, suffix, i),
+			})
+			remaining -= extentSize
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported image type '%s'", createType)
+	}
+
+	return d, nil
+}
+
+func (d *Descriptor) Write(w io.Writer) error {
+	return headerTemplate.Execute(w, d)
+}
+
+func (d *Descriptor) WriteFile(location string) error {
+	file, err := os.Create(location)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return d.Write(file)
+}
+
+// parseExtent parses an extent line such as 'RW 2048 FLAT "disk.vmdk" 0'
+func parseExtent(line string) (e Extent, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return e, fmt.Errorf("Invalid extent '%s'", line)
+	}
+
+	e.AccessMode, e.Type = fields[0], fields[2]
+	if e.Size, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+		return e, fmt.Errorf("Invalid extent size '%s'", fields[1])
+	}
+
+	if len(fields) > 3 {
+		start := strings.Index(line, "\"")
+		end := strings.LastIndex(line, "\"")
+		if start == -1 || end <= start {
+			return e, fmt.Errorf("Invalid extent path in '%s'", line)
+		}
+		e.Path = line[start+1 : end]
+
+		if offset := strings.TrimSpace(line[end+1:]); offset != "" {
+			if e.Offset, err = strconv.ParseUint(offset, 10, 64); err != nil {
+				return e, fmt.Errorf("Invalid extent offset '%s'", offset)
+			}
+		}
+	}
+
+	return e, nil
+}
+
+// Parse reads a descriptor, only the keys handled by Descriptor are kept
+func Parse(r io.Reader) (*Descriptor, error) {
+	d := &Descriptor{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		equal := strings.Index(line, "=")
+		if equal == -1 {
+			extent, err := parseExtent(line)
+			if err != nil {
+				return nil, err
+			}
+			d.Extents = append(d.Extents, extent)
+			continue
+		}
+
+		key := strings.TrimSpace(line[:equal])
+		value := strings.Trim(strings.TrimSpace(line[equal+1:]), "\"")
+
+		var err error
+		switch key {
+		case "createType":
+			d.Type = value
+		case "ddb.adapterType":
+			d.AdapterType = value
+		case "ddb.virtualHWVersion":
+			d.HWVersion, err = strconv.Atoi(value)
+		case "ddb.geometry.cylinders":
+			d.Cylinders, err = strconv.ParseUint(value, 10, 64)
+		case "ddb.geometry.heads":
+			d.Heads, err = strconv.ParseUint(value, 10, 64)
+		case "ddb.geometry.sectors":
+			d.Sectors, err = strconv.ParseUint(value, 10, 64)
+		case "ddb.geometry.biosCylinders":
+			d.BIOSCylinders, err = strconv.ParseUint(value, 10, 64)
+		case "ddb.geometry.biosHeads":
+			d.BIOSHeads, err = strconv.ParseUint(value, 10, 64)
+		case "ddb.geometry.biosSectors":
+			d.BIOSSectors, err = strconv.ParseUint(value, 10, 64)
+		case "ddb.uuid.image":
+			d.UUID, err = uuid.Parse(value)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value '%s' for %s", value, key)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if d.Type == "" || len(d.Extents) == 0 {
+		return nil, errors.New("Not a VMDK descriptor")
+	}
+
+	return d, nil
+}
+
+// ReadFile parses the descriptor stored at location
+func ReadFile(location string) (*Descriptor, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Parse(file)
+}
+
+// Size returns the size of the disk in sectors
+func (d *Descriptor) Size() (size uint64) {
+	for _, e := range d.Extents {
+		size += e.Size
+	}
+	return size
+}
@@ -4,54 +4,47 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path"
 	"strings"
-	"text/template"
 
-	"github.com/google/uuid"
 	"github.com/lebauce/vlaunch/backend"
+	"github.com/lebauce/vlaunch/logging"
 	"github.com/rekby/gpt"
 	"github.com/rekby/mbr"
 )
 
+var logger = logging.Module("vmdk")
+
 var blockSize uint64 = 512
-var headerTemplate = `# Disk DescriptorFile
-version=1
-CID=8902101c
-parentCID=ffffffff
-createType="{{.Type}}"
-{{range .Extents}}{{.AccessMode}} {{.Size}} {{.Type}}{{if .Path}} "{{.Path}}"{{end}}{{if eq .Type "FLAT"}} {{.Offset}}{{end}}
-{{end}}ddb.virtualHWVersion = "4"
-ddb.adapterType="ide"
-ddb.geometry.cylinders="{{.Cylinders}}"
-ddb.geometry.heads="16"
-ddb.geometry.sectors="63"
-ddb.geometry.biosCylinders="{{.Cylinders}}"
-ddb.geometry.biosHeads="16"
-ddb.geometry.biosSectors="63"
-ddb.uuid.image="{{.UUID}}"
-ddb.uuid.parent="00000000-0000-0000-0000-000000000000"
-ddb.uuid.modification="b0004a36-2323-433e-9bbc-103368bc5e41"
-ddb.uuid.parentmodification="00000000-0000-0000-0000-000000000000"`
-
-type rawVMDK struct {
-	UUID       uuid.UUID
-	TargetPath string
-	DeviceName string
-	DeviceSize uint64
-	Type       string
-	Cylinders  uint64
-	Extents    []extent
+
+// RawOptions control the descriptor generated for a raw device
+type RawOptions struct {
+	// Partitions maps the partitions of the device instead of the whole
+	// device, the partition table being copied to a separate file
+	Partitions bool
+	// Selected restricts the access to the given partitions, numbered from
+	// 1, the others reading as zeros. All partitions are mapped if empty.
+	Selected []int
+	// Relative makes partition extents refer to the partition devices
+	Relative bool
+	// Split limits the size of the flat extents to 2GB
+	Split bool
+	// ESX generates an ESX raw device mapping
+	ESX bool
 }
 
-type extent struct {
-	AccessMode string
-	Size       uint64
-	Type       string
-	Path       string
-	Offset     uint64
+func (o RawOptions) isSelected(number int) bool {
+	if len(o.Selected) == 0 {
+		return true
+	}
+
+	for _, selected := range o.Selected {
+		if selected == number {
+			return true
+		}
+	}
+	return false
 }
 
 type partition struct {
@@ -87,25 +80,80 @@ func readPartitions(r io.ReadSeeker) ([]partition, error) {
 	return parts, nil
 }
 
+// diskGeometry returns the geometry of a device, assuming 512-byte sectors
+// when the host does not report it
+func diskGeometry(device string) backend.DiskGeometry {
+	geometry, err := backend.GetDiskGeometry(device)
+	if err != nil {
+		logger.Warn("Failed to get disk geometry, assuming 512-byte sectors", "device", device, "error", err)
+		return backend.DiskGeometry{LogicalSectorSize: blockSize, PhysicalSectorSize: blockSize}
+	}
+	return geometry
+}
+
+// checkSectorSize returns an error for the devices whose sectors are not
+// 512 bytes, 4Kn disks, as VirtualBox exposes 512-byte sectors to the guest
+// which would not find the partitions laid out for larger ones
+func checkSectorSize(device string, geometry backend.DiskGeometry) error {
+	if geometry.LogicalSectorSize != blockSize {
+		return fmt.Errorf("%s has %d-byte logical sectors but VirtualBox only exposes %d-byte sectors to the guest, "+
+			"which would not find its partitions. Use an enclosure emulating %d-byte sectors (512e) or a disk image",
+			device, geometry.LogicalSectorSize, blockSize, blockSize)
+	}
+	return nil
+}
+
+// setBIOSGeometry sets the BIOS geometry of the descriptor of a device to the
+// one reported by the host, so that the CHS addresses used by boot loaders
+// are translated as on a physical machine. VirtualBox only handles up to
+// 255 heads, 63 sectors per track and 1024 cylinders.
+func setBIOSGeometry(d *Descriptor, geometry backend.DiskGeometry, sectors uint64) {
+	heads, sectorsPerTrack := geometry.Heads, geometry.SectorsPerTrack
+	if heads == 0 || heads > 255 || sectorsPerTrack == 0 || sectorsPerTrack > 63 {
+		return
+	}
+
+	cylinders := sectors / heads / sectorsPerTrack
+	if cylinders > 1024 {
+		cylinders = 1024
+	}
+	d.BIOSCylinders, d.BIOSHeads, d.BIOSSectors = cylinders, heads, sectorsPerTrack
+}
+
 func CreateRawVMDK(location string, deviceName string, partitions bool, relative bool) error {
+	return WriteRawVMDK(location, deviceName, RawOptions{Partitions: partitions, Relative: relative})
+}
+
+// WriteRawVMDK writes a descriptor giving access to a raw device
+func WriteRawVMDK(location string, deviceName string, opts RawOptions) error {
 	deviceSize, err := backend.GetDeviceSize(deviceName)
 	if err != nil {
 		return err
 	}
 
-	cylinders := deviceSize / 16 / 64
-	if cylinders > 16383 {
-		cylinders = 16383
+	geometry := diskGeometry(deviceName)
+	if err := checkSectorSize(deviceName, geometry); err != nil {
+		return err
+	}
+
+	if geometry.PhysicalSectorSize > geometry.LogicalSectorSize {
+		logger.Info("Device has larger physical sectors (512e)", "device", deviceName, "physical", geometry.PhysicalSectorSize)
 	}
 
-	vmdk := rawVMDK{
-		UUID:       uuid.New(),
-		DeviceName: deviceName,
-		DeviceSize: deviceSize,
-		Cylinders:  cylinders,
+	sectors := deviceSize / blockSize
+	if sectors == 0 {
+		return fmt.Errorf("%s is empty", deviceName)
 	}
 
-	if partitions {
+	vmdk := NewDescriptor(FullDevice, sectors, opts.ESX)
+	if !opts.ESX {
+		setBIOSGeometry(vmdk, geometry, sectors)
+	}
+
+	if opts.ESX {
+		vmdk.Type = VMFSRawDeviceMap
+		vmdk.Extents = []Extent{{AccessMode: "RW", Size: sectors, Type: "VMFSRDM", Path: deviceName}}
+	} else if opts.Partitions || len(opts.Selected) > 0 {
 		dev, err := backend.OpenDevice(deviceName, os.O_RDONLY)
 		if err != nil {
 			return fmt.Errorf("Failed to open device: %s", err.Error())
@@ -127,6 +175,12 @@ func CreateRawVMDK(location string, deviceName string, partitions bool, relative
 			return fmt.Errorf("Failed to read GPT or MBR table: %s", err.Error())
 		}
 
+		for _, number := range opts.Selected {
+			if number < 1 || number > len(partitions) {
+				return fmt.Errorf("Partition %d not found on %s", number, deviceName)
+			}
+		}
+
 		offset := partitions[0].FirstLBA
 		headerPath := strings.TrimSuffix(location, path.Ext(location)) + "-pt.vmdk"
 		deviceHeader, err := os.Create(headerPath)
@@ -141,15 +195,15 @@ func CreateRawVMDK(location string, deviceName string, partitions bool, relative
 			return err
 		}
 
-		log.Printf("Copied %d bytes to %s\n", int64(offset*blockSize), headerPath)
+		logger.Debug("Copied partition table", "bytes", int64(offset*blockSize), "path", headerPath)
 
-		header := extent{AccessMode: "RW", Size: offset, Type: "FLAT", Path: path.Base(headerPath)}
-		vmdk.Type = "partitionedDevice"
+		header := Extent{AccessMode: "RW", Size: offset, Type: "FLAT", Path: path.Base(headerPath)}
+		vmdk.Type = PartitionedDevice
 		vmdk.Extents = append(vmdk.Extents, header)
 
 		for i, part := range partitions {
 			if part.FirstLBA > offset {
-				vmdk.Extents = append(vmdk.Extents, extent{
+				vmdk.Extents = append(vmdk.Extents, Extent{
 					AccessMode: "RW",
 					Size:       part.FirstLBA - offset,
 					Type:       "ZERO",
@@ -157,7 +211,7 @@ func CreateRawVMDK(location string, deviceName string, partitions bool, relative
 			}
 
 			size := part.LastLBA - part.FirstLBA + 1
-			newExtent := extent{
+			newExtent := Extent{
 				AccessMode: "RW",
 				Size:       size,
 				Type:       "FLAT",
@@ -165,38 +219,34 @@ func CreateRawVMDK(location string, deviceName string, partitions bool, relative
 				Path:       deviceName,
 			}
 
-			if relative {
+			if opts.Relative {
 				newExtent.Path = fmt.Sprintf("%s%d", deviceName, i+1)
 				newExtent.Offset = 0
 			}
 
+			// Hidden partitions are exposed to the guest as zeros
+			if !opts.isSelected(i + 1) {
+				newExtent = Extent{AccessMode: "RW", Size: size, Type: "ZERO"}
+			}
+
 			vmdk.Extents = append(vmdk.Extents, newExtent)
 			offset += size
 		}
 
-		vmdk.Extents = append(vmdk.Extents, extent{
+		vmdk.Extents = append(vmdk.Extents, Extent{
 			AccessMode: "RW",
-			Size:       (deviceSize / 512) - offset,
+			Size:       sectors - offset,
 			Type:       "ZERO",
 		})
 	} else {
-		vmdk.Type = "fullDevice"
-		vmdk.Extents = []extent{
-			extent{AccessMode: "RW", Size: deviceSize, Type: "FLAT", Path: deviceName},
+		vmdk.Extents = []Extent{
+			{AccessMode: "RW", Size: sectors, Type: "FLAT", Path: deviceName},
 		}
 	}
 
-	t := template.Must(template.New("VMDK").Parse(headerTemplate))
-
-	file, err := os.Create(location)
-	if err != nil {
-		return err
+	if opts.Split {
+		vmdk.Split()
 	}
-	defer file.Close()
 
-	if err := t.Execute(file, vmdk); err != nil {
-		return err
-	}
-
-	return nil
+	return vmdk.WriteFile(location)
 }
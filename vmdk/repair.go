@@ -0,0 +1,249 @@
+package vmdk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/lebauce/vlaunch/backend"
+)
+
+// isRaw returns whether the descriptor gives access to a device
+func (d *Descriptor) isRaw() bool {
+	return d.Type == FullDevice || d.Type == PartitionedDevice || d.Type == VMFSRawDeviceMap
+}
+
+// isDeviceExtent returns whether the extent maps a device, as opposed to
+// a file such as the copy of the partition table
+func (d *Descriptor) isDeviceExtent(e Extent) bool {
+	return d.isRaw() && e.Path != "" && path.Ext(e.Path) != ".vmdk"
+}
+
+// devicePath returns the device an extent maps, extents of relative
+// descriptors mapping partitions of the device
+func (d *Descriptor) devicePath(e Extent) string {
+	if d.Type == PartitionedDevice && backend.RelativeRawVMDK {
+		return strings.TrimRightFunc(e.Path, unicode.IsDigit)
+	}
+	return e.Path
+}
+
+// Device returns the device the descriptor gives access to, if any
+func (d *Descriptor) Device() string {
+	for _, e := range d.Extents {
+		if d.isDeviceExtent(e) {
+			return d.devicePath(e)
+		}
+	}
+	return ""
+}
+
+// DevicePaths returns the devices and partitions the descriptor maps
+func (d *Descriptor) DevicePaths() (paths []string) {
+	for _, e := range d.Extents {
+		if d.isDeviceExtent(e) {
+			paths = append(paths, e.Path)
+		}
+	}
+	return paths
+}
+
+func (d *Descriptor) setDevice(device string) {
+	for i, e := range d.Extents {
+		if d.isDeviceExtent(e) {
+			d.Extents[i].Path = device + strings.TrimPrefix(e.Path, d.devicePath(e))
+		}
+	}
+}
+
+func (d *Descriptor) geometry() (cylinders, heads, sectors uint64) {
+	expected := NewDescriptor(d.Type, d.Size(), d.Type == VMFS || d.Type == VMFSRawDeviceMap)
+	return expected.Cylinders, expected.Heads, expected.Sectors
+}
+
+func resolvePath(dir, location string) string {
+	if filepath.IsAbs(location) {
+		return location
+	}
+	return filepath.Join(dir, location)
+}
+
+// matchDevice checks that the device has the size of the disk and, for
+// partitioned disks, the partitions found when the descriptor was written
+func (d *Descriptor) matchDevice(dir, device string) error {
+	deviceSize, err := backend.GetDeviceSize(device)
+	if err != nil {
+		return fmt.Errorf("Failed to get size of %s: %s", device, err.Error())
+	}
+
+	if err := checkSectorSize(device, diskGeometry(device)); err != nil {
+		return err
+	}
+
+	if sectors := deviceSize / blockSize; sectors != d.Size() {
+		return fmt.Errorf("%s has %d sectors, %d expected", device, sectors, d.Size())
+	}
+
+	if d.Type != PartitionedDevice {
+		return nil
+	}
+
+	var header Extent
+	for _, e := range d.Extents {
+		if e.Path != "" && !d.isDeviceExtent(e) {
+			header = e
+			break
+		}
+	}
+
+	if header.Path == "" {
+		return errors.New("No partition table found in descriptor")
+	}
+
+	table, err := os.ReadFile(resolvePath(dir, header.Path))
+	if err != nil {
+		return err
+	}
+
+	expected, err := readPartitions(bytes.NewReader(table))
+	if err != nil {
+		return fmt.Errorf("Failed to read partition table copy: %s", err.Error())
+	}
+
+	dev, err := backend.OpenDevice(device, os.O_RDONLY)
+	if err != nil {
+		return fmt.Errorf("Failed to open device: %s", err.Error())
+	}
+	defer dev.Close()
+
+	data := make([]byte, 32768)
+	if _, err := io.ReadFull(dev, data); err != nil {
+		return fmt.Errorf("Failed to read: %s", err.Error())
+	}
+
+	partitions, err := readPartitions(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("Failed to read GPT or MBR table: %s", err.Error())
+	}
+
+	if !reflect.DeepEqual(partitions, expected) {
+		return fmt.Errorf("The partitions of %s changed", device)
+	}
+
+	return nil
+}
+
+func (d *Descriptor) validate(dir string) error {
+	if cylinders, heads, sectors := d.geometry(); d.Cylinders != cylinders || d.Heads != heads || d.Sectors != sectors {
+		return fmt.Errorf("Invalid geometry %d/%d/%d, %d/%d/%d expected", d.Cylinders, d.Heads, d.Sectors, cylinders, heads, sectors)
+	}
+
+	if d.BIOSCylinders == 0 || d.BIOSHeads == 0 || d.BIOSSectors == 0 {
+		return errors.New("Missing BIOS geometry")
+	}
+
+	if !d.isRaw() {
+		for _, e := range d.Extents {
+			if e.Path == "" {
+				continue
+			}
+			if _, err := os.Stat(resolvePath(dir, e.Path)); err != nil {
+				return fmt.Errorf("Missing extent %s", e.Path)
+			}
+		}
+		return nil
+	}
+
+	device := d.Device()
+	if device == "" {
+		return errors.New("No device found in descriptor")
+	}
+
+	for _, e := range d.Extents {
+		if d.isDeviceExtent(e) && d.devicePath(e) != device {
+			return fmt.Errorf("Descriptor maps both %s and %s", device, d.devicePath(e))
+		}
+	}
+
+	return d.matchDevice(dir, device)
+}
+
+// Validate checks that the descriptor at location is consistent and, for
+// raw disks, that the device it maps still has the expected size and
+// partitions. Device names are not stable across reboots.
+func Validate(location string) error {
+	d, err := ReadFile(location)
+	if err != nil {
+		return err
+	}
+
+	return d.validate(path.Dir(location))
+}
+
+// findDevice returns the device matching the descriptor, starting with
+// the device it currently maps
+func (d *Descriptor) findDevice(dir string) (string, error) {
+	current := d.Device()
+	if current != "" && d.matchDevice(dir, current) == nil {
+		return current, nil
+	}
+
+	disks, err := backend.ListDisks()
+	if err != nil {
+		return "", err
+	}
+
+	for _, disk := range disks {
+		if disk != current && d.matchDevice(dir, disk) == nil {
+			return disk, nil
+		}
+	}
+
+	return "", backend.DeviceNotFound
+}
+
+// Repair fixes the geometry of the descriptor at location and, for raw
+// disks, looks for the device it was written for if it moved. The
+// descriptor is only rewritten if it was invalid.
+func Repair(location string) error {
+	d, err := ReadFile(location)
+	if err != nil {
+		return err
+	}
+
+	dir := path.Dir(location)
+	if err = d.validate(dir); err == nil {
+		return nil
+	}
+	logger.Warn("Repairing VMDK descriptor", "path", location, "error", err)
+
+	d.Cylinders, d.Heads, d.Sectors = d.geometry()
+	if d.BIOSCylinders == 0 || d.BIOSHeads == 0 || d.BIOSSectors == 0 {
+		d.BIOSCylinders, d.BIOSHeads, d.BIOSSectors = d.Cylinders, d.Heads, d.Sectors
+	}
+
+	if d.isRaw() {
+		device, err := d.findDevice(dir)
+		if err != nil {
+			return fmt.Errorf("Failed to find device of %s: %s", location, err.Error())
+		}
+
+		if device != d.Device() {
+			logger.Info("Device of VMDK descriptor moved", "path", location, "from", d.Device(), "to", device)
+			d.setDevice(device)
+		}
+	}
+
+	if err := d.validate(dir); err != nil {
+		return fmt.Errorf("Failed to repair %s: %s", location, err.Error())
+	}
+
+	return d.WriteFile(location)
+}
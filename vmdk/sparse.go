@@ -0,0 +1,149 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// sparseMagic starts the sparse extents, "KDMV"
+const sparseMagic = 0x564d444b
+
+// gdAtEnd is the grain directory offset of stream optimized extents, whose
+// grain directory is found in a footer
+const gdAtEnd = 0xffffffffffffffff
+
+// sparseHeader is the header of a hosted sparse extent
+type sparseHeader struct {
+	Magic              uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RGDOffset          uint64
+	GDOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+}
+
+// checkSparse checks the header of a sparse extent against the size of
+// the file, its offsets being in sectors
+func checkSparse(r io.ReaderAt, fileSize int64) error {
+	var h sparseHeader
+	if err := binary.Read(io.NewSectionReader(r, 0, int64(binary.Size(h))), binary.LittleEndian, &h); err != nil {
+		return fmt.Errorf("Failed to read sparse header: %s", err.Error())
+	}
+
+	if h.Magic != sparseMagic {
+		return errors.New("Invalid sparse extent magic")
+	}
+
+	if h.Version < 1 || h.Version > 3 {
+		return fmt.Errorf("Unsupported sparse extent version %d", h.Version)
+	}
+
+	if h.GrainSize < 8 || h.GrainSize&(h.GrainSize-1) != 0 {
+		return fmt.Errorf("Invalid grain size %d", h.GrainSize)
+	}
+
+	if h.NumGTEsPerGT != 512 {
+		return fmt.Errorf("Invalid number of grain table entries %d", h.NumGTEsPerGT)
+	}
+
+	sectors := uint64(fileSize) / blockSize
+	if h.DescriptorOffset+h.DescriptorSize > sectors {
+		return errors.New("The embedded descriptor is past the end of the extent")
+	}
+
+	if h.GDOffset != gdAtEnd && h.GDOffset >= sectors {
+		return errors.New("The grain directory is past the end of the extent, it is truncated")
+	}
+
+	if h.UncleanShutdown != 0 {
+		logger.Warn("Sparse extent was not closed cleanly")
+	}
+	return nil
+}
+
+// checkSparseFile checks the header of the sparse extent at location
+func checkSparseFile(location string) error {
+	f, err := os.Open(location)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return checkSparse(f, fi.Size())
+}
+
+// isSparse returns whether the file at location starts with the magic of
+// the sparse extents
+func isSparse(location string) (bool, error) {
+	f, err := os.Open(location)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var magic uint32
+	if err := binary.Read(f, binary.LittleEndian, &magic); err != nil {
+		return false, nil
+	}
+	return magic == sparseMagic, nil
+}
+
+// Check checks that the VMDK image at location is not visibly corrupted: the
+// header of a monolithic sparse image, or the descriptor and the extents it
+// refers to. The devices of raw disks are checked by Validate.
+func Check(location string) error {
+	sparse, err := isSparse(location)
+	if err != nil {
+		return err
+	}
+
+	if sparse {
+		return checkSparseFile(location)
+	}
+
+	d, err := ReadFile(location)
+	if err != nil {
+		return err
+	}
+
+	if d.isRaw() {
+		return nil
+	}
+
+	for _, e := range d.Extents {
+		if e.Path == "" {
+			continue
+		}
+
+		extent := resolvePath(path.Dir(location), e.Path)
+		if _, err := os.Stat(extent); err != nil {
+			return fmt.Errorf("Missing extent %s", e.Path)
+		}
+
+		if e.Type == "SPARSE" {
+			if err := checkSparseFile(extent); err != nil {
+				return fmt.Errorf("Invalid extent %s: %s", e.Path, err.Error())
+			}
+		}
+	}
+	return nil
+}